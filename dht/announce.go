@@ -0,0 +1,115 @@
+package dht
+
+import (
+	"context"
+	"encoding/hex"
+	"log"
+	"sync/atomic"
+	"time"
+)
+
+// announceTimeout is how long a re-announcement takes at most.
+const announceTimeout = time.Minute
+
+// announcement is an infohash announced by the dht.
+type announcement struct {
+	infoHash    string
+	port        int
+	impliedPort bool
+}
+
+// announce looks up the nodes closest to the infohash with get_peers queries
+// and sends announce_peer with their tokens. It returns nil if any node
+// accepts it.
+func (dht *DHT) announce(ctx context.Context, a *announcement) error {
+	l := newLookup(dht, a.infoHash, func(no *node,
+		callback func(map[string]interface{}, error)) {
+
+		dht.transactionManager.lookupQuery(no, getPeersType, a.infoHash, callback)
+	})
+	if err := l.run(ctx); err != nil {
+		return err
+	}
+
+	impliedPort := 0
+	if a.impliedPort {
+		impliedPort = 1
+	}
+
+	return l.store(ctx, func(no *node, token string,
+		callback func(map[string]interface{}, error)) {
+
+		dht.transactionManager.announcePeer(
+			no, a.infoHash, impliedPort, a.port, token, callback)
+	})
+}
+
+// Announce announces that the peer listening on port has infoHash to the
+// nodes closest to it, and announces it again every AnnouncePeriod until
+// Unannounce is called or the dht stops, even if this announcement fails.
+// infoHash is 20-length or 40-length hex string. If impliedPort is true, the
+// nodes use the source port of the packets instead of port, see BEP 5. It
+// returns nil if any node accepts the announcement.
+func (dht *DHT) Announce(ctx context.Context, infoHash string, port int,
+	impliedPort bool) error {
+
+	if !dht.Ready() {
+		return ErrNotReady
+	}
+
+	infoHash, err := rawTarget(infoHash)
+	if err != nil {
+		return err
+	}
+
+	a := &announcement{
+		infoHash:    infoHash,
+		port:        port,
+		impliedPort: impliedPort,
+	}
+	dht.announcements.Set(infoHash, a)
+
+	return dht.announce(ctx, a)
+}
+
+// Unannounce stops announcing infoHash again. The nodes forget it after
+// their peers expire.
+func (dht *DHT) Unannounce(infoHash string) {
+	if infoHash, err := rawTarget(infoHash); err == nil {
+		dht.announcements.Delete(infoHash)
+	}
+}
+
+// reannounce announces the infohashes again one by one. Only one runs at a
+// time.
+func (dht *DHT) reannounce() {
+	if !atomic.CompareAndSwapInt32(&dht.reannouncing, 0, 1) {
+		return
+	}
+	defer atomic.StoreInt32(&dht.reannouncing, 0)
+
+	// Don't hold the lock of the map while announcing.
+	announcements := make([]*announcement, 0, dht.announcements.Len())
+	for item := range dht.announcements.Iter() {
+		announcements = append(announcements, item.val.(*announcement))
+	}
+
+	for _, a := range announcements {
+		select {
+		case <-dht.closing:
+			return
+		default:
+		}
+
+		if v, ok := dht.announcements.Get(a.infoHash); !ok || v != a {
+			continue
+		}
+
+		ctx, cancel := context.WithTimeout(context.Background(), announceTimeout)
+		if err := dht.announce(ctx, a); err != nil {
+			log.Printf("重新 announce %s 失败: %v",
+				hex.EncodeToString([]byte(a.infoHash)), err)
+		}
+		cancel()
+	}
+}
@@ -3,6 +3,7 @@ package dht
 import (
 	"bytes"
 	"errors"
+	"sort"
 	"strconv"
 	"strings"
 	"unicode"
@@ -232,15 +233,20 @@ func EncodeList(data []interface{}) string {
 	return strings.Join([]string{"l", strings.Join(result, ""), "e"}, "")
 }
 
-// EncodeDict encodes a dict value.
+// EncodeDict encodes a dict value. Keys are sorted as the specification
+// requires.
 func EncodeDict(data map[string]interface{}) string {
-	result, i := make([]string, len(data)), 0
+	keys := make([]string, 0, len(data))
+	for key := range data {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
 
-	for key, val := range data {
+	result := make([]string, len(data))
+	for i, key := range keys {
 		result[i] = strings.Join(
-			[]string{EncodeString(key), encodeItem(val)},
+			[]string{EncodeString(key), encodeItem(data[key])},
 			"")
-		i++
 	}
 
 	return strings.Join([]string{"d", strings.Join(result, ""), "e"}, "")
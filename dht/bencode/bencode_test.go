@@ -0,0 +1,364 @@
+package bencode
+
+import (
+	"bytes"
+	"crypto/sha1"
+	"io"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+type file struct {
+	Length int64    `bencode:"length"`
+	Path   []string `bencode:"path"`
+}
+
+type info struct {
+	Name        string `bencode:"name"`
+	PieceLength int64  `bencode:"piece length"`
+	Pieces      []byte `bencode:"pieces"`
+	Length      int64  `bencode:"length,omitempty"`
+	Files       []file `bencode:"files,omitempty"`
+	Private     bool   `bencode:"private,omitempty"`
+	Ignored     string `bencode:"-"`
+	unexported  int
+}
+
+func TestMarshal(t *testing.T) {
+	cases := []struct {
+		in  interface{}
+		out string
+	}{
+		{"hello", "5:hello"},
+		{[]byte{0, 1}, "2:\x00\x01"},
+		{[2]byte{'a', 'b'}, "2:ab"},
+		{int64(-1 << 40), "i-1099511627776e"},
+		{uint8(255), "i255e"},
+		{true, "i1e"},
+		{[]interface{}{1, "a"}, "li1e1:ae"},
+		{[]int(nil), "le"},
+		{map[string]interface{}{"b": 1, "a": "x", "c": nil}, "d1:a1:x1:bi1ee"},
+		{RawMessage("d1:ai1ee"), "d1:ai1ee"},
+		{
+			info{Name: "a", PieceLength: 16384, Pieces: []byte("xx"),
+				Ignored: "x", unexported: 1},
+			"d4:name1:a12:piece lengthi16384e6:pieces2:xxe",
+		},
+		{
+			&info{Name: "a", Files: []file{{1, []string{"b", "c"}}}, Private: true},
+			"d5:filesld6:lengthi1e4:pathl1:b1:ceee4:name1:a12:piece lengthi0e" +
+				"6:pieces0:7:privatei1ee",
+		},
+	}
+
+	for _, c := range cases {
+		out, err := Marshal(c.in)
+		if err != nil {
+			t.Errorf("Marshal(%#v): %v", c.in, err)
+			continue
+		}
+		if string(out) != c.out {
+			t.Errorf("Marshal(%#v) = %q, want %q", c.in, out, c.out)
+		}
+	}
+}
+
+func TestMarshalError(t *testing.T) {
+	cases := []interface{}{
+		nil,
+		1.5,
+		map[int]string{1: "a"},
+		[]interface{}{(*info)(nil)},
+		RawMessage{},
+	}
+
+	for _, c := range cases {
+		if _, err := Marshal(c); err == nil {
+			t.Errorf("Marshal(%#v) should fail", c)
+		}
+	}
+}
+
+func TestUnmarshal(t *testing.T) {
+	var v info
+	data := "d5:filesld6:lengthi1099511627776e4:pathl1:b1:ceee" +
+		"4:name1:a5:otherld1:xi1eee12:piece lengthi16384e6:pieces2:xx" +
+		"7:privatei1ee"
+
+	if err := Unmarshal([]byte(data), &v); err != nil {
+		t.Fatal(err)
+	}
+
+	want := info{
+		Name:        "a",
+		PieceLength: 16384,
+		Pieces:      []byte("xx"),
+		Files:       []file{{1 << 40, []string{"b", "c"}}},
+		Private:     true,
+	}
+	if !reflect.DeepEqual(v, want) {
+		t.Errorf("Unmarshal = %#v, want %#v", v, want)
+	}
+
+	out, err := Marshal(v)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Replace(data, "5:otherld1:xi1eee", "", 1) != string(out) {
+		t.Errorf("Marshal(Unmarshal(%q)) = %q", data, out)
+	}
+}
+
+func TestUnmarshalGeneric(t *testing.T) {
+	var v interface{}
+	if err := Unmarshal([]byte("d1:ali1e1:be1:bd1:c0:ee"), &v); err != nil {
+		t.Fatal(err)
+	}
+
+	want := map[string]interface{}{
+		"a": []interface{}{int64(1), "b"},
+		"b": map[string]interface{}{"c": ""},
+	}
+	if !reflect.DeepEqual(v, want) {
+		t.Errorf("Unmarshal = %#v, want %#v", v, want)
+	}
+
+	var m map[string][]byte
+	if err := Unmarshal([]byte("d1:a1:x1:b0:e"), &m); err != nil {
+		t.Fatal(err)
+	}
+	if string(m["a"]) != "x" || len(m["b"]) != 0 {
+		t.Errorf("Unmarshal = %v", m)
+	}
+}
+
+func TestUnmarshalError(t *testing.T) {
+	cases := []struct {
+		in string
+		v  interface{}
+	}{
+		{"", new(string)},
+		{"5:abc", new(string)},
+		{"99999999999:abc", new(string)},
+		{"-1:a", new(string)},
+		{"i1e", new(string)},
+		{"1:a", new(int)},
+		{"i300e", new(int8)},
+		{"i-1e", new(uint)},
+		{"iae", new(int)},
+		{"ie", new(int)},
+		{"i1", new(int)},
+		{"li1e", new([]int)},
+		{"li1ei2ee", new([1]int)},
+		{"d1:ai1e", new(map[string]int)},
+		{"di1ei1ee", new(map[string]int)},
+		{"d4:namei1ee", new(info)},
+		{"x", new(interface{})},
+		{"i1ei2e", new(int)},
+		{"1:a", nil},
+	}
+
+	for _, c := range cases {
+		if err := Unmarshal([]byte(c.in), c.v); err == nil {
+			t.Errorf("Unmarshal(%q) into %T should fail", c.in, c.v)
+		}
+	}
+}
+
+func TestUnmarshalTypeMismatch(t *testing.T) {
+	// the mismatched values are skipped, the rest is still decoded and the
+	// first UnmarshalTypeError is returned
+	var v info
+	err := Unmarshal([]byte("d5:filesld6:lengthli1ee4:pathl1:ai2eeed6:lengthi3eee"+
+		"4:name1:a12:piece length1:x7:privated1:ai1eee"), &v)
+	e, ok := err.(*UnmarshalTypeError)
+	if !ok || e.Path != "files[0].length" || e.Value != "list" {
+		t.Errorf("Unmarshal = %v, want an UnmarshalTypeError in files[0].length", err)
+	}
+
+	want := info{
+		Name:  "a",
+		Files: []file{{Path: []string{"a", ""}}, {Length: 3}},
+	}
+	if !reflect.DeepEqual(v, want) {
+		t.Errorf("Unmarshal = %+v, want %+v", v, want)
+	}
+
+	// the data after the value is more serious
+	if err := Unmarshal([]byte("i1ex"), new(string)); err == nil {
+		t.Error("Unmarshal should fail")
+	} else if _, ok := err.(*SyntaxError); !ok {
+		t.Errorf("Unmarshal = %v, want a SyntaxError", err)
+	}
+}
+
+func TestRawMessage(t *testing.T) {
+	// The keys of info aren't sorted, so it must be hashed as it is.
+	rawInfo := "d4:name1:a6:lengthi1ee"
+	data := "d8:announce3:url4:info" + rawInfo + "e"
+
+	var torrent struct {
+		Announce string     `bencode:"announce"`
+		Info     RawMessage `bencode:"info"`
+	}
+	if err := Unmarshal([]byte(data), &torrent); err != nil {
+		t.Fatal(err)
+	}
+
+	if string(torrent.Info) != rawInfo {
+		t.Fatalf("Info = %q, want %q", torrent.Info, rawInfo)
+	}
+	if sha1.Sum(torrent.Info) != sha1.Sum([]byte(rawInfo)) {
+		t.Error("wrong info hash")
+	}
+
+	var nested struct {
+		Outer RawMessage `bencode:"outer"`
+	}
+	data = "d5:outerd4:info" + rawInfo + "ee"
+	if err := Unmarshal([]byte(data), &nested); err != nil {
+		t.Fatal(err)
+	}
+	if string(nested.Outer) != "d4:info"+rawInfo+"e" {
+		t.Errorf("Outer = %q", nested.Outer)
+	}
+
+	out, err := Marshal(torrent)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(out) != "d8:announce3:url4:info"+rawInfo+"e" {
+		t.Errorf("Marshal = %q", out)
+	}
+}
+
+func TestDecoder(t *testing.T) {
+	d := NewDecoder(bytes.NewReader([]byte("i1e3:abcli2eed1:ai3ee")))
+
+	var (
+		n int
+		s string
+		l []int
+		m map[string]int
+	)
+	for _, v := range []interface{}{&n, &s, &l, &m} {
+		if err := d.Decode(v); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if n != 1 || s != "abc" || !reflect.DeepEqual(l, []int{2}) ||
+		!reflect.DeepEqual(m, map[string]int{"a": 3}) {
+
+		t.Errorf("Decode = %v %v %v %v", n, s, l, m)
+	}
+
+	if err := d.Decode(&n); err != io.EOF {
+		t.Errorf("Decode at the end = %v, want io.EOF", err)
+	}
+}
+
+func TestUnmarshalStrict(t *testing.T) {
+	cases := []struct {
+		in        string
+		canonical bool
+	}{
+		{"i0e", true},
+		{"i-1e", true},
+		{"i10e", true},
+		{"i01e", false},
+		{"i-0e", false},
+		{"i-01e", false},
+		{"0:", true},
+		{"01:a", false},
+		{"d1:ai1e1:bi2ee", true},
+		{"d1:bi2e1:ai1ee", false},
+		{"d1:ai1e1:ai2ee", false},
+		{"ld1:bi1e1:ai2eee", false},
+	}
+
+	for _, c := range cases {
+		var v interface{}
+		if err := Unmarshal([]byte(c.in), &v); err != nil {
+			t.Errorf("Unmarshal(%q): %v", c.in, err)
+		}
+
+		err := UnmarshalStrict([]byte(c.in), &v)
+		if c.canonical && err != nil {
+			t.Errorf("UnmarshalStrict(%q): %v", c.in, err)
+		} else if !c.canonical {
+			if _, ok := err.(*SyntaxError); !ok {
+				t.Errorf("UnmarshalStrict(%q) = %v, want a SyntaxError", c.in, err)
+			}
+		}
+	}
+}
+
+func TestSyntaxError(t *testing.T) {
+	cases := []struct {
+		in     string
+		offset int64
+		path   string
+	}{
+		{"", 0, ""},
+		{"i1ex", 3, ""},
+		{"d5:filesld6:lengthi01eeee4:name1:ae", 18, "files[0].length"},
+		{"d5:filesld6:lengthi1e4:pathl1:a1:bxeeee", 34, "files[0].path[2]"},
+		{"d4:name1:ae1:x", 11, ""},
+		{"d4:name5:ab", 11, "name"},
+		{"d1:b0:1:a0:e", 6, ""},
+	}
+
+	for _, c := range cases {
+		var v interface{}
+		err := UnmarshalStrict([]byte(c.in), &v)
+		e, ok := err.(*SyntaxError)
+		if !ok {
+			t.Errorf("UnmarshalStrict(%q) = %v, want a SyntaxError", c.in, err)
+			continue
+		}
+		if e.Offset != c.offset || e.Path != c.path {
+			t.Errorf("UnmarshalStrict(%q) = %v, want offset %d in %q",
+				c.in, err, c.offset, c.path)
+		}
+	}
+
+	var v info
+	err := Unmarshal([]byte("d5:filesld6:length1:aeee"), &v)
+	e, ok := err.(*UnmarshalTypeError)
+	if !ok || e.Offset != 18 || e.Path != "files[0].length" {
+		t.Errorf("Unmarshal = %#v, want an UnmarshalTypeError", err)
+	}
+}
+
+func TestDecoderLimits(t *testing.T) {
+	deep := strings.Repeat("l", 10) + strings.Repeat("e", 10)
+
+	d := NewDecoder(strings.NewReader(deep))
+	d.SetMaxDepth(10)
+	var v interface{}
+	if err := d.Decode(&v); err != nil {
+		t.Error(err)
+	}
+
+	d = NewDecoder(strings.NewReader(deep))
+	d.SetMaxDepth(9)
+	if err := d.Decode(&v); err == nil {
+		t.Error("Decode should exceed the max depth")
+	}
+
+	d = NewDecoder(strings.NewReader("4:abcd5:abcde"))
+	d.SetMaxStringLength(4)
+	var s string
+	if err := d.Decode(&s); err != nil || s != "abcd" {
+		t.Errorf("Decode = %q, %v", s, err)
+	}
+	if d.InputOffset() != 6 {
+		t.Errorf("InputOffset = %d, want 6", d.InputOffset())
+	}
+	err := d.Decode(&s)
+	if e, ok := err.(*SyntaxError); !ok || e.Offset != 6 {
+		t.Errorf("Decode = %v, want exceeding the max string length", err)
+	}
+}
@@ -0,0 +1,646 @@
+package bencode
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+	"reflect"
+	"strconv"
+	"strings"
+)
+
+const (
+	// maxIntLength is the max length of an encoded integer, which is enough
+	// for any int64 or uint64.
+	maxIntLength = 21
+	// DefaultMaxDepth is the default max nesting depth of lists and dicts.
+	DefaultMaxDepth = 64
+)
+
+// SyntaxError is returned when the data is malformed, isn't canonical in
+// strict mode or exceeds the limits of the Decoder.
+type SyntaxError struct {
+	msg string
+	// the offset of the byte where the error is found
+	Offset int64
+	// the path of the value being decoded, e.g. files[2].path, which is empty
+	// at the top level
+	Path string
+}
+
+func (e *SyntaxError) Error() string {
+	if e.Path == "" {
+		return fmt.Sprintf("bencode: %s at offset %d", e.msg, e.Offset)
+	}
+	return fmt.Sprintf("bencode: %s at offset %d in %s", e.msg, e.Offset, e.Path)
+}
+
+// UnmarshalTypeError is returned when a value can't be stored in the Go
+// value of a type.
+type UnmarshalTypeError struct {
+	// "string", "integer", "list" or "dict", or the integer which overflows
+	Value  string
+	Type   reflect.Type
+	Offset int64
+	Path   string
+}
+
+func (e *UnmarshalTypeError) Error() string {
+	s := "bencode: cannot unmarshal " + e.Value +
+		" into Go value of type " + e.Type.String()
+	if e.Path != "" {
+		s += " in " + e.Path
+	}
+	return s
+}
+
+// Unmarshal decodes the bencoded data into the value pointed to by v. It
+// returns an error if data has anything after the value. Dict keys without
+// a matching struct field are ignored. An interface{} holds int64, string,
+// []interface{} or map[string]interface{}.
+//
+// Like encoding/json, a value which doesn't fit the Go type is skipped and
+// the rest is still decoded. The first UnmarshalTypeError is returned if
+// there isn't a more serious error.
+func Unmarshal(data []byte, v interface{}) error {
+	return unmarshal(NewDecoder(bytes.NewReader(data)), v)
+}
+
+// UnmarshalStrict is like Unmarshal but rejects data which isn't canonical,
+// see Decoder.Strict.
+func UnmarshalStrict(data []byte, v interface{}) error {
+	d := NewDecoder(bytes.NewReader(data))
+	d.Strict()
+	return unmarshal(d, v)
+}
+
+func unmarshal(d *Decoder, v interface{}) error {
+	err := d.Decode(v)
+	if _, ok := err.(*UnmarshalTypeError); err != nil && !ok {
+		if err == io.EOF {
+			return d.syntaxError(0, "unexpected end of data")
+		}
+		return err
+	}
+
+	if _, err := d.r.Peek(1); err != io.EOF {
+		return d.syntaxError(d.off, "invalid data after top-level value")
+	}
+	return err
+}
+
+// Decoder reads and decodes bencoded values from a stream.
+type Decoder struct {
+	r *bufio.Reader
+	// raw records the bytes read while decoding a RawMessage
+	raw *bytes.Buffer
+
+	strict          bool
+	maxDepth        int
+	maxStringLength int64
+
+	// off is the offset of the next byte
+	off   int64
+	depth int
+	// path holds the dict keys and list indexes, e.g. "[2]", down to the
+	// value being decoded
+	path []string
+	// typeErr is the first UnmarshalTypeError of the value being decoded
+	typeErr error
+}
+
+// NewDecoder returns a Decoder pointer reading from r. The Decoder buffers
+// the data so it may read more than the values it decodes.
+func NewDecoder(r io.Reader) *Decoder {
+	return &Decoder{r: bufio.NewReader(r), maxDepth: DefaultMaxDepth}
+}
+
+// Strict makes the Decoder reject data which isn't canonical: integers and
+// string lengths with leading zeros, "-0", and dict keys which aren't
+// sorted or are duplicated. The same value has only one canonical encoding,
+// so the hash of the data can be trusted.
+func (d *Decoder) Strict() {
+	d.strict = true
+}
+
+// SetMaxDepth sets the max nesting depth of lists and dicts, which is
+// DefaultMaxDepth by default.
+func (d *Decoder) SetMaxDepth(n int) {
+	d.maxDepth = n
+}
+
+// SetMaxStringLength sets the max length of strings. 0 means no limit, which
+// is the default.
+func (d *Decoder) SetMaxStringLength(n int64) {
+	d.maxStringLength = n
+}
+
+// InputOffset returns the offset of the next byte to decode.
+func (d *Decoder) InputOffset() int64 {
+	return d.off
+}
+
+// Decode reads the next value from the stream into the value pointed to by
+// v. It returns io.EOF if the stream ends before the value starts. The
+// values which don't fit the Go types are skipped as Unmarshal does, and
+// the whole value is still read.
+func (d *Decoder) Decode(v interface{}) error {
+	rv := reflect.ValueOf(v)
+	if rv.Kind() != reflect.Ptr || rv.IsNil() {
+		return fmt.Errorf("bencode: Decode(non-pointer %T)", v)
+	}
+
+	if _, err := d.r.Peek(1); err != nil {
+		return err
+	}
+
+	d.depth = 0
+	d.path = d.path[:0]
+	d.typeErr = nil
+	if err := d.value(rv.Elem()); err != nil {
+		return err
+	}
+	return d.typeErr
+}
+
+// syntaxError returns a SyntaxError at off in the current path.
+func (d *Decoder) syntaxError(off int64, format string,
+	args ...interface{}) error {
+
+	return &SyntaxError{
+		msg:    fmt.Sprintf(format, args...),
+		Offset: off,
+		Path:   d.pathString(),
+	}
+}
+
+// typeError records an UnmarshalTypeError at off in the current path if
+// it's the first one, which Decode returns after reading the whole value.
+func (d *Decoder) typeError(off int64, value string, t reflect.Type) {
+	if d.typeErr != nil {
+		return
+	}
+	d.typeErr = &UnmarshalTypeError{
+		Value:  value,
+		Type:   t,
+		Offset: off,
+		Path:   d.pathString(),
+	}
+}
+
+// skipList skips the rest of a list whose leading 'l' is at start and has
+// been read.
+func (d *Decoder) skipList(start int64) error {
+	return d.list(start, func(int) error {
+		_, err := d.generic()
+		return err
+	})
+}
+
+// skipDict skips the rest of a dict whose leading 'd' is at start and has
+// been read.
+func (d *Decoder) skipDict(start int64) error {
+	return d.dict(start, func(string) error {
+		_, err := d.generic()
+		return err
+	})
+}
+
+func (d *Decoder) pathString() string {
+	var b strings.Builder
+	for i, p := range d.path {
+		if i > 0 && !strings.HasPrefix(p, "[") {
+			b.WriteByte('.')
+		}
+		b.WriteString(p)
+	}
+	return b.String()
+}
+
+// ioError returns a SyntaxError if err means the data ends too early.
+func (d *Decoder) ioError(err error) error {
+	if err == io.EOF || err == io.ErrUnexpectedEOF {
+		return d.syntaxError(d.off, "unexpected end of data")
+	}
+	return err
+}
+
+// peek returns the next byte without consuming it.
+func (d *Decoder) peek() (byte, error) {
+	b, err := d.r.Peek(1)
+	if err != nil {
+		return 0, d.ioError(err)
+	}
+	return b[0], nil
+}
+
+func (d *Decoder) readByte() (byte, error) {
+	c, err := d.r.ReadByte()
+	if err != nil {
+		return 0, d.ioError(err)
+	}
+	d.off++
+	if d.raw != nil {
+		d.raw.WriteByte(c)
+	}
+	return c, nil
+}
+
+// readUntil reads the bytes before delim, which is consumed, and at most
+// maxIntLength bytes.
+func (d *Decoder) readUntil(delim byte) ([]byte, error) {
+	buf := make([]byte, 0, maxIntLength)
+	for {
+		c, err := d.readByte()
+		if err != nil {
+			return nil, err
+		}
+		if c == delim {
+			return buf, nil
+		}
+		if len(buf) == maxIntLength {
+			return nil, d.syntaxError(d.off-1, "%q not found", delim)
+		}
+		buf = append(buf, c)
+	}
+}
+
+// readString reads a string. The data isn't allocated up front so that a
+// forged length can't exhaust the memory.
+func (d *Decoder) readString() ([]byte, error) {
+	start := d.off
+	s, err := d.readUntil(':')
+	if err != nil {
+		return nil, err
+	}
+
+	length, err := strconv.ParseInt(string(s), 10, 64)
+	if err != nil || length < 0 || s[0] == '+' {
+		return nil, d.syntaxError(start, "invalid string length %q", s)
+	}
+	if d.strict && len(s) > 1 && s[0] == '0' {
+		return nil, d.syntaxError(start, "non-canonical string length %q", s)
+	}
+	if d.maxStringLength > 0 && length > d.maxStringLength {
+		return nil, d.syntaxError(start,
+			"string length %d exceeds the limit %d", length, d.maxStringLength)
+	}
+
+	var buf bytes.Buffer
+	n, err := io.CopyN(&buf, d.r, length)
+	d.off += n
+	if err != nil {
+		return nil, d.ioError(err)
+	}
+	if d.raw != nil {
+		d.raw.Write(buf.Bytes())
+	}
+	return buf.Bytes(), nil
+}
+
+// readInt reads an integer after the leading 'i'. start is the offset of
+// the 'i'.
+func (d *Decoder) readInt(start int64) (string, error) {
+	s, err := d.readUntil('e')
+	if err != nil {
+		return "", err
+	}
+	if len(s) == 0 || s[0] == '+' {
+		return "", d.syntaxError(start, "invalid integer %q", s)
+	}
+	if d.strict && !canonicalInt(s) {
+		return "", d.syntaxError(start, "non-canonical integer %q", s)
+	}
+	return string(s), nil
+}
+
+// canonicalInt returns whether s has no leading zeros and isn't "-0".
+func canonicalInt(s []byte) bool {
+	if s[0] == '-' {
+		s = s[1:]
+		if len(s) == 0 || s[0] == '0' {
+			return false
+		}
+	}
+	return len(s) == 1 || s[0] != '0'
+}
+
+// list calls fn with the index of each item of a list whose leading 'l' is
+// at start and has been read.
+func (d *Decoder) list(start int64, fn func(i int) error) error {
+	if err := d.enter(start); err != nil {
+		return err
+	}
+	defer d.leave()
+
+	for i := 0; ; i++ {
+		end, err := d.end()
+		if err != nil || end {
+			return err
+		}
+
+		d.path = append(d.path, "["+strconv.Itoa(i)+"]")
+		if err := fn(i); err != nil {
+			return err
+		}
+		d.path = d.path[:len(d.path)-1]
+	}
+}
+
+// dict calls fn with each key of a dict whose leading 'd' is at start and
+// has been read. fn must decode the value.
+func (d *Decoder) dict(start int64, fn func(key string) error) error {
+	if err := d.enter(start); err != nil {
+		return err
+	}
+	defer d.leave()
+
+	var prev string
+	for i := 0; ; i++ {
+		end, err := d.end()
+		if err != nil || end {
+			return err
+		}
+
+		off := d.off
+		b, err := d.readString()
+		if err != nil {
+			return err
+		}
+		key := string(b)
+
+		if d.strict && i > 0 && key <= prev {
+			return d.syntaxError(off, "dict key %q isn't sorted or duplicated", key)
+		}
+		prev = key
+
+		d.path = append(d.path, key)
+		if err := fn(key); err != nil {
+			return err
+		}
+		d.path = d.path[:len(d.path)-1]
+	}
+}
+
+// enter goes down a level of lists and dicts.
+func (d *Decoder) enter(start int64) error {
+	if d.depth == d.maxDepth {
+		return d.syntaxError(start, "exceeded max depth %d", d.maxDepth)
+	}
+	d.depth++
+	return nil
+}
+
+func (d *Decoder) leave() {
+	d.depth--
+}
+
+// end consumes the 'e' which ends a list or dict if it's the next byte.
+func (d *Decoder) end() (bool, error) {
+	c, err := d.peek()
+	if err != nil {
+		return false, err
+	}
+	if c == 'e' {
+		d.readByte()
+		return true, nil
+	}
+	return false, nil
+}
+
+// value decodes the next value into v.
+func (d *Decoder) value(v reflect.Value) error {
+	if v.Type() == rawMessageType {
+		return d.rawMessage(v)
+	}
+
+	switch v.Kind() {
+	case reflect.Ptr:
+		if v.IsNil() {
+			v.Set(reflect.New(v.Type().Elem()))
+		}
+		return d.value(v.Elem())
+	case reflect.Interface:
+		if v.NumMethod() == 0 {
+			item, err := d.generic()
+			if err != nil {
+				return err
+			}
+			v.Set(reflect.ValueOf(item))
+			return nil
+		}
+	}
+
+	c, err := d.peek()
+	if err != nil {
+		return err
+	}
+
+	start := d.off
+	switch {
+	case c == 'i':
+		d.readByte()
+		return d.intValue(start, v)
+	case c == 'l':
+		d.readByte()
+		return d.listValue(start, v)
+	case c == 'd':
+		d.readByte()
+		return d.dictValue(start, v)
+	case c >= '0' && c <= '9':
+		return d.stringValue(v)
+	}
+	return d.syntaxError(start, "invalid character %q looking for value", c)
+}
+
+// rawMessage records the next value into v.
+func (d *Decoder) rawMessage(v reflect.Value) error {
+	outer := d.raw
+	d.raw = &bytes.Buffer{}
+	_, err := d.generic()
+	raw := d.raw.Bytes()
+	d.raw = outer
+
+	if err != nil {
+		return err
+	}
+	if outer != nil {
+		outer.Write(raw)
+	}
+	v.SetBytes(raw)
+	return nil
+}
+
+func (d *Decoder) stringValue(v reflect.Value) error {
+	start := d.off
+	s, err := d.readString()
+	if err != nil {
+		return err
+	}
+
+	switch v.Kind() {
+	case reflect.String:
+		v.SetString(string(s))
+		return nil
+	case reflect.Slice:
+		if v.Type().Elem().Kind() == reflect.Uint8 {
+			v.SetBytes(s)
+			return nil
+		}
+	case reflect.Array:
+		if v.Type().Elem().Kind() == reflect.Uint8 && v.Len() == len(s) {
+			reflect.Copy(v, reflect.ValueOf(s))
+			return nil
+		}
+	}
+	d.typeError(start, "string", v.Type())
+	return nil
+}
+
+func (d *Decoder) intValue(start int64, v reflect.Value) error {
+	s, err := d.readInt(start)
+	if err != nil {
+		return err
+	}
+
+	switch v.Kind() {
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		n, err := strconv.ParseInt(s, 10, 64)
+		if err != nil || v.OverflowInt(n) {
+			d.typeError(start, "integer "+s, v.Type())
+			return nil
+		}
+		v.SetInt(n)
+		return nil
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32,
+		reflect.Uint64, reflect.Uintptr:
+
+		n, err := strconv.ParseUint(s, 10, 64)
+		if err != nil || v.OverflowUint(n) {
+			d.typeError(start, "integer "+s, v.Type())
+			return nil
+		}
+		v.SetUint(n)
+		return nil
+	case reflect.Bool:
+		n, err := strconv.ParseInt(s, 10, 64)
+		if err != nil {
+			return d.syntaxError(start, "invalid integer %q", s)
+		}
+		v.SetBool(n != 0)
+		return nil
+	}
+	d.typeError(start, "integer", v.Type())
+	return nil
+}
+
+func (d *Decoder) listValue(start int64, v reflect.Value) error {
+	switch v.Kind() {
+	case reflect.Slice:
+		v.SetLen(0)
+	case reflect.Array:
+	default:
+		d.typeError(start, "list", v.Type())
+		return d.skipList(start)
+	}
+
+	err := d.list(start, func(i int) error {
+		if v.Kind() == reflect.Slice {
+			v.Set(reflect.Append(v, reflect.Zero(v.Type().Elem())))
+		} else if i >= v.Len() {
+			return d.syntaxError(d.off, "too many items for %s", v.Type())
+		}
+		return d.value(v.Index(i))
+	})
+	if err != nil {
+		return err
+	}
+
+	if v.Kind() == reflect.Slice && v.IsNil() {
+		v.Set(reflect.MakeSlice(v.Type(), 0, 0))
+	}
+	return nil
+}
+
+func (d *Decoder) dictValue(start int64, v reflect.Value) error {
+	switch v.Kind() {
+	case reflect.Map:
+		if v.Type().Key().Kind() != reflect.String {
+			d.typeError(start, "dict", v.Type())
+			return d.skipDict(start)
+		}
+		if v.IsNil() {
+			v.Set(reflect.MakeMap(v.Type()))
+		}
+
+		return d.dict(start, func(key string) error {
+			item := reflect.New(v.Type().Elem()).Elem()
+			if err := d.value(item); err != nil {
+				return err
+			}
+			v.SetMapIndex(reflect.ValueOf(key).Convert(v.Type().Key()), item)
+			return nil
+		})
+	case reflect.Struct:
+		fields := cachedFields(v.Type())
+
+		return d.dict(start, func(key string) error {
+			for _, f := range fields {
+				if f.name == key {
+					return d.value(v.Field(f.index))
+				}
+			}
+			_, err := d.generic()
+			return err
+		})
+	}
+	d.typeError(start, "dict", v.Type())
+	return d.skipDict(start)
+}
+
+// generic decodes the next value to int64, string, []interface{} or
+// map[string]interface{}.
+func (d *Decoder) generic() (interface{}, error) {
+	c, err := d.peek()
+	if err != nil {
+		return nil, err
+	}
+	if c >= '0' && c <= '9' {
+		s, err := d.readString()
+		return string(s), err
+	}
+
+	start := d.off
+	d.readByte()
+
+	switch c {
+	case 'i':
+		s, err := d.readInt(start)
+		if err != nil {
+			return nil, err
+		}
+		n, err := strconv.ParseInt(s, 10, 64)
+		if err != nil {
+			return nil, d.syntaxError(start, "invalid integer %q", s)
+		}
+		return n, nil
+	case 'l':
+		list := make([]interface{}, 0)
+		err := d.list(start, func(int) error {
+			item, err := d.generic()
+			list = append(list, item)
+			return err
+		})
+		return list, err
+	case 'd':
+		dict := make(map[string]interface{})
+		err := d.dict(start, func(key string) error {
+			item, err := d.generic()
+			dict[key] = item
+			return err
+		})
+		return dict, err
+	}
+	return nil, d.syntaxError(start, "invalid character %q looking for value", c)
+}
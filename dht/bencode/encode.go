@@ -0,0 +1,261 @@
+// Package bencode converts between bencoded data and Go values using
+// reflection, in the manner of encoding/json.
+//
+// Strings map to string, []byte and byte arrays, integers to any integer
+// kind and bool, lists to slices and arrays, and dicts to structs and maps
+// with string keys. Struct fields are named by the `bencode:"name,omitempty"`
+// tag, or by the field name if there's no tag. A field tagged "-" is
+// ignored. RawMessage keeps a value exactly as it's encoded, for example to
+// hash the info dict of a torrent.
+package bencode
+
+import (
+	"bytes"
+	"errors"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// RawMessage is a raw encoded value. It's written as is by Marshal and
+// holds the exact bytes of the value after Unmarshal.
+type RawMessage []byte
+
+var rawMessageType = reflect.TypeOf(RawMessage(nil))
+
+// UnsupportedTypeError is returned by Marshal when it meets a value which
+// can't be encoded.
+type UnsupportedTypeError struct {
+	Type reflect.Type
+}
+
+func (e *UnsupportedTypeError) Error() string {
+	return "bencode: unsupported type: " + e.Type.String()
+}
+
+// Marshal returns the bencoding of v. Dict keys are sorted as the
+// specification requires. Nil pointers and interfaces in structs and maps
+// are omitted since bencode has no null.
+func Marshal(v interface{}) ([]byte, error) {
+	e := &encodeState{}
+	if err := e.marshal(reflect.ValueOf(v)); err != nil {
+		return nil, err
+	}
+	return e.Bytes(), nil
+}
+
+// encodeState encodes values into a buffer.
+type encodeState struct {
+	bytes.Buffer
+}
+
+func (e *encodeState) writeString(s string) {
+	e.WriteString(strconv.Itoa(len(s)))
+	e.WriteByte(':')
+	e.WriteString(s)
+}
+
+func (e *encodeState) writeBytes(b []byte) {
+	e.WriteString(strconv.Itoa(len(b)))
+	e.WriteByte(':')
+	e.Write(b)
+}
+
+func (e *encodeState) writeInt(s string) {
+	e.WriteByte('i')
+	e.WriteString(s)
+	e.WriteByte('e')
+}
+
+func (e *encodeState) marshal(v reflect.Value) error {
+	if !v.IsValid() {
+		return errors.New("bencode: nil value")
+	}
+
+	if v.Type() == rawMessageType {
+		if v.Len() == 0 {
+			return errors.New("bencode: empty RawMessage")
+		}
+		e.Write(v.Bytes())
+		return nil
+	}
+
+	switch v.Kind() {
+	case reflect.Ptr, reflect.Interface:
+		if v.IsNil() {
+			return errors.New("bencode: nil value")
+		}
+		return e.marshal(v.Elem())
+	case reflect.String:
+		e.writeString(v.String())
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		e.writeInt(strconv.FormatInt(v.Int(), 10))
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32,
+		reflect.Uint64, reflect.Uintptr:
+
+		e.writeInt(strconv.FormatUint(v.Uint(), 10))
+	case reflect.Bool:
+		if v.Bool() {
+			e.writeInt("1")
+		} else {
+			e.writeInt("0")
+		}
+	case reflect.Slice:
+		if v.Type().Elem().Kind() == reflect.Uint8 {
+			e.writeBytes(v.Bytes())
+			return nil
+		}
+		return e.marshalList(v)
+	case reflect.Array:
+		if v.Type().Elem().Kind() == reflect.Uint8 {
+			b := make([]byte, v.Len())
+			reflect.Copy(reflect.ValueOf(b), v)
+			e.writeBytes(b)
+			return nil
+		}
+		return e.marshalList(v)
+	case reflect.Map:
+		return e.marshalMap(v)
+	case reflect.Struct:
+		return e.marshalStruct(v)
+	default:
+		return &UnsupportedTypeError{v.Type()}
+	}
+	return nil
+}
+
+func (e *encodeState) marshalList(v reflect.Value) error {
+	e.WriteByte('l')
+	for i := 0; i < v.Len(); i++ {
+		if err := e.marshal(v.Index(i)); err != nil {
+			return err
+		}
+	}
+	e.WriteByte('e')
+	return nil
+}
+
+func (e *encodeState) marshalMap(v reflect.Value) error {
+	if v.Type().Key().Kind() != reflect.String {
+		return &UnsupportedTypeError{v.Type()}
+	}
+
+	keys := v.MapKeys()
+	sort.Slice(keys, func(i, j int) bool {
+		return keys[i].String() < keys[j].String()
+	})
+
+	e.WriteByte('d')
+	for _, key := range keys {
+		item := v.MapIndex(key)
+		if isNil(item) {
+			continue
+		}
+
+		e.writeString(key.String())
+		if err := e.marshal(item); err != nil {
+			return err
+		}
+	}
+	e.WriteByte('e')
+	return nil
+}
+
+func (e *encodeState) marshalStruct(v reflect.Value) error {
+	e.WriteByte('d')
+	for _, f := range cachedFields(v.Type()) {
+		item := v.Field(f.index)
+		if isNil(item) || (f.omitEmpty && isEmpty(item)) {
+			continue
+		}
+
+		e.writeString(f.name)
+		if err := e.marshal(item); err != nil {
+			return err
+		}
+	}
+	e.WriteByte('e')
+	return nil
+}
+
+// isNil returns whether v is a nil pointer or interface, which can't be
+// encoded.
+func isNil(v reflect.Value) bool {
+	switch v.Kind() {
+	case reflect.Ptr, reflect.Interface:
+		return v.IsNil()
+	}
+	return false
+}
+
+// isEmpty returns whether v is omitted by omitempty.
+func isEmpty(v reflect.Value) bool {
+	switch v.Kind() {
+	case reflect.Array, reflect.Map, reflect.Slice, reflect.String:
+		return v.Len() == 0
+	case reflect.Bool:
+		return !v.Bool()
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return v.Int() == 0
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32,
+		reflect.Uint64, reflect.Uintptr:
+
+		return v.Uint() == 0
+	case reflect.Ptr, reflect.Interface:
+		return v.IsNil()
+	}
+	return false
+}
+
+// field is an encoded field of a struct.
+type field struct {
+	name      string
+	index     int
+	omitEmpty bool
+}
+
+// fieldCache maps a struct type to its fields sorted by name.
+var fieldCache sync.Map
+
+// cachedFields returns the exported fields of struct type t sorted by their
+// names.
+func cachedFields(t reflect.Type) []field {
+	if fields, ok := fieldCache.Load(t); ok {
+		return fields.([]field)
+	}
+
+	fields := make([]field, 0, t.NumField())
+	for i := 0; i < t.NumField(); i++ {
+		sf := t.Field(i)
+		if sf.PkgPath != "" {
+			continue
+		}
+
+		tag := sf.Tag.Get("bencode")
+		if tag == "-" {
+			continue
+		}
+
+		name, opts := tag, ""
+		if i := strings.IndexByte(tag, ','); i != -1 {
+			name, opts = tag[:i], tag[i+1:]
+		}
+		if name == "" {
+			name = sf.Name
+		}
+
+		fields = append(fields, field{
+			name:      name,
+			index:     i,
+			omitEmpty: opts == "omitempty",
+		})
+	}
+	sort.Slice(fields, func(i, j int) bool {
+		return fields[i].name < fields[j].name
+	})
+
+	fieldCache.Store(t, fields)
+	return fields
+}
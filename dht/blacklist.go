@@ -1,6 +1,7 @@
 package dht
 
 import (
+	"net"
 	"time"
 )
 
@@ -17,6 +18,8 @@ type blackList struct {
 	list         *syncedMap
 	maxSize      int
 	expiredAfter time.Duration
+	// the blocked ip ranges, it's optional
+	blocklist *Blocklist
 }
 
 // newBlackList returns a blackList pointer.
@@ -62,6 +65,10 @@ func (bl *blackList) in(ip string, port int) bool {
 		return true
 	}
 
+	if bl.blocklist.Contains(net.ParseIP(ip)) {
+		return true
+	}
+
 	key := bl.genKey(ip, port)
 
 	v, ok := bl.list.Get(key)
@@ -74,9 +81,18 @@ func (bl *blackList) in(ip string, port int) bool {
 	return false
 }
 
-// clear cleans the expired items every 10 minutes.
-func (bl *blackList) clear() {
-	for _ = range time.Tick(time.Minute * 10) {
+// clear cleans the expired items every 10 minutes until done is closed.
+func (bl *blackList) clear(done <-chan struct{}) {
+	ticker := time.NewTicker(time.Minute * 10)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+		case <-done:
+			return
+		}
+
 		keys := make([]interface{}, 0, 100)
 
 		for item := range bl.list.Iter() {
@@ -0,0 +1,358 @@
+package dht
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"log"
+	"net"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// blocklistCheckPeriod is how long a Blocklist checks whether its files
+// have changed.
+const blocklistCheckPeriod = time.Minute
+
+// ipRange is an inclusive range of IPv6 or IPv4-mapped IPv6 addresses.
+type ipRange struct {
+	first, last [net.IPv6len]byte
+}
+
+// toKey returns the 16-byte form of ip. IPv4 is mapped to IPv6 so that both
+// can be compared in the same way.
+func toKey(ip net.IP) (key [net.IPv6len]byte, ok bool) {
+	ip = ip.To16()
+	if ip == nil {
+		return key, false
+	}
+	copy(key[:], ip)
+	return key, true
+}
+
+// parseIP parses an IP, allowing the zero-padded IPv4 like 001.002.003.004
+// used by ipfilter.dat.
+func parseIP(s string) net.IP {
+	s = strings.TrimSpace(s)
+	if ip := net.ParseIP(s); ip != nil {
+		return ip
+	}
+
+	parts := strings.Split(s, ".")
+	if len(parts) != 4 {
+		return nil
+	}
+
+	ip := make(net.IP, net.IPv4len)
+	for i, part := range parts {
+		n, err := strconv.ParseUint(part, 10, 8)
+		if err != nil {
+			return nil
+		}
+		ip[i] = byte(n)
+	}
+	return ip.To16()
+}
+
+// parseRange parses a CIDR, a single IP, or a range like `first - last`.
+func parseRange(s string) (r ipRange, err error) {
+	s = strings.TrimSpace(s)
+
+	if strings.Contains(s, "/") {
+		_, ipNet, err := net.ParseCIDR(s)
+		if err != nil {
+			return r, err
+		}
+
+		first := ipNet.IP.To16()
+		last := make(net.IP, len(ipNet.IP))
+		for i := range ipNet.IP {
+			last[i] = ipNet.IP[i] | ^ipNet.Mask[i]
+		}
+		r.first, _ = toKey(first)
+		r.last, _ = toKey(last)
+		return r, nil
+	}
+
+	first, last := s, s
+	if i := strings.IndexByte(s, '-'); i != -1 {
+		first, last = s[:i], s[i+1:]
+	}
+
+	firstIP, lastIP := parseIP(first), parseIP(last)
+	if firstIP == nil || lastIP == nil ||
+		(firstIP.To4() == nil) != (lastIP.To4() == nil) {
+
+		return r, fmt.Errorf("invalid ip range %q", s)
+	}
+
+	r.first, _ = toKey(firstIP)
+	r.last, _ = toKey(lastIP)
+	if bytes.Compare(r.first[:], r.last[:]) > 0 {
+		return r, fmt.Errorf("invalid ip range %q", s)
+	}
+	return r, nil
+}
+
+// parseBlocklistLine parses a line of a blocklist file. It returns false if
+// the line is a comment, is empty or isn't blocked. The formats are:
+//   - eMule ipfilter.dat: `first - last , level , description`, where the
+//     ranges whose access level is greater than 127 aren't blocked
+//   - PeerGuardian .p2p: `description:first-last`
+//   - a CIDR or a single IP
+func parseBlocklistLine(line string) (r ipRange, ok bool, err error) {
+	line = strings.TrimSpace(line)
+	if line == "" || line[0] == '#' || strings.HasPrefix(line, "//") {
+		return r, false, nil
+	}
+
+	// The description of a .p2p line may contain commas, so it's detected
+	// by the range after the last colon before the ipfilter.dat format.
+	if i := strings.LastIndexByte(line, ':'); i != -1 &&
+		strings.Contains(line[i+1:], "-") {
+
+		if r, err := parseRange(line[i+1:]); err == nil {
+			return r, true, nil
+		}
+	}
+
+	if fields := strings.Split(line, ","); len(fields) > 1 {
+		if level, err := strconv.Atoi(strings.TrimSpace(fields[1])); err == nil &&
+			level > 127 {
+
+			return r, false, nil
+		}
+		line = fields[0]
+	}
+
+	r, err = parseRange(line)
+	return r, err == nil, err
+}
+
+// loadBlocklistFile reads the ranges in a blocklist file. Invalid lines are
+// skipped and counted.
+func loadBlocklistFile(path string) (ranges []ipRange, invalid int, err error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, 0, err
+	}
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		r, ok, err := parseBlocklistLine(scanner.Text())
+		if err != nil {
+			invalid++
+		} else if ok {
+			ranges = append(ranges, r)
+		}
+	}
+	return ranges, invalid, scanner.Err()
+}
+
+// mergeRanges sorts the ranges and merges the overlapping and adjacent ones.
+func mergeRanges(ranges []ipRange) []ipRange {
+	sort.Slice(ranges, func(i, j int) bool {
+		return bytes.Compare(ranges[i].first[:], ranges[j].first[:]) < 0
+	})
+
+	merged := make([]ipRange, 0, len(ranges))
+	for _, r := range ranges {
+		if n := len(merged); n > 0 {
+			last := &merged[n-1]
+			// r overlaps or is next to last, or last ends at the max address
+			next := last.last
+			if !incKey(&next) || bytes.Compare(r.first[:], next[:]) <= 0 {
+				if bytes.Compare(r.last[:], last.last[:]) > 0 {
+					last.last = r.last
+				}
+				continue
+			}
+		}
+		merged = append(merged, r)
+	}
+	return merged
+}
+
+// incKey adds 1 to key. It returns false if key overflows.
+func incKey(key *[net.IPv6len]byte) bool {
+	for i := len(key) - 1; i >= 0; i-- {
+		key[i]++
+		if key[i] != 0 {
+			return true
+		}
+	}
+	*key = [net.IPv6len]byte{}
+	return false
+}
+
+// blocklistFile is a blocklist file and the ranges loaded from it.
+type blocklistFile struct {
+	modTime time.Time
+	size    int64
+	ranges  []ipRange
+}
+
+// Blocklist blocks IP ranges, which are CIDRs, single IPs or ranges loaded
+// from PeerGuardian .p2p and eMule ipfilter.dat files. The files are loaded
+// again when they change. A Blocklist can be shared by a DHT and a Wire.
+type Blocklist struct {
+	mutex  sync.RWMutex
+	static []ipRange
+	files  map[string]*blocklistFile
+	// merged ranges of static and files
+	ranges []ipRange
+}
+
+// NewBlocklist returns an empty Blocklist pointer.
+func NewBlocklist() *Blocklist {
+	return &Blocklist{files: make(map[string]*blocklistFile)}
+}
+
+// Add blocks a CIDR, a single IP or a range like `first-last`.
+func (bl *Blocklist) Add(entry string) error {
+	r, err := parseRange(entry)
+	if err != nil {
+		return err
+	}
+
+	bl.mutex.Lock()
+	bl.static = append(bl.static, r)
+	bl.merge()
+	bl.mutex.Unlock()
+	return nil
+}
+
+// AddFile blocks the ranges in the blocklist file at path. The file is
+// watched even if it fails to load, so that it's loaded once it's fixed.
+func (bl *Blocklist) AddFile(path string) error {
+	bl.mutex.Lock()
+	if _, ok := bl.files[path]; !ok {
+		bl.files[path] = &blocklistFile{}
+	}
+	bl.mutex.Unlock()
+
+	_, err := bl.reloadFile(path)
+	return err
+}
+
+// Reload loads the files which have changed since they are loaded. It
+// returns the last error and keeps the old ranges of the files which fail.
+func (bl *Blocklist) Reload() error {
+	bl.mutex.RLock()
+	paths := make([]string, 0, len(bl.files))
+	for path := range bl.files {
+		paths = append(paths, path)
+	}
+	bl.mutex.RUnlock()
+
+	var lastErr error
+	for _, path := range paths {
+		if changed, err := bl.reloadFile(path); err != nil {
+			lastErr = err
+		} else if changed {
+			log.Printf("屏蔽列表 %s 已重新加载, 共 %d 个地址段", path, bl.Len())
+		}
+	}
+	return lastErr
+}
+
+// reloadFile loads the file at path if it has changed.
+func (bl *Blocklist) reloadFile(path string) (bool, error) {
+	info, err := os.Stat(path)
+	if err != nil {
+		return false, err
+	}
+
+	bl.mutex.RLock()
+	f, ok := bl.files[path]
+	changed := ok && (!info.ModTime().Equal(f.modTime) || info.Size() != f.size)
+	bl.mutex.RUnlock()
+	if !changed {
+		return false, nil
+	}
+
+	ranges, invalid, err := loadBlocklistFile(path)
+	if err != nil {
+		return false, err
+	}
+	if invalid > 0 {
+		log.Printf("屏蔽列表 %s 中有 %d 行无效", path, invalid)
+	}
+
+	bl.mutex.Lock()
+	bl.files[path] = &blocklistFile{
+		modTime: info.ModTime(),
+		size:    info.Size(),
+		ranges:  ranges,
+	}
+	bl.merge()
+	bl.mutex.Unlock()
+	return true, nil
+}
+
+// merge rebuilds the merged ranges. The caller must hold the lock.
+func (bl *Blocklist) merge() {
+	n := len(bl.static)
+	for _, f := range bl.files {
+		n += len(f.ranges)
+	}
+
+	ranges := make([]ipRange, 0, n)
+	ranges = append(ranges, bl.static...)
+	for _, f := range bl.files {
+		ranges = append(ranges, f.ranges...)
+	}
+	bl.ranges = mergeRanges(ranges)
+}
+
+// Contains returns whether ip is blocked. It's safe to call on nil.
+func (bl *Blocklist) Contains(ip net.IP) bool {
+	if bl == nil {
+		return false
+	}
+
+	key, ok := toKey(ip)
+	if !ok {
+		return false
+	}
+
+	bl.mutex.RLock()
+	defer bl.mutex.RUnlock()
+
+	i := sort.Search(len(bl.ranges), func(i int) bool {
+		return bytes.Compare(bl.ranges[i].last[:], key[:]) >= 0
+	})
+	return i < len(bl.ranges) &&
+		bytes.Compare(bl.ranges[i].first[:], key[:]) <= 0
+}
+
+// Len returns the number of the merged ranges.
+func (bl *Blocklist) Len() int {
+	bl.mutex.RLock()
+	defer bl.mutex.RUnlock()
+	return len(bl.ranges)
+}
+
+// watch reloads the changed files every blocklistCheckPeriod until done is
+// closed.
+func (bl *Blocklist) watch(done <-chan struct{}) {
+	ticker := time.NewTicker(blocklistCheckPeriod)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+		case <-done:
+			return
+		}
+
+		if err := bl.Reload(); err != nil {
+			log.Printf("重新加载屏蔽列表失败: %v", err)
+		}
+	}
+}
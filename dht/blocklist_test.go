@@ -0,0 +1,153 @@
+package dht
+
+import (
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestParseBlocklistLine(t *testing.T) {
+	cases := []struct {
+		in          string
+		first, last string
+		ok          bool
+		err         bool
+	}{
+		{"", "", "", false, false},
+		{"# comment", "", "", false, false},
+		{"001.002.003.000 - 001.002.003.255 , 000 , Some Org", "1.2.3.0", "1.2.3.255", true, false},
+		{"001.002.004.000 - 001.002.004.255 , 200 , Allowed", "", "", false, false},
+		{"Some Org: Inc:5.6.7.8-5.6.7.9", "5.6.7.8", "5.6.7.9", true, false},
+		{"Level 3 Communications, Inc:4.0.0.0-4.255.255.255", "4.0.0.0", "4.255.255.255", true, false},
+		{"Some Org, LLC:1.2.3.0-1.2.3.255", "1.2.3.0", "1.2.3.255", true, false},
+		{"2001:0db8:0000:0000:0000:0000:0000:0000 - 2001:0db8:0000:0000:0000:0000:0000:00ff , 000 , Some Org", "2001:db8::", "2001:db8::ff", true, false},
+		{"10.0.0.0/8", "10.0.0.0", "10.255.255.255", true, false},
+		{"2001:db8::/32", "2001:db8::", "2001:db8:ffff:ffff:ffff:ffff:ffff:ffff", true, false},
+		{"8.8.8.8", "8.8.8.8", "8.8.8.8", true, false},
+		{"1.2.3.9-1.2.3.4", "", "", false, true},
+		{"1.2.3.4-::1", "", "", false, true},
+		{"garbage", "", "", false, true},
+	}
+
+	for _, c := range cases {
+		r, ok, err := parseBlocklistLine(c.in)
+		if ok != c.ok || (err != nil) != c.err {
+			t.Errorf("parseBlocklistLine(%q) = %v, %v", c.in, ok, err)
+			continue
+		}
+		if !ok {
+			continue
+		}
+
+		first, _ := toKey(net.ParseIP(c.first))
+		last, _ := toKey(net.ParseIP(c.last))
+		if r.first != first || r.last != last {
+			t.Errorf("parseBlocklistLine(%q) = %v - %v, want %s - %s",
+				c.in, net.IP(r.first[:]), net.IP(r.last[:]), c.first, c.last)
+		}
+	}
+}
+
+func TestBlocklist(t *testing.T) {
+	bl := NewBlocklist()
+	for _, entry := range []string{
+		"1.2.3.0/24", "1.2.4.0-1.2.4.255", "1.2.3.128/25", "9.9.9.9", "fe80::/10",
+	} {
+		if err := bl.Add(entry); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := bl.Add("1.2.3"); err == nil {
+		t.Error("Add should fail")
+	}
+
+	// 1.2.3.0/24 and 1.2.4.0/24 are merged
+	if bl.Len() != 3 {
+		t.Errorf("Len = %d, want 3", bl.Len())
+	}
+
+	cases := []struct {
+		ip      string
+		blocked bool
+	}{
+		{"1.2.2.255", false},
+		{"1.2.3.0", true},
+		{"1.2.4.255", true},
+		{"1.2.5.0", false},
+		{"9.9.9.9", true},
+		{"9.9.9.10", false},
+		{"fe80::1", true},
+		{"2001:db8::1", false},
+	}
+
+	for _, c := range cases {
+		if bl.Contains(net.ParseIP(c.ip)) != c.blocked {
+			t.Errorf("Contains(%s) != %v", c.ip, c.blocked)
+		}
+	}
+
+	var nilList *Blocklist
+	if nilList.Contains(net.ParseIP("1.2.3.4")) {
+		t.Error("nil Blocklist shouldn't contain any ip")
+	}
+}
+
+func TestBlocklistReload(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "level1.p2p")
+
+	bl := NewBlocklist()
+	if err := bl.AddFile(path); err == nil {
+		t.Error("AddFile should fail when the file doesn't exist")
+	}
+
+	write := func(content string, modTime time.Time) {
+		if err := os.WriteFile(path, []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.Chtimes(path, modTime, modTime); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	now := time.Now()
+	write("Bad:1.1.1.0-1.1.1.255\ninvalid line\n", now.Add(-time.Hour))
+	if err := bl.Reload(); err != nil {
+		t.Fatal(err)
+	}
+	if !bl.Contains(net.ParseIP("1.1.1.1")) {
+		t.Error("the file isn't loaded")
+	}
+
+	write("Bad:2.2.2.0-2.2.2.255\n", now)
+	if err := bl.Reload(); err != nil {
+		t.Fatal(err)
+	}
+	if bl.Contains(net.ParseIP("1.1.1.1")) ||
+		!bl.Contains(net.ParseIP("2.2.2.2")) {
+
+		t.Error("the file isn't reloaded")
+	}
+
+	os.Remove(path)
+	if err := bl.Reload(); err == nil {
+		t.Error("Reload should fail when the file is removed")
+	}
+	if !bl.Contains(net.ParseIP("2.2.2.2")) {
+		t.Error("the ranges should be kept when the file fails to load")
+	}
+}
+
+func TestBlackListBlocklist(t *testing.T) {
+	bl := newBlackList(256)
+	if bl.in("1.2.3.4", 80) {
+		t.Fatal("empty blacklist shouldn't block")
+	}
+
+	bl.blocklist = NewBlocklist()
+	bl.blocklist.Add("1.2.3.0/24")
+	if !bl.in("1.2.3.4", 80) || bl.in("1.2.4.4", 80) {
+		t.Error("blacklist should check the blocklist")
+	}
+}
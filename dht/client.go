@@ -0,0 +1,296 @@
+package dht
+
+import (
+	"errors"
+	"net"
+	"sort"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+)
+
+// maxClientVLength is the max length of v in the extension handshake, the
+// longer ones are dropped.
+const maxClientVLength = 64
+
+// azureusClients maps the client codes of Azureus-style peer ids like
+// -UT3550- to the client names.
+var azureusClients = map[string]string{
+	"AG": "Ares",
+	"AZ": "Vuze",
+	"BC": "BitComet",
+	"BI": "BiglyBT",
+	"BN": "Baidu Netdisk",
+	"BT": "BitTorrent",
+	"DE": "Deluge",
+	"FD": "Free Download Manager",
+	"FG": "FlashGet",
+	"KT": "KTorrent",
+	"LT": "libtorrent",
+	"lt": "rTorrent",
+	"PI": "PicoTorrent",
+	"qB": "qBittorrent",
+	"QD": "QQDownload",
+	"SD": "Thunder",
+	"TL": "Tribler",
+	"TR": "Transmission",
+	"UM": "µTorrent Mac",
+	"UT": "µTorrent",
+	"UW": "µTorrent Web",
+	"WD": "WebTorrent Desktop",
+	"WW": "WebTorrent",
+	"XL": "Xunlei",
+}
+
+// shadowClients maps the first bytes of Shadow-style peer ids like
+// T03I-----... to the client names.
+var shadowClients = map[byte]string{
+	'A': "ABC",
+	'O': "Osprey Permaseed",
+	'Q': "BTQueue",
+	'R': "Tribler",
+	'S': "Shadow",
+	'T': "BitTornado",
+	'U': "UPnP NAT Bit Torrent",
+}
+
+// shadowVersionChars are the characters of the version in Shadow-style peer
+// ids, each is a version number of its index.
+const shadowVersionChars = "0123456789ABCDEFGHIJKLMNOPQRSTUVWXYZabcdefghijklmnopqrstuvwxyz.-"
+
+// PeerClient describes the client of the remote peer, which is learned from
+// the BitTorrent handshake and the BEP 10 extension handshake.
+type PeerClient struct {
+	// the 20-byte peer id in the BitTorrent handshake
+	PeerID []byte
+	// the client name and version decoded from the peer id, or from v if
+	// the peer id isn't recognized. They are empty if neither is known
+	Name    string
+	Version string
+	// v in the extension handshake as it is, like "µTorrent 3.5.5". It's
+	// empty if v is longer than 64 bytes or isn't UTF-8
+	V string
+	// our ip seen by the remote peer, nil if it isn't sent
+	YourIP net.IP
+	// how many outstanding requests the peer accepts, 0 if it isn't sent
+	Reqq int
+	// the extension messages supported by the peer and their ids
+	Extensions map[string]int
+}
+
+// ExtensionNames returns the sorted names of the supported extensions.
+func (c *PeerClient) ExtensionNames() []string {
+	names := make([]string, 0, len(c.Extensions))
+	for name := range c.Extensions {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// ParsePeerID decodes the client name and version from an Azureus-style
+// (-UT3550-), Shadow-style (T03I--) or Mainline-style (M4-3-6--) peer id.
+// It returns empty strings if the style isn't recognized. The name is the
+// client code itself for unknown Azureus-style codes.
+func ParsePeerID(peerID []byte) (name, version string) {
+	if len(peerID) != 20 {
+		return "", ""
+	}
+
+	if peerID[0] == '-' && peerID[7] == '-' {
+		code := string(peerID[1:3])
+		if !isAlnum(peerID[1]) || !isAlnum(peerID[2]) {
+			return "", ""
+		}
+
+		name, ok := azureusClients[code]
+		if !ok {
+			name = code
+		}
+		return name, azureusVersion(peerID[3:7])
+	}
+
+	if peerID[0] == 'M' {
+		if version, ok := mainlineVersion(peerID[1:]); ok {
+			return "BitTorrent", version
+		}
+	}
+
+	if name, ok := shadowClients[peerID[0]]; ok &&
+		string(peerID[6:9]) == "---" {
+
+		if version, ok := shadowVersion(peerID[1:6]); ok {
+			return name, version
+		}
+	}
+
+	return "", ""
+}
+
+// azureusVersion decodes the version like 3550 or 355B. The trailing
+// non-digit, which is the release type, and the trailing zeros are dropped.
+func azureusVersion(v []byte) string {
+	n := len(v)
+	if n > 0 && !isDigit(v[n-1]) {
+		n--
+	}
+	for n > 1 && v[n-1] == '0' {
+		n--
+	}
+
+	parts := make([]string, 0, n)
+	for _, c := range v[:n] {
+		if !isAlnum(c) {
+			return ""
+		}
+		parts = append(parts, strconv.Itoa(strings.IndexByte(shadowVersionChars, c)))
+	}
+	return strings.Join(parts, ".")
+}
+
+// mainlineVersion decodes the version like 4-3-6-- or 4-20-8-, each
+// number has one or two digits and ends with '-'.
+func mainlineVersion(v []byte) (string, bool) {
+	s := string(v)
+	parts := make([]string, 0, 3)
+	for len(parts) < 3 {
+		i := strings.IndexByte(s, '-')
+		if i < 1 || i > 2 || !isDigits(s[:i]) {
+			return "", false
+		}
+		parts = append(parts, s[:i])
+		s = s[i+1:]
+	}
+	return strings.Join(parts, "."), true
+}
+
+// shadowVersion decodes the version of Shadow-style peer ids, which is
+// padded with '-'.
+func shadowVersion(v []byte) (string, bool) {
+	s := strings.TrimRight(string(v), "-")
+	if s == "" || strings.Contains(s, "-") {
+		return "", false
+	}
+
+	parts := make([]string, 0, len(s))
+	for i := 0; i < len(s); i++ {
+		n := strings.IndexByte(shadowVersionChars, s[i])
+		if n == -1 {
+			return "", false
+		}
+		parts = append(parts, strconv.Itoa(n))
+	}
+	return strings.Join(parts, "."), true
+}
+
+// parseClientVersion splits v like "µTorrent 3.5.5" or "libtorrent/1.2.3"
+// into the name and version. The version is empty if v doesn't end with
+// one.
+func parseClientVersion(v string) (name, version string) {
+	v = strings.TrimSpace(v)
+	if i := strings.LastIndexAny(v, " /"); i > 0 && i < len(v)-1 &&
+		isDigit(v[i+1]) {
+
+		return strings.TrimSpace(v[:i]), v[i+1:]
+	}
+	return v, ""
+}
+
+func isDigit(c byte) bool {
+	return c >= '0' && c <= '9'
+}
+
+func isDigits(s string) bool {
+	for i := 0; i < len(s); i++ {
+		if !isDigit(s[i]) {
+			return false
+		}
+	}
+	return true
+}
+
+func isAlnum(c byte) bool {
+	return isDigit(c) || c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z'
+}
+
+// extHandshake is the BEP 10 extension handshake.
+type extHandshake struct {
+	utMetadata   int
+	metadataSize int
+	client       PeerClient
+}
+
+// parseExtHandshake parses the payload of the extension handshake. It fails
+// if the peer doesn't support ut_metadata, see BEP 9.
+func parseExtHandshake(data []byte) (hs extHandshake, err error) {
+	v, err := Decode(data)
+	if err != nil {
+		return
+	}
+
+	dict, ok := v.(map[string]interface{})
+	if !ok {
+		err = errors.New("invalid dict")
+		return
+	}
+
+	if err = ParseKeys(
+		dict, [][]string{{"metadata_size", "int"}, {"m", "map"}}); err != nil {
+		return
+	}
+
+	m := dict["m"].(map[string]interface{})
+	if err = ParseKey(m, "ut_metadata", "int"); err != nil {
+		return
+	}
+
+	hs.utMetadata = m["ut_metadata"].(int)
+	hs.metadataSize = dict["metadata_size"].(int)
+
+	if hs.metadataSize > MaxMetadataSize {
+		err = errors.New("metadata_size too long")
+		return
+	}
+
+	// the optional fields are kept only if they are valid
+	hs.client.Extensions = make(map[string]int, len(m))
+	for name, id := range m {
+		// 0 means the extension is disabled
+		if id, ok := id.(int); ok && id > 0 {
+			hs.client.Extensions[name] = id
+		}
+	}
+
+	if v, ok := dict["v"].(string); ok && len(v) <= maxClientVLength &&
+		utf8.ValidString(v) {
+
+		hs.client.V = v
+	}
+
+	if yourIP, ok := dict["yourip"].(string); ok &&
+		(len(yourIP) == net.IPv4len || len(yourIP) == net.IPv6len) {
+
+		hs.client.YourIP = net.IP(yourIP)
+	}
+
+	if reqq, ok := dict["reqq"].(int); ok && reqq > 0 {
+		hs.client.Reqq = reqq
+	}
+
+	return
+}
+
+// newPeerClient returns the PeerClient of peerID and the extension
+// handshake. The name and version in the peer id are preferred to v, so a
+// client gets the same version whichever the peer sends, e.g. 2.9.4 of
+// -TR2940- rather than 2.94 of "Transmission 2.94".
+func newPeerClient(peerID []byte, hs extHandshake) PeerClient {
+	client := hs.client
+	client.PeerID = peerID
+
+	client.Name, client.Version = ParsePeerID(peerID)
+	if client.Name == "" && client.V != "" {
+		client.Name, client.Version = parseClientVersion(client.V)
+	}
+	return client
+}
@@ -0,0 +1,239 @@
+package dht
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha1"
+	"encoding/binary"
+	"io"
+	"net"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestParsePeerID(t *testing.T) {
+	cases := []struct {
+		in            string
+		name, version string
+	}{
+		{"-UT355S-abcdefghijkl", "µTorrent", "3.5.5"},
+		{"-qB4350-abcdefghijkl", "qBittorrent", "4.3.5"},
+		{"-TR2940-abcdefghijkl", "Transmission", "2.9.4"},
+		{"-XY1000-abcdefghijkl", "XY", "1"},
+		{"M4-3-6--abcdefghijkl", "BitTorrent", "4.3.6"},
+		{"M4-20-8-abcdefghijkl", "BitTorrent", "4.20.8"},
+		{"T03I-----abcdefghijk", "BitTornado", "0.3.18"},
+		{"S58B-----abcdefghijk", "Shadow", "5.8.11"},
+		{"Tabcdefghijklmnopqrs", "", ""},
+		{"abcdefghijklmnopqrst", "", ""},
+		{"-UT355S-", "", ""},
+	}
+
+	for _, c := range cases {
+		name, version := ParsePeerID([]byte(c.in))
+		if name != c.name || version != c.version {
+			t.Errorf("ParsePeerID(%q) = %q, %q, want %q, %q",
+				c.in, name, version, c.name, c.version)
+		}
+	}
+}
+
+func TestParseClientVersion(t *testing.T) {
+	cases := []struct {
+		in            string
+		name, version string
+	}{
+		{"µTorrent 3.5.5", "µTorrent", "3.5.5"},
+		{"libtorrent/1.2.3.0", "libtorrent", "1.2.3.0"},
+		{"Transmission 2.94", "Transmission", "2.94"},
+		{"qBittorrent v4.3.5", "qBittorrent v4.3.5", ""},
+		{"Deluge", "Deluge", ""},
+	}
+
+	for _, c := range cases {
+		name, version := parseClientVersion(c.in)
+		if name != c.name || version != c.version {
+			t.Errorf("parseClientVersion(%q) = %q, %q, want %q, %q",
+				c.in, name, version, c.name, c.version)
+		}
+	}
+}
+
+func TestParseExtHandshake(t *testing.T) {
+	data := Encode(map[string]interface{}{
+		"m": map[string]interface{}{
+			"ut_metadata": 2, "ut_pex": 1, "lt_donthave": 0,
+		},
+		"metadata_size": 100,
+		"v":             "µTorrent 3.5.5",
+		"yourip":        string(net.IPv4(1, 2, 3, 4).To4()),
+		"reqq":          255,
+	})
+
+	hs, err := parseExtHandshake([]byte(data))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if hs.utMetadata != 2 || hs.metadataSize != 100 {
+		t.Errorf("ut_metadata = %d, metadata_size = %d",
+			hs.utMetadata, hs.metadataSize)
+	}
+
+	client := newPeerClient([]byte("-qB4350-abcdefghijkl"), hs)
+	if client.Name != "qBittorrent" || client.Version != "4.3.5" ||
+		client.V != "µTorrent 3.5.5" {
+
+		t.Errorf("client = %q %q, the peer id should be preferred",
+			client.Name, client.Version)
+	}
+
+	// v is used if the peer id isn't recognized
+	client = newPeerClient([]byte("abcdefghijklmnopqrst"), hs)
+	if client.Name != "µTorrent" || client.Version != "3.5.5" {
+		t.Errorf("client = %q %q, want the one of v", client.Name, client.Version)
+	}
+	if !client.YourIP.Equal(net.IPv4(1, 2, 3, 4)) || client.Reqq != 255 {
+		t.Errorf("yourip = %v, reqq = %d", client.YourIP, client.Reqq)
+	}
+	if names := client.ExtensionNames(); len(names) != 2 ||
+		names[0] != "ut_metadata" || names[1] != "ut_pex" {
+
+		t.Errorf("extensions = %v", names)
+	}
+
+	// the optional fields are dropped if they are invalid
+	for _, v := range []string{strings.Repeat("a", maxClientVLength+1), "a\xff"} {
+		data = Encode(map[string]interface{}{
+			"m":             map[string]interface{}{"ut_metadata": 1},
+			"metadata_size": 100,
+			"v":             v,
+			"yourip":        "abc",
+			"reqq":          -1,
+		})
+		if hs, err = parseExtHandshake([]byte(data)); err != nil {
+			t.Fatal(err)
+		}
+		client = newPeerClient([]byte("abcdefghijklmnopqrst"), hs)
+		if client.YourIP != nil || client.Reqq != 0 || client.V != "" ||
+			client.Name != "" {
+
+			t.Errorf("client = %+v", client)
+		}
+	}
+
+	for _, data := range []string{
+		Encode(map[string]interface{}{"metadata_size": 100}),
+		Encode(map[string]interface{}{
+			"m": map[string]interface{}{}, "metadata_size": 100,
+		}),
+		Encode(map[string]interface{}{
+			"m":             map[string]interface{}{"ut_metadata": 1},
+			"metadata_size": MaxMetadataSize + 1,
+		}),
+	} {
+		if _, err := parseExtHandshake([]byte(data)); err == nil {
+			t.Errorf("parseExtHandshake(%q) should fail", data)
+		}
+	}
+}
+
+// servePeer serves metadata on l like a peer whose id is peerID and the
+// extension handshake is extra plus m and metadata_size.
+func servePeer(t *testing.T, l net.Listener, peerID string,
+	metadata []byte, extra map[string]interface{}) {
+
+	conn, err := l.Accept()
+	if err != nil {
+		return
+	}
+	defer conn.Close()
+
+	handshake := make([]byte, 68)
+	if _, err := io.ReadFull(conn, handshake); err != nil {
+		t.Error(err)
+		return
+	}
+	// a plaintext peer drops the encrypted handshake
+	if !bytes.Equal(handshake[:20], []byte("\x13BitTorrent protocol")) {
+		return
+	}
+	copy(handshake[48:], peerID)
+	conn.Write(handshake)
+
+	ext := map[string]interface{}{
+		"m":             map[string]interface{}{"ut_metadata": 3},
+		"metadata_size": len(metadata),
+	}
+	for k, v := range extra {
+		ext[k] = v
+	}
+
+	send := func(payload []byte) {
+		length := make([]byte, 4)
+		binary.BigEndian.PutUint32(length, uint32(len(payload)))
+		conn.Write(append(length, payload...))
+	}
+	send(append([]byte{EXTENDED, HANDSHAKE}, Encode(ext)...))
+
+	// the extension handshake and the piece request
+	for i := 0; i < 2; i++ {
+		length := make([]byte, 4)
+		if _, err := io.ReadFull(conn, length); err != nil {
+			return
+		}
+		if _, err := io.CopyN(io.Discard, conn,
+			int64(bytes2int(length))); err != nil {
+			return
+		}
+	}
+
+	send(append(append([]byte{EXTENDED, 3}, Encode(map[string]interface{}{
+		"msg_type": DATA, "piece": 0, "total_size": len(metadata),
+	})...), metadata...))
+
+	io.Copy(io.Discard, conn)
+}
+
+func TestWireResponseClient(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+
+	metadata := []byte(Encode(map[string]interface{}{"name": "test"}))
+	infoHash := sha1.Sum(metadata)
+
+	go servePeer(t, l, "-TR2940-abcdefghijkl", metadata,
+		map[string]interface{}{
+			"yourip": string(net.IPv4(127, 0, 0, 1).To4()),
+			"reqq":   500,
+		})
+
+	wire := NewWire(16, 1, 1)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go wire.Run(ctx)
+
+	addr := l.Addr().(*net.TCPAddr)
+	wire.Request(infoHash[:], addr.IP.String(), addr.Port)
+
+	select {
+	case resp := <-wire.Response():
+		if !bytes.Equal(resp.MetadataInfo, metadata) {
+			t.Error("wrong metadata")
+		}
+
+		client := resp.Client
+		if string(client.PeerID) != "-TR2940-abcdefghijkl" ||
+			client.Name != "Transmission" || client.Version != "2.9.4" ||
+			client.Reqq != 500 || !client.YourIP.Equal(addr.IP) ||
+			client.Extensions["ut_metadata"] != 3 {
+
+			t.Errorf("client = %+v", client)
+		}
+	case <-time.After(time.Second * 5):
+		t.Fatal("no response")
+	}
+}
@@ -10,8 +10,10 @@ import (
 	"magnet-search/hole/stun"
 	"math"
 	"net"
+	"os"
 	"strconv"
 	"sync"
+	"sync/atomic"
 	"time"
 )
 
@@ -34,10 +36,13 @@ var (
 type Config struct {
 	// in mainline dht, k = 8
 	K int
+	// how many queries an iterative lookup sends concurrently
+	Alpha int
 	// for crawling mode, we put all nodes in one bucket, so KBucketSize may
 	// not be K
 	KBucketSize int
-	// candidates are udp, udp4, udp6
+	// candidates are udp, udp4, udp6. udp works on both IPv4 and IPv6 and
+	// keeps a routing table for each of them, see BEP 32
 	Network string
 	// format is `ip:port`
 	Address string
@@ -61,8 +66,14 @@ type Config struct {
 	OnGetPeersResponse func(string, *Peer)
 	// callback when got announce_peer request
 	OnAnnouncePeer func(string, string, int)
-	// blcoked ips
+	// callback when got infohashes from sample_infohashes response, ip and
+	// port belong to the node which sampled them
+	OnSampleInfohashes func(string, string, int)
+	// blocked ips, CIDRs like 1.2.3.0/24 or ranges like 1.2.3.4-1.2.3.9
 	BlockedIPs []string
+	// PeerGuardian .p2p or eMule ipfilter.dat files whose ranges are
+	// blocked, they are loaded again when changed
+	BlocklistFiles []string
 	// blacklist size
 	BlackListMaxSize int
 	// StandardMode or CrawlMode
@@ -75,14 +86,45 @@ type Config struct {
 	PacketWorkerLimit int
 	// the nodes num to be fresh in a kbucket
 	RefreshNodeNum int
+	// whether to refuse nodes whose id doesn't match their ip in the routing
+	// table, see BEP 42
+	SecureNodeID bool
+	// the nodes num to be sampled by sample_infohashes every
+	// CheckKBucketPeriod in CrawlMode, 0 disables it
+	SampleNodeNum int
+	// how many BEP 44 items can be stored, only in StandardMode
+	MaxItems int
+	// the file to keep the node id and routing table between restarts,
+	// empty disables it
+	StateFile string
+	// how long it saves the state file
+	SaveStatePeriod time.Duration
+	// how long it announces the infohashes passed to Announce again, 0
+	// disables it
+	AnnouncePeriod time.Duration
+	// the max number of queries sent per second, 0 means no limit
+	MaxQueriesPerSecond int
+	// the max number of queries sent to the same node per second, 0 means
+	// no limit
+	MaxQueriesPerNodePerSecond int
+	// the max number of packets accepted from the same ip per second, 0
+	// means no limit
+	MaxPacketsPerIPPerSecond int
+	// how many packets from an ip are dropped by MaxPacketsPerIPPerSecond
+	// before the ip is blacklisted, 0 means never
+	BlacklistAfterDropped int
+	// the transport to send and receive packets, if nil, it listens on
+	// Address by Network. NAT traversal is skipped when it's set
+	Transport Transport
 }
 
 // NewStandardConfig returns a Config pointer with default values.
 func NewStandardConfig() *Config {
 	return &Config{
 		K:           8,
+		Alpha:       3,
 		KBucketSize: 8,
-		Network:     "udp4",
+		Network:     "udp",
 		Address:     ":26881",
 		PrimeNodes: []string{
 			"router.bittorrent.com:6881",
@@ -97,19 +139,27 @@ func NewStandardConfig() *Config {
 			"dht.acgtracker.com:6881",     // 动漫资源相关，亚洲连通性好
 			"router.asiandht.com:6881",    // 亚洲优化节点
 		},
-		NodeExpriedAfter:     time.Duration(time.Minute * 15),
-		KBucketExpiredAfter:  time.Duration(time.Minute * 15),
-		CheckKBucketPeriod:   time.Duration(time.Second * 30),
-		TokenExpiredAfter:    time.Duration(time.Minute * 10),
-		MaxTransactionCursor: math.MaxUint32,
-		MaxNodes:             6666,
-		BlockedIPs:           make([]string, 0),
-		BlackListMaxSize:     65536,
-		Try:                  2,
-		Mode:                 StandardMode,
-		PacketJobLimit:       1024,
-		PacketWorkerLimit:    256,
-		RefreshNodeNum:       8,
+		NodeExpriedAfter:           time.Duration(time.Minute * 15),
+		KBucketExpiredAfter:        time.Duration(time.Minute * 15),
+		CheckKBucketPeriod:         time.Duration(time.Second * 30),
+		TokenExpiredAfter:          time.Duration(time.Minute * 10),
+		MaxTransactionCursor:       math.MaxUint32,
+		MaxNodes:                   6666,
+		BlockedIPs:                 make([]string, 0),
+		BlackListMaxSize:           65536,
+		Try:                        2,
+		Mode:                       StandardMode,
+		PacketJobLimit:             1024,
+		PacketWorkerLimit:          256,
+		RefreshNodeNum:             8,
+		SampleNodeNum:              0,
+		MaxItems:                   1024,
+		SaveStatePeriod:            time.Duration(time.Minute * 5),
+		AnnouncePeriod:             time.Duration(time.Minute * 15),
+		MaxQueriesPerSecond:        0,
+		MaxQueriesPerNodePerSecond: 10,
+		MaxPacketsPerIPPerSecond:   50,
+		BlacklistAfterDropped:      500,
 	}
 }
 
@@ -122,6 +172,7 @@ func NewCrawlConfig() *Config {
 	config.KBucketSize = math.MaxInt32
 	config.Mode = CrawlMode
 	config.RefreshNodeNum = 512
+	config.SampleNodeNum = 256
 
 	return config
 }
@@ -130,13 +181,22 @@ func NewCrawlConfig() *Config {
 type DHT struct {
 	*Config
 	node               *node
-	conn               *net.UDPConn
+	conn               Transport
 	routingTable       *routingTable
+	routingTable6      *routingTable
 	transactionManager *transactionManager
 	peersManager       *peersManager
 	tokenManager       *tokenManager
+	samplingManager    *samplingManager
+	itemStore          *itemStore
+	announcements      *syncedMap
+	savedNodes         []*node
+	events             *eventBus
+	packetStats        *packetStats
+	queryLimiter       *rateLimiter
+	packetLimiter      *rateLimiter
 	blackList          *blackList
-	Ready              bool
+	blocklist          *Blocklist
 	packets            chan packet
 	workerTokens       chan struct{}
 	//NAT 穿透相关字段
@@ -159,7 +219,19 @@ type DHT struct {
 	uniquePeerMap    map[string]struct{} // 用于跟踪唯一对等点
 
 	// 关闭通道
-	closing chan struct{}
+	closing   chan struct{}
+	closeOnce sync.Once
+	// Run 返回后关闭
+	done    chan struct{}
+	started int32
+	// init 完成后置为 1
+	initialized int32
+	// 加入网络后置为 1，见 Ready
+	ready int32
+	// findSelf 运行时置为 1
+	findingSelf int32
+	// reannounce 运行时置为 1
+	reannouncing int32
 }
 
 // isPublicIP 检查IP是否为公网IP
@@ -188,8 +260,14 @@ func isPublicIP(ip net.IP) bool {
 		}
 	}
 
-	// IPv6私有地址范围检查
-	if ip.IsPrivate() || ip.IsLinkLocalUnicast() || ip.IsLinkLocalMulticast() {
+	// IPv6私有地址范围检查 (fc00::/7, fe80::/10, 组播和未指定地址)
+	if ip.IsPrivate() || ip.IsLinkLocalUnicast() || ip.IsLinkLocalMulticast() ||
+		ip.IsUnspecified() || ip.IsMulticast() || !ip.IsGlobalUnicast() {
+		return false
+	}
+
+	// 2001:db8::/32 文档地址
+	if ip[0] == 0x20 && ip[1] == 0x01 && ip[2] == 0x0d && ip[3] == 0xb8 {
 		return false
 	}
 
@@ -286,13 +364,30 @@ func New(config *Config) *DHT {
 		activeInfoHashes: make(map[string]int),
 		uniquePeerMap:    make(map[string]struct{}),
 		closing:          make(chan struct{}),
+		done:             make(chan struct{}),
+		events:           newEventBus(),
+		packetStats:      newPacketStats(),
+		announcements:    newSyncedMap(),
 	}
 
 	// 记录总引导节点数量
 	d.totalBootNodes = len(config.PrimeNodes)
 
+	d.blocklist = NewBlocklist()
+	d.blackList.blocklist = d.blocklist
 	for _, ip := range config.BlockedIPs {
-		d.blackList.insert(ip, -1)
+		if err := d.blocklist.Add(ip); err != nil {
+			log.Printf("无效的屏蔽地址 %s: %v", ip, err)
+		}
+	}
+	for _, path := range config.BlocklistFiles {
+		if err := d.blocklist.AddFile(path); err != nil {
+			log.Printf("加载屏蔽列表 %s 失败: %v", path, err)
+		}
+	}
+
+	if config.Transport != nil {
+		return d
 	}
 
 	go func() {
@@ -309,6 +404,13 @@ func New(config *Config) *DHT {
 	return d
 }
 
+// Blocklist returns the blocked ip ranges of the dht, which can be shared
+// with a Wire by Wire.SetBlocklist. Its files are reloaded while the dht
+// runs.
+func (dht *DHT) Blocklist() *Blocklist {
+	return dht.blocklist
+}
+
 // IsStandardMode returns whether mode is StandardMode.
 func (dht *DHT) IsStandardMode() bool {
 	return dht.Mode == StandardMode
@@ -319,6 +421,66 @@ func (dht *DHT) IsCrawlMode() bool {
 	return dht.Mode == CrawlMode
 }
 
+// IsDualStack returns whether the dht works on both IPv4 and IPv6.
+func (dht *DHT) IsDualStack() bool {
+	return dht.Network == "udp"
+}
+
+// table returns the routing table of the ip's address family.
+// See http://www.bittorrent.org/beps/bep_0032.html.
+func (dht *DHT) table(ip net.IP) *routingTable {
+	if ip.To4() == nil {
+		return dht.routingTable6
+	}
+	return dht.routingTable
+}
+
+// tables returns the routing tables of the address families in use.
+func (dht *DHT) tables() []*routingTable {
+	switch dht.Network {
+	case "udp4":
+		return []*routingTable{dht.routingTable}
+	case "udp6":
+		return []*routingTable{dht.routingTable6}
+	default:
+		return []*routingTable{dht.routingTable, dht.routingTable6}
+	}
+}
+
+// neighbors returns at most size-length nodes closest to id in each
+// routing table.
+func (dht *DHT) neighbors(id *bitmap, size int) []*node {
+	nodes := make([]*node, 0, size*2)
+	for _, rt := range dht.tables() {
+		nodes = append(nodes, rt.GetNeighbors(id, size)...)
+	}
+	return nodes
+}
+
+// NodesNum returns the number of nodes in the routing tables, 0 before Run
+// initializes them.
+func (dht *DHT) NodesNum() int {
+	if atomic.LoadInt32(&dht.initialized) == 0 {
+		return 0
+	}
+	return dht.nodesLen()
+}
+
+// Ready returns whether the dht has joined the network. The lookups and the
+// queries fail with ErrNotReady before it.
+func (dht *DHT) Ready() bool {
+	return atomic.LoadInt32(&dht.ready) == 1
+}
+
+// nodesLen returns the number of nodes in all routing tables.
+func (dht *DHT) nodesLen() int {
+	n := 0
+	for _, rt := range dht.tables() {
+		n += rt.Len()
+	}
+	return n
+}
+
 // 记录收到节点响应的方法
 func (dht *DHT) recordNodeResponse(addr string) {
 	dht.bootNodesMutex.Lock()
@@ -330,6 +492,12 @@ func (dht *DHT) recordNodeResponse(addr string) {
 		if !dht.bootNodeStatus[addr] {
 			dht.connectedBootNodes++
 			log.Printf("成功连接到DHT引导节点: %s", addr)
+
+			dht.events.publish(BootstrapEvent{
+				Total:     dht.totalBootNodes,
+				Connected: dht.connectedBootNodes,
+				Nodes:     dht.nodesLen(),
+			})
 		}
 		dht.bootNodeStatus[addr] = true
 	}
@@ -412,6 +580,7 @@ func (dht *DHT) printStats() {
 	// 获取DHT节点统计
 	total, connected, _, _ := dht.GetBootNodeStats()
 	routingTableSize := dht.routingTable.Len()
+	routingTable6Size := dht.routingTable6.Len()
 
 	// 获取对等点统计
 	totalPeers, uniquePeers, activeHashes := dht.GetPeerStats()
@@ -420,8 +589,9 @@ func (dht *DHT) printStats() {
 	activeInfoHashCount := len(activeHashes)
 
 	// 输出统计信息
-	log.Printf("DHT状态: 路由表=%d节点 | 引导节点=%d/%d (%.1f%%) | 发现对等点=%d | 唯一对等点=%d | 活跃资源=%d",
+	log.Printf("DHT状态: 路由表=%d节点 (IPv6=%d) | 引导节点=%d/%d (%.1f%%) | 发现对等点=%d | 唯一对等点=%d | 活跃资源=%d",
 		routingTableSize,
+		routingTable6Size,
 		connected,
 		total,
 		float64(connected)/float64(total)*100,
@@ -457,32 +627,66 @@ func (dht *DHT) init() {
 	ctx, cancel := context.WithCancel(context.Background())
 	defer cancel()
 
-	// 初始化NAT穿透
-	err := dht.initNAT(ctx)
-	if err != nil {
-		log.Printf("NAT穿透初始化失败: %v", err)
-		// 即使NAT穿透失败，我们仍然继续，以防在没有NAT的环境下
+	// 初始化NAT穿透，使用自定义传输层时跳过
+	if dht.Transport == nil {
+		if err := dht.initNAT(ctx); err != nil {
+			log.Printf("NAT穿透初始化失败: %v", err)
+			// 即使NAT穿透失败，我们仍然继续，以防在没有NAT的环境下
+		}
 	}
 
-	listener, err := net.ListenPacket(dht.Network, dht.Address)
-	log.Printf("监听地址: Network type :%s  address: %s \n", dht.Network, dht.Address)
-	if err != nil {
-		panic(err)
+	// 从状态文件恢复节点ID和路由表，节点在响应ping后才加入路由表
+	if dht.StateFile != "" {
+		if st, err := loadState(dht.StateFile); err == nil {
+			dht.node.id = newBitmapFromString(st.id)
+			dht.savedNodes = st.nodes
+			log.Printf("从状态文件 %s 恢复了 %d 个节点", dht.StateFile, len(st.nodes))
+		} else if !os.IsNotExist(err) {
+			log.Printf("读取状态文件失败: %v", err)
+		}
 	}
 
-	dht.conn = listener.(*net.UDPConn)
+	// 根据外部IP生成符合BEP 42的节点ID
+	if dht.externalIP != nil &&
+		!isSecureNodeID(dht.node.id.RawString(), dht.externalIP) {
+
+		dht.node.id = newBitmapFromString(genSecureNodeID(dht.externalIP))
+		log.Printf("根据外部IP %s 生成节点ID: %s",
+			dht.externalIP.String(), hex.EncodeToString([]byte(dht.node.id.RawString())))
+	}
+
+	if dht.Transport != nil {
+		dht.conn = dht.Transport
+	} else {
+		listener, err := net.ListenPacket(dht.Network, dht.Address)
+		log.Printf("监听地址: Network type :%s  address: %s \n", dht.Network, dht.Address)
+		if err != nil {
+			panic(err)
+		}
+
+		dht.conn = listener.(*net.UDPConn)
+	}
 	dht.routingTable = newRoutingTable(dht.KBucketSize, dht)
+	dht.routingTable6 = newRoutingTable(dht.KBucketSize, dht)
 	dht.peersManager = newPeersManager(dht)
-	dht.tokenManager = newTokenManager(dht.TokenExpiredAfter, dht)
+	dht.tokenManager = newTokenManager(dht.TokenExpiredAfter)
+	dht.samplingManager = newSamplingManager(dht)
+	dht.itemStore = newItemStore(dht.MaxItems)
+	dht.queryLimiter = newRateLimiter(
+		dht.MaxQueriesPerSecond, dht.MaxQueriesPerNodePerSecond)
+	dht.packetLimiter = newRateLimiter(0, dht.MaxPacketsPerIPPerSecond)
 	dht.transactionManager = newTransactionManager(
 		dht.MaxTransactionCursor, dht)
 
 	// 初始化引导节点状态
 	dht.initBootNodeStatus()
+	atomic.StoreInt32(&dht.initialized, 1)
 
 	go dht.transactionManager.run()
-	go dht.tokenManager.clear()
-	go dht.blackList.clear()
+	go dht.blackList.clear(dht.closing)
+	go dht.blocklist.watch(dht.closing)
+	go dht.queryLimiter.clear(dht.closing)
+	go dht.packetLimiter.clear(dht.closing)
 
 	// 启动统计监控
 	go dht.startStatsMonitor()
@@ -509,19 +713,35 @@ func (dht *DHT) join() {
 
 	log.Printf("正在连接到 %d 个DHT引导节点...", dht.totalBootNodes)
 
+	dht.bootNodesMutex.RLock()
+	dht.events.publish(BootstrapEvent{
+		Total:     dht.totalBootNodes,
+		Connected: dht.connectedBootNodes,
+		Nodes:     dht.nodesLen(),
+	})
+	dht.bootNodesMutex.RUnlock()
+
+	// 双栈模式下分别解析IPv4和IPv6地址，以便同时填充两个路由表
+	networks := []string{dht.Network}
+	if dht.IsDualStack() {
+		networks = []string{"udp4", "udp6"}
+	}
+
 	for _, addr := range dht.PrimeNodes {
-		raddr, err := net.ResolveUDPAddr(dht.Network, addr)
-		if err != nil {
-			log.Printf("解析引导节点地址失败: %s, 错误: %v", addr, err)
-			continue
-		}
+		for _, network := range networks {
+			raddr, err := net.ResolveUDPAddr(network, addr)
+			if err != nil {
+				log.Printf("解析引导节点地址失败: %s (%s), 错误: %v", addr, network, err)
+				continue
+			}
 
-		// 发送find_node请求到引导节点
-		dht.transactionManager.findNode(
-			&node{addr: raddr},
-			dht.node.id.RawString(),
-		)
-		log.Printf("连接到引导节点请求：【find_node】: %s", addr)
+			// 发送find_node请求到引导节点
+			dht.transactionManager.findNode(
+				&node{addr: raddr, stats: &nodeStats{}},
+				dht.node.id.RawString(),
+			)
+			log.Printf("连接到引导节点请求：【find_node】: %s (%s)", addr, raddr)
+		}
 	}
 }
 
@@ -539,7 +759,11 @@ func (dht *DHT) listen() {
 				if err != nil {
 					continue
 				}
-				dht.packets <- packet{buff[:n], raddr}
+
+				// packets are decoded concurrently, so buff can't be shared
+				data := make([]byte, n)
+				copy(data, buff[:n])
+				dht.packets <- packet{data, raddr}
 			}
 		}
 	}()
@@ -556,7 +780,7 @@ func (dht *DHT) id(target string) string {
 
 // GetPeers returns peers who have announced having infoHash.
 func (dht *DHT) GetPeers(infoHash string) error {
-	if !dht.Ready {
+	if !dht.Ready() {
 		return ErrNotReady
 	}
 
@@ -572,8 +796,8 @@ func (dht *DHT) GetPeers(infoHash string) error {
 		infoHash = string(data)
 	}
 
-	neighbors := dht.routingTable.GetNeighbors(
-		newBitmapFromString(infoHash), dht.routingTable.Len())
+	neighbors := dht.neighbors(
+		newBitmapFromString(infoHash), dht.nodesLen())
 
 	for _, no := range neighbors {
 		dht.transactionManager.getPeers(no, infoHash)
@@ -582,17 +806,26 @@ func (dht *DHT) GetPeers(infoHash string) error {
 	return nil
 }
 
-// Run starts the dht.
-func (dht *DHT) Run() {
-	// 创建上下文，用于NAT穿透的生命周期管理
-	ctx, cancel := context.WithCancel(context.Background())
-	defer cancel()
+// Run starts the dht and blocks until ctx is done or Stop is called. Before
+// it returns, the state is saved, the NAT mappings are released and the
+// connection is closed.
+func (dht *DHT) Run(ctx context.Context) {
+	if !atomic.CompareAndSwapInt32(&dht.started, 0, 1) {
+		return
+	}
+	defer close(dht.done)
+	defer dht.shutdown()
 
 	dht.init()
 	dht.listen()
-	dht.join()
 
-	dht.Ready = true
+	if len(dht.savedNodes) > 0 {
+		dht.pingSavedNodes()
+	} else {
+		dht.join()
+	}
+
+	atomic.StoreInt32(&dht.ready, 1)
 
 	// 开始监控后立即输出初始状态
 	go func() {
@@ -602,9 +835,25 @@ func (dht *DHT) Run() {
 	}()
 
 	var pkt packet
-	tick := time.Tick(dht.CheckKBucketPeriod)
+	tick := time.NewTicker(dht.CheckKBucketPeriod)
+	defer tick.Stop()
 	// 每10分钟刷新一次NAT映射，保持映射活跃
-	natRefreshTick := time.Tick(10 * time.Minute)
+	natRefreshTick := time.NewTicker(10 * time.Minute)
+	defer natRefreshTick.Stop()
+
+	var saveStateTick <-chan time.Time
+	if dht.StateFile != "" {
+		ticker := time.NewTicker(dht.SaveStatePeriod)
+		defer ticker.Stop()
+		saveStateTick = ticker.C
+	}
+
+	var announceTick <-chan time.Time
+	if dht.AnnouncePeriod > 0 {
+		ticker := time.NewTicker(dht.AnnouncePeriod)
+		defer ticker.Stop()
+		announceTick = ticker.C
+	}
 
 	for {
 		select {
@@ -616,13 +865,27 @@ func (dht *DHT) Run() {
 				dht.recordNodeResponse(addrStr)
 			}
 			handle(dht, pkt)
-		case <-tick:
-			if dht.routingTable.Len() == 0 {
+		case <-tick.C:
+			if n := dht.nodesLen(); n == 0 {
 				dht.join()
+			} else if n < dht.K {
+				go dht.findSelf()
 			} else if dht.transactionManager.len() == 0 {
-				go dht.routingTable.Fresh()
+				for _, rt := range dht.tables() {
+					go rt.Fresh()
+				}
+			}
+
+			if dht.IsCrawlMode() && dht.SampleNodeNum > 0 {
+				go dht.samplingManager.sample(dht.SampleNodeNum)
 			}
-		case <-natRefreshTick:
+		case <-saveStateTick:
+			if err := dht.saveState(); err != nil {
+				log.Printf("保存状态文件失败: %v", err)
+			}
+		case <-announceTick:
+			go dht.reannounce()
+		case <-natRefreshTick.C:
 			// 刷新NAT映射
 			if dht.natTraversal != nil {
 				err := dht.natTraversal.Refresh(ctx)
@@ -632,16 +895,44 @@ func (dht *DHT) Run() {
 			} else {
 				log.Println("❌NAT穿透未启用，跳过刷新")
 			}
+		case <-ctx.Done():
+			return
 		case <-dht.closing:
 			return
 		}
 	}
 }
 
-// Stop stops the DHT and cleans up NAT mappings
+// Stop stops the dht and waits until Run returns. It's the same as
+// canceling the context of Run.
 func (dht *DHT) Stop() {
+	dht.close()
+
+	if atomic.LoadInt32(&dht.started) == 1 {
+		<-dht.done
+	}
+}
+
+// close informs all goroutines to exit, it's safe to call it many times.
+func (dht *DHT) close() {
+	dht.closeOnce.Do(func() {
+		close(dht.closing)
+	})
+}
+
+// shutdown saves the state, cleans up NAT mappings and closes the
+// connection after Run exits.
+func (dht *DHT) shutdown() {
 	// 通知所有协程关闭
-	close(dht.closing)
+	dht.close()
+	atomic.StoreInt32(&dht.ready, 0)
+
+	// 保存节点ID和路由表，以便下次启动时恢复
+	if dht.StateFile != "" && dht.routingTable != nil {
+		if err := dht.saveState(); err != nil {
+			log.Printf("保存状态文件失败: %v", err)
+		}
+	}
 
 	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
 	defer cancel()
@@ -0,0 +1,91 @@
+package dhttest
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	"magnet-search/dht"
+)
+
+// Cluster is a group of dht nodes running on a Network. The first node is
+// the prime node of the others.
+type Cluster struct {
+	Network *Network
+	Nodes   []*dht.DHT
+}
+
+// NewCluster creates size nodes on network. configure is called with the
+// index and the default config of each node, it can be nil.
+func NewCluster(network *Network, size int,
+	configure func(int, *dht.Config)) (*Cluster, error) {
+
+	c := &Cluster{
+		Network: network,
+		Nodes:   make([]*dht.DHT, 0, size),
+	}
+
+	var prime string
+	for i := 0; i < size; i++ {
+		addr := network.NewAddr()
+		conn, err := network.Listen(addr)
+		if err != nil {
+			return nil, err
+		}
+
+		config := dht.NewStandardConfig()
+		config.Network = "udp4"
+		config.Address = addr.String()
+		config.Transport = conn
+		config.PrimeNodes = []string{}
+		// the network is small, so refresh buckets more frequently
+		config.CheckKBucketPeriod = time.Second
+		// all nodes join by the first one at the same time, don't drop
+		// the burst of packets
+		config.PacketJobLimit = 4096
+		config.PacketWorkerLimit = 4096
+		if i > 0 {
+			config.PrimeNodes = []string{prime}
+		} else {
+			prime = addr.String()
+		}
+
+		if configure != nil {
+			configure(i, config)
+		}
+
+		c.Nodes = append(c.Nodes, dht.New(config))
+	}
+
+	return c, nil
+}
+
+// Start runs all nodes.
+func (c *Cluster) Start() {
+	for _, d := range c.Nodes {
+		go d.Run(context.Background())
+	}
+}
+
+// Stop stops all nodes.
+func (c *Cluster) Stop() {
+	for _, d := range c.Nodes {
+		d.Stop()
+	}
+}
+
+// WaitNodes waits until every node has at least n nodes in its routing
+// table.
+func (c *Cluster) WaitNodes(n int, timeout time.Duration) error {
+	deadline := time.Now().Add(timeout)
+
+	for _, d := range c.Nodes {
+		for !d.Ready() || d.NodesNum() < n {
+			if time.Now().After(deadline) {
+				return errors.New("dhttest: timeout waiting for nodes")
+			}
+			time.Sleep(time.Millisecond * 10)
+		}
+	}
+	return nil
+}
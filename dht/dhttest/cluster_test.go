@@ -0,0 +1,477 @@
+package dhttest
+
+import (
+	"context"
+	"errors"
+	"io/ioutil"
+	"log"
+	"net"
+	"os"
+	"testing"
+	"time"
+
+	"magnet-search/dht"
+)
+
+func TestMain(m *testing.M) {
+	log.SetOutput(ioutil.Discard)
+	os.Exit(m.Run())
+}
+
+func TestNetworkLoss(t *testing.T) {
+	network := NewNetwork(1)
+	network.Loss = 1
+
+	a, _ := network.Listen(network.NewAddr())
+	b, _ := network.Listen(network.NewAddr())
+
+	a.WriteToUDP([]byte("ping"), b.LocalAddr().(*net.UDPAddr))
+	if sent, dropped := network.Stats(); sent != 1 || dropped != 1 {
+		t.Fail()
+	}
+}
+
+func TestNetworkLatency(t *testing.T) {
+	network := NewNetwork(1)
+	network.Latency = time.Millisecond * 20
+
+	a, _ := network.Listen(network.NewAddr())
+	b, _ := network.Listen(network.NewAddr())
+
+	start := time.Now()
+	a.WriteToUDP([]byte("ping"), b.LocalAddr().(*net.UDPAddr))
+
+	buff := make([]byte, 16)
+	n, raddr, err := b.ReadFromUDP(buff)
+	if err != nil || string(buff[:n]) != "ping" ||
+		raddr.String() != a.LocalAddr().String() {
+		t.Fatal("packet not received")
+	}
+
+	if time.Since(start) < network.Latency {
+		t.Fail()
+	}
+
+	b.Close()
+	if _, _, err := b.ReadFromUDP(buff); err != ErrClosed {
+		t.Fail()
+	}
+}
+
+func TestClusterBootstrap(t *testing.T) {
+	network := NewNetwork(1)
+	network.Latency = time.Millisecond
+	network.Jitter = time.Millisecond * 5
+
+	cluster, err := NewCluster(network, 200, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cluster.Start()
+	defer cluster.Stop()
+
+	if err := cluster.WaitNodes(8, time.Second*30); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestClusterPutGet(t *testing.T) {
+	network := NewNetwork(1)
+
+	cluster, err := NewCluster(network, 50, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cluster.Start()
+	defer cluster.Stop()
+
+	if err := cluster.WaitNodes(8, time.Second*30); err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*10)
+	defer cancel()
+
+	item, _ := dht.NewImmutableItem("Hello World!")
+	if err := cluster.Nodes[1].Put(ctx, item); err != nil {
+		t.Fatal(err)
+	}
+
+	got, err := cluster.Nodes[len(cluster.Nodes)-1].Get(ctx, item.Target(), "")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if got.V != "Hello World!" {
+		t.Fail()
+	}
+}
+
+func TestClusterFindClosest(t *testing.T) {
+	network := NewNetwork(1)
+	network.Latency = time.Millisecond
+
+	cluster, err := NewCluster(network, 100, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cluster.Start()
+	defer cluster.Stop()
+
+	if err := cluster.WaitNodes(8, time.Second*30); err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*10)
+	defer cancel()
+
+	nodes, err := cluster.Nodes[1].FindClosest(ctx, "0123456789abcdefghij")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(nodes) != 8 {
+		t.Fatalf("found %d nodes", len(nodes))
+	}
+
+	// looking up the id of a node from another one ends at the node itself
+	want := nodes[0]
+	from := cluster.Nodes[len(cluster.Nodes)-1]
+	if from.Address == want.Addr.String() {
+		from = cluster.Nodes[len(cluster.Nodes)-2]
+	}
+	nodes, err = from.FindClosest(ctx, want.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(nodes) == 0 || nodes[0].ID != want.ID ||
+		nodes[0].Addr.String() != want.Addr.String() {
+		t.Fail()
+	}
+}
+
+func TestClusterLookupPeers(t *testing.T) {
+	network := NewNetwork(1)
+	network.Latency = time.Millisecond
+
+	cluster, err := NewCluster(network, 50, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cluster.Start()
+	defer cluster.Stop()
+
+	if err := cluster.WaitNodes(8, time.Second*30); err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*10)
+	defer cancel()
+
+	infoHash := "0123456789abcdefghij"
+	nodes, err := cluster.Nodes[1].FindClosest(ctx, infoHash)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// announce a peer to the nodes closest to the infohash
+	peer, _ := network.Listen(network.NewAddr())
+	for _, no := range nodes {
+		if err := announce(peer, no.Addr, infoHash, 6881); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	peers, err := cluster.Nodes[len(cluster.Nodes)-1].LookupPeers(ctx, infoHash)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	found := 0
+	for p := range peers {
+		if !p.IP.Equal(peer.LocalAddr().(*net.UDPAddr).IP) || p.Port != 6881 {
+			t.Fatalf("unexpected peer %s:%d", p.IP, p.Port)
+		}
+		found++
+	}
+
+	// the peer is returned once though it's stored on many nodes
+	if found != 1 {
+		t.Fatalf("found the peer %d times", found)
+	}
+}
+
+func TestClusterAnnounce(t *testing.T) {
+	network := NewNetwork(1)
+	network.Latency = time.Millisecond
+
+	cluster, err := NewCluster(network, 50, func(_ int, config *dht.Config) {
+		config.AnnouncePeriod = time.Millisecond * 200
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cluster.Start()
+	defer cluster.Stop()
+
+	if err := cluster.WaitNodes(8, time.Second*30); err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*10)
+	defer cancel()
+
+	infoHash := "0123456789abcdefghij"
+	if err := cluster.Nodes[1].Announce(ctx, infoHash, 6881, false); err != nil {
+		t.Fatal(err)
+	}
+
+	peers, err := cluster.Nodes[len(cluster.Nodes)-1].LookupPeers(ctx, infoHash)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	found := false
+	for p := range peers {
+		if p.Port == 6881 {
+			found = true
+		}
+	}
+	if !found {
+		t.Fatal("the announced peer is not found")
+	}
+
+	// it's announced again after AnnouncePeriod
+	announced := make(chan struct{}, 1)
+	for _, d := range cluster.Nodes {
+		events := d.Events(16)
+		defer events.Close()
+
+		go func() {
+			for e := range events.C {
+				if e, ok := e.(dht.AnnouncePeerEvent); ok && e.InfoHash == infoHash {
+					select {
+					case announced <- struct{}{}:
+					default:
+					}
+				}
+			}
+		}()
+	}
+
+	select {
+	case <-announced:
+	case <-time.After(time.Second * 5):
+		t.Fatal("not announced again")
+	}
+}
+
+func TestClusterScrape(t *testing.T) {
+	network := NewNetwork(1)
+	network.Latency = time.Millisecond
+
+	cluster, err := NewCluster(network, 50, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cluster.Start()
+	defer cluster.Stop()
+
+	if err := cluster.WaitNodes(8, time.Second*30); err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*10)
+	defer cancel()
+
+	// the scraping node may not know the nodes closest to the infohash,
+	// which are found by the lookup
+	infoHash := "0123456789abcdefghij"
+	for _, d := range cluster.Nodes[1:4] {
+		if err := d.Announce(ctx, infoHash, 6881, false); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	seeds, peers, err := cluster.Nodes[len(cluster.Nodes)-1].Scrape(ctx, infoHash)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if seeds != 0 || peers < 1 || peers > 3 {
+		t.Errorf("Scrape = %d seeds, %d peers, want 3 peers", seeds, peers)
+	}
+
+	if _, _, err := cluster.Nodes[0].Scrape(ctx, "abcdefghij0123456789"); err != dht.ErrNoScrape {
+		t.Errorf("Scrape = %v, want ErrNoScrape", err)
+	}
+}
+
+// announce announces conn as a peer of infoHash on port to the node at addr
+// by raw KRPC messages.
+func announce(conn *Conn, addr *net.UDPAddr, infoHash string, port int) error {
+	id := "abcdefghij0123456789"
+
+	query := func(q string, a map[string]interface{}) (
+		map[string]interface{}, error) {
+
+		a["id"] = id
+		conn.WriteToUDP([]byte(dht.Encode(map[string]interface{}{
+			"t": q, "y": "q", "q": q, "a": a,
+		})), addr)
+
+		// the node may query the peer too, skip the messages other than
+		// the response
+		buff := make([]byte, 2048)
+		for {
+			n, raddr, err := conn.ReadFromUDP(buff)
+			if err != nil {
+				return nil, err
+			}
+
+			response, err := dht.Decode(buff[:n])
+			if err != nil || raddr.String() != addr.String() {
+				continue
+			}
+
+			msg, ok := response.(map[string]interface{})
+			if !ok || msg["t"] != q {
+				continue
+			}
+
+			r, ok := msg["r"].(map[string]interface{})
+			if !ok {
+				return nil, errors.New("not a response")
+			}
+			return r, nil
+		}
+	}
+
+	// announce_peer needs the token in get_peers response
+	r, err := query("get_peers", map[string]interface{}{"info_hash": infoHash})
+	if err != nil {
+		return err
+	}
+
+	_, err = query("announce_peer", map[string]interface{}{
+		"info_hash": infoHash,
+		"port":      port,
+		"token":     r["token"],
+	})
+	return err
+}
+
+func TestCrawlerAnnounce(t *testing.T) {
+	network := NewNetwork(1)
+	announced := make(chan string, 1)
+
+	var crawler *net.UDPAddr
+	cluster, err := NewCluster(network, 1, func(_ int, config *dht.Config) {
+		crawler, _ = net.ResolveUDPAddr("udp4", config.Address)
+
+		crawl := dht.NewCrawlConfig()
+		crawl.Network, crawl.Address = config.Network, config.Address
+		crawl.Transport = config.Transport
+		crawl.PrimeNodes = config.PrimeNodes
+		crawl.OnAnnouncePeer = func(infoHash, ip string, port int) {
+			announced <- infoHash
+		}
+		*config = *crawl
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	events := cluster.Nodes[0].Events(16)
+	defer events.Close()
+
+	cluster.Start()
+	defer cluster.Stop()
+
+	for !cluster.Nodes[0].Ready() {
+		time.Sleep(time.Millisecond * 10)
+	}
+
+	peer, _ := network.Listen(network.NewAddr())
+	id, infoHash := "abcdefghij0123456789", "0123456789abcdefghij"
+
+	// announce_peer needs the token in get_peers response
+	peer.WriteToUDP([]byte(dht.Encode(map[string]interface{}{
+		"t": "aa", "y": "q", "q": "get_peers",
+		"a": map[string]interface{}{"id": id, "info_hash": infoHash},
+	})), crawler)
+
+	buff := make([]byte, 1024)
+	n, _, err := peer.ReadFromUDP(buff)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	response, err := dht.Decode(buff[:n])
+	if err != nil {
+		t.Fatal(err)
+	}
+	r := response.(map[string]interface{})["r"].(map[string]interface{})
+
+	peer.WriteToUDP([]byte(dht.Encode(map[string]interface{}{
+		"t": "bb", "y": "q", "q": "announce_peer",
+		"a": map[string]interface{}{
+			"id":           id,
+			"info_hash":    infoHash,
+			"port":         6881,
+			"implied_port": 1,
+			"token":        r["token"],
+		},
+	})), crawler)
+
+	select {
+	case got := <-announced:
+		if got != infoHash {
+			t.Fail()
+		}
+	case <-time.After(time.Second * 5):
+		t.Fatal("announce_peer not handled")
+	}
+
+	// implied_port is set, so the port is the one the packet comes from
+	port := peer.LocalAddr().(*net.UDPAddr).Port
+	for e := range events.C {
+		if e, ok := e.(dht.AnnouncePeerEvent); ok {
+			if e.InfoHash != infoHash || e.Port != port {
+				t.Fail()
+			}
+			break
+		}
+	}
+}
+
+func TestRunContext(t *testing.T) {
+	network := NewNetwork(1)
+
+	cluster, err := NewCluster(network, 1, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		cluster.Nodes[0].Run(ctx)
+		close(done)
+	}()
+
+	cancel()
+
+	select {
+	case <-done:
+	case <-time.After(time.Second * 5):
+		t.Fatal("Run should return after ctx is done")
+	}
+
+	// Stop after Run returns doesn't block
+	cluster.Nodes[0].Stop()
+}
@@ -0,0 +1,195 @@
+// Package dhttest provides an in-memory network to run many dht nodes in
+// one process without touching the internet.
+package dhttest
+
+import (
+	"encoding/binary"
+	"errors"
+	"math/rand"
+	"net"
+	"sync"
+	"time"
+)
+
+// ErrClosed is the error when read from or write to a closed Conn.
+var ErrClosed = errors.New("dhttest: use of closed connection")
+
+// packet represents a packet in flight.
+type packet struct {
+	data  []byte
+	raddr *net.UDPAddr
+}
+
+// Network is an in-memory network which delivers packets between Conns with
+// the configured latency and loss.
+type Network struct {
+	sync.Mutex
+	// the base delay of each packet
+	Latency time.Duration
+	// the random delay added to Latency, in [0, Jitter)
+	Jitter time.Duration
+	// the probability a packet is dropped, in [0, 1]
+	Loss float64
+	// how many packets can be queued in a Conn before dropping
+	QueueSize int
+
+	conns  map[string]*Conn
+	rand   *rand.Rand
+	nextIP uint32
+
+	sent, dropped int
+}
+
+// NewNetwork returns a Network without latency and loss. seed makes the
+// loss and jitter reproducible.
+func NewNetwork(seed int64) *Network {
+	return &Network{
+		QueueSize: 1024,
+		conns:     make(map[string]*Conn),
+		rand:      rand.New(rand.NewSource(seed)),
+		// 198.18.0.0/15 is reserved for benchmarking
+		nextIP: binary.BigEndian.Uint32(net.IPv4(198, 18, 0, 1).To4()),
+	}
+}
+
+// NewAddr returns an unused address.
+func (n *Network) NewAddr() *net.UDPAddr {
+	n.Lock()
+	defer n.Unlock()
+
+	ip := make(net.IP, 4)
+	binary.BigEndian.PutUint32(ip, n.nextIP)
+	n.nextIP++
+
+	return &net.UDPAddr{IP: ip, Port: 6881}
+}
+
+// Listen returns a Conn bound to addr.
+func (n *Network) Listen(addr *net.UDPAddr) (*Conn, error) {
+	n.Lock()
+	defer n.Unlock()
+
+	if _, ok := n.conns[addr.String()]; ok {
+		return nil, errors.New("dhttest: address already in use")
+	}
+
+	conn := &Conn{
+		network: n,
+		addr:    addr,
+		packets: make(chan packet, n.QueueSize),
+		closed:  make(chan struct{}),
+	}
+	n.conns[addr.String()] = conn
+
+	return conn, nil
+}
+
+// Stats returns the number of packets sent and dropped.
+func (n *Network) Stats() (sent, dropped int) {
+	n.Lock()
+	defer n.Unlock()
+
+	return n.sent, n.dropped
+}
+
+// deliver sends the packet to the Conn bound to raddr after the delay.
+func (n *Network) deliver(from *net.UDPAddr, data []byte, raddr *net.UDPAddr) {
+	n.Lock()
+	n.sent++
+
+	dst, ok := n.conns[raddr.String()]
+	if !ok || n.rand.Float64() < n.Loss {
+		n.dropped++
+		n.Unlock()
+		return
+	}
+
+	delay := n.Latency
+	if n.Jitter > 0 {
+		delay += time.Duration(n.rand.Int63n(int64(n.Jitter)))
+	}
+	n.Unlock()
+
+	pkt := packet{data: data, raddr: from}
+	if delay == 0 {
+		dst.push(pkt)
+		return
+	}
+	time.AfterFunc(delay, func() { dst.push(pkt) })
+}
+
+// remove unbinds the Conn.
+func (n *Network) remove(conn *Conn) {
+	n.Lock()
+	defer n.Unlock()
+
+	if n.conns[conn.addr.String()] == conn {
+		delete(n.conns, conn.addr.String())
+	}
+}
+
+// Conn is an endpoint of the Network. It implements dht.Transport.
+type Conn struct {
+	network *Network
+	addr    *net.UDPAddr
+	packets chan packet
+	closed  chan struct{}
+	once    sync.Once
+}
+
+// push queues the packet, it's dropped when the queue is full.
+func (conn *Conn) push(pkt packet) {
+	select {
+	case <-conn.closed:
+	case conn.packets <- pkt:
+	default:
+		conn.network.Lock()
+		conn.network.dropped++
+		conn.network.Unlock()
+	}
+}
+
+// LocalAddr returns the address the Conn is bound to.
+func (conn *Conn) LocalAddr() net.Addr {
+	return conn.addr
+}
+
+// ReadFromUDP waits for a packet.
+func (conn *Conn) ReadFromUDP(b []byte) (int, *net.UDPAddr, error) {
+	select {
+	case <-conn.closed:
+		return 0, nil, ErrClosed
+	case pkt := <-conn.packets:
+		return copy(b, pkt.data), pkt.raddr, nil
+	}
+}
+
+// WriteToUDP sends b to addr. Like udp, no error is returned when the packet
+// is lost.
+func (conn *Conn) WriteToUDP(b []byte, addr *net.UDPAddr) (int, error) {
+	select {
+	case <-conn.closed:
+		return 0, ErrClosed
+	default:
+	}
+
+	data := make([]byte, len(b))
+	copy(data, b)
+	conn.network.deliver(conn.addr, data, addr)
+
+	return len(b), nil
+}
+
+// SetWriteDeadline does nothing as writing never blocks.
+func (conn *Conn) SetWriteDeadline(t time.Time) error {
+	return nil
+}
+
+// Close unbinds the Conn, pending reads return ErrClosed.
+func (conn *Conn) Close() error {
+	conn.once.Do(func() {
+		close(conn.closed)
+		conn.network.remove(conn)
+	})
+	return nil
+}
@@ -0,0 +1,193 @@
+package dht
+
+import (
+	"net"
+	"sync"
+	"sync/atomic"
+)
+
+// defaultEventBufferSize is the buffer size of a subscription if it's not
+// given.
+const defaultEventBufferSize = 1024
+
+// Event is one of AnnouncePeerEvent, GetPeersEvent, GetPeersResponseEvent,
+// SampleInfohashesEvent, NodeAddedEvent, NodeRemovedEvent, BootstrapEvent
+// and ErrorEvent.
+type Event interface {
+	event()
+}
+
+// AnnouncePeerEvent is emitted when got announce_peer request.
+type AnnouncePeerEvent struct {
+	InfoHash string
+	IP       string
+	Port     int
+	// whether the peer announces as a seed, see BEP 33
+	Seed bool
+}
+
+// GetPeersEvent is emitted when got get_peers request.
+type GetPeersEvent struct {
+	InfoHash string
+	IP       string
+	Port     int
+}
+
+// GetPeersResponseEvent is emitted for each peer in get_peers responses.
+type GetPeersResponseEvent struct {
+	InfoHash string
+	Peer     *Peer
+}
+
+// SampleInfohashesEvent is emitted when got sample_infohashes response. IP
+// and Port belong to the node which sampled the infohashes.
+type SampleInfohashesEvent struct {
+	InfoHashes []string
+	IP         string
+	Port       int
+}
+
+// NodeAddedEvent is emitted when a node is added to the routing table.
+type NodeAddedEvent struct {
+	ID   string
+	Addr *net.UDPAddr
+}
+
+// NodeRemovedEvent is emitted when a node is removed from the routing
+// table.
+type NodeRemovedEvent struct {
+	ID   string
+	Addr *net.UDPAddr
+}
+
+// BootstrapEvent is emitted when the dht joins the network by the prime
+// nodes and when a prime node responds.
+type BootstrapEvent struct {
+	// the number of prime nodes
+	Total int
+	// the number of prime nodes which have responded
+	Connected int
+	// the number of nodes in the routing tables
+	Nodes int
+}
+
+// ErrorEvent is emitted when a node returns a KRPC error or a packet fails
+// to be sent.
+type ErrorEvent struct {
+	Addr *net.UDPAddr
+	Err  error
+}
+
+func (AnnouncePeerEvent) event()     {}
+func (GetPeersEvent) event()         {}
+func (GetPeersResponseEvent) event() {}
+func (SampleInfohashesEvent) event() {}
+func (NodeAddedEvent) event()        {}
+func (NodeRemovedEvent) event()      {}
+func (BootstrapEvent) event()        {}
+func (ErrorEvent) event()            {}
+
+// Subscription receives the events of a dht. When its buffer is full, new
+// events are dropped instead of blocking the dht.
+type Subscription struct {
+	// dropped is the first field to be 64-bit aligned for atomic
+	dropped uint64
+
+	// C delivers the events, it's closed after Close is called.
+	C <-chan Event
+
+	bus    *eventBus
+	events chan Event
+}
+
+// Dropped returns how many events are dropped because the buffer is full.
+func (sub *Subscription) Dropped() uint64 {
+	return atomic.LoadUint64(&sub.dropped)
+}
+
+// Close unsubscribes and closes C.
+func (sub *Subscription) Close() {
+	sub.bus.unsubscribe(sub)
+}
+
+// eventBus delivers events to subscriptions.
+type eventBus struct {
+	sync.RWMutex
+	subs map[*Subscription]struct{}
+}
+
+// newEventBus returns a new eventBus pointer.
+func newEventBus() *eventBus {
+	return &eventBus{
+		subs: make(map[*Subscription]struct{}),
+	}
+}
+
+// subscribe returns a new subscription whose buffer size is size.
+func (bus *eventBus) subscribe(size int) *Subscription {
+	if size <= 0 {
+		size = defaultEventBufferSize
+	}
+
+	events := make(chan Event, size)
+	sub := &Subscription{
+		C:      events,
+		bus:    bus,
+		events: events,
+	}
+
+	bus.Lock()
+	bus.subs[sub] = struct{}{}
+	bus.Unlock()
+
+	return sub
+}
+
+// unsubscribe removes sub and closes its channel.
+func (bus *eventBus) unsubscribe(sub *Subscription) {
+	bus.Lock()
+	defer bus.Unlock()
+
+	if _, ok := bus.subs[sub]; ok {
+		delete(bus.subs, sub)
+		close(sub.events)
+	}
+}
+
+// active returns whether there are subscriptions, so events needn't be
+// created if not.
+func (bus *eventBus) active() bool {
+	if bus == nil {
+		return false
+	}
+
+	bus.RLock()
+	defer bus.RUnlock()
+
+	return len(bus.subs) > 0
+}
+
+// publish sends e to all subscriptions without blocking.
+func (bus *eventBus) publish(e Event) {
+	if bus == nil {
+		return
+	}
+
+	bus.RLock()
+	defer bus.RUnlock()
+
+	for sub := range bus.subs {
+		select {
+		case sub.events <- e:
+		default:
+			atomic.AddUint64(&sub.dropped, 1)
+		}
+	}
+}
+
+// Events subscribes the events of the dht. size is the buffer size, the
+// default one is used if it's not positive. Close the subscription when
+// it's not used anymore.
+func (dht *DHT) Events(size int) *Subscription {
+	return dht.events.subscribe(size)
+}
@@ -0,0 +1,34 @@
+package dht
+
+import (
+	"testing"
+)
+
+func TestEventBus(t *testing.T) {
+	bus := newEventBus()
+	if bus.active() {
+		t.Fail()
+	}
+
+	sub := bus.subscribe(1)
+	other := bus.subscribe(2)
+
+	bus.publish(GetPeersEvent{InfoHash: "a"})
+	bus.publish(GetPeersEvent{InfoHash: "b"})
+
+	if e := (<-sub.C).(GetPeersEvent); e.InfoHash != "a" {
+		t.Fail()
+	}
+	if sub.Dropped() != 1 || other.Dropped() != 0 || len(other.C) != 2 {
+		t.Fail()
+	}
+
+	sub.Close()
+	other.Close()
+	if _, ok := <-sub.C; ok || bus.active() {
+		t.Fail()
+	}
+
+	// publishing after closing never panics
+	bus.publish(GetPeersEvent{InfoHash: "c"})
+}
@@ -0,0 +1,472 @@
+package dht
+
+import (
+	"context"
+	"crypto/ed25519"
+	"crypto/sha1"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net"
+	"strings"
+	"sync"
+	"time"
+)
+
+// The storage of arbitrary data in the dht.
+// See http://www.bittorrent.org/beps/bep_0044.html.
+
+const (
+	getType = "get"
+	putType = "put"
+)
+
+const (
+	messageTooBigError    = 205
+	invalidSignatureError = 206
+	saltTooBigError       = 207
+	casMismatchError      = 301
+	seqLessError          = 302
+)
+
+const (
+	// maxItemValueSize is the max size of the bencoded value of an item.
+	maxItemValueSize = 1000
+	// maxItemSaltSize is the max size of the salt of a mutable item.
+	maxItemSaltSize = 64
+	// itemExpiredAfter is how long an item is stored without being put again.
+	itemExpiredAfter = time.Hour * 2
+)
+
+var (
+	// ErrItemNotFound is the error when no node returns the item.
+	ErrItemNotFound = errors.New("item not found")
+	// ErrNoNodes is the error when there are no nodes to query.
+	ErrNoNodes = errors.New("no nodes in routing table")
+)
+
+// itemError is an error with a KRPC error code.
+type itemError struct {
+	code int
+	msg  string
+}
+
+func (e *itemError) Error() string {
+	return e.msg
+}
+
+// Item represents an immutable or mutable item stored in the dht. V should
+// be string, int, []interface{} or map[string]interface{}.
+type Item struct {
+	V interface{}
+	// K is the public key of a mutable item, it's nil for immutable items
+	K    ed25519.PublicKey
+	Salt string
+	Seq  int
+	Sig  []byte
+	// Cas is the expected Seq of the stored item when put it. 0 means no
+	// compare and swap.
+	Cas int
+
+	createTime time.Time
+}
+
+// NewImmutableItem returns an immutable item whose target is the sha1 of
+// bencoded v.
+func NewImmutableItem(v interface{}) (*Item, error) {
+	item := &Item{V: v}
+	if _, err := item.encodedValue(); err != nil {
+		return nil, err
+	}
+	return item, nil
+}
+
+// NewMutableItem returns a mutable item signed by key, whose target is the
+// sha1 of the public key and salt.
+func NewMutableItem(v interface{}, salt string, seq int,
+	key ed25519.PrivateKey) (*Item, error) {
+
+	item := &Item{
+		V:    v,
+		K:    key.Public().(ed25519.PublicKey),
+		Salt: salt,
+		Seq:  seq,
+	}
+
+	buff, err := item.signBuffer()
+	if err != nil {
+		return nil, err
+	}
+	item.Sig = ed25519.Sign(key, buff)
+
+	return item, nil
+}
+
+// IsMutable returns whether the item is mutable.
+func (item *Item) IsMutable() bool {
+	return item.K != nil
+}
+
+// encodedValue returns the bencoded v.
+func (item *Item) encodedValue() (v string, err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			err = fmt.Errorf("invalid item value: %v", r)
+		}
+	}()
+
+	v = Encode(item.V)
+	if len(v) > maxItemValueSize {
+		err = &itemError{messageTooBigError, "message (v field) too big"}
+	}
+	return
+}
+
+// signBuffer returns the data to be signed of the mutable item.
+func (item *Item) signBuffer() ([]byte, error) {
+	v, err := item.encodedValue()
+	if err != nil {
+		return nil, err
+	}
+
+	buff := make([]string, 0, 4)
+	if item.Salt != "" {
+		buff = append(buff, "4:salt", EncodeString(item.Salt))
+	}
+	buff = append(buff, "3:seq", EncodeInt(item.Seq), "1:v", v)
+
+	return []byte(strings.Join(buff, "")), nil
+}
+
+// Target returns the 20-length target of the item.
+func (item *Item) Target() string {
+	var target [20]byte
+	if item.IsMutable() {
+		target = sha1.Sum(append(append([]byte{}, item.K...), item.Salt...))
+	} else {
+		v, _ := item.encodedValue()
+		target = sha1.Sum([]byte(v))
+	}
+	return string(target[:])
+}
+
+// Verify checks the size of the item and the signature of the mutable item.
+func (item *Item) Verify() error {
+	if !item.IsMutable() {
+		_, err := item.encodedValue()
+		return err
+	}
+
+	if len(item.Salt) > maxItemSaltSize {
+		return &itemError{saltTooBigError, "salt (salt field) too big"}
+	}
+
+	buff, err := item.signBuffer()
+	if err != nil {
+		return err
+	}
+
+	if len(item.K) != ed25519.PublicKeySize ||
+		!ed25519.Verify(item.K, buff, item.Sig) {
+		return &itemError{invalidSignatureError, "invalid signature"}
+	}
+	return nil
+}
+
+// dict returns the fields of the item in get response or put query.
+func (item *Item) dict() map[string]interface{} {
+	d := map[string]interface{}{"v": item.V}
+	if item.IsMutable() {
+		d["k"] = string(item.K)
+		d["sig"] = string(item.Sig)
+		d["seq"] = item.Seq
+		if item.Salt != "" {
+			d["salt"] = item.Salt
+		}
+	}
+	return d
+}
+
+// newItemFromDict parses the item in get response or put query.
+func newItemFromDict(d map[string]interface{}) (*Item, error) {
+	v, ok := d["v"]
+	if !ok {
+		return nil, errors.New("lack of key")
+	}
+
+	item := &Item{V: v}
+	if _, ok := d["k"]; !ok {
+		return item, nil
+	}
+
+	if err := ParseKeys(d, [][]string{
+		{"k", "string"}, {"sig", "string"}, {"seq", "int"}}); err != nil {
+		return nil, err
+	}
+
+	item.K = ed25519.PublicKey(d["k"].(string))
+	item.Sig = []byte(d["sig"].(string))
+	item.Seq = d["seq"].(int)
+
+	if err := ParseKey(d, "salt", "string"); err == nil {
+		item.Salt = d["salt"].(string)
+	}
+	if err := ParseKey(d, "cas", "int"); err == nil {
+		item.Cas = d["cas"].(int)
+	}
+	return item, nil
+}
+
+// itemStore stores the items put by other nodes. When it's full, the least
+// recently put item is removed.
+type itemStore struct {
+	sync.Mutex
+	items   *keyedDeque
+	maxSize int
+}
+
+// newItemStore returns a new itemStore.
+func newItemStore(maxSize int) *itemStore {
+	return &itemStore{
+		items:   newKeyedDeque(),
+		maxSize: maxSize,
+	}
+}
+
+// Get returns the item whose target is target, nil if not found or expired.
+func (store *itemStore) Get(target string) *Item {
+	store.Lock()
+	defer store.Unlock()
+
+	e, ok := store.items.Get(target)
+	if !ok {
+		return nil
+	}
+
+	item := e.Value.(*Item)
+	if time.Since(item.createTime) > itemExpiredAfter {
+		store.items.Delete(target)
+		return nil
+	}
+	return item
+}
+
+// Put verifies the item and stores it.
+func (store *itemStore) Put(item *Item) error {
+	if err := item.Verify(); err != nil {
+		return err
+	}
+
+	target := item.Target()
+
+	store.Lock()
+	defer store.Unlock()
+
+	if e, ok := store.items.Get(target); ok && item.IsMutable() {
+		old := e.Value.(*Item)
+		if item.Cas != 0 && item.Cas != old.Seq {
+			return &itemError{casMismatchError, "CAS mismatched"}
+		}
+		if item.Seq < old.Seq {
+			return &itemError{seqLessError, "sequence number less than current"}
+		}
+	}
+
+	item.createTime = time.Now()
+	store.items.Push(target, item)
+
+	if store.items.Len() > store.maxSize {
+		store.items.Remove(store.items.Front())
+	}
+	return nil
+}
+
+// get sends get query to the chan.
+func (tm *transactionManager) get(no *node, target string,
+	callback func(map[string]interface{}, error)) {
+
+	tm.sendQueryWithCallback(no, getType, tm.want(map[string]interface{}{
+		"id":     tm.dht.id(target),
+		"target": target,
+	}), callback)
+}
+
+// put sends put query to the chan.
+func (tm *transactionManager) put(no *node, item *Item, token string,
+	callback func(map[string]interface{}, error)) {
+
+	a := item.dict()
+	a["id"] = tm.dht.id(no.id.RawString())
+	a["token"] = token
+	if item.Cas != 0 {
+		a["cas"] = item.Cas
+	}
+
+	tm.sendQueryWithCallback(no, putType, a, callback)
+}
+
+// handleGetRequest answers the get query.
+func handleGetRequest(dht *DHT, addr *net.UDPAddr, t string,
+	a map[string]interface{}) {
+
+	if err := ParseKey(a, "target", "string"); err != nil {
+		send(dht, addr, makeError(t, protocolError, err.Error()))
+		return
+	}
+
+	target := a["target"].(string)
+	if len(target) != 20 {
+		send(dht, addr, makeError(t, protocolError, "invalid target"))
+		return
+	}
+
+	r := wantedNodes(dht, addr, a, newBitmapFromString(target))
+	r["id"] = dht.id(target)
+	r["token"] = dht.tokenManager.token(addr)
+
+	// If the requester has the newer one, v is omitted.
+	if item := dht.itemStore.Get(target); item != nil {
+		if seq, ok := a["seq"].(int); !ok || !item.IsMutable() ||
+			item.Seq > seq {
+
+			for key, val := range item.dict() {
+				r[key] = val
+			}
+		}
+	}
+
+	send(dht, addr, makeResponse(t, r))
+}
+
+// handlePutRequest stores the item in the put query.
+func handlePutRequest(dht *DHT, addr *net.UDPAddr, t string,
+	a map[string]interface{}) {
+
+	if err := ParseKey(a, "token", "string"); err != nil {
+		send(dht, addr, makeError(t, protocolError, err.Error()))
+		return
+	}
+
+	if !dht.tokenManager.check(addr, a["token"].(string)) {
+		send(dht, addr, makeError(t, protocolError, "invalid token"))
+		return
+	}
+
+	item, err := newItemFromDict(a)
+	if err != nil {
+		send(dht, addr, makeError(t, protocolError, err.Error()))
+		return
+	}
+
+	if err := dht.itemStore.Put(item); err != nil {
+		code := protocolError
+		if e, ok := err.(*itemError); ok {
+			code = e.code
+		}
+		send(dht, addr, makeError(t, code, err.Error()))
+		return
+	}
+
+	send(dht, addr, makeResponse(t, map[string]interface{}{
+		"id": dht.id(a["id"].(string)),
+	}))
+}
+
+// rawTarget returns the 20-length target. The 40-length hex target is
+// decoded.
+func rawTarget(target string) (string, error) {
+	if len(target) == 40 {
+		data, err := hex.DecodeString(target)
+		if err != nil {
+			return "", err
+		}
+		target = string(data)
+	}
+
+	if len(target) != 20 {
+		return "", errors.New("invalid target")
+	}
+	return target, nil
+}
+
+// Put stores the item to the nodes closest to its target, which are found
+// by an iterative lookup with get queries. It returns nil if any node stores
+// it.
+func (dht *DHT) Put(ctx context.Context, item *Item) error {
+	if !dht.Ready() {
+		return ErrNotReady
+	}
+
+	if err := item.Verify(); err != nil {
+		return err
+	}
+
+	target := item.Target()
+	l := newLookup(dht, target, func(no *node,
+		callback func(map[string]interface{}, error)) {
+
+		dht.transactionManager.get(no, target, callback)
+	})
+	if err := l.run(ctx); err != nil {
+		return err
+	}
+
+	return l.store(ctx, func(no *node, token string,
+		callback func(map[string]interface{}, error)) {
+
+		dht.transactionManager.put(no, item, token, callback)
+	})
+}
+
+// Get returns the item whose target is target by an iterative lookup with
+// get queries. target is 20-length or 40-length hex string. salt is used to
+// verify mutable items. An immutable item is returned once it's found, while
+// for mutable items the one with the largest seq wins.
+func (dht *DHT) Get(ctx context.Context, target, salt string) (*Item, error) {
+	if !dht.Ready() {
+		return nil, ErrNotReady
+	}
+
+	target, err := rawTarget(target)
+	if err != nil {
+		return nil, err
+	}
+
+	l := newLookup(dht, target, func(no *node,
+		callback func(map[string]interface{}, error)) {
+
+		dht.transactionManager.get(no, target, callback)
+	})
+
+	var found *Item
+	l.onResponse = func(_ *node, r map[string]interface{}) bool {
+		item, err := newItemFromDict(r)
+		if err != nil {
+			return false
+		}
+
+		// The salt isn't returned, so use ours to verify it.
+		item.Salt = salt
+		if item.Verify() != nil || item.Target() != target {
+			return false
+		}
+
+		if !item.IsMutable() {
+			found = item
+			return true
+		}
+		if found == nil || item.Seq > found.Seq {
+			found = item
+		}
+		return false
+	}
+
+	err = l.run(ctx)
+	if found != nil {
+		return found, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return nil, ErrItemNotFound
+}
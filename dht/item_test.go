@@ -0,0 +1,72 @@
+package dht
+
+import (
+	"crypto/ed25519"
+	"encoding/hex"
+	"testing"
+)
+
+func TestImmutableItemTarget(t *testing.T) {
+	// test vector from BEP 44
+	item, err := NewImmutableItem("Hello World!")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if hex.EncodeToString([]byte(item.Target())) !=
+		"e5f96f6f38320f0f33959cb4d3d656452117aadb" {
+		t.Fail()
+	}
+}
+
+func TestMutableItemVerify(t *testing.T) {
+	_, key, _ := ed25519.GenerateKey(nil)
+
+	item, err := NewMutableItem("Hello World!", "foobar", 1, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if item.Verify() != nil {
+		t.Fail()
+	}
+
+	item.Seq = 2
+	if item.Verify() == nil {
+		t.Fail()
+	}
+}
+
+func TestItemStorePut(t *testing.T) {
+	_, key, _ := ed25519.GenerateKey(nil)
+	store := newItemStore(1)
+
+	item, _ := NewMutableItem("v2", "", 2, key)
+	if store.Put(item) != nil {
+		t.Fatal("put should succeed")
+	}
+
+	old, _ := NewMutableItem("v1", "", 1, key)
+	if err, ok := store.Put(old).(*itemError); !ok ||
+		err.code != seqLessError {
+		t.Fail()
+	}
+
+	newer, _ := NewMutableItem("v3", "", 3, key)
+	newer.Cas = 1
+	if err, ok := store.Put(newer).(*itemError); !ok ||
+		err.code != casMismatchError {
+		t.Fail()
+	}
+
+	newer.Cas = 2
+	if store.Put(newer) != nil || store.Get(item.Target()).V != "v3" {
+		t.Fail()
+	}
+
+	immutable, _ := NewImmutableItem("v")
+	store.Put(immutable)
+	if store.Get(item.Target()) != nil || store.Get(immutable.Target()) == nil {
+		t.Fail()
+	}
+}
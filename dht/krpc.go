@@ -1,10 +1,13 @@
 package dht
 
 import (
+	"crypto/sha1"
 	"errors"
+	"fmt"
 	"net"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 )
 
@@ -13,6 +16,8 @@ const (
 	findNodeType     = "find_node"
 	getPeersType     = "get_peers"
 	announcePeerType = "announce_peer"
+	// See http://www.bittorrent.org/beps/bep_0051.html.
+	sampleInfohashesType = "sample_infohashes"
 )
 
 const (
@@ -28,72 +33,75 @@ type packet struct {
 	raddr *net.UDPAddr
 }
 
-// token represents the token when response getPeers request.
-type token struct {
-	data       string
-	createTime time.Time
-}
+// tokenSize is the length of the tokens.
+const tokenSize = 8
 
-// tokenManager managers the tokens.
+// tokenManager makes the tokens in get_peers and get responses, which are
+// the hash of the ip and a secret, see BEP 5. The secret rotates every half
+// of expiredAfter and the previous one is still accepted, so nothing is kept
+// per address.
 type tokenManager struct {
-	*syncedMap
+	sync.Mutex
+	secret       string
+	prevSecret   string
+	rotatedAt    time.Time
 	expiredAfter time.Duration
-	dht          *DHT
 }
 
 // newTokenManager returns a new tokenManager.
-func newTokenManager(expiredAfter time.Duration, dht *DHT) *tokenManager {
+func newTokenManager(expiredAfter time.Duration) *tokenManager {
 	return &tokenManager{
-		syncedMap:    newSyncedMap(),
+		secret:       randomString(20),
+		prevSecret:   randomString(20),
+		rotatedAt:    time.Now(),
 		expiredAfter: expiredAfter,
-		dht:          dht,
 	}
 }
 
-// token returns a token. If it doesn't exist or is expired, it will add a
-// new token.
-func (tm *tokenManager) token(addr *net.UDPAddr) string {
-	v, ok := tm.Get(addr.IP.String())
-	tk, _ := v.(token)
+// secrets rotates the secrets if it's time and returns them.
+func (tm *tokenManager) secrets() (secret, prevSecret string) {
+	tm.Lock()
+	defer tm.Unlock()
 
-	if !ok || time.Now().Sub(tk.createTime) > tm.expiredAfter {
-		tk = token{
-			data:       randomString(5),
-			createTime: time.Now(),
+	period := tm.expiredAfter / 2
+	if elapsed := time.Since(tm.rotatedAt); period > 0 && elapsed >= period {
+		// The tokens made by the current secret are expired too if it
+		// should have rotated twice.
+		if elapsed < period*2 {
+			tm.prevSecret = tm.secret
+		} else {
+			tm.prevSecret = randomString(20)
 		}
-
-		tm.Set(addr.IP.String(), tk)
+		tm.secret = randomString(20)
+		tm.rotatedAt = time.Now()
 	}
 
-	return tk.data
+	return tm.secret, tm.prevSecret
 }
 
-// clear removes expired tokens.
-func (tm *tokenManager) clear() {
-	for _ = range time.Tick(time.Minute * 3) {
-		keys := make([]interface{}, 0, 100)
+// makeToken returns the token of ip made by secret.
+func makeToken(ip net.IP, secret string) string {
+	if ip4 := ip.To4(); ip4 != nil {
+		ip = ip4
+	}
 
-		for item := range tm.Iter() {
-			if time.Now().Sub(item.val.(token).createTime) > tm.expiredAfter {
-				keys = append(keys, item.key)
-			}
-		}
+	h := sha1.New()
+	h.Write(ip)
+	h.Write([]byte(secret))
+	return string(h.Sum(nil)[:tokenSize])
+}
 
-		tm.DeleteMulti(keys)
-	}
+// token returns the token of addr.
+func (tm *tokenManager) token(addr *net.UDPAddr) string {
+	secret, _ := tm.secrets()
+	return makeToken(addr.IP, secret)
 }
 
 // check returns whether the token is valid.
 func (tm *tokenManager) check(addr *net.UDPAddr, tokenString string) bool {
-	key := addr.IP.String()
-	v, ok := tm.Get(key)
-	tk, _ := v.(token)
-
-	if ok {
-		tm.Delete(key)
-	}
-
-	return ok && tokenString == tk.data
+	secret, prevSecret := tm.secrets()
+	return tokenString == makeToken(addr.IP, secret) ||
+		tokenString == makeToken(addr.IP, prevSecret)
 }
 
 // makeQuery returns a query-formed data.
@@ -124,25 +132,52 @@ func makeError(t string, errCode int, errMsg string) map[string]interface{} {
 	}
 }
 
-// send sends data to the udp.
+// send sends data to the udp. Responses carry the compact ip/port of addr
+// in the `ip` field, see http://www.bittorrent.org/beps/bep_0042.html.
 func send(dht *DHT, addr *net.UDPAddr, data map[string]interface{}) error {
+	if data["y"] == "r" {
+		if ip, err := encodeCompactIPPortInfo(addr.IP, addr.Port); err == nil {
+			data["ip"] = ip
+		}
+	}
+
 	dht.conn.SetWriteDeadline(time.Now().Add(time.Second * 15))
 
 	_, err := dht.conn.WriteToUDP([]byte(Encode(data)), addr)
 	if err != nil {
 		dht.blackList.insert(addr.IP.String(), -1)
+		dht.events.publish(ErrorEvent{Addr: addr, Err: err})
+		return err
 	}
-	return err
+
+	dht.packetStats.sent(packetType(data))
+	return nil
 }
 
 // query represents the query data included queried node and query-formed data.
 type query struct {
 	node *node
 	data map[string]interface{}
+	// callback is called once with the response dict, or with an error when
+	// the query fails.
+	callback func(map[string]interface{}, error)
 }
 
+// maxQueryDelay is how long a query can wait for the rate limit.
+const maxQueryDelay = time.Second * 5
+
+// errRateLimited is passed to the query callback when the query is dropped by
+// the rate limit.
+var errRateLimited = errors.New("query rate limited")
+
+// errQueryFailed is passed to the query callback when no response arrives.
+var errQueryFailed = errors.New("query failed")
+
 // transaction implements transaction.
 type transaction struct {
+	// when the last try is sent in unix nanoseconds, it's the first field to
+	// be 64-bit aligned for atomic
+	sent int64
 	*query
 	id       string
 	response chan struct{}
@@ -200,13 +235,16 @@ func (tm *transactionManager) genIndexKeyByTrans(trans *transaction) string {
 	return tm.genIndexKey(trans.data["q"].(string), trans.node.addr.String())
 }
 
-// insert adds a transaction to transactionManager.
+// insert adds a transaction to transactionManager. Transactions with a
+// callback aren't indexed, see sendQueryWithCallback.
 func (tm *transactionManager) insert(trans *transaction) {
 	tm.Lock()
 	defer tm.Unlock()
 
 	tm.transactions.Set(trans.id, trans)
-	tm.index.Set(tm.genIndexKeyByTrans(trans), trans)
+	if trans.callback == nil {
+		tm.index.Set(tm.genIndexKeyByTrans(trans), trans)
+	}
 }
 
 // delete removes a transaction from transactionManager.
@@ -221,7 +259,9 @@ func (tm *transactionManager) delete(transID string) {
 
 	trans := v.(*transaction)
 	tm.transactions.Delete(trans.id)
-	tm.index.Delete(tm.genIndexKeyByTrans(trans))
+	if trans.callback == nil {
+		tm.index.Delete(tm.genIndexKeyByTrans(trans))
+	}
 }
 
 // len returns how many transactions are requesting now.
@@ -281,7 +321,30 @@ func (tm *transactionManager) query(q *query, try int) {
 	defer tm.delete(trans.id)
 
 	success := false
-	for i := 0; i < try; i++ {
+	for i := 0; i < try && !success; i++ {
+		// Drop the query rather than piling up goroutines if it can't be
+		// sent in time.
+		delay, ok := tm.dht.queryLimiter.reserve(
+			q.node.addr.String(), maxQueryDelay)
+		if !ok {
+			if q.callback != nil {
+				q.callback(nil, errRateLimited)
+			}
+			return
+		}
+
+		if delay > 0 {
+			select {
+			case <-time.After(delay):
+			case <-tm.dht.closing:
+				if q.callback != nil {
+					q.callback(nil, ErrNotReady)
+				}
+				return
+			}
+		}
+
+		atomic.StoreInt64(&trans.sent, time.Now().UnixNano())
 		if err := send(tm.dht, q.node.addr, q.data); err != nil {
 			break
 		}
@@ -289,18 +352,25 @@ func (tm *transactionManager) query(q *query, try int) {
 		select {
 		case <-trans.response:
 			success = true
-			break
 		case <-time.After(time.Second * 15):
 		}
 	}
 
-	if !success && q.node.id != nil {
+	if !success && q.callback != nil {
+		q.callback(nil, errQueryFailed)
+	}
+
+	// Nodes in the routing table are removed and blacklisted only when they
+	// fail again and again.
+	if !success && q.node.id != nil &&
+		tm.dht.table(q.node.addr.IP).failed(q.node.addr.String()) {
+
 		tm.dht.blackList.insert(q.node.addr.IP.String(), q.node.addr.Port)
-		tm.dht.routingTable.RemoveByAddr(q.node.addr.String())
 	}
 }
 
-// run starts to listen and consume the query chan.
+// run starts to listen and consume the query chan until the dht is
+// closing.
 func (tm *transactionManager) run() {
 	var q *query
 
@@ -308,6 +378,8 @@ func (tm *transactionManager) run() {
 		select {
 		case q = <-tm.queryChan:
 			go tm.query(q, tm.dht.Try)
+		case <-tm.dht.closing:
+			return
 		}
 	}
 }
@@ -316,17 +388,47 @@ func (tm *transactionManager) run() {
 func (tm *transactionManager) sendQuery(
 	no *node, queryType string, a map[string]interface{}) {
 
-	// If the target is self, then stop.
+	tm.sendQueryWithCallback(no, queryType, a, nil)
+}
+
+// sendQueryWithCallback send query-formed data to the chan. callback is
+// called once when the response arrives or the query fails.
+func (tm *transactionManager) sendQueryWithCallback(no *node, queryType string,
+	a map[string]interface{}, callback func(map[string]interface{}, error)) {
+
+	if callback != nil {
+		var once sync.Once
+		f := callback
+		callback = func(r map[string]interface{}, err error) {
+			once.Do(func() { f(r, err) })
+		}
+	}
+
+	// If the target is self, then stop. The same query to the same node is
+	// sent once at a time, except the ones with a callback, whose callers
+	// wait for their own responses.
 	if no.id != nil && no.id.RawString() == tm.dht.node.id.RawString() ||
-		tm.getByIndex(tm.genIndexKey(queryType, no.addr.String())) != nil ||
+		callback == nil &&
+			tm.getByIndex(tm.genIndexKey(queryType, no.addr.String())) != nil ||
 		tm.dht.blackList.in(no.addr.IP.String(), no.addr.Port) {
+
+		if callback != nil {
+			callback(nil, errQueryFailed)
+		}
 		return
 	}
 
 	data := makeQuery(tm.genTransID(), queryType, a)
-	tm.queryChan <- &query{
-		node: no,
-		data: data,
+	select {
+	case tm.queryChan <- &query{
+		node:     no,
+		data:     data,
+		callback: callback,
+	}:
+	case <-tm.dht.closing:
+		if callback != nil {
+			callback(nil, errQueryFailed)
+		}
 	}
 }
 
@@ -337,32 +439,52 @@ func (tm *transactionManager) ping(no *node) {
 	})
 }
 
+// want adds the `want` argument to the query if the dht is dual-stack.
+// See http://www.bittorrent.org/beps/bep_0032.html.
+func (tm *transactionManager) want(
+	a map[string]interface{}) map[string]interface{} {
+
+	if tm.dht.IsDualStack() {
+		a["want"] = []interface{}{"n4", "n6"}
+	}
+	return a
+}
+
 // findNode sends find_node query to the chan.
 func (tm *transactionManager) findNode(no *node, target string) {
-	tm.sendQuery(no, findNodeType, map[string]interface{}{
+	tm.sendQuery(no, findNodeType, tm.want(map[string]interface{}{
 		"id":     tm.dht.id(target),
 		"target": target,
-	})
+	}))
 }
 
 // getPeers sends get_peers query to the chan.
 func (tm *transactionManager) getPeers(no *node, infoHash string) {
-	tm.sendQuery(no, getPeersType, map[string]interface{}{
+	tm.sendQuery(no, getPeersType, tm.want(map[string]interface{}{
 		"id":        tm.dht.id(infoHash),
 		"info_hash": infoHash,
-	})
+	}))
 }
 
 // announcePeer sends announce_peer query to the chan.
-func (tm *transactionManager) announcePeer(
-	no *node, infoHash string, impliedPort, port int, token string) {
+func (tm *transactionManager) announcePeer(no *node, infoHash string,
+	impliedPort, port int, token string,
+	callback func(map[string]interface{}, error)) {
 
-	tm.sendQuery(no, announcePeerType, map[string]interface{}{
+	tm.sendQueryWithCallback(no, announcePeerType, map[string]interface{}{
 		"id":           tm.dht.id(no.id.RawString()),
 		"info_hash":    infoHash,
 		"implied_port": impliedPort,
 		"port":         port,
 		"token":        token,
+	}, callback)
+}
+
+// sampleInfohashes sends sample_infohashes query to the chan.
+func (tm *transactionManager) sampleInfohashes(no *node, target string) {
+	tm.sendQuery(no, sampleInfohashesType, map[string]interface{}{
+		"id":     tm.dht.id(target),
+		"target": target,
 	})
 }
 
@@ -421,6 +543,84 @@ func parseMessage(data interface{}) (map[string]interface{}, error) {
 	return response, nil
 }
 
+// compactNodes returns the compact node info of the node whose id is target
+// if it's in the routing table, otherwise the size-length nodes closest to
+// target.
+func compactNodes(rt *routingTable, target *bitmap, size int) string {
+	if no, _ := rt.GetNodeKBucktByID(target); no != nil {
+		return no.CompactNodeInfo()
+	}
+	return strings.Join(rt.GetNeighborCompactInfos(target, size), "")
+}
+
+// wantedNodes returns the "nodes" and "nodes6" fields of a response
+// according to the `want` argument of the query. If it's absent, only the
+// nodes of the querying node's address family are returned.
+// See http://www.bittorrent.org/beps/bep_0032.html.
+func wantedNodes(dht *DHT, addr *net.UDPAddr, a map[string]interface{},
+	target *bitmap) map[string]interface{} {
+
+	want4, want6 := addr.IP.To4() != nil, addr.IP.To4() == nil
+	if err := ParseKey(a, "want", "list"); err == nil {
+		want4, want6 = false, false
+		for _, w := range a["want"].([]interface{}) {
+			switch w {
+			case "n4":
+				want4 = true
+			case "n6":
+				want6 = true
+			}
+		}
+	}
+
+	r := make(map[string]interface{})
+	if want4 {
+		r["nodes"] = compactNodes(dht.routingTable, target, dht.K)
+	}
+	if want6 {
+		r["nodes6"] = compactNodes(dht.routingTable6, target, dht.K)
+	}
+	return r
+}
+
+// parseNodes returns the nodes in the "nodes" and "nodes6" fields of a
+// response. It returns error if both are absent or malformed.
+func parseNodes(dht *DHT, r map[string]interface{}) ([]*node, error) {
+	fields := []struct {
+		key  string
+		size int
+	}{{"nodes", 26}, {"nodes6", 38}}
+
+	found := false
+	nodes := make([]*node, 0, 16)
+
+	for _, f := range fields {
+		if err := ParseKey(r, f.key, "string"); err != nil {
+			continue
+		}
+		found = true
+
+		data := r[f.key].(string)
+		if len(data)%f.size != 0 {
+			return nil, fmt.Errorf(
+				"the length of %s should can be divided by %d", f.key, f.size)
+		}
+
+		for i := 0; i < len(data)/f.size; i++ {
+			no, err := newNodeFromCompactInfo(
+				data[i*f.size:(i+1)*f.size], dht.Network)
+			if err == nil {
+				nodes = append(nodes, no)
+			}
+		}
+	}
+
+	if !found {
+		return nil, errors.New("lack of key")
+	}
+	return nodes, nil
+}
+
 // handleRequest handles the requests received from udp.
 func handleRequest(dht *DHT, addr *net.UDPAddr,
 	response map[string]interface{}) (success bool) {
@@ -453,11 +653,11 @@ func handleRequest(dht *DHT, addr *net.UDPAddr,
 		return
 	}
 
-	if no, ok := dht.routingTable.GetNodeByAddress(addr.String()); ok &&
+	if no, ok := dht.table(addr.IP).GetNodeByAddress(addr.String()); ok &&
 		no.id.RawString() != id {
 
 		dht.blackList.insert(addr.IP.String(), addr.Port)
-		dht.routingTable.RemoveByAddr(addr.String())
+		dht.table(addr.IP).RemoveByAddr(addr.String())
 
 		send(dht, addr, makeError(t, protocolError, "invalid id"))
 		return
@@ -481,23 +681,10 @@ func handleRequest(dht *DHT, addr *net.UDPAddr,
 				return
 			}
 
-			var nodes string
-			targetID := newBitmapFromString(target)
+			r := wantedNodes(dht, addr, a, newBitmapFromString(target))
+			r["id"] = dht.id(target)
 
-			no, _ := dht.routingTable.GetNodeKBucktByID(targetID)
-			if no != nil {
-				nodes = no.CompactNodeInfo()
-			} else {
-				nodes = strings.Join(
-					dht.routingTable.GetNeighborCompactInfos(targetID, dht.K),
-					"",
-				)
-			}
-
-			send(dht, addr, makeResponse(t, map[string]interface{}{
-				"id":    dht.id(target),
-				"nodes": nodes,
-			}))
+			send(dht, addr, makeResponse(t, r))
 		}
 	case getPeersType:
 		if err := ParseKey(a, "info_hash", "string"); err != nil {
@@ -518,31 +705,52 @@ func handleRequest(dht *DHT, addr *net.UDPAddr,
 				"token": dht.tokenManager.token(addr),
 				"nodes": "",
 			}))
-		} else if peers := dht.peersManager.GetPeers(
-			infoHash, dht.K); len(peers) > 0 {
+		} else {
+			var r map[string]interface{}
+
+			if peers := dht.peersManager.GetPeers(
+				infoHash, dht.K); len(peers) > 0 {
 
-			values := make([]interface{}, len(peers))
-			for i, p := range peers {
-				values[i] = p.CompactIPPortInfo()
+				noSeed, _ := a["noseed"].(int)
+
+				// only peers of the querying node's address family are
+				// returned
+				values := make([]interface{}, 0, len(peers))
+				for _, p := range peers {
+					if (p.IP.To4() == nil) == (addr.IP.To4() == nil) &&
+						!(p.seed && noSeed != 0) {
+
+						values = append(values, p.CompactIPPortInfo())
+					}
+				}
+				r = map[string]interface{}{"values": values}
+			} else {
+				r = wantedNodes(dht, addr, a, newBitmapFromString(infoHash))
 			}
 
-			send(dht, addr, makeResponse(t, map[string]interface{}{
-				"id":     dht.id(infoHash),
-				"values": values,
-				"token":  dht.tokenManager.token(addr),
-			}))
-		} else {
-			send(dht, addr, makeResponse(t, map[string]interface{}{
-				"id":    dht.id(infoHash),
-				"token": dht.tokenManager.token(addr),
-				"nodes": strings.Join(dht.routingTable.GetNeighborCompactInfos(
-					newBitmapFromString(infoHash), dht.K), ""),
-			}))
+			r["id"] = dht.id(infoHash)
+			r["token"] = dht.tokenManager.token(addr)
+
+			if scrape, _ := a["scrape"].(int); scrape != 0 {
+				if seeds, peers, ok := dht.peersManager.Scrape(
+					infoHash); ok {
+
+					r["BFsd"] = seeds
+					r["BFpe"] = peers
+				}
+			}
+
+			send(dht, addr, makeResponse(t, r))
 		}
 
 		if dht.OnGetPeers != nil {
 			dht.OnGetPeers(infoHash, addr.IP.String(), addr.Port)
 		}
+		dht.events.publish(GetPeersEvent{
+			InfoHash: infoHash,
+			IP:       addr.IP.String(),
+			Port:     addr.Port,
+		})
 	case announcePeerType:
 		if err := ParseKeys(a, [][]string{
 			{"info_hash", "string"},
@@ -568,8 +776,12 @@ func handleRequest(dht *DHT, addr *net.UDPAddr,
 			port = addr.Port
 		}
 
+		seed, _ := a["seed"].(int)
+
 		if dht.IsStandardMode() {
-			dht.peersManager.Insert(infoHash, newPeer(addr.IP, port, token))
+			peer := newPeer(addr.IP, port, token)
+			peer.seed = seed != 0
+			dht.peersManager.Insert(infoHash, peer)
 
 			send(dht, addr, makeResponse(t, map[string]interface{}{
 				"id": dht.id(id),
@@ -579,13 +791,42 @@ func handleRequest(dht *DHT, addr *net.UDPAddr,
 		if dht.OnAnnouncePeer != nil {
 			dht.OnAnnouncePeer(infoHash, addr.IP.String(), port)
 		}
+		dht.events.publish(AnnouncePeerEvent{
+			InfoHash: infoHash,
+			IP:       addr.IP.String(),
+			Port:     port,
+			Seed:     seed != 0,
+		})
+	case sampleInfohashesType:
+		if dht.IsStandardMode() {
+			if err := ParseKey(a, "target", "string"); err != nil {
+				send(dht, addr, makeError(t, protocolError, err.Error()))
+				return
+			}
+
+			target := a["target"].(string)
+			if len(target) != 20 {
+				send(dht, addr, makeError(t, protocolError, "invalid target"))
+				return
+			}
+
+			send(dht, addr, makeSampleResponse(dht, addr, a, t, target))
+		}
+	case getType:
+		if dht.IsStandardMode() {
+			handleGetRequest(dht, addr, t, a)
+		}
+	case putType:
+		if dht.IsStandardMode() {
+			handlePutRequest(dht, addr, t, a)
+		}
 	default:
 		//		send(dht, addr, makeError(t, protocolError, "invalid q"))
 		return
 	}
 
 	no, _ := newNode(id, addr.Network(), addr.String())
-	dht.routingTable.Insert(no)
+	dht.table(addr.IP).Insert(no)
 	return true
 }
 
@@ -595,25 +836,18 @@ func handleRequest(dht *DHT, addr *net.UDPAddr,
 func findOn(dht *DHT, r map[string]interface{}, target *bitmap,
 	queryType string) error {
 
-	if err := ParseKey(r, "nodes", "string"); err != nil {
+	nodes, err := parseNodes(dht, r)
+	if err != nil {
 		return err
 	}
 
-	nodes := r["nodes"].(string)
-	if len(nodes)%26 != 0 {
-		return errors.New("the length of nodes should can be divided by 26")
-	}
-
 	hasNew, found := false, false
-	for i := 0; i < len(nodes)/26; i++ {
-		no, _ := newNodeFromCompactInfo(
-			string(nodes[i*26:(i+1)*26]), dht.Network)
-
+	for _, no := range nodes {
 		if no.id.RawString() == target.RawString() {
 			found = true
 		}
 
-		if dht.routingTable.Insert(no) {
+		if dht.table(no.addr.IP).Insert(no) {
 			hasNew = true
 		}
 	}
@@ -623,7 +857,7 @@ func findOn(dht *DHT, r map[string]interface{}, target *bitmap,
 	}
 
 	targetID := target.RawString()
-	for _, no := range dht.routingTable.GetNeighbors(target, dht.K) {
+	for _, no := range dht.neighbors(target, dht.K) {
 		switch queryType {
 		case findNodeType:
 			dht.transactionManager.findNode(no, targetID)
@@ -647,6 +881,12 @@ func handleResponse(dht *DHT, addr *net.UDPAddr,
 		return
 	}
 
+	defer func() {
+		if !success {
+			dht.table(addr.IP).invalidReply(addr.String())
+		}
+	}()
+
 	// inform transManager to delete the transaction.
 	if err := ParseKey(response, "r", "map"); err != nil {
 		return
@@ -666,7 +906,7 @@ func handleResponse(dht *DHT, addr *net.UDPAddr,
 	// transaction, raise error.
 	if trans.node.id != nil && trans.node.id.RawString() != r["id"].(string) {
 		dht.blackList.insert(addr.IP.String(), addr.Port)
-		dht.routingTable.RemoveByAddr(addr.String())
+		dht.table(addr.IP).RemoveByAddr(addr.String())
 		return
 	}
 
@@ -682,8 +922,11 @@ func handleResponse(dht *DHT, addr *net.UDPAddr,
 			return
 		}
 
+		// Queries with a callback are driven by their callers, such as the
+		// iterative lookups, so don't continue to find on.
 		target := trans.data["a"].(map[string]interface{})["target"].(string)
-		if findOn(dht, r, newBitmapFromString(target), findNodeType) != nil {
+		if trans.callback == nil &&
+			findOn(dht, r, newBitmapFromString(target), findNodeType) != nil {
 			return
 		}
 	case getPeersType:
@@ -705,21 +948,76 @@ func handleResponse(dht *DHT, addr *net.UDPAddr,
 				if dht.OnGetPeersResponse != nil {
 					dht.OnGetPeersResponse(infoHash, p)
 				}
+				dht.events.publish(GetPeersResponseEvent{
+					InfoHash: infoHash,
+					Peer:     p,
+				})
 			}
-		} else if findOn(
+		} else if trans.callback == nil && findOn(
 			dht, r, newBitmapFromString(infoHash), getPeersType) != nil {
 			return
 		}
 	case announcePeerType:
+	case sampleInfohashesType:
+		if err := ParseKey(r, "samples", "string"); err != nil {
+			return
+		}
+
+		samples := r["samples"].(string)
+		if len(samples)%20 != 0 {
+			return
+		}
+
+		interval := sampleInterval
+		if err := ParseKey(r, "interval", "int"); err == nil {
+			interval = time.Duration(r["interval"].(int)) * time.Second
+		}
+		dht.samplingManager.delay(addr.String(), interval)
+
+		if nodes, err := parseNodes(dht, r); err == nil {
+			for _, no := range nodes {
+				dht.table(no.addr.IP).Insert(no)
+			}
+		}
+
+		infoHashes := make([]string, len(samples)/20)
+		for i := range infoHashes {
+			infoHashes[i] = samples[i*20 : (i+1)*20]
+		}
+
+		if dht.OnSampleInfohashes != nil {
+			for _, infoHash := range infoHashes {
+				dht.OnSampleInfohashes(infoHash, addr.IP.String(), addr.Port)
+			}
+		}
+		dht.events.publish(SampleInfohashesEvent{
+			InfoHashes: infoHashes,
+			IP:         addr.IP.String(),
+			Port:       addr.Port,
+		})
+	case getType:
+		if nodes, err := parseNodes(dht, r); err == nil {
+			for _, no := range nodes {
+				dht.table(no.addr.IP).Insert(no)
+			}
+		}
+	case putType:
 	default:
 		return
 	}
 
+	if trans.callback != nil {
+		trans.callback(r, nil)
+	}
+
 	// inform transManager to delete transaction.
 	trans.response <- struct{}{}
 
 	dht.blackList.delete(addr.IP.String(), addr.Port)
-	dht.routingTable.Insert(node)
+	dht.table(addr.IP).Insert(node)
+	// node has the stats of the one in the routing table after Insert
+	node.stats.responded(
+		time.Since(time.Unix(0, atomic.LoadInt64(&trans.sent))))
 
 	return true
 }
@@ -732,13 +1030,26 @@ func handleError(dht *DHT, addr *net.UDPAddr,
 		return
 	}
 
-	if e := response["e"].([]interface{}); len(e) != 2 {
+	e := response["e"].([]interface{})
+	if len(e) != 2 {
 		return
 	}
 
 	if trans := dht.transactionManager.filterOne(
 		response["t"].(string), addr); trans != nil {
 
+		if code, ok := e[0].(int); ok && code == unknownError &&
+			trans.data["q"].(string) == sampleInfohashesType {
+
+			dht.samplingManager.delay(addr.String(), unsupportedSampleInterval)
+		}
+
+		err := fmt.Errorf("krpc error %v: %v", e[0], e[1])
+		if trans.callback != nil {
+			trans.callback(nil, err)
+		}
+		dht.events.publish(ErrorEvent{Addr: addr, Err: err})
+
 		trans.response <- struct{}{}
 	}
 
@@ -754,6 +1065,18 @@ var handlers = map[string]func(*DHT, *net.UDPAddr, map[string]interface{}) bool{
 // handle handles packets received from udp.
 func handle(dht *DHT, pkt packet) {
 	if len(dht.workerTokens) == dht.PacketWorkerLimit {
+		dht.packetStats.drop()
+		return
+	}
+
+	ip := pkt.raddr.IP.String()
+	if ok, dropped := dht.packetLimiter.allow(ip); !ok {
+		if dht.BlacklistAfterDropped > 0 &&
+			dropped >= dht.BlacklistAfterDropped {
+
+			dht.blackList.insert(ip, -1)
+		}
+		dht.packetStats.drop()
 		return
 	}
 
@@ -765,18 +1088,22 @@ func handle(dht *DHT, pkt packet) {
 		}()
 
 		if dht.blackList.in(pkt.raddr.IP.String(), pkt.raddr.Port) {
+			dht.packetStats.drop()
 			return
 		}
 
 		data, err := Decode(pkt.data)
 		if err != nil {
+			dht.packetStats.received(invalidPacket)
 			return
 		}
 
 		response, err := parseMessage(data)
 		if err != nil {
+			dht.packetStats.received(invalidPacket)
 			return
 		}
+		dht.packetStats.received(packetType(response))
 
 		if f, ok := handlers[response["y"].(string)]; ok {
 			f(dht, pkt.raddr, response)
@@ -0,0 +1,44 @@
+package dht
+
+import (
+	"net"
+	"testing"
+	"time"
+)
+
+func TestTokenManager(t *testing.T) {
+	tm := newTokenManager(time.Minute * 10)
+	addr := &net.UDPAddr{IP: net.ParseIP("1.2.3.4"), Port: 6881}
+	other := &net.UDPAddr{IP: net.ParseIP("1.2.3.5"), Port: 6881}
+
+	token := tm.token(addr)
+	if len(token) != tokenSize || !tm.check(addr, token) ||
+		tm.check(other, token) {
+
+		t.Fatal("token should be valid for its ip only")
+	}
+
+	// the port and the IPv4-mapped form don't matter
+	mapped := &net.UDPAddr{IP: net.ParseIP("::ffff:1.2.3.4"), Port: 1}
+	if !tm.check(mapped, token) {
+		t.Fail()
+	}
+
+	// the previous secret is still accepted after a rotation
+	tm.rotatedAt = tm.rotatedAt.Add(-time.Minute * 6)
+	if tm.token(addr) == token || !tm.check(addr, token) {
+		t.Fatal("token should be valid after a rotation")
+	}
+
+	tm.rotatedAt = tm.rotatedAt.Add(-time.Minute * 6)
+	if tm.check(addr, token) {
+		t.Fatal("token should be expired after two rotations")
+	}
+
+	// both secrets are replaced if it's idle for a long time
+	token = tm.token(addr)
+	tm.rotatedAt = tm.rotatedAt.Add(-time.Minute * 11)
+	if tm.check(addr, token) {
+		t.Fail()
+	}
+}
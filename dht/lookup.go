@@ -0,0 +1,438 @@
+package dht
+
+import (
+	"context"
+	"errors"
+	"net"
+	"sort"
+	"sync/atomic"
+	"time"
+)
+
+// lookupQueryTimeout is how long a lookup waits for a node before it
+// queries the next one. The query isn't cancelled and a late response is
+// still used.
+const lookupQueryTimeout = time.Second * 2
+
+// NodeInfo is the id and the address of a node.
+type NodeInfo struct {
+	ID   string
+	Addr *net.UDPAddr
+}
+
+// The states of a node in a lookup.
+const (
+	lookupPending = iota
+	lookupQuerying
+	lookupResponded
+	lookupFailed
+)
+
+// lookupNode is a node found by a lookup.
+type lookupNode struct {
+	node     *node
+	distance *bitmap
+	state    int
+	// when the query is sent
+	sent time.Time
+	// the response of the node
+	response map[string]interface{}
+}
+
+// lookupResult is the result of a query sent by a lookup.
+type lookupResult struct {
+	ln  *lookupNode
+	r   map[string]interface{}
+	err error
+}
+
+// lookup is an iterative Kademlia lookup. It queries the Alpha closest
+// unqueried nodes concurrently, adds the nodes returned by them and finishes
+// when the K closest nodes have all responded or failed.
+type lookup struct {
+	dht    *DHT
+	target *bitmap
+	alpha  int
+	// send sends the query to the node, callback is called once.
+	send func(no *node, callback func(map[string]interface{}, error))
+	// onResponse is called with each response and stops the lookup if it
+	// returns true. It's optional.
+	onResponse func(no *node, r map[string]interface{}) bool
+
+	// nodes are sorted by distance
+	nodes []*lookupNode
+	seen  map[string]struct{}
+}
+
+// newLookup returns a lookup pointer starting with the nodes closest to
+// target in the routing tables.
+func newLookup(dht *DHT, target string,
+	send func(*node, func(map[string]interface{}, error))) *lookup {
+
+	l := &lookup{
+		dht:    dht,
+		target: newBitmapFromString(target),
+		alpha:  dht.Alpha,
+		send:   send,
+		seen:   make(map[string]struct{}),
+	}
+	if l.alpha <= 0 {
+		l.alpha = 1
+	}
+
+	for _, no := range dht.neighbors(l.target, dht.K) {
+		l.add(no)
+	}
+	return l
+}
+
+// add adds a node to the lookup if it's new. The node in the routing table
+// is used if there is one, so that its stats are updated.
+func (l *lookup) add(no *node) {
+	key := no.addr.String()
+	if _, ok := l.seen[key]; ok ||
+		no.id.RawString() == l.dht.node.id.RawString() {
+
+		return
+	}
+	l.seen[key] = struct{}{}
+
+	if nd, ok := l.dht.table(no.addr.IP).GetNodeByAddress(key); ok &&
+		nd.id.RawString() == no.id.RawString() {
+
+		no = nd
+	}
+
+	ln := &lookupNode{
+		node:     no,
+		distance: l.target.Xor(no.id),
+		state:    lookupPending,
+	}
+
+	i := sort.Search(len(l.nodes), func(i int) bool {
+		return l.nodes[i].distance.Compare(ln.distance, maxPrefixLength) > 0
+	})
+
+	l.nodes = append(l.nodes, nil)
+	copy(l.nodes[i+1:], l.nodes[i:])
+	l.nodes[i] = ln
+}
+
+// next returns the nodes to query so that at most Alpha queries are in
+// flight, and whether the lookup is finished, that's to say none of the K
+// closest nodes which haven't failed is pending or being queried. Among the
+// K closest pending nodes, the ones with better scores are queried first.
+func (l *lookup) next(inflight int) ([]*lookupNode, bool) {
+	var (
+		pending  []*lookupNode
+		count    int
+		finished = true
+	)
+
+	for _, ln := range l.nodes {
+		if count == l.dht.K {
+			break
+		}
+
+		switch ln.state {
+		case lookupFailed:
+			continue
+		case lookupPending:
+			finished = false
+			pending = append(pending, ln)
+		case lookupQuerying:
+			finished = false
+		}
+		count++
+	}
+
+	n := l.alpha - inflight
+	if n <= 0 {
+		return nil, finished
+	}
+
+	if len(pending) > n {
+		scores := make(map[*lookupNode]float64, len(pending))
+		for _, ln := range pending {
+			scores[ln] = ln.node.stats.score()
+		}
+		sort.SliceStable(pending, func(i, j int) bool {
+			return scores[pending[i]] > scores[pending[j]]
+		})
+		pending = pending[:n]
+	}
+
+	return pending, finished
+}
+
+// closest returns at most K closest nodes which have responded.
+func (l *lookup) closest() []*lookupNode {
+	nodes := make([]*lookupNode, 0, l.dht.K)
+	for _, ln := range l.nodes {
+		if len(nodes) == l.dht.K {
+			break
+		}
+		if ln.state == lookupResponded {
+			nodes = append(nodes, ln)
+		}
+	}
+	return nodes
+}
+
+// store sends a store query, which is put or announce_peer, with the token
+// in the response of each of the closest nodes. It returns nil once any of
+// them succeeds, otherwise the last error.
+func (l *lookup) store(ctx context.Context, send func(no *node, token string,
+	callback func(map[string]interface{}, error))) error {
+
+	nodes := l.closest()
+	if len(nodes) == 0 {
+		return ErrNoNodes
+	}
+
+	results := make(chan error, len(nodes))
+	for _, ln := range nodes {
+		token, ok := ln.response["token"].(string)
+		if !ok {
+			results <- errors.New("lack of token")
+			continue
+		}
+
+		send(ln.node, token, func(_ map[string]interface{}, err error) {
+			results <- err
+		})
+	}
+
+	var err error
+	for i := 0; i < len(nodes); i++ {
+		select {
+		case err = <-results:
+			if err == nil {
+				return nil
+			}
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-l.dht.closing:
+			return ErrNotReady
+		}
+	}
+	return err
+}
+
+// run runs the lookup until it's finished, stopped by onResponse, ctx is
+// done or the dht is closing.
+func (l *lookup) run(ctx context.Context) error {
+	if len(l.nodes) == 0 {
+		return ErrNoNodes
+	}
+
+	results := make(chan lookupResult)
+	done := make(chan struct{})
+	defer close(done)
+
+	ticker := time.NewTicker(lookupQueryTimeout / 4)
+	defer ticker.Stop()
+
+	inflight := 0
+	for {
+		pending, finished := l.next(inflight)
+		if finished {
+			return nil
+		}
+
+		for _, ln := range pending {
+			ln := ln
+			ln.state = lookupQuerying
+			ln.sent = time.Now()
+			inflight++
+
+			// The callback may be called before the results are received,
+			// so don't block it.
+			l.send(ln.node, func(r map[string]interface{}, err error) {
+				go func() {
+					select {
+					case results <- lookupResult{ln, r, err}:
+					case <-done:
+					}
+				}()
+			})
+		}
+
+		select {
+		case res := <-results:
+			if res.ln.state == lookupQuerying {
+				inflight--
+			} else if res.err != nil {
+				// it has timed out
+				continue
+			}
+
+			if res.err != nil {
+				res.ln.state = lookupFailed
+				continue
+			}
+
+			res.ln.state = lookupResponded
+			res.ln.response = res.r
+
+			if l.onResponse != nil && l.onResponse(res.ln.node, res.r) {
+				return nil
+			}
+
+			if nodes, err := parseNodes(l.dht, res.r); err == nil {
+				for _, no := range nodes {
+					l.add(no)
+				}
+			}
+		case <-ticker.C:
+			for _, ln := range l.nodes {
+				if ln.state == lookupQuerying &&
+					time.Since(ln.sent) > lookupQueryTimeout {
+
+					ln.state = lookupFailed
+					inflight--
+				}
+			}
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-l.dht.closing:
+			return ErrNotReady
+		}
+	}
+}
+
+// findSelf looks up the id of the dht to fill the routing tables when the
+// prime nodes return too few nodes. Only one runs at a time.
+func (dht *DHT) findSelf() {
+	if !atomic.CompareAndSwapInt32(&dht.findingSelf, 0, 1) {
+		return
+	}
+	defer atomic.StoreInt32(&dht.findingSelf, 0)
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+	defer cancel()
+
+	// The nodes which know the dht return only it for its own id, so look
+	// up the id next to it.
+	id := []byte(dht.node.id.RawString())
+	id[len(id)-1] ^= 1
+	dht.FindClosest(ctx, string(id))
+}
+
+// lookupQuery sends the find_node or get_peers query of a lookup.
+func (tm *transactionManager) lookupQuery(no *node, queryType, target string,
+	callback func(map[string]interface{}, error)) {
+
+	a := map[string]interface{}{"id": tm.dht.id(target)}
+	switch queryType {
+	case findNodeType:
+		a["target"] = target
+	case getPeersType:
+		a["info_hash"] = target
+	default:
+		panic("invalid lookup type")
+	}
+
+	tm.sendQueryWithCallback(no, queryType, tm.want(a), callback)
+}
+
+// FindClosest looks up the K nodes closest to target iteratively, querying
+// Alpha nodes at a time. target is 20-length or 40-length hex string. The
+// nodes are sorted by distance. If ctx is done before the lookup finishes,
+// the closest nodes found so far are returned with ctx.Err().
+func (dht *DHT) FindClosest(ctx context.Context, target string) (
+	[]NodeInfo, error) {
+
+	if !dht.Ready() {
+		return nil, ErrNotReady
+	}
+
+	target, err := rawTarget(target)
+	if err != nil {
+		return nil, err
+	}
+
+	l := newLookup(dht, target, func(no *node,
+		callback func(map[string]interface{}, error)) {
+
+		dht.transactionManager.lookupQuery(no, findNodeType, target, callback)
+	})
+
+	err = l.run(ctx)
+	if err == ErrNoNodes {
+		return nil, err
+	}
+
+	nodes := l.closest()
+	infos := make([]NodeInfo, len(nodes))
+	for i, ln := range nodes {
+		infos[i] = NodeInfo{ID: ln.node.id.RawString(), Addr: ln.node.addr}
+	}
+	return infos, err
+}
+
+// LookupPeers looks up the peers of infoHash iteratively with get_peers
+// queries. infoHash is 20-length or 40-length hex string. Each peer is sent
+// to the returned chan once, and the chan is closed when the lookup finishes
+// or ctx is done. Cancel ctx if the chan isn't drained.
+func (dht *DHT) LookupPeers(ctx context.Context, infoHash string) (
+	<-chan *Peer, error) {
+
+	if !dht.Ready() {
+		return nil, ErrNotReady
+	}
+
+	infoHash, err := rawTarget(infoHash)
+	if err != nil {
+		return nil, err
+	}
+
+	l := newLookup(dht, infoHash, func(no *node,
+		callback func(map[string]interface{}, error)) {
+
+		dht.transactionManager.lookupQuery(no, getPeersType, infoHash, callback)
+	})
+	if len(l.nodes) == 0 {
+		return nil, ErrNoNodes
+	}
+
+	peers := make(chan *Peer)
+	seen := make(map[string]struct{})
+
+	l.onResponse = func(_ *node, r map[string]interface{}) bool {
+		token, _ := r["token"].(string)
+		values, _ := r["values"].([]interface{})
+
+		for _, v := range values {
+			s, ok := v.(string)
+			if !ok {
+				continue
+			}
+
+			p, err := newPeerFromCompactIPPortInfo(s, token)
+			if err != nil {
+				continue
+			}
+
+			key := genAddress(p.IP.String(), p.Port)
+			if _, ok := seen[key]; ok {
+				continue
+			}
+			seen[key] = struct{}{}
+
+			select {
+			case peers <- p:
+			case <-ctx.Done():
+				return true
+			}
+		}
+		return false
+	}
+
+	go func() {
+		defer close(peers)
+		l.run(ctx)
+	}()
+
+	return peers, nil
+}
@@ -0,0 +1,151 @@
+package dht
+
+import (
+	"context"
+	"fmt"
+	"math/rand"
+	"sort"
+	"strings"
+	"testing"
+)
+
+func TestLookupConverges(t *testing.T) {
+	d := New(NewStandardConfig())
+	d.routingTable = newRoutingTable(d.KBucketSize, d)
+	d.routingTable6 = newRoutingTable(d.KBucketSize, d)
+	rnd := rand.New(rand.NewSource(1))
+
+	randomID := func() string {
+		id := make([]byte, 20)
+		rnd.Read(id)
+		return string(id)
+	}
+
+	// every node knows 20 random nodes and the 8 nodes closest to itself
+	nodes := make([]*node, 500)
+	for i := range nodes {
+		nodes[i], _ = newNode(randomID(), "udp4",
+			fmt.Sprintf("10.0.%d.%d:6881", i/250, i%250+1))
+	}
+
+	closest := func(id *bitmap, candidates []*node, k int) []*node {
+		sorted := append([]*node(nil), candidates...)
+		sort.Slice(sorted, func(i, j int) bool {
+			return id.Xor(sorted[i].id).Compare(
+				id.Xor(sorted[j].id), maxPrefixLength) < 0
+		})
+		if len(sorted) > k {
+			sorted = sorted[:k]
+		}
+		return sorted
+	}
+
+	known := make(map[string][]*node)
+	for _, no := range nodes {
+		others := make([]*node, 0, len(nodes)-1)
+		for _, other := range nodes {
+			if other != no {
+				others = append(others, other)
+			}
+		}
+
+		list := closest(no.id, others, 8)
+		for i := 0; i < 20; i++ {
+			list = append(list, others[rnd.Intn(len(others))])
+		}
+		known[no.addr.String()] = list
+	}
+
+	// every tenth node doesn't respond
+	failed := make(map[string]bool)
+	for i := 0; i < len(nodes); i += 10 {
+		failed[nodes[i].addr.String()] = true
+	}
+
+	target := newBitmapFromString(randomID())
+	queried := 0
+
+	l := &lookup{
+		dht:    d,
+		target: target,
+		alpha:  3,
+		seen:   make(map[string]struct{}),
+	}
+	l.send = func(no *node, callback func(map[string]interface{}, error)) {
+		queried++
+		if failed[no.addr.String()] {
+			callback(nil, errQueryFailed)
+			return
+		}
+
+		infos := make([]string, 0, d.K)
+		for _, other := range closest(target, known[no.addr.String()], d.K) {
+			infos = append(infos, other.CompactNodeInfo())
+		}
+		callback(map[string]interface{}{
+			"nodes": strings.Join(infos, ""),
+		}, nil)
+	}
+
+	for _, no := range nodes[len(nodes)-3:] {
+		l.add(no)
+	}
+
+	if err := l.run(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+
+	alive := make([]*node, 0, len(nodes))
+	for _, no := range nodes {
+		if !failed[no.addr.String()] {
+			alive = append(alive, no)
+		}
+	}
+
+	got, want := l.closest(), closest(target, alive, d.K)
+	if len(got) != len(want) {
+		t.Fatalf("got %d nodes, want %d", len(got), len(want))
+	}
+	for i := range want {
+		if got[i].node.addr.String() != want[i].addr.String() {
+			t.Fatalf("node %d is not the closest", i)
+		}
+	}
+
+	if queried >= len(nodes) {
+		t.Fatalf("queried %d nodes, the lookup doesn't converge", queried)
+	}
+}
+
+func TestLookupNoNodes(t *testing.T) {
+	l := &lookup{alpha: 3, seen: make(map[string]struct{})}
+	if l.run(context.Background()) != ErrNoNodes {
+		t.Fail()
+	}
+}
+
+func TestLookupStoreClosing(t *testing.T) {
+	d := New(NewStandardConfig())
+	d.routingTable = newRoutingTable(d.KBucketSize, d)
+	d.routingTable6 = newRoutingTable(d.KBucketSize, d)
+
+	l := &lookup{
+		dht:    d,
+		target: newBitmapFromString(strings.Repeat("a", 20)),
+		alpha:  3,
+		seen:   make(map[string]struct{}),
+	}
+	no, _ := newNode(strings.Repeat("b", 20), "udp4", "10.0.0.1:6881")
+	l.add(no)
+	l.nodes[0].state = lookupResponded
+	l.nodes[0].response = map[string]interface{}{"token": "token"}
+
+	// the store query never gets its callback called
+	close(d.closing)
+	err := l.store(context.Background(), func(*node, string,
+		func(map[string]interface{}, error)) {
+	})
+	if err != ErrNotReady {
+		t.Errorf("store = %v, want %v", err, ErrNotReady)
+	}
+}
@@ -0,0 +1,245 @@
+package dht
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/rand"
+	"crypto/rc4"
+	"crypto/sha1"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"math/big"
+	"net"
+	"sync"
+	"time"
+)
+
+// EncryptionPolicy tells whether Wire encrypts the connections to the peers
+// with Message Stream Encryption, also known as Protocol Encryption.
+type EncryptionPolicy int
+
+const (
+	// EncryptionDisable only makes plaintext connections.
+	EncryptionDisable EncryptionPolicy = iota
+	// EncryptionPrefer tries an encrypted connection first, and a plaintext
+	// one if the encrypted handshake fails. The peer may choose plaintext
+	// after the encrypted handshake.
+	EncryptionPrefer
+	// EncryptionRequire only makes RC4 encrypted connections.
+	EncryptionRequire
+)
+
+var encryptionPolicies = []string{"disable", "prefer", "require"}
+
+// ParseEncryptionPolicy parses "disable", "prefer" or "require".
+func ParseEncryptionPolicy(s string) (EncryptionPolicy, error) {
+	for i, name := range encryptionPolicies {
+		if s == name {
+			return EncryptionPolicy(i), nil
+		}
+	}
+	return 0, fmt.Errorf("unknown encryption policy %q", s)
+}
+
+func (p EncryptionPolicy) String() string {
+	if p < 0 || int(p) >= len(encryptionPolicies) {
+		return fmt.Sprintf("EncryptionPolicy(%d)", int(p))
+	}
+	return encryptionPolicies[p]
+}
+
+const (
+	// mseKeySize is the size of the Diffie-Hellman public keys.
+	mseKeySize = 96
+	// mseMaxPad is the max size of the random paddings.
+	mseMaxPad = 512
+	// mseTimeout is how long the MSE handshake can take.
+	mseTimeout = time.Second * 15
+
+	// the crypto methods in crypto_provide and crypto_select
+	mseCryptoPlain = 1
+	mseCryptoRC4   = 2
+)
+
+var (
+	// mseP and mseG are the Diffie-Hellman prime and generator of MSE.
+	mseP, _ = new(big.Int).SetString(
+		"FFFFFFFFFFFFFFFFC90FDAA22168C234C4C6628B80DC1CD129024E088A67CC74"+
+			"020BBEA63B139B22514A08798E3404DDEF9519B3CD3A431B302B0A6DF25F1437"+
+			"4FE1356D6D51C245E485B576625E7EC6F44C42E9A63A36210000000000090563", 16)
+	mseG = big.NewInt(2)
+
+	// msePrivateKeyMax bounds the 160-bit private keys.
+	msePrivateKeyMax = new(big.Int).Lsh(big.NewInt(1), 160)
+
+	// mseVC is the verification constant.
+	mseVC = make([]byte, 8)
+)
+
+// mseConn reads and writes the payload stream after the MSE handshake. The
+// stream is RC4 encrypted unless the peer selects plaintext.
+type mseConn struct {
+	net.Conn
+	// r reads conn with the bytes buffered in the handshake
+	r io.Reader
+
+	// writes are serialized to keep the key stream in order
+	mutex sync.Mutex
+	enc   *rc4.Cipher
+	dec   *rc4.Cipher
+}
+
+// Read reads and decrypts data from the connection.
+func (c *mseConn) Read(b []byte) (int, error) {
+	n, err := c.r.Read(b)
+	if c.dec != nil {
+		c.dec.XORKeyStream(b[:n], b[:n])
+	}
+	return n, err
+}
+
+// Write encrypts and writes data to the connection.
+func (c *mseConn) Write(b []byte) (int, error) {
+	if c.enc == nil {
+		return c.Conn.Write(b)
+	}
+
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	data := make([]byte, len(b))
+	c.enc.XORKeyStream(data, b)
+	return c.Conn.Write(data)
+}
+
+// encrypted returns whether the payload stream is encrypted.
+func (c *mseConn) encrypted() bool {
+	return c.enc != nil
+}
+
+// mseHash returns the SHA1 of the parts joined.
+func mseHash(parts ...[]byte) []byte {
+	h := sha1.New()
+	for _, part := range parts {
+		h.Write(part)
+	}
+	return h.Sum(nil)
+}
+
+// mseCipher returns the RC4 cipher of the key, whose first 1024 bytes are
+// discarded as MSE requires.
+func mseCipher(key []byte) *rc4.Cipher {
+	c, _ := rc4.NewCipher(key)
+	discard := make([]byte, 1024)
+	c.XORKeyStream(discard, discard)
+	return c
+}
+
+// msePad returns a random padding of 0 to mseMaxPad bytes.
+func msePad() []byte {
+	n := binary.BigEndian.Uint16([]byte(randomString(2)))
+	return []byte(randomString(int(n) % (mseMaxPad + 1)))
+}
+
+// mseHandshake runs the MSE handshake as the initiator for infoHash, and
+// sends ia, the initial payload which is usually the BitTorrent handshake,
+// in it. provide is the crypto methods offered. It returns the conn of the
+// payload stream.
+func mseHandshake(conn net.Conn, infoHash, ia []byte, provide uint32) (*mseConn, error) {
+	conn.SetDeadline(time.Now().Add(mseTimeout))
+
+	x, err := rand.Int(rand.Reader, msePrivateKeyMax)
+	if err != nil {
+		return nil, err
+	}
+
+	// 1 A->B: Diffie Hellman Ya, PadA
+	ya := new(big.Int).Exp(mseG, x, mseP).FillBytes(make([]byte, mseKeySize))
+	if _, err = conn.Write(append(ya, msePad()...)); err != nil {
+		return nil, err
+	}
+
+	// 2 B->A: Diffie Hellman Yb, PadB
+	br := bufio.NewReader(conn)
+	yb := make([]byte, mseKeySize)
+	if _, err = io.ReadFull(br, yb); err != nil {
+		return nil, err
+	}
+
+	y := new(big.Int).SetBytes(yb)
+	if y.Cmp(big.NewInt(1)) <= 0 || y.Cmp(new(big.Int).Sub(mseP, big.NewInt(1))) >= 0 {
+		return nil, errors.New("invalid public key")
+	}
+	s := new(big.Int).Exp(y, x, mseP).FillBytes(make([]byte, mseKeySize))
+
+	enc := mseCipher(mseHash([]byte("keyA"), s, infoHash))
+	dec := mseCipher(mseHash([]byte("keyB"), s, infoHash))
+
+	// 3 A->B: HASH('req1', S), HASH('req2', SKEY) xor HASH('req3', S),
+	// ENCRYPT(VC, crypto_provide, len(PadC), PadC, len(IA)), ENCRYPT(IA)
+	req2, req3 := mseHash([]byte("req2"), infoHash), mseHash([]byte("req3"), s)
+	for i := range req2 {
+		req2[i] ^= req3[i]
+	}
+
+	payload := make([]byte, 0, 16+len(ia))
+	payload = append(payload, mseVC...)
+	payload = binary.BigEndian.AppendUint32(payload, provide)
+	// PadC is empty
+	payload = binary.BigEndian.AppendUint16(payload, 0)
+	payload = binary.BigEndian.AppendUint16(payload, uint16(len(ia)))
+	payload = append(payload, ia...)
+	enc.XORKeyStream(payload, payload)
+
+	msg := append(mseHash([]byte("req1"), s), req2...)
+	if _, err = conn.Write(append(msg, payload...)); err != nil {
+		return nil, err
+	}
+
+	// 4 B->A: ENCRYPT(VC, crypto_select, len(padD), padD). PadB is
+	// skipped by finding ENCRYPT(VC)
+	vc := make([]byte, len(mseVC))
+	dec.XORKeyStream(vc, mseVC)
+
+	window := make([]byte, 0, mseMaxPad+len(vc))
+	for !bytes.HasSuffix(window, vc) {
+		if len(window) == cap(window) {
+			return nil, errors.New("verification constant not found")
+		}
+
+		c, err := br.ReadByte()
+		if err != nil {
+			return nil, err
+		}
+		window = append(window, c)
+	}
+
+	selected := make([]byte, 6)
+	if _, err = io.ReadFull(br, selected); err != nil {
+		return nil, err
+	}
+	dec.XORKeyStream(selected, selected)
+
+	padD := int(binary.BigEndian.Uint16(selected[4:]))
+	if padD > mseMaxPad {
+		return nil, errors.New("padD too long")
+	}
+	pad := make([]byte, padD)
+	if _, err = io.ReadFull(br, pad); err != nil {
+		return nil, err
+	}
+	dec.XORKeyStream(pad, pad)
+
+	switch method := binary.BigEndian.Uint32(selected); {
+	case method&provide != method:
+		return nil, fmt.Errorf("crypto method %d not provided", method)
+	case method == mseCryptoRC4:
+		return &mseConn{Conn: conn, r: br, enc: enc, dec: dec}, nil
+	case method == mseCryptoPlain:
+		return &mseConn{Conn: conn, r: br}, nil
+	default:
+		return nil, fmt.Errorf("invalid crypto method %d", method)
+	}
+}
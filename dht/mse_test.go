@@ -0,0 +1,264 @@
+package dht
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/rand"
+	"crypto/sha1"
+	"encoding/binary"
+	"errors"
+	"io"
+	"math/big"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestParseEncryptionPolicy(t *testing.T) {
+	for _, policy := range []EncryptionPolicy{
+		EncryptionDisable, EncryptionPrefer, EncryptionRequire,
+	} {
+		if p, err := ParseEncryptionPolicy(policy.String()); err != nil || p != policy {
+			t.Errorf("ParseEncryptionPolicy(%q) = %v, %v", policy.String(), p, err)
+		}
+	}
+
+	if _, err := ParseEncryptionPolicy("always"); err == nil {
+		t.Error("ParseEncryptionPolicy should fail")
+	}
+}
+
+// mseReceiver accepts the MSE handshakes of infoHash on its listener, and
+// selects the crypto method in selectMethod.
+type mseReceiver struct {
+	net.Listener
+	infoHash     []byte
+	selectMethod uint32
+}
+
+// Accept returns the payload stream of the next connection, which reads
+// the initial payload first.
+func (l *mseReceiver) Accept() (net.Conn, error) {
+	conn, err := l.Listener.Accept()
+	if err != nil {
+		return nil, err
+	}
+
+	c, ia, err := l.handshake(conn)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	// the initial payload is decrypted already
+	c.r = io.MultiReader(bytes.NewReader(ia), &mseConn{r: c.r, dec: c.dec})
+	c.dec = nil
+	return c, nil
+}
+
+// handshake runs the MSE handshake as the receiver.
+func (l *mseReceiver) handshake(conn net.Conn) (*mseConn, []byte, error) {
+	br := bufio.NewReader(conn)
+
+	ya := make([]byte, mseKeySize)
+	if _, err := io.ReadFull(br, ya); err != nil {
+		return nil, nil, err
+	}
+
+	x, _ := rand.Int(rand.Reader, msePrivateKeyMax)
+	yb := new(big.Int).Exp(mseG, x, mseP).FillBytes(make([]byte, mseKeySize))
+	conn.Write(append(yb, msePad()...))
+
+	s := new(big.Int).Exp(new(big.Int).SetBytes(ya), x, mseP).
+		FillBytes(make([]byte, mseKeySize))
+
+	// skip PadA by finding HASH('req1', S)
+	req1 := mseHash([]byte("req1"), s)
+	window := make([]byte, 0, mseMaxPad+len(req1))
+	for !bytes.HasSuffix(window, req1) {
+		c, err := br.ReadByte()
+		if err != nil || len(window) == cap(window) {
+			return nil, nil, errors.New("req1 not found")
+		}
+		window = append(window, c)
+	}
+
+	req2 := make([]byte, sha1.Size)
+	io.ReadFull(br, req2)
+	req3 := mseHash([]byte("req3"), s)
+	for i := range req2 {
+		req2[i] ^= req3[i]
+	}
+	if !bytes.Equal(req2, mseHash([]byte("req2"), l.infoHash)) {
+		return nil, nil, errors.New("unknown infohash")
+	}
+
+	dec := mseCipher(mseHash([]byte("keyA"), s, l.infoHash))
+	enc := mseCipher(mseHash([]byte("keyB"), s, l.infoHash))
+
+	read := func(n int) []byte {
+		b := make([]byte, n)
+		io.ReadFull(br, b)
+		dec.XORKeyStream(b, b)
+		return b
+	}
+
+	header := read(14)
+	if !bytes.Equal(header[:8], mseVC) {
+		return nil, nil, errors.New("wrong verification constant")
+	}
+	provide := binary.BigEndian.Uint32(header[8:])
+	read(int(binary.BigEndian.Uint16(header[12:])))
+	ia := read(int(binary.BigEndian.Uint16(read(2))))
+
+	if provide&l.selectMethod == 0 {
+		return nil, nil, errors.New("crypto method not provided")
+	}
+
+	reply := append([]byte(nil), mseVC...)
+	reply = binary.BigEndian.AppendUint32(reply, l.selectMethod)
+	reply = binary.BigEndian.AppendUint16(reply, 3)
+	reply = append(reply, 0, 0, 0)
+	enc.XORKeyStream(reply, reply)
+	conn.Write(reply)
+
+	c := &mseConn{Conn: conn, r: br}
+	if l.selectMethod == mseCryptoRC4 {
+		c.enc, c.dec = enc, dec
+	}
+	return c, ia, nil
+}
+
+func TestMSEHandshake(t *testing.T) {
+	infoHash := []byte(randomString(20))
+
+	for _, method := range []uint32{mseCryptoRC4, mseCryptoPlain} {
+		ln, err := net.Listen("tcp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatal(err)
+		}
+		l := &mseReceiver{Listener: ln, infoHash: infoHash, selectMethod: method}
+
+		go func() {
+			conn, err := l.Accept()
+			if err != nil {
+				t.Error(err)
+				return
+			}
+			defer conn.Close()
+			io.Copy(conn, conn)
+		}()
+
+		conn, err := net.Dial("tcp", ln.Addr().String())
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		c, err := mseHandshake(conn, infoHash, []byte("initial payload"),
+			mseCryptoRC4|mseCryptoPlain)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if c.encrypted() != (method == mseCryptoRC4) {
+			t.Errorf("method %d: encrypted = %v", method, c.encrypted())
+		}
+
+		c.Write([]byte("data"))
+		echo := make([]byte, 19)
+		if _, err := io.ReadFull(c, echo); err != nil ||
+			string(echo) != "initial payloaddata" {
+
+			t.Errorf("method %d: echo = %q, %v", method, echo, err)
+		}
+
+		c.Close()
+		ln.Close()
+	}
+}
+
+func TestMSEHandshakeFail(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+
+	infoHash := []byte(randomString(20))
+	l := &mseReceiver{Listener: ln, infoHash: infoHash, selectMethod: mseCryptoPlain}
+	go l.Accept()
+
+	conn, err := net.Dial("tcp", ln.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	// the receiver selects plaintext which isn't provided
+	if _, err := mseHandshake(conn, infoHash, nil, mseCryptoRC4); err == nil {
+		t.Error("mseHandshake should fail")
+	}
+}
+
+func TestWireEncryption(t *testing.T) {
+	metadata := []byte(Encode(map[string]interface{}{"name": "test"}))
+	infoHash := sha1.Sum(metadata)
+
+	cases := []struct {
+		policy EncryptionPolicy
+		// the peer only accepts MSE if it's set
+		mse    bool
+		method uint32
+		stats  WireStats
+	}{
+		{EncryptionRequire, true, mseCryptoRC4, WireStats{Encrypted: 1}},
+		{EncryptionPrefer, true, mseCryptoPlain, WireStats{}},
+		{EncryptionPrefer, false, 0, WireStats{PlaintextFallbacks: 1}},
+		{EncryptionDisable, false, 0, WireStats{}},
+	}
+
+	for _, c := range cases {
+		ln, err := net.Listen("tcp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		var l net.Listener = ln
+		if c.mse {
+			l = &mseReceiver{Listener: ln, infoHash: infoHash[:], selectMethod: c.method}
+		}
+		go func() {
+			// a plaintext peer closes the encrypted connection first
+			if c.policy == EncryptionPrefer && !c.mse {
+				servePeer(t, l, "-TR2940-abcdefghijkl", metadata, nil)
+			}
+			servePeer(t, l, "-TR2940-abcdefghijkl", metadata, nil)
+		}()
+
+		wire := NewWire(16, 1, 1)
+		wire.SetEncryption(c.policy)
+		ctx, cancel := context.WithCancel(context.Background())
+		go wire.Run(ctx)
+
+		addr := ln.Addr().(*net.TCPAddr)
+		wire.Request(infoHash[:], addr.IP.String(), addr.Port)
+
+		select {
+		case resp := <-wire.Response():
+			if !bytes.Equal(resp.MetadataInfo, metadata) {
+				t.Errorf("%v: wrong metadata", c.policy)
+			}
+		case <-time.After(time.Second * 5):
+			t.Errorf("%v: no response", c.policy)
+		}
+
+		stats := wire.Stats()
+		if stats.Encrypted != c.stats.Encrypted ||
+			stats.PlaintextFallbacks != c.stats.PlaintextFallbacks {
+
+			t.Errorf("%v: stats = %+v", c.policy, stats)
+		}
+
+		cancel()
+		ln.Close()
+	}
+}
@@ -2,14 +2,17 @@ package dht
 
 import (
 	"bytes"
-	"crypto/sha1"
+	"context"
 	"encoding/binary"
 	"errors"
 	"io"
 	"io/ioutil"
 	"net"
-	"strings"
+	"sync"
+	"sync/atomic"
 	"time"
+
+	"magnet-search/dht/utp"
 )
 
 const (
@@ -32,13 +35,20 @@ const (
 	HANDSHAKE = 0
 )
 
+// wireDrainTimeout is how long Wire waits for the in-flight fetches when it
+// stops. After that, their connections are closed.
+const wireDrainTimeout = time.Second * 10
+
+// wireDialTimeout is how long Wire waits for a peer to accept a connection.
+const wireDialTimeout = time.Second * 15
+
 var handshakePrefix = []byte{
 	19, 66, 105, 116, 84, 111, 114, 114, 101, 110, 116, 32, 112, 114,
 	111, 116, 111, 99, 111, 108, 0, 0, 0, 0, 0, 16, 0, 1,
 }
 
 // read reads size-length bytes from conn to data.
-func read(conn *net.TCPConn, size int, data *bytes.Buffer) error {
+func read(conn net.Conn, size int, data *bytes.Buffer) error {
 	conn.SetReadDeadline(time.Now().Add(time.Second * 15))
 
 	n, err := io.CopyN(data, conn, int64(size))
@@ -48,8 +58,8 @@ func read(conn *net.TCPConn, size int, data *bytes.Buffer) error {
 	return nil
 }
 
-// readMessage gets a message from the tcp connection.
-func readMessage(conn *net.TCPConn, data *bytes.Buffer) (
+// readMessage gets a message from the connection.
+func readMessage(conn net.Conn, data *bytes.Buffer) (
 	length int, err error) {
 
 	if err = read(conn, 4, data); err != nil {
@@ -68,7 +78,7 @@ func readMessage(conn *net.TCPConn, data *bytes.Buffer) (
 }
 
 // sendMessage sends data to the connection.
-func sendMessage(conn *net.TCPConn, data []byte) error {
+func sendMessage(conn net.Conn, data []byte) error {
 	length := int32(len(data))
 
 	buffer := bytes.NewBuffer(nil)
@@ -79,15 +89,19 @@ func sendMessage(conn *net.TCPConn, data []byte) error {
 	return err
 }
 
-// sendHandshake sends handshake message to conn.
-func sendHandshake(conn *net.TCPConn, infoHash, peerID []byte) error {
+// handshakeMessage returns the handshake message.
+func handshakeMessage(infoHash, peerID []byte) []byte {
 	data := make([]byte, 68)
 	copy(data[:28], handshakePrefix)
 	copy(data[28:48], infoHash)
 	copy(data[48:], peerID)
+	return data
+}
 
+// sendHandshake sends handshake message to conn.
+func sendHandshake(conn net.Conn, infoHash, peerID []byte) error {
 	conn.SetWriteDeadline(time.Now().Add(time.Second * 10))
-	_, err := conn.Write(data)
+	_, err := conn.Write(handshakeMessage(infoHash, peerID))
 	return err
 }
 
@@ -99,52 +113,20 @@ func onHandshake(data []byte) (err error) {
 	return
 }
 
-// sendExtHandshake requests for the ut_metadata and metadata_size.
-func sendExtHandshake(conn *net.TCPConn) error {
+// sendExtHandshake requests for the ut_metadata and metadata_size, and
+// tells the peer to send ut_pex. The handshake of the peer is parsed by
+// parseExtHandshake.
+func sendExtHandshake(conn net.Conn) error {
 	data := append(
 		[]byte{EXTENDED, HANDSHAKE},
 		Encode(map[string]interface{}{
-			"m": map[string]interface{}{"ut_metadata": 1},
+			"m": map[string]interface{}{"ut_metadata": 1, "ut_pex": utPexID},
 		})...,
 	)
 
 	return sendMessage(conn, data)
 }
 
-// getUTMetaSize returns the ut_metadata and metadata_size.
-func getUTMetaSize(data []byte) (
-	utMetadata int, metadataSize int, err error) {
-
-	v, err := Decode(data)
-	if err != nil {
-		return
-	}
-
-	dict, ok := v.(map[string]interface{})
-	if !ok {
-		err = errors.New("invalid dict")
-		return
-	}
-
-	if err = ParseKeys(
-		dict, [][]string{{"metadata_size", "int"}, {"m", "map"}}); err != nil {
-		return
-	}
-
-	m := dict["m"].(map[string]interface{})
-	if err = ParseKey(m, "ut_metadata", "int"); err != nil {
-		return
-	}
-
-	utMetadata = m["ut_metadata"].(int)
-	metadataSize = dict["metadata_size"].(int)
-
-	if metadataSize > MaxMetadataSize {
-		err = errors.New("metadata_size too long")
-	}
-	return
-}
-
 // Request represents the request context.
 type Request struct {
 	InfoHash []byte
@@ -152,60 +134,157 @@ type Request struct {
 	Port     int
 }
 
-// Response contains the request context and the metadata info.
+// Response contains the request context, the metadata info and the client
+// of the peer which sends it. Swarm is how many peers are known for the
+// infohash, by the requests and ut_pex.
 type Response struct {
 	Request
 	MetadataInfo []byte
+	Client       PeerClient
+	Swarm        int
+}
+
+// WireStats counts the outcomes of the metadata fetches.
+type WireStats struct {
+	DialSucceeded      uint64
+	DialFailed         uint64
+	HandshakeSucceeded uint64
+	HandshakeFailed    uint64
+	// fetched and verified metadata
+	MetadataSucceeded uint64
+	// connections closed or broken before the metadata is fetched
+	MetadataFailed uint64
+	// metadata with wrong piece sizes or not matching the infohash
+	MetadataInvalid uint64
+	// requests of the infohashes being fetched, whose peers are added to
+	// the fetching tasks
+	Deduplicated uint64
+	// requests dropped because too many infohashes are being fetched
+	Dropped uint64
+	// fetches from another peer after the previous ones fail
+	Retried uint64
+	// fetches from another peer in parallel because the others are slow
+	Parallel uint64
+	// connections over uTP
+	UTPConnected uint64
+	// connections made by the other transport after the preferred one fails
+	Fallbacks uint64
+	// connections whose payload streams are encrypted by MSE/PE
+	Encrypted uint64
+	// plaintext connections made after the encrypted handshakes fail
+	PlaintextFallbacks uint64
+	// ut_pex messages received
+	PexMessages uint64
+	// new peers told by ut_pex, which are added to the fetching tasks
+	PexPeers uint64
 }
 
 // Wire represents the wire protocol.
 type Wire struct {
-	blackList    *blackList
+	// stats is the first field to be 64-bit aligned for atomic
+	stats WireStats
+
+	blackList *blackList
+	// the metadataTasks being run by the raw infohashes, only Run writes it
 	queue        *syncedMap
+	maxTasks     int
+	taskDone     chan *metadataTask
 	requests     chan Request
 	responses    chan Response
 	workerTokens chan struct{}
+	// stopped is closed when Run stops accepting requests
+	stopped chan struct{}
+	// aborting is closed when the in-flight fetches should be aborted
+	aborting chan struct{}
+	// utp connects to the peers over uTP if it's set, and preferUTP makes it
+	// tried before TCP
+	utp        *utp.Socket
+	preferUTP  bool
+	encryption EncryptionPolicy
 }
 
 // NewWire returns a Wire pointer.
 //   - blackListSize: the blacklist size
-//   - requestQueueSize: the max requests it can buffers
+//   - requestQueueSize: the max requests it can buffers, and the max
+//     infohashes being fetched
 //   - workerQueueSize: the max goroutine downloading workers
 func NewWire(blackListSize, requestQueueSize, workerQueueSize int) *Wire {
 	return &Wire{
 		blackList:    newBlackList(blackListSize),
 		queue:        newSyncedMap(),
+		maxTasks:     requestQueueSize,
+		taskDone:     make(chan *metadataTask),
 		requests:     make(chan Request, requestQueueSize),
 		responses:    make(chan Response, 1024),
 		workerTokens: make(chan struct{}, workerQueueSize),
+		stopped:      make(chan struct{}),
+		aborting:     make(chan struct{}),
 	}
 }
 
-// Request pushes the request to the queue.
+// SetBlocklist makes the wire skip the peers in bl, usually the one of the
+// dht. It must be called before Run.
+func (wire *Wire) SetBlocklist(bl *Blocklist) {
+	wire.blackList.blocklist = bl
+}
+
+// SetUTP makes the wire connect to the peers over uTP with socket as well
+// as TCP. The preferred transport is tried first, and the other one is
+// tried if it fails. It must be called before Run, and socket should be
+// closed after Run returns.
+func (wire *Wire) SetUTP(socket *utp.Socket, preferUTP bool) {
+	wire.utp = socket
+	wire.preferUTP = preferUTP
+}
+
+// SetEncryption sets whether the connections to the peers are encrypted by
+// MSE/PE, they are plaintext by default. It must be called before Run.
+func (wire *Wire) SetEncryption(policy EncryptionPolicy) {
+	wire.encryption = policy
+}
+
+// Request pushes the request to the queue. It's dropped if the wire has
+// stopped. The requests of the same infohash are fetched by one task, which
+// tries their peers one by one until the metadata is fetched.
 func (wire *Wire) Request(infoHash []byte, ip string, port int) {
-	wire.requests <- Request{InfoHash: infoHash, IP: ip, Port: port}
+	select {
+	case wire.requests <- Request{InfoHash: infoHash, IP: ip, Port: port}:
+	case <-wire.stopped:
+	}
 }
 
-// Response returns a chan of Response.
+// Response returns a chan of Response. It's closed after Run returns.
 func (wire *Wire) Response() <-chan Response {
 	return wire.responses
 }
 
-// isDone returns whether the wire get all pieces of the metadata info.
-func (wire *Wire) isDone(pieces [][]byte) bool {
-	for _, piece := range pieces {
-		if len(piece) == 0 {
-			return false
-		}
+// Stats returns the current counters.
+func (wire *Wire) Stats() WireStats {
+	return WireStats{
+		DialSucceeded:      atomic.LoadUint64(&wire.stats.DialSucceeded),
+		DialFailed:         atomic.LoadUint64(&wire.stats.DialFailed),
+		HandshakeSucceeded: atomic.LoadUint64(&wire.stats.HandshakeSucceeded),
+		HandshakeFailed:    atomic.LoadUint64(&wire.stats.HandshakeFailed),
+		MetadataSucceeded:  atomic.LoadUint64(&wire.stats.MetadataSucceeded),
+		MetadataFailed:     atomic.LoadUint64(&wire.stats.MetadataFailed),
+		MetadataInvalid:    atomic.LoadUint64(&wire.stats.MetadataInvalid),
+		Deduplicated:       atomic.LoadUint64(&wire.stats.Deduplicated),
+		Dropped:            atomic.LoadUint64(&wire.stats.Dropped),
+		Retried:            atomic.LoadUint64(&wire.stats.Retried),
+		Parallel:           atomic.LoadUint64(&wire.stats.Parallel),
+		UTPConnected:       atomic.LoadUint64(&wire.stats.UTPConnected),
+		Fallbacks:          atomic.LoadUint64(&wire.stats.Fallbacks),
+		Encrypted:          atomic.LoadUint64(&wire.stats.Encrypted),
+		PlaintextFallbacks: atomic.LoadUint64(&wire.stats.PlaintextFallbacks),
+		PexMessages:        atomic.LoadUint64(&wire.stats.PexMessages),
+		PexPeers:           atomic.LoadUint64(&wire.stats.PexPeers),
 	}
-	return true
 }
 
-func (wire *Wire) requestPieces(
-	conn *net.TCPConn, utMetadata int, metadataSize int, piecesNum int) {
-
+// requestPieces requests the pieces of the metadata from conn.
+func (wire *Wire) requestPieces(conn net.Conn, utMetadata int, pieces []int) {
 	buffer := make([]byte, 1024)
-	for i := 0; i < piecesNum; i++ {
+	for _, i := range pieces {
 		buffer[0] = EXTENDED
 		buffer[1] = byte(utMetadata)
 
@@ -222,43 +301,178 @@ func (wire *Wire) requestPieces(
 	buffer = nil
 }
 
-// fetchMetadata fetchs medata info accroding to infohash from dht.
-func (wire *Wire) fetchMetadata(r Request) {
+// isAborting returns whether the in-flight fetches should be aborted.
+func (wire *Wire) isAborting() bool {
+	select {
+	case <-wire.aborting:
+		return true
+	default:
+		return false
+	}
+}
+
+// dial connects to address over TCP, and over uTP if it's set. The
+// preferred transport is tried first, and the other one if it fails.
+func (wire *Wire) dial(address string) (net.Conn, error) {
+	dialTCP := func() (net.Conn, error) {
+		conn, err := net.DialTimeout("tcp", address, wireDialTimeout)
+		if err != nil {
+			return nil, err
+		}
+		conn.(*net.TCPConn).SetLinger(0)
+		return conn, nil
+	}
+	dialUTP := func() (net.Conn, error) {
+		conn, err := wire.utp.DialTimeout(address, wireDialTimeout)
+		if err != nil {
+			return nil, err
+		}
+		atomic.AddUint64(&wire.stats.UTPConnected, 1)
+		return conn, nil
+	}
+
+	if wire.utp == nil {
+		return dialTCP()
+	}
+
+	dials := []func() (net.Conn, error){dialTCP, dialUTP}
+	if wire.preferUTP {
+		dials[0], dials[1] = dials[1], dials[0]
+	}
+
+	conn, err := dials[0]()
+	if err == nil {
+		return conn, nil
+	}
+
+	// the wire may be stopping, which aborts the fetch anyway
+	if wire.isAborting() {
+		return nil, err
+	}
+
+	if conn, err = dials[1](); err == nil {
+		atomic.AddUint64(&wire.stats.Fallbacks, 1)
+	}
+	return conn, err
+}
+
+// handshake sends the handshake message on conn, in the MSE handshake if
+// encrypt. It returns the conn to use afterwards.
+func (wire *Wire) handshake(conn net.Conn, infoHash []byte, encrypt bool) (
+	net.Conn, error) {
+
+	peerID := []byte(randomString(20))
+	if !encrypt {
+		return conn, sendHandshake(conn, infoHash, peerID)
+	}
+
+	provide := uint32(mseCryptoRC4)
+	if wire.encryption == EncryptionPrefer {
+		provide |= mseCryptoPlain
+	}
+
+	c, err := mseHandshake(conn, infoHash, handshakeMessage(infoHash, peerID), provide)
+	if err != nil {
+		return conn, err
+	}
+	if c.encrypted() {
+		atomic.AddUint64(&wire.stats.Encrypted, 1)
+	}
+	return c, nil
+}
+
+// fetchMetadata fetchs the pieces of task's metadata from the peer r until
+// the task finishes or the peer fails. The peer which completes the
+// metadata sends the Response.
+func (wire *Wire) fetchMetadata(task *metadataTask, r Request) {
 	var (
-		length       int
-		msgType      byte
-		piecesNum    int
-		pieces       [][]byte
-		utMetadata   int
-		metadataSize int
+		length     int
+		msgType    byte
+		utMetadata int
+		batch      = wirePieceBatch
+		peerID     []byte
+		client     PeerClient
+		// the pieces requested from the peer and not received
+		mine = make(map[int]struct{})
 	)
 
 	defer func() {
-		pieces = nil
+		task.unclaim(mine)
 		recover()
 	}()
 
-	infoHash := r.InfoHash
 	address := genAddress(r.IP, r.Port)
 
-	dial, err := net.DialTimeout("tcp", address, time.Second*15)
+	finished := make(chan struct{})
+	defer close(finished)
+
+	// watch closes conn when the fetch is aborted or the task finishes
+	watch := func(conn net.Conn) {
+		go func() {
+			select {
+			case <-wire.aborting:
+			case <-task.finished:
+			case <-finished:
+				return
+			}
+			conn.Close()
+		}()
+	}
+
+	conn, err := wire.dial(address)
 	if err != nil {
+		atomic.AddUint64(&wire.stats.DialFailed, 1)
 		wire.blackList.insert(r.IP, r.Port)
 		return
 	}
-	conn := dial.(*net.TCPConn)
-	conn.SetLinger(0)
-	defer conn.Close()
+	atomic.AddUint64(&wire.stats.DialSucceeded, 1)
+	watch(conn)
+	defer func() {
+		conn.Close()
+	}()
+
+	conn, err = wire.handshake(conn, task.infoHash, wire.encryption != EncryptionDisable)
+	if err != nil && wire.encryption == EncryptionPrefer && !wire.isAborting() &&
+		!task.isFinished() {
+
+		// the peer may not support MSE, so try a plaintext connection. conn
+		// is kept if the redial fails, as the deferred Close uses it.
+		conn.Close()
+		var redial net.Conn
+		if redial, err = wire.dial(address); err != nil {
+			atomic.AddUint64(&wire.stats.HandshakeFailed, 1)
+			return
+		}
+		conn = redial
+		watch(conn)
+		atomic.AddUint64(&wire.stats.PlaintextFallbacks, 1)
+		conn, err = wire.handshake(conn, task.infoHash, false)
+	}
 
 	data := bytes.NewBuffer(nil)
 	data.Grow(BLOCK)
 
-	if sendHandshake(conn, infoHash, []byte(randomString(20))) != nil ||
-		read(conn, 68, data) != nil ||
-		onHandshake(data.Next(68)) != nil ||
-		sendExtHandshake(conn) != nil {
+	if err != nil || read(conn, 68, data) != nil {
+		atomic.AddUint64(&wire.stats.HandshakeFailed, 1)
+		return
+	}
+
+	handshake := data.Next(68)
+	if onHandshake(handshake) != nil || sendExtHandshake(conn) != nil {
+		atomic.AddUint64(&wire.stats.HandshakeFailed, 1)
 		return
 	}
+	peerID = append([]byte(nil), handshake[48:68]...)
+	atomic.AddUint64(&wire.stats.HandshakeSucceeded, 1)
+
+	// outcome is counted when the fetch returns, unless another peer has
+	// completed the metadata
+	outcome := &wire.stats.MetadataFailed
+	defer func() {
+		if outcome != &wire.stats.MetadataFailed || !task.isFinished() {
+			atomic.AddUint64(outcome, 1)
+		}
+	}()
 
 	for {
 		length, err = readMessage(conn, data)
@@ -288,27 +502,35 @@ func (wire *Wire) fetchMetadata(r Request) {
 			}
 
 			if extendedID == 0 {
-				if pieces != nil {
+				if utMetadata != 0 {
 					return
 				}
 
-				utMetadata, metadataSize, err = getUTMetaSize(payload)
-				if err != nil {
+				hs, err := parseExtHandshake(payload)
+				if err != nil || hs.utMetadata <= 0 {
+					return
+				}
+				if !task.setSize(hs.metadataSize) {
+					outcome = &wire.stats.MetadataInvalid
 					return
 				}
 
-				piecesNum = metadataSize / BLOCK
-				if metadataSize%BLOCK != 0 {
-					piecesNum++
+				utMetadata = hs.utMetadata
+				client = newPeerClient(peerID, hs)
+				if client.Reqq > 0 && client.Reqq < batch {
+					batch = client.Reqq
 				}
 
-				pieces = make([][]byte, piecesNum)
-				go wire.requestPieces(conn, utMetadata, metadataSize, piecesNum)
+				go wire.requestPieces(conn, utMetadata, task.claim(mine, batch))
+				continue
+			}
 
+			if extendedID == utPexID {
+				wire.onPex(task, payload)
 				continue
 			}
 
-			if pieces == nil {
+			if utMetadata == 0 {
 				return
 			}
 
@@ -324,62 +546,152 @@ func (wire *Wire) fetchMetadata(r Request) {
 				return
 			}
 
-			if dict["msg_type"].(int) != DATA {
+			switch dict["msg_type"].(int) {
+			case DATA:
+			case REJECT:
+				return
+			default:
 				continue
 			}
 
 			piece := dict["piece"].(int)
-			pieceLen := length - 2 - index
+			if size := task.pieceSize(piece); size == 0 ||
+				length-2-index != size {
 
-			if (piece != piecesNum-1 && pieceLen != BLOCK) ||
-				(piece == piecesNum-1 && pieceLen != metadataSize%BLOCK) {
+				outcome = &wire.stats.MetadataInvalid
 				return
 			}
 
-			pieces[piece] = payload[index:]
-
-			if wire.isDone(pieces) {
-				metadataInfo := bytes.Join(pieces, nil)
+			if _, ok := mine[piece]; ok {
+				delete(mine, piece)
+				task.unclaim(map[int]struct{}{piece: {}})
+			}
 
-				info := sha1.Sum(metadataInfo)
-				if !bytes.Equal(infoHash, info[:]) {
-					return
-				}
+			metadataInfo, err := task.put(piece, payload[index:])
+			if err != nil {
+				outcome = &wire.stats.MetadataInvalid
+				return
+			}
 
-				wire.responses <- Response{
-					Request:      r,
+			if metadataInfo != nil {
+				select {
+				case wire.responses <- Response{
+					Request: Request{
+						InfoHash: task.infoHash, IP: r.IP, Port: r.Port,
+					},
 					MetadataInfo: metadataInfo,
+					Client:       client,
+					Swarm:        task.swarmSize(),
+				}:
+					outcome = &wire.stats.MetadataSucceeded
+				case <-wire.aborting:
 				}
 				return
 			}
+
+			// request more pieces once the ones requested are received
+			if len(mine) == 0 {
+				go wire.requestPieces(conn, utMetadata, task.claim(mine, batch))
+			}
 		default:
 			data.Reset()
 		}
 	}
 }
 
-// Run starts the peer wire protocol.
-func (wire *Wire) Run() {
-	go wire.blackList.clear()
+// onPex adds the peers told by a ut_pex message to task, so that they are
+// tried if the other peers fail. The invalid messages are ignored.
+func (wire *Wire) onPex(task *metadataTask, payload []byte) {
+	added, dropped, err := parsePex(task.infoHash, payload)
+	if err != nil {
+		return
+	}
+	atomic.AddUint64(&wire.stats.PexMessages, 1)
 
-	for r := range wire.requests {
-		wire.workerTokens <- struct{}{}
+	peers := added[:0]
+	for _, r := range added {
+		if !wire.blackList.in(r.IP, r.Port) {
+			peers = append(peers, r)
+		}
+	}
 
-		go func(r Request) {
-			defer func() {
-				<-wire.workerTokens
-			}()
+	if n := task.addPex(peers, dropped); n > 0 {
+		atomic.AddUint64(&wire.stats.PexPeers, uint64(n))
+	}
+}
 
-			key := strings.Join([]string{
-				string(r.InfoHash), genAddress(r.IP, r.Port),
-			}, ":")
+// schedule adds the peer of r to the task fetching its infohash, or starts a
+// new task if there isn't one.
+func (wire *Wire) schedule(r Request, wg *sync.WaitGroup) {
+	if len(r.InfoHash) != 20 || wire.blackList.in(r.IP, r.Port) {
+		return
+	}
 
-			if len(r.InfoHash) != 20 || wire.blackList.in(r.IP, r.Port) ||
-				wire.queue.Has(key) {
-				return
+	key := string(r.InfoHash)
+	if v, ok := wire.queue.Get(key); ok && v.(*metadataTask).addPeer(r) {
+		atomic.AddUint64(&wire.stats.Deduplicated, 1)
+		return
+	}
+
+	if wire.queue.Len() >= wire.maxTasks {
+		atomic.AddUint64(&wire.stats.Dropped, 1)
+		return
+	}
+
+	task := newMetadataTask(r.InfoHash)
+	task.addPeer(r)
+	wire.queue.Set(key, task)
+
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		wire.runTask(task)
+
+		select {
+		case wire.taskDone <- task:
+		case <-wire.stopped:
+		}
+	}()
+}
+
+// Run starts the peer wire protocol and blocks until ctx is done. Then it
+// stops accepting requests, drains the in-flight fetches and closes the
+// Response chan.
+func (wire *Wire) Run(ctx context.Context) {
+	go wire.blackList.clear(ctx.Done())
+
+	var wg sync.WaitGroup
+
+loop:
+	for {
+		select {
+		case r := <-wire.requests:
+			wire.schedule(r, &wg)
+		case task := <-wire.taskDone:
+			key := string(task.infoHash)
+			if v, ok := wire.queue.Get(key); ok && v == task {
+				wire.queue.Delete(key)
 			}
+		case <-ctx.Done():
+			break loop
+		}
+	}
 
-			wire.fetchMetadata(r)
-		}(r)
+	close(wire.stopped)
+
+	drained := make(chan struct{})
+	go func() {
+		wg.Wait()
+		close(drained)
+	}()
+
+	select {
+	case <-drained:
+	case <-time.After(wireDrainTimeout):
+		close(wire.aborting)
+		<-drained
 	}
+
+	wire.queue.Clear()
+	close(wire.responses)
 }
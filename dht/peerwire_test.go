@@ -0,0 +1,122 @@
+package dht
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha1"
+	"net"
+	"testing"
+	"time"
+
+	"magnet-search/dht/utp"
+)
+
+func TestWireRunContext(t *testing.T) {
+	wire := NewWire(16, 1, 1)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		wire.Run(ctx)
+		close(done)
+	}()
+
+	cancel()
+
+	select {
+	case <-done:
+	case <-time.After(time.Second * 5):
+		t.Fatal("Run should return after ctx is done")
+	}
+
+	if _, ok := <-wire.Response(); ok {
+		t.Fail()
+	}
+
+	// requests after stopping neither block nor panic
+	for i := 0; i < 3; i++ {
+		wire.Request([]byte(randomString(20)), "127.0.0.1", 6881)
+	}
+}
+
+// listenUTP returns a uTP socket which only dials.
+func listenUTP(t *testing.T, address string) *utp.Socket {
+	conn, err := net.ListenPacket("udp", address)
+	if err != nil {
+		t.Fatal(err)
+	}
+	socket := utp.NewSocket(conn)
+	t.Cleanup(func() { socket.Close() })
+	return socket
+}
+
+func TestWireUTP(t *testing.T) {
+	l, err := utp.Listen("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+
+	metadata := []byte(Encode(map[string]interface{}{"name": "test"}))
+	infoHash := sha1.Sum(metadata)
+	go servePeer(t, l, "-UT355S-abcdefghijkl", metadata, nil)
+
+	wire := NewWire(16, 1, 1)
+	wire.SetUTP(listenUTP(t, "127.0.0.1:0"), true)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go wire.Run(ctx)
+
+	addr := l.Addr().(*net.UDPAddr)
+	wire.Request(infoHash[:], addr.IP.String(), addr.Port)
+
+	select {
+	case resp := <-wire.Response():
+		if !bytes.Equal(resp.MetadataInfo, metadata) || resp.Client.Name != "µTorrent" {
+			t.Errorf("wrong response %+v", resp)
+		}
+	case <-time.After(time.Second * 5):
+		t.Fatal("no response")
+	}
+
+	if stats := wire.Stats(); stats.UTPConnected != 1 || stats.Fallbacks != 0 {
+		t.Errorf("stats = %+v", stats)
+	}
+}
+
+func TestWireFallback(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+
+	// the peer resets uTP connections on the same port
+	addr := l.Addr().(*net.TCPAddr)
+	listenUTP(t, addr.String())
+
+	metadata := []byte(Encode(map[string]interface{}{"name": "test"}))
+	infoHash := sha1.Sum(metadata)
+	go servePeer(t, l, "-TR2940-abcdefghijkl", metadata, nil)
+
+	wire := NewWire(16, 1, 1)
+	wire.SetUTP(listenUTP(t, "127.0.0.1:0"), true)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go wire.Run(ctx)
+
+	wire.Request(infoHash[:], addr.IP.String(), addr.Port)
+
+	select {
+	case resp := <-wire.Response():
+		if !bytes.Equal(resp.MetadataInfo, metadata) {
+			t.Error("wrong metadata")
+		}
+	case <-time.After(time.Second * 5):
+		t.Fatal("no response")
+	}
+
+	if stats := wire.Stats(); stats.UTPConnected != 0 || stats.Fallbacks != 1 {
+		t.Errorf("stats = %+v", stats)
+	}
+}
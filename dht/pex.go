@@ -0,0 +1,78 @@
+package dht
+
+import (
+	"errors"
+)
+
+const (
+	// utPexID is the extended message id of ut_pex told to the peers in the
+	// extension handshake, see BEP 11.
+	utPexID = 2
+	// pexMessageMaxPeers is how many peers a ut_pex message can add at most.
+	pexMessageMaxPeers = 50
+	// pexTaskMaxPeers is how many peers told by ut_pex a task keeps at most.
+	pexTaskMaxPeers = 500
+	// pexTaskMaxAttempts is how many peers told by ut_pex a task tries at
+	// most, besides the announced ones.
+	pexTaskMaxAttempts = 16
+)
+
+// parsePex parses the payload of a ut_pex message, and returns the peers
+// added and dropped as the requests of infoHash. The IPv4 peers of the added
+// and dropped keys and the IPv6 ones of added6 and dropped6 are returned
+// together, the peers of port 0 are skipped.
+func parsePex(infoHash, data []byte) (added, dropped []Request, err error) {
+	v, err := Decode(data)
+	if err != nil {
+		return
+	}
+
+	dict, ok := v.(map[string]interface{})
+	if !ok {
+		err = errors.New("invalid dict")
+		return
+	}
+
+	peers := func(key string, size int) (requests []Request, err error) {
+		info, ok := dict[key].(string)
+		if !ok {
+			return
+		}
+		if len(info)%size != 0 {
+			return nil, errors.New(key + " has invalid length")
+		}
+
+		for i := 0; i < len(info); i += size {
+			ip, port, _ := decodeCompactIPPortInfo(info[i : i+size])
+			if port == 0 {
+				continue
+			}
+			requests = append(requests, Request{
+				InfoHash: infoHash, IP: ip.String(), Port: port,
+			})
+		}
+		return
+	}
+
+	for _, key := range []struct {
+		name string
+		size int
+		to   *[]Request
+	}{
+		{"added", 6, &added},
+		{"added6", 18, &added},
+		{"dropped", 6, &dropped},
+		{"dropped6", 18, &dropped},
+	} {
+		requests, err := peers(key.name, key.size)
+		if err != nil {
+			return nil, nil, err
+		}
+		*key.to = append(*key.to, requests...)
+	}
+
+	if len(added) > pexMessageMaxPeers {
+		added = added[:pexMessageMaxPeers]
+	}
+	return
+}
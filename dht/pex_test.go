@@ -0,0 +1,254 @@
+package dht
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha1"
+	"encoding/binary"
+	"io"
+	"net"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestParsePex(t *testing.T) {
+	infoHash := []byte(strings.Repeat("a", 20))
+	compact := func(ip string, port int) string {
+		info, _ := encodeCompactIPPortInfo(net.ParseIP(ip), port)
+		return info
+	}
+
+	data := Encode(map[string]interface{}{
+		"added":    compact("1.2.3.4", 6881) + compact("5.6.7.8", 0),
+		"added.f":  "\x10\x00",
+		"added6":   compact("2001:db8::1", 6882),
+		"dropped":  compact("9.9.9.9", 6883),
+		"dropped6": "",
+	})
+	added, dropped, err := parsePex(infoHash, []byte(data))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// the peer of port 0 is skipped
+	if len(added) != 2 || added[0].IP != "1.2.3.4" || added[0].Port != 6881 ||
+		added[1].IP != "2001:db8::1" || added[1].Port != 6882 ||
+		!bytes.Equal(added[0].InfoHash, infoHash) {
+
+		t.Errorf("added = %+v", added)
+	}
+	if len(dropped) != 1 || dropped[0].IP != "9.9.9.9" || dropped[0].Port != 6883 {
+		t.Errorf("dropped = %+v", dropped)
+	}
+
+	many := strings.Repeat(compact("1.2.3.4", 6881), pexMessageMaxPeers+1)
+	added, _, err = parsePex(infoHash, []byte(Encode(map[string]interface{}{"added": many})))
+	if err != nil || len(added) != pexMessageMaxPeers {
+		t.Errorf("parsePex = %d peers, %v", len(added), err)
+	}
+
+	for _, data := range []string{
+		"i1e",
+		Encode(map[string]interface{}{"added": "12345"}),
+		Encode(map[string]interface{}{"dropped6": compact("1.2.3.4", 6881)}),
+	} {
+		if _, _, err := parsePex(infoHash, []byte(data)); err == nil {
+			t.Errorf("parsePex(%q) should fail", data)
+		}
+	}
+}
+
+func TestMetadataTaskAddPex(t *testing.T) {
+	task := newMetadataTask(make([]byte, 20))
+	task.addPeer(Request{IP: "1.1.1.1", Port: 1})
+	task.nextPeer()
+
+	peer := func(i int) Request {
+		return Request{IP: "2.2.2.2", Port: i}
+	}
+
+	// the peers already added are only counted in the swarm
+	if n := task.addPex([]Request{peer(1), peer(2), {IP: "1.1.1.1", Port: 1}}, nil); n != 2 {
+		t.Errorf("addPex = %d, want 2", n)
+	}
+	if n := task.swarmSize(); n != 3 {
+		t.Errorf("swarmSize = %d, want 3", n)
+	}
+
+	if n := task.addPex(nil, []Request{peer(1), {IP: "1.1.1.1", Port: 1}}); n != 0 {
+		t.Errorf("addPex = %d, want 0", n)
+	}
+	if n := task.swarmSize(); n != 1 {
+		t.Errorf("swarmSize = %d, want 1", n)
+	}
+
+	// the candidates aren't removed by dropped
+	if r, ok := task.nextPeer(); !ok || r.Port != 1 {
+		t.Errorf("nextPeer = %+v, %v", r, ok)
+	}
+
+	added := make([]Request, 0, pexTaskMaxPeers)
+	for i := 3; len(added) < pexTaskMaxPeers; i++ {
+		added = append(added, peer(i))
+	}
+	if n := task.addPex(added, nil); n != pexTaskMaxPeers-2 {
+		t.Errorf("addPex = %d, want %d", n, pexTaskMaxPeers-2)
+	}
+
+	task.close()
+	if n := task.addPex([]Request{peer(0)}, nil); n != 0 {
+		t.Errorf("addPex = %d after close", n)
+	}
+}
+
+func TestMetadataTaskAttempts(t *testing.T) {
+	task := newMetadataTask(make([]byte, 20))
+	peer := func(ip string, i int) Request {
+		return Request{IP: ip, Port: i + 1}
+	}
+
+	pex := make([]Request, 0, pexTaskMaxAttempts+1)
+	for i := 0; i <= pexTaskMaxAttempts; i++ {
+		pex = append(pex, peer("2.2.2.2", i))
+	}
+	task.addPex(pex, nil)
+	for i := 0; i <= wireMaxAttempts; i++ {
+		task.addPeer(peer("1.1.1.1", i))
+	}
+
+	// the announced peers are tried first, then the ones told by ut_pex
+	for i := 0; i < wireMaxAttempts+pexTaskMaxAttempts; i++ {
+		r, ok := task.nextPeer()
+		want := "1.1.1.1"
+		if i >= wireMaxAttempts {
+			want = "2.2.2.2"
+		}
+		if !ok || r.IP != want {
+			t.Fatalf("attempt %d: nextPeer = %+v, %v, want a peer of %s", i, r, ok, want)
+		}
+	}
+
+	if task.hasPeer() || task.canTryAnnounced() {
+		t.Error("the attempts should be used up")
+	}
+	if r, ok := task.nextPeer(); ok {
+		t.Errorf("nextPeer = %+v after the attempts are used up", r)
+	}
+}
+
+// servePexPeer tells the peer in pex by ut_pex on l, and rejects the piece
+// requests.
+func servePexPeer(t *testing.T, l net.Listener, metadata []byte, pex string) {
+	conn, err := l.Accept()
+	if err != nil {
+		return
+	}
+	defer conn.Close()
+
+	handshake := make([]byte, 68)
+	if _, err := io.ReadFull(conn, handshake); err != nil {
+		t.Error(err)
+		return
+	}
+	conn.Write(handshake)
+
+	send := func(payload []byte) {
+		length := make([]byte, 4)
+		binary.BigEndian.PutUint32(length, uint32(len(payload)))
+		conn.Write(append(length, payload...))
+	}
+	receive := func() []byte {
+		length := make([]byte, 4)
+		if _, err := io.ReadFull(conn, length); err != nil {
+			return nil
+		}
+		payload := make([]byte, bytes2int(length))
+		if _, err := io.ReadFull(conn, payload); err != nil {
+			return nil
+		}
+		return payload
+	}
+
+	send(append([]byte{EXTENDED, HANDSHAKE}, Encode(map[string]interface{}{
+		"m":             map[string]interface{}{"ut_metadata": 3, "ut_pex": 5},
+		"metadata_size": len(metadata),
+	})...))
+
+	// the ut_pex message is sent with the id told by the wire
+	hs := receive()
+	if len(hs) < 2 {
+		t.Error("no extension handshake")
+		return
+	}
+	v, err := Decode(hs[2:])
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	m := v.(map[string]interface{})["m"].(map[string]interface{})
+	id, ok := m["ut_pex"].(int)
+	if !ok {
+		t.Errorf("ut_pex isn't in the extension handshake: %v", m)
+		return
+	}
+
+	send(append([]byte{EXTENDED, byte(id)}, Encode(map[string]interface{}{
+		"added": pex, "added.f": "\x10",
+	})...))
+
+	receive()
+	send(append([]byte{EXTENDED, 3}, Encode(map[string]interface{}{
+		"msg_type": REJECT, "piece": 0,
+	})...))
+
+	io.Copy(io.Discard, conn)
+}
+
+func TestWirePex(t *testing.T) {
+	metadata := []byte(Encode(map[string]interface{}{"name": "test"}))
+	infoHash := sha1.Sum(metadata)
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	go servePeer(t, l, "-TR2940-abcdefghijkl", metadata, nil)
+
+	// the announcer only knows the peer which has the metadata
+	announcer, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer announcer.Close()
+
+	addr := l.Addr().(*net.TCPAddr)
+	pex, _ := encodeCompactIPPortInfo(addr.IP, addr.Port)
+	go servePexPeer(t, announcer, metadata, pex)
+
+	wire := NewWire(16, 4, 4)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go wire.Run(ctx)
+
+	announcerAddr := announcer.Addr().(*net.TCPAddr)
+	wire.Request(infoHash[:], announcerAddr.IP.String(), announcerAddr.Port)
+
+	select {
+	case resp := <-wire.Response():
+		if !bytes.Equal(resp.MetadataInfo, metadata) || resp.Port != addr.Port {
+			t.Errorf("wrong response from %s:%d", resp.IP, resp.Port)
+		}
+		if resp.Swarm != 2 {
+			t.Errorf("Swarm = %d, want 2", resp.Swarm)
+		}
+	case <-time.After(time.Second * 5):
+		t.Fatal("no response")
+	}
+
+	stats := wire.Stats()
+	if stats.PexMessages != 1 || stats.PexPeers != 1 || stats.Retried != 1 {
+		t.Errorf("stats = %+v", stats)
+	}
+}
@@ -0,0 +1,99 @@
+package dht
+
+import (
+	"sync"
+	"time"
+)
+
+const (
+	// a node is evicted after it fails this many queries in a row
+	maxNodeFailures = 3
+	// a node is evicted if less than minResponseRate of its queries are
+	// answered after minJudgedQueries queries
+	minJudgedQueries = 8
+	minResponseRate  = 0.25
+	// a node is bad and can be replaced by a new one in a full bucket after
+	// it fails this many queries in a row
+	badNodeFailures = 2
+	// the rtt assumed for a node which hasn't responded
+	defaultRTT = time.Millisecond * 500
+)
+
+// nodeStats measures the quality of a node by the queries sent to it. It's
+// shared by the node objects with the same id and address, see
+// kbucket.Insert.
+type nodeStats struct {
+	sync.Mutex
+	responses int
+	failures  int
+	// failed queries since the last response
+	consecutiveFailures int
+	// responses which can't be parsed or don't match the query
+	invalid int
+	// smoothed rtt like TCP's
+	rtt      time.Duration
+	lastSeen time.Time
+}
+
+// responded records a response which arrives in rtt.
+func (s *nodeStats) responded(rtt time.Duration) {
+	s.Lock()
+	defer s.Unlock()
+
+	s.responses++
+	s.consecutiveFailures = 0
+	s.lastSeen = time.Now()
+
+	if s.rtt == 0 {
+		s.rtt = rtt
+	} else {
+		s.rtt += (rtt - s.rtt) / 8
+	}
+}
+
+// failed records a query which isn't answered. It returns whether the node
+// is a chronic non-responder and should be evicted.
+func (s *nodeStats) failed() bool {
+	s.Lock()
+	defer s.Unlock()
+
+	s.failures++
+	s.consecutiveFailures++
+
+	queries := s.responses + s.failures
+	return s.consecutiveFailures >= maxNodeFailures ||
+		queries >= minJudgedQueries &&
+			float64(s.responses) < minResponseRate*float64(queries)
+}
+
+// invalidReply records an invalid response.
+func (s *nodeStats) invalidReply() {
+	s.Lock()
+	s.invalid++
+	s.Unlock()
+}
+
+// bad returns whether the node has failed badNodeFailures queries in a row.
+func (s *nodeStats) bad() bool {
+	s.Lock()
+	defer s.Unlock()
+
+	return s.consecutiveFailures >= badNodeFailures
+}
+
+// score returns the quality of the node between 0 and 1, higher is better.
+// It's the smoothed response rate weighted by the rtt and the invalid
+// responses, so that a node never queried scores about 0.33.
+func (s *nodeStats) score() float64 {
+	s.Lock()
+	defer s.Unlock()
+
+	rate := float64(s.responses+1) / float64(s.responses+s.failures+2)
+
+	rtt := s.rtt
+	if rtt == 0 {
+		rtt = defaultRTT
+	}
+
+	return rate / (1 + rtt.Seconds()) / float64(1+s.invalid)
+}
@@ -0,0 +1,161 @@
+package dht
+
+import (
+	"fmt"
+	"testing"
+	"time"
+)
+
+func TestNodeStats(t *testing.T) {
+	s := &nodeStats{}
+	fresh := s.score()
+
+	s.responded(time.Millisecond * 50)
+	if s.score() <= fresh {
+		t.Errorf("score %v should be better than %v after a response",
+			s.score(), fresh)
+	}
+	if s.rtt != time.Millisecond*50 {
+		t.Errorf("rtt = %v, want 50ms", s.rtt)
+	}
+
+	s.responded(time.Millisecond * 130)
+	if s.rtt != time.Millisecond*60 {
+		t.Errorf("rtt = %v, want 60ms", s.rtt)
+	}
+
+	for i := 1; i <= maxNodeFailures; i++ {
+		if chronic := s.failed(); chronic != (i == maxNodeFailures) {
+			t.Errorf("failed() = %v after %d failures", chronic, i)
+		}
+		if s.bad() != (i >= badNodeFailures) {
+			t.Errorf("bad() = %v after %d failures", s.bad(), i)
+		}
+	}
+
+	s.responded(time.Millisecond * 50)
+	if s.bad() {
+		t.Error("a response should reset the failures")
+	}
+
+	// 1 response of minJudgedQueries queries
+	s = &nodeStats{responses: 1, failures: minJudgedQueries - 2}
+	if !s.failed() {
+		t.Error("a node answering too few queries should be evicted")
+	}
+
+	s = &nodeStats{}
+	s.invalidReply()
+	if s.score() >= fresh {
+		t.Error("an invalid reply should lower the score")
+	}
+}
+
+func newTestRoutingTable(maxNodes int) *routingTable {
+	config := NewStandardConfig()
+	config.MaxNodes = maxNodes
+	dht := New(config)
+	dht.routingTable = newRoutingTable(dht.KBucketSize, dht)
+	dht.routingTable6 = newRoutingTable(dht.KBucketSize, dht)
+	return dht.routingTable
+}
+
+func TestRoutingTableFailed(t *testing.T) {
+	rt := newTestRoutingTable(100)
+
+	no, _ := newNode(randomString(20), "udp4", "1.2.3.4:6881")
+	rt.Insert(no)
+
+	for i := 1; i < maxNodeFailures; i++ {
+		if rt.failed(no.addr.String()) {
+			t.Fatalf("node is evicted after %d failures", i)
+		}
+	}
+	if !rt.failed(no.addr.String()) {
+		t.Error("node should be evicted")
+	}
+	if _, ok := rt.GetNodeByAddress(no.addr.String()); ok {
+		t.Error("node should be removed")
+	}
+	if !rt.failed("5.6.7.8:6881") {
+		t.Error("nodes not in the table should be blacklisted")
+	}
+}
+
+func TestInsertKeepsStats(t *testing.T) {
+	rt := newTestRoutingTable(100)
+
+	id := randomString(20)
+	no, _ := newNode(id, "udp4", "1.2.3.4:6881")
+	rt.Insert(no)
+	no.stats.responded(time.Millisecond * 10)
+
+	again, _ := newNode(id, "udp4", "1.2.3.4:6881")
+	if rt.Insert(again) {
+		t.Error("node shouldn't be new")
+	}
+	if again.stats != no.stats {
+		t.Error("stats should be kept")
+	}
+
+	moved, _ := newNode(id, "udp4", "1.2.3.5:6881")
+	rt.Insert(moved)
+	if moved.stats == no.stats {
+		t.Error("stats shouldn't be kept when the address changes")
+	}
+}
+
+func TestInsertReplacesBadNode(t *testing.T) {
+	rt := newTestRoutingTable(4)
+
+	nodes := make([]*node, 4)
+	for i := range nodes {
+		nodes[i], _ = newNode(randomString(20), "udp4",
+			fmt.Sprintf("1.2.3.%d:6881", i+1))
+		rt.Insert(nodes[i])
+	}
+
+	no, _ := newNode(randomString(20), "udp4", "1.2.3.9:6881")
+	if rt.Insert(no) {
+		t.Fatal("the full table shouldn't accept a node without bad ones")
+	}
+
+	for i := 0; i < badNodeFailures; i++ {
+		nodes[2].stats.failed()
+	}
+	if !rt.Insert(no) {
+		t.Fatal("the node should replace the bad one")
+	}
+
+	if _, ok := rt.GetNodeByAddress(nodes[2].addr.String()); ok {
+		t.Error("the bad node should be removed")
+	}
+	if rt.Len() != 4 {
+		t.Errorf("Len = %d, want 4", rt.Len())
+	}
+}
+
+func TestReplaceBestCandidate(t *testing.T) {
+	bucket := newKBucket(newBitmap(0))
+
+	old, _ := newNode(randomString(20), "udp4", "1.2.3.4:6881")
+	bucket.Insert(old)
+
+	good, _ := newNode(randomString(20), "udp4", "1.2.3.5:6881")
+	good.stats.responded(time.Millisecond * 10)
+	bucket.candidates.Push(good.id.RawString(), good)
+
+	for i := 0; i < 3; i++ {
+		no, _ := newNode(randomString(20), "udp4",
+			fmt.Sprintf("1.2.4.%d:6881", i+1))
+		bucket.candidates.Push(no.id.RawString(), no)
+	}
+
+	bucket.Replace(old)
+	if bucket.nodes.Len() != 1 || !bucket.nodes.HasKey(good.id.RawString()) {
+		t.Error("the candidate with the best score should replace the node")
+	}
+	if bucket.candidates.Len() != 3 {
+		t.Errorf("candidates = %d, want 3", bucket.candidates.Len())
+	}
+}
@@ -0,0 +1,177 @@
+package dht
+
+import (
+	"sync"
+	"time"
+)
+
+// tokenBucket holds at most burst tokens and is refilled at rate tokens per
+// second.
+type tokenBucket struct {
+	rate, burst, tokens float64
+	last                time.Time
+	// how many packets are dropped since the bucket was full
+	dropped int
+}
+
+// newTokenBucket returns a full tokenBucket pointer. The burst is one
+// second of rate.
+func newTokenBucket(rate float64, now time.Time) *tokenBucket {
+	return &tokenBucket{
+		rate:   rate,
+		burst:  rate,
+		tokens: rate,
+		last:   now,
+	}
+}
+
+// refill adds the tokens accumulated since the last refill.
+func (tb *tokenBucket) refill(now time.Time) {
+	if now.After(tb.last) {
+		tb.tokens += now.Sub(tb.last).Seconds() * tb.rate
+		tb.last = now
+	}
+
+	if tb.tokens >= tb.burst {
+		tb.tokens = tb.burst
+		tb.dropped = 0
+	}
+}
+
+// isFull returns whether the bucket is full, that's to say it's unused.
+func (tb *tokenBucket) isFull(now time.Time) bool {
+	tb.refill(now)
+	return tb.tokens >= tb.burst
+}
+
+// wait returns how long it waits for a token.
+func (tb *tokenBucket) wait(now time.Time) time.Duration {
+	tb.refill(now)
+	if tb.tokens >= 1 {
+		return 0
+	}
+	return time.Duration((1 - tb.tokens) / tb.rate * float64(time.Second))
+}
+
+// take takes a token. The tokens may be negative, which means the token is
+// reserved and the caller should wait.
+func (tb *tokenBucket) take() {
+	tb.tokens--
+}
+
+// rateLimiter limits the rate of packets globally and per key, which is an
+// address or an ip. A rate less than or equal to 0 means no limit.
+type rateLimiter struct {
+	sync.Mutex
+	global  *tokenBucket
+	rate    float64
+	buckets map[string]*tokenBucket
+}
+
+// newRateLimiter returns a rateLimiter pointer.
+func newRateLimiter(globalRate, rate int) *rateLimiter {
+	rl := &rateLimiter{
+		rate:    float64(rate),
+		buckets: make(map[string]*tokenBucket),
+	}
+
+	if globalRate > 0 {
+		rl.global = newTokenBucket(float64(globalRate), time.Now())
+	}
+	return rl
+}
+
+// bucket returns the bucket of key, nil if there is no limit per key.
+func (rl *rateLimiter) bucket(key string, now time.Time) *tokenBucket {
+	if rl.rate <= 0 {
+		return nil
+	}
+
+	tb, ok := rl.buckets[key]
+	if !ok {
+		tb = newTokenBucket(rl.rate, now)
+		rl.buckets[key] = tb
+	}
+	return tb
+}
+
+// reserve reserves a token in both the global bucket and the bucket of key,
+// and returns how long the caller should wait before sending. If it should
+// wait longer than maxWait, nothing is reserved and false is returned.
+func (rl *rateLimiter) reserve(key string, maxWait time.Duration) (
+	time.Duration, bool) {
+
+	rl.Lock()
+	defer rl.Unlock()
+
+	now := time.Now()
+	buckets := make([]*tokenBucket, 0, 2)
+	if rl.global != nil {
+		buckets = append(buckets, rl.global)
+	}
+	if tb := rl.bucket(key, now); tb != nil {
+		buckets = append(buckets, tb)
+	}
+
+	delay := time.Duration(0)
+	for _, tb := range buckets {
+		if wait := tb.wait(now); wait > delay {
+			delay = wait
+		}
+	}
+
+	if delay > maxWait {
+		return 0, false
+	}
+
+	for _, tb := range buckets {
+		tb.take()
+	}
+	return delay, true
+}
+
+// allow takes a token of key if there is one. Otherwise it returns false and
+// how many packets of key are dropped since its bucket was full.
+func (rl *rateLimiter) allow(key string) (bool, int) {
+	rl.Lock()
+	defer rl.Unlock()
+
+	now := time.Now()
+	tb := rl.bucket(key, now)
+	if tb == nil {
+		return true, 0
+	}
+
+	if tb.wait(now) > 0 {
+		tb.dropped++
+		return false, tb.dropped
+	}
+
+	tb.take()
+	return true, 0
+}
+
+// clear removes the unused buckets every minute until done is closed.
+func (rl *rateLimiter) clear(done <-chan struct{}) {
+	ticker := time.NewTicker(time.Minute)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+		case <-done:
+			return
+		}
+
+		rl.Lock()
+
+		now := time.Now()
+		for key, tb := range rl.buckets {
+			if tb.isFull(now) {
+				delete(rl.buckets, key)
+			}
+		}
+
+		rl.Unlock()
+	}
+}
@@ -0,0 +1,70 @@
+package dht
+
+import (
+	"testing"
+	"time"
+)
+
+func TestTokenBucket(t *testing.T) {
+	now := time.Now()
+	tb := newTokenBucket(2, now)
+
+	for i := 0; i < 2; i++ {
+		if tb.wait(now) != 0 {
+			t.Fatal("burst should be allowed")
+		}
+		tb.take()
+	}
+
+	if tb.wait(now) != time.Millisecond*500 {
+		t.Fail()
+	}
+
+	if tb.wait(now.Add(time.Millisecond*500)) != 0 {
+		t.Fail()
+	}
+
+	if !tb.isFull(now.Add(time.Second * 2)) {
+		t.Fail()
+	}
+}
+
+func TestRateLimiterReserve(t *testing.T) {
+	rl := newRateLimiter(0, 1)
+
+	if delay, ok := rl.reserve("a", time.Second); !ok || delay != 0 {
+		t.Fail()
+	}
+
+	if _, ok := rl.reserve("a", 0); ok {
+		t.Fail()
+	}
+
+	if delay, ok := rl.reserve("a", time.Second*2); !ok || delay == 0 {
+		t.Fail()
+	}
+
+	if delay, ok := rl.reserve("b", 0); !ok || delay != 0 {
+		t.Fail()
+	}
+
+	if delay, ok := newRateLimiter(0, 0).reserve("a", 0); !ok || delay != 0 {
+		t.Fail()
+	}
+}
+
+func TestRateLimiterAllow(t *testing.T) {
+	rl := newRateLimiter(0, 2)
+
+	for i := 0; i < 2; i++ {
+		if ok, _ := rl.allow("1.2.3.4"); !ok {
+			t.Fatal("burst should be allowed")
+		}
+	}
+
+	for i := 1; i <= 3; i++ {
+		if ok, dropped := rl.allow("1.2.3.4"); ok || dropped != i {
+			t.Fail()
+		}
+	}
+}
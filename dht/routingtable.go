@@ -2,6 +2,7 @@ package dht
 
 import (
 	"container/heap"
+	"container/list"
 	"errors"
 	"net"
 	"strings"
@@ -17,6 +18,7 @@ type node struct {
 	id             *bitmap
 	addr           *net.UDPAddr
 	lastActiveTime time.Time
+	stats          *nodeStats
 }
 
 // newNode returns a node pointer.
@@ -30,19 +32,29 @@ func newNode(id, network, address string) (*node, error) {
 		return nil, err
 	}
 
-	return &node{newBitmapFromString(id), addr, time.Now()}, nil
+	return &node{
+		id:             newBitmapFromString(id),
+		addr:           addr,
+		lastActiveTime: time.Now(),
+		stats:          &nodeStats{},
+	}, nil
 }
 
 // newNodeFromCompactInfo parses compactNodeInfo and returns a node pointer.
+// compactNodeInfo is 26-length for IPv4 and 38-length for IPv6.
 func newNodeFromCompactInfo(
 	compactNodeInfo string, network string) (*node, error) {
 
-	if len(compactNodeInfo) != 26 {
-		return nil, errors.New("compactNodeInfo should be a 26-length string")
+	if len(compactNodeInfo) != 26 && len(compactNodeInfo) != 38 {
+		return nil, errors.New(
+			"compactNodeInfo should be a 26 or 38-length string")
 	}
 
 	id := compactNodeInfo[:20]
-	ip, port, _ := decodeCompactIPPortInfo(compactNodeInfo[20:])
+	ip, port, err := decodeCompactIPPortInfo(compactNodeInfo[20:])
+	if err != nil {
+		return nil, err
+	}
 
 	return newNode(id, network, genAddress(ip.String(), port))
 }
@@ -67,6 +79,8 @@ type Peer struct {
 	IP    net.IP
 	Port  int
 	token string
+	// whether the peer announces as a seed, see BEP 33
+	seed bool
 }
 
 // newPeer returns a new peer pointer.
@@ -98,15 +112,17 @@ func (p *Peer) CompactIPPortInfo() string {
 // peersManager represents a proxy that manipulates peers.
 type peersManager struct {
 	sync.RWMutex
-	table *syncedMap
-	dht   *DHT
+	table  *syncedMap
+	swarms *syncedMap
+	dht    *DHT
 }
 
 // newPeersManager returns a new peersManager.
 func newPeersManager(dht *DHT) *peersManager {
 	return &peersManager{
-		table: newSyncedMap(),
-		dht:   dht,
+		table:  newSyncedMap(),
+		swarms: newSyncedMap(),
+		dht:    dht,
 	}
 }
 
@@ -115,10 +131,14 @@ func (pm *peersManager) Insert(infoHash string, peer *Peer) {
 	pm.Lock()
 	if _, ok := pm.table.Get(infoHash); !ok {
 		pm.table.Set(infoHash, newKeyedDeque())
+		pm.swarms.Set(infoHash, &swarm{})
 	}
 	pm.Unlock()
 
-	v, _ := pm.table.Get(infoHash)
+	v, _ := pm.swarms.Get(infoHash)
+	v.(*swarm).insert(peer)
+
+	v, _ = pm.table.Get(infoHash)
 	queue := v.(*keyedDeque)
 
 	queue.Push(peer.CompactIPPortInfo(), peer)
@@ -192,9 +212,16 @@ func (bucket *kbucket) UpdateTimestamp() {
 }
 
 // Insert inserts node to the bucket. It returns whether the node is new in
-// the bucket.
+// the bucket. If the node is in the bucket with the same address, it keeps
+// the stats of the node.
 func (bucket *kbucket) Insert(no *node) bool {
-	isNew := !bucket.nodes.HasKey(no.id.RawString())
+	e, ok := bucket.nodes.Get(no.id.RawString())
+	isNew := !ok
+	if ok {
+		if old := e.Value.(*node); old.addr.String() == no.addr.String() {
+			no.stats = old.stats
+		}
+	}
 
 	bucket.nodes.Push(no.id.RawString(), no)
 	bucket.UpdateTimestamp()
@@ -202,8 +229,8 @@ func (bucket *kbucket) Insert(no *node) bool {
 	return isNew
 }
 
-// Replace removes node, then put bucket.candidates.Back() to the right
-// place of bucket.nodes.
+// Replace removes node, then moves the candidate with the best score, the
+// latest one if they are equal, to bucket.nodes.
 func (bucket *kbucket) Replace(no *node) {
 	bucket.nodes.Delete(no.id.RawString())
 	bucket.UpdateTimestamp()
@@ -212,21 +239,67 @@ func (bucket *kbucket) Replace(no *node) {
 		return
 	}
 
-	no = bucket.candidates.Remove(bucket.candidates.Back()).(*node)
+	var (
+		best      *list.Element
+		bestScore float64
+	)
+	for e := range bucket.candidates.Iter() {
+		if score := e.Value.(*node).stats.score(); best == nil ||
+			score >= bestScore {
+
+			best, bestScore = e, score
+		}
+	}
+
+	no = bucket.candidates.Remove(best).(*node)
+	bucket.nodes.Push(no.id.RawString(), no)
+}
 
-	inserted := false
+// ReplaceInsecure replaces a node whose id doesn't match its ip with no. It
+// returns the replaced node, nil if there isn't an insecure one.
+func (bucket *kbucket) ReplaceInsecure(no *node, cachedNodes *syncedMap) *node {
+	var insecure *node
 	for e := range bucket.nodes.Iter() {
-		if e.Value.(*node).lastActiveTime.After(
-			no.lastActiveTime) && !inserted {
+		if nd := e.Value.(*node); insecure == nil && !nd.isSecure() {
+			insecure = nd
+		}
+	}
+
+	return bucket.replaceWith(insecure, no, cachedNodes)
+}
 
-			bucket.nodes.InsertBefore(no, e)
-			inserted = true
+// ReplaceBad replaces the bad node with the lowest score with no. It returns
+// the replaced node, nil if there isn't a bad one.
+func (bucket *kbucket) ReplaceBad(no *node, cachedNodes *syncedMap) *node {
+	var (
+		worst      *node
+		worstScore float64
+	)
+	for e := range bucket.nodes.Iter() {
+		nd := e.Value.(*node)
+		if !nd.stats.bad() {
+			continue
+		}
+		if score := nd.stats.score(); worst == nil || score < worstScore {
+			worst, worstScore = nd, score
 		}
 	}
 
-	if !inserted {
-		bucket.nodes.PushBack(no)
+	return bucket.replaceWith(worst, no, cachedNodes)
+}
+
+// replaceWith replaces old with no if old isn't nil, and returns old.
+func (bucket *kbucket) replaceWith(old, no *node, cachedNodes *syncedMap) *node {
+	if old == nil {
+		return nil
 	}
+
+	bucket.nodes.Delete(old.id.RawString())
+	cachedNodes.Delete(old.addr.String())
+
+	bucket.Insert(no)
+	cachedNodes.Set(no.addr.String(), no)
+	return old
 }
 
 // Fresh pings the expired nodes in the bucket.
@@ -310,12 +383,14 @@ func (tableNode *routingTableNode) Split() {
 
 	for e := range tableNode.KBucket().nodes.Iter() {
 		nd := e.Value.(*node)
-		tableNode.Child(nd.id.Bit(prefixLen)).KBucket().nodes.PushBack(nd)
+		tableNode.Child(nd.id.Bit(prefixLen)).KBucket().nodes.Push(
+			nd.id.RawString(), nd)
 	}
 
 	for e := range tableNode.KBucket().candidates.Iter() {
 		nd := e.Value.(*node)
-		tableNode.Child(nd.id.Bit(prefixLen)).KBucket().candidates.PushBack(nd)
+		tableNode.Child(nd.id.Bit(prefixLen)).KBucket().candidates.Push(
+			nd.id.RawString(), nd)
 	}
 
 	for i := 0; i < 2; i++ {
@@ -353,16 +428,23 @@ func newRoutingTable(k int, dht *DHT) *routingTable {
 }
 
 // Insert adds a node to routing table. It returns whether the node is new
-// in the routingtable.
+// in the routingtable. If SecureNodeID is set, nodes whose id doesn't match
+// their ip are refused, otherwise they are replaced by secure ones when the
+// bucket is full. When the table holds MaxNodes nodes, a new node only takes
+// the place of a bad one in its bucket.
 func (rt *routingTable) Insert(nd *node) bool {
 	rt.Lock()
 	defer rt.Unlock()
 
+	secure := nd.isSecure()
+
 	if rt.dht.blackList.in(nd.addr.IP.String(), nd.addr.Port) ||
-		rt.cachedNodes.Len() >= rt.dht.MaxNodes {
+		(rt.dht.SecureNodeID && !secure) {
 		return false
 	}
 
+	full := rt.cachedNodes.Len() >= rt.dht.MaxNodes
+
 	var (
 		next   *routingTableNode
 		bucket *kbucket
@@ -375,6 +457,8 @@ func (rt *routingTable) Insert(nd *node) bool {
 		if next != nil {
 			// If next is not the leaf.
 			root = next
+		} else if full && !root.KBucket().nodes.HasKey(nd.id.RawString()) {
+			return rt.replaceBad(root.KBucket(), nd)
 		} else if root.KBucket().nodes.Len() < rt.k ||
 			root.KBucket().nodes.HasKey(nd.id.RawString()) {
 
@@ -384,6 +468,10 @@ func (rt *routingTable) Insert(nd *node) bool {
 			rt.cachedNodes.Set(nd.addr.String(), nd)
 			rt.cachedKBuckets.Push(bucket.prefix.String(), bucket)
 
+			if isNew && rt.dht.events.active() {
+				rt.dht.events.publish(NodeAddedEvent{
+					ID: nd.id.RawString(), Addr: nd.addr})
+			}
 			return isNew
 		} else if root.KBucket().prefix.Compare(nd.id, prefixLen-1) == 0 {
 			// If node has the same prefix with bucket, split it.
@@ -399,9 +487,15 @@ func (rt *routingTable) Insert(nd *node) bool {
 			}
 
 			root = root.Child(nd.id.Bit(prefixLen - 1))
+		} else if secure && rt.replaceInsecure(root.KBucket(), nd) {
+			// Prefer the secure node to the insecure ones in the full bucket.
+			return true
+		} else if rt.replaceBad(root.KBucket(), nd) {
+			// Prefer the new node to the ones not responding.
+			return true
 		} else {
 			// Finally, store node as a candidate and fresh the bucket.
-			root.KBucket().candidates.PushBack(nd)
+			root.KBucket().candidates.Push(nd.id.RawString(), nd)
 			if root.KBucket().candidates.Len() > rt.k {
 				root.KBucket().candidates.Remove(
 					root.KBucket().candidates.Front())
@@ -414,6 +508,36 @@ func (rt *routingTable) Insert(nd *node) bool {
 	return false
 }
 
+// replaceInsecure replaces an insecure node in bucket with nd. It returns
+// whether the replacement happens.
+func (rt *routingTable) replaceInsecure(bucket *kbucket, nd *node) bool {
+	return rt.replaced(bucket, bucket.ReplaceInsecure(nd, rt.cachedNodes), nd)
+}
+
+// replaceBad replaces a bad node in bucket with nd. It returns whether the
+// replacement happens.
+func (rt *routingTable) replaceBad(bucket *kbucket, nd *node) bool {
+	return rt.replaced(bucket, bucket.ReplaceBad(nd, rt.cachedNodes), nd)
+}
+
+// replaced publishes the events after old in bucket is replaced by nd. It
+// returns false if old is nil, which means nothing is replaced.
+func (rt *routingTable) replaced(bucket *kbucket, old, nd *node) bool {
+	if old == nil {
+		return false
+	}
+
+	rt.cachedKBuckets.Push(bucket.prefix.String(), bucket)
+
+	if rt.dht.events.active() {
+		rt.dht.events.publish(NodeRemovedEvent{
+			ID: old.id.RawString(), Addr: old.addr})
+		rt.dht.events.publish(NodeAddedEvent{
+			ID: nd.id.RawString(), Addr: nd.addr})
+	}
+	return true
+}
+
 // GetNeighbors returns the size-length nodes closest to id.
 func (rt *routingTable) GetNeighbors(id *bitmap, size int) []*node {
 	rt.RLock()
@@ -488,6 +612,11 @@ func (rt *routingTable) Remove(id *bitmap) {
 		bucket.Replace(nd)
 		rt.cachedNodes.Delete(nd.addr.String())
 		rt.cachedKBuckets.Push(bucket.prefix.String(), bucket)
+
+		if rt.dht.events.active() {
+			rt.dht.events.publish(NodeRemovedEvent{
+				ID: nd.id.RawString(), Addr: nd.addr})
+		}
 	}
 }
 
@@ -499,6 +628,32 @@ func (rt *routingTable) RemoveByAddr(address string) {
 	}
 }
 
+// failed records a failed query to the node whose address is `ip:port`, and
+// removes the node if it's a chronic non-responder. It returns whether the
+// node should be blacklisted, which is true if it's removed or isn't in the
+// routing table.
+func (rt *routingTable) failed(address string) bool {
+	no, ok := rt.GetNodeByAddress(address)
+	if !ok {
+		return true
+	}
+
+	if !no.stats.failed() {
+		return false
+	}
+
+	rt.Remove(no.id)
+	return true
+}
+
+// invalidReply records an invalid response from the node whose address is
+// `ip:port`.
+func (rt *routingTable) invalidReply(address string) {
+	if no, ok := rt.GetNodeByAddress(address); ok {
+		no.stats.invalidReply()
+	}
+}
+
 // Fresh sends findNode to all nodes in the expired nodes.
 func (rt *routingTable) Fresh() {
 	now := time.Now()
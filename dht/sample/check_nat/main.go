@@ -179,7 +179,8 @@ func testDHTConnectivity(extIP string, extPort int) (bool, int, time.Duration) {
 	d := dht.New(config)
 
 	// 启动DHT
-	go d.Run()
+	go d.Run(context.Background())
+	defer d.Stop()
 
 	// 等待DHT准备就绪
 	log.Println("  DHT启动中，等待30秒让路由表填充...")
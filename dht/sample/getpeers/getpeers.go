@@ -1,6 +1,7 @@
 package main
 
 import (
+	"context"
 	"fmt"
 	"log"
 	"time"
@@ -31,5 +32,5 @@ func main() {
 		}
 	}()
 
-	d.Run()
+	d.Run(context.Background())
 }
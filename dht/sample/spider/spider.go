@@ -1,6 +1,7 @@
 package main
 
 import (
+	"context"
 	"encoding/hex"
 	"encoding/json"
 	"fmt"
@@ -66,7 +67,7 @@ func main() {
 			}
 		}
 	}()
-	go w.Run()
+	go w.Run(context.Background())
 
 	config := dht.NewCrawlConfig()
 	// 公告对等点时的回调
@@ -83,6 +84,12 @@ func main() {
 		log.Printf("收到get_peers请求: %s，来自 %s:%d", hexInfoHash, ip, port)
 	}
 
+	// 采样到infohash时的回调
+	config.OnSampleInfohashes = func(infoHash, ip string, port int) {
+		hexInfoHash := hex.EncodeToString([]byte(infoHash))
+		log.Printf("采样到infohash: %s，来自节点 %s:%d", hexInfoHash, ip, port)
+	}
+
 	// 对等点找到时的回调
 	config.OnGetPeersResponse = func(infoHash string, peer *dht.Peer) {
 		hexInfoHash := hex.EncodeToString([]byte(infoHash))
@@ -92,5 +99,5 @@ func main() {
 
 	d := dht.New(config)
 
-	d.Run()
+	d.Run(context.Background())
 }
@@ -1,6 +1,7 @@
 package test
 
 import (
+	"context"
 	"log"
 	"magnet-search/dht"
 	"magnet-search/hole/stun"
@@ -58,7 +59,7 @@ func verifyDHTPublicConnectivity() {
 	d := dht.New(config)
 
 	// 启动DHT (在新的goroutine中)
-	go d.Run()
+	go d.Run(context.Background())
 
 	// 等待DHT准备就绪
 	time.Sleep(30 * time.Second)
@@ -0,0 +1,106 @@
+package dht
+
+import (
+	"net"
+	"strings"
+	"time"
+)
+
+const (
+	// maxSamples is the max number of infohashes in a sample_infohashes
+	// response. See http://www.bittorrent.org/beps/bep_0051.html.
+	maxSamples = 20
+	// sampleInterval is the interval we ask others to respect when they
+	// sample us.
+	sampleInterval = time.Minute * 5
+	// maxSampleInterval caps the interval returned by remote nodes.
+	maxSampleInterval = time.Hour * 6
+	// unsupportedSampleInterval is how long we wait before sampling a node
+	// which doesn't support sample_infohashes again.
+	unsupportedSampleInterval = time.Hour
+)
+
+// samplingManager issues sample_infohashes queries and tracks when each node
+// can be sampled again according to the `interval` it returned.
+type samplingManager struct {
+	next *syncedMap
+	dht  *DHT
+}
+
+// newSamplingManager returns a new samplingManager.
+func newSamplingManager(dht *DHT) *samplingManager {
+	return &samplingManager{
+		next: newSyncedMap(),
+		dht:  dht,
+	}
+}
+
+// allow returns whether the node whose address is `address` can be sampled
+// now.
+func (sm *samplingManager) allow(address string) bool {
+	v, ok := sm.next.Get(address)
+	return !ok || !time.Now().Before(v.(time.Time))
+}
+
+// delay forbids sampling the node whose address is `address` in interval.
+func (sm *samplingManager) delay(address string, interval time.Duration) {
+	if interval > maxSampleInterval {
+		interval = maxSampleInterval
+	}
+	sm.next.Set(address, time.Now().Add(interval))
+}
+
+// sample sends sample_infohashes queries to at most size nodes in the
+// routing table whose interval is expired.
+func (sm *samplingManager) sample(size int) {
+	now := time.Now()
+
+	keys := make([]interface{}, 0, 100)
+	for item := range sm.next.Iter() {
+		if !now.Before(item.val.(time.Time)) {
+			keys = append(keys, item.key)
+		}
+	}
+	sm.next.DeleteMulti(keys)
+
+	nodes := make([]*node, 0, size)
+	for _, rt := range sm.dht.tables() {
+		for item := range rt.cachedNodes.Iter() {
+			no := item.val.(*node)
+			if len(nodes) < size && sm.allow(no.addr.String()) {
+				nodes = append(nodes, no)
+			}
+		}
+	}
+
+	for _, no := range nodes {
+		// The node may not respond, so don't sample it until the next
+		// interval. A response will overwrite it.
+		sm.delay(no.addr.String(), sampleInterval)
+		sm.dht.transactionManager.sampleInfohashes(no, randomString(20))
+	}
+}
+
+// Sample returns at most size infohashes the peersManager holds.
+func (pm *peersManager) Sample(size int) []string {
+	infoHashes := make([]string, 0, size)
+	for item := range pm.table.Iter() {
+		if len(infoHashes) < size {
+			infoHashes = append(infoHashes, item.key.(string))
+		}
+	}
+	return infoHashes
+}
+
+// makeSampleResponse returns the response data of sample_infohashes.
+func makeSampleResponse(dht *DHT, addr *net.UDPAddr, a map[string]interface{},
+	t, target string) map[string]interface{} {
+
+	r := wantedNodes(dht, addr, a, newBitmapFromString(target))
+	r["id"] = dht.id(target)
+	r["interval"] = int(sampleInterval / time.Second)
+	r["num"] = dht.peersManager.table.Len()
+	r["samples"] = strings.Join(dht.peersManager.Sample(maxSamples), "")
+
+	return makeResponse(t, r)
+}
@@ -0,0 +1,31 @@
+package dht
+
+import (
+	"testing"
+	"time"
+)
+
+func TestSamplingManagerDelay(t *testing.T) {
+	sm := newSamplingManager(nil)
+	address := "1.2.3.4:6881"
+
+	if !sm.allow(address) {
+		t.Fail()
+	}
+
+	sm.delay(address, time.Minute)
+	if sm.allow(address) {
+		t.Fail()
+	}
+
+	sm.delay(address, 0)
+	if !sm.allow(address) {
+		t.Fail()
+	}
+
+	sm.delay(address, time.Hour*24)
+	v, _ := sm.next.Get(address)
+	if v.(time.Time).After(time.Now().Add(maxSampleInterval)) {
+		t.Fail()
+	}
+}
@@ -0,0 +1,187 @@
+package dht
+
+import (
+	"context"
+	"crypto/sha1"
+	"errors"
+	"math"
+	"net"
+	"sync"
+)
+
+// The scrape extension estimates the swarm size by bloom filters.
+// See http://www.bittorrent.org/beps/bep_0033.html.
+
+const (
+	// bloomFilterSize is the size of BFsd and BFpe in bytes, m = 2048
+	bloomFilterSize = 256
+	bloomFilterBits = bloomFilterSize * 8
+)
+
+// ErrNoScrape is the error when no node returns bloom filters.
+var ErrNoScrape = errors.New("no scrape response")
+
+// bloomFilter represents the bloom filter of BFsd or BFpe with k = 2.
+type bloomFilter [bloomFilterSize]byte
+
+// newBloomFilterFromString parses BFsd or BFpe in the response.
+func newBloomFilterFromString(data string) (*bloomFilter, error) {
+	if len(data) != bloomFilterSize {
+		return nil, errors.New("invalid bloom filter")
+	}
+
+	bf := &bloomFilter{}
+	copy(bf[:], data)
+	return bf, nil
+}
+
+// Insert adds ip to the bloom filter.
+func (bf *bloomFilter) Insert(ip net.IP) {
+	if ip4 := ip.To4(); ip4 != nil {
+		ip = ip4
+	}
+
+	hash := sha1.Sum(ip)
+	for _, i := range []int{
+		int(hash[0]) | int(hash[1])<<8,
+		int(hash[2]) | int(hash[3])<<8,
+	} {
+		i %= bloomFilterBits
+		bf[i/8] |= 1 << uint(i%8)
+	}
+}
+
+// Merge adds all ips in other to the bloom filter.
+func (bf *bloomFilter) Merge(other *bloomFilter) {
+	for i := range bf {
+		bf[i] |= other[i]
+	}
+}
+
+// Estimate returns the estimated number of ips in the bloom filter.
+func (bf *bloomFilter) Estimate() int {
+	zeros := 0
+	for _, b := range bf {
+		for i := uint(0); i < 8; i++ {
+			if b&(1<<i) == 0 {
+				zeros++
+			}
+		}
+	}
+
+	if zeros == 0 {
+		zeros = 1
+	}
+
+	m := float64(bloomFilterBits)
+	return int(math.Log(float64(zeros)/m) / (2 * math.Log(1-1/m)))
+}
+
+// String returns the raw bytes of the bloom filter.
+func (bf *bloomFilter) String() string {
+	return string(bf[:])
+}
+
+// swarm holds the bloom filters of seeds and peers of an infohash.
+type swarm struct {
+	sync.Mutex
+	seeds, peers bloomFilter
+}
+
+// insert adds the peer to the bloom filters.
+func (s *swarm) insert(peer *Peer) {
+	s.Lock()
+	defer s.Unlock()
+
+	if peer.seed {
+		s.seeds.Insert(peer.IP)
+	} else {
+		s.peers.Insert(peer.IP)
+	}
+}
+
+// scrape returns BFsd and BFpe.
+func (s *swarm) scrape() (string, string) {
+	s.Lock()
+	defer s.Unlock()
+
+	return s.seeds.String(), s.peers.String()
+}
+
+// Scrape returns BFsd and BFpe of infoHash, false if no peer announces it.
+func (pm *peersManager) Scrape(infoHash string) (string, string, bool) {
+	v, ok := pm.swarms.Get(infoHash)
+	if !ok {
+		return "", "", false
+	}
+
+	seeds, peers := v.(*swarm).scrape()
+	return seeds, peers, true
+}
+
+// scrape sends get_peers query with scrape flag to the chan.
+func (tm *transactionManager) scrape(no *node, infoHash string,
+	callback func(map[string]interface{}, error)) {
+
+	tm.sendQueryWithCallback(no, getPeersType, tm.want(map[string]interface{}{
+		"id":        tm.dht.id(infoHash),
+		"info_hash": infoHash,
+		"scrape":    1,
+	}), callback)
+}
+
+// Scrape estimates the number of seeds and peers of infoHash by merging the
+// bloom filters returned by the K nodes closest to it, which are found by an
+// iterative get_peers lookup with the scrape flag. infoHash is 20-length or
+// 40-length hex string. If ctx is done before the lookup finishes, the
+// estimates are made by the closest nodes found so far.
+func (dht *DHT) Scrape(ctx context.Context, infoHash string) (
+	seeds, peers int, err error) {
+
+	if !dht.Ready() {
+		return 0, 0, ErrNotReady
+	}
+
+	infoHash, err = rawTarget(infoHash)
+	if err != nil {
+		return 0, 0, err
+	}
+
+	l := newLookup(dht, infoHash, func(no *node,
+		callback func(map[string]interface{}, error)) {
+
+		dht.transactionManager.scrape(no, infoHash, callback)
+	})
+
+	err = l.run(ctx)
+	if err == ErrNoNodes || err == ErrNotReady {
+		return 0, 0, err
+	}
+
+	var seedFilter, peerFilter bloomFilter
+	found := false
+
+	for _, ln := range l.closest() {
+		sd, _ := ln.response["BFsd"].(string)
+		pe, _ := ln.response["BFpe"].(string)
+
+		bfsd, sdErr := newBloomFilterFromString(sd)
+		bfpe, peErr := newBloomFilterFromString(pe)
+		if sdErr != nil || peErr != nil {
+			continue
+		}
+
+		seedFilter.Merge(bfsd)
+		peerFilter.Merge(bfpe)
+		found = true
+	}
+
+	switch {
+	case found:
+		return seedFilter.Estimate(), peerFilter.Estimate(), nil
+	case err != nil:
+		return 0, 0, err
+	default:
+		return 0, 0, ErrNoScrape
+	}
+}
@@ -0,0 +1,47 @@
+package dht
+
+import (
+	"net"
+	"testing"
+)
+
+func TestBloomFilterEstimate(t *testing.T) {
+	// test vector from BEP 33
+	bf := &bloomFilter{}
+	for i := 0; i < 256; i++ {
+		bf.Insert(net.IPv4(192, 0, 2, byte(i)))
+	}
+	for i := 0; i < 1000; i++ {
+		ip := net.ParseIP("2001:db8::")
+		ip[14], ip[15] = byte(i>>8), byte(i)
+		bf.Insert(ip)
+	}
+
+	if n := bf.Estimate(); n != 1224 {
+		t.Errorf("estimate %d, want 1224", n)
+	}
+}
+
+func TestPeersManagerScrape(t *testing.T) {
+	pm := newPeersManager(&DHT{Config: NewStandardConfig()})
+
+	seed := newPeer(net.ParseIP("1.2.3.4"), 6881, "")
+	seed.seed = true
+	pm.Insert("infohash", seed)
+	pm.Insert("infohash", newPeer(net.ParseIP("5.6.7.8"), 6881, ""))
+
+	seeds, peers, ok := pm.Scrape("infohash")
+	if !ok {
+		t.Fatal("scrape should be found")
+	}
+
+	bfsd, _ := newBloomFilterFromString(seeds)
+	bfpe, _ := newBloomFilterFromString(peers)
+	if bfsd.Estimate() != 1 || bfpe.Estimate() != 1 {
+		t.Fail()
+	}
+
+	if _, _, ok := pm.Scrape("unknown"); ok {
+		t.Fail()
+	}
+}
@@ -0,0 +1,69 @@
+package dht
+
+import (
+	"crypto/rand"
+	"hash/crc32"
+	"net"
+)
+
+// The DHT security extension binds node ids to their ips.
+// See http://www.bittorrent.org/beps/bep_0042.html.
+
+var (
+	castagnoliTable = crc32.MakeTable(crc32.Castagnoli)
+	ipv4Mask        = []byte{0x03, 0x0f, 0x3f, 0xff}
+	ipv6Mask        = []byte{0x01, 0x03, 0x07, 0x0f, 0x1f, 0x3f, 0x7f, 0xff}
+)
+
+// nodeIDPrefix returns crc32c((ip & mask) | (r << 5)), whose 21 most
+// significant bits are the prefix of the node id.
+func nodeIDPrefix(ip net.IP, r byte) uint32 {
+	mask := ipv4Mask
+	if ip4 := ip.To4(); ip4 != nil {
+		ip = ip4
+	} else {
+		mask = ipv6Mask
+	}
+
+	data := make([]byte, len(mask))
+	for i := range mask {
+		data[i] = ip[i] & mask[i]
+	}
+	data[0] |= (r & 0x07) << 5
+
+	return crc32.Checksum(data, castagnoliTable)
+}
+
+// genSecureNodeID returns a random node id which is valid for ip.
+func genSecureNodeID(ip net.IP) string {
+	id := make([]byte, 20)
+	rand.Read(id)
+
+	crc := nodeIDPrefix(ip, id[19])
+	id[0] = byte(crc >> 24)
+	id[1] = byte(crc >> 16)
+	id[2] = byte(crc>>8)&0xf8 | id[2]&0x07
+
+	return string(id)
+}
+
+// isSecureNodeID returns whether id is valid for ip. Ips of local networks
+// are exempted.
+func isSecureNodeID(id string, ip net.IP) bool {
+	if len(id) != 20 {
+		return false
+	}
+
+	if !isPublicIP(ip) {
+		return true
+	}
+
+	crc := nodeIDPrefix(ip, id[19])
+	return id[0] == byte(crc>>24) && id[1] == byte(crc>>16) &&
+		id[2]&0xf8 == byte(crc>>8)&0xf8
+}
+
+// isSecure returns whether the node's id is valid for its ip.
+func (node *node) isSecure() bool {
+	return isSecureNodeID(node.id.RawString(), node.addr.IP)
+}
@@ -0,0 +1,46 @@
+package dht
+
+import (
+	"encoding/hex"
+	"net"
+	"testing"
+)
+
+func TestIsSecureNodeID(t *testing.T) {
+	// test vectors from BEP 42
+	cases := []struct {
+		ip string
+		id string
+	}{
+		{"124.31.75.21", "5fbfbff10c5d6a4ec8a88e4c6ab4c28b95eee401"},
+		{"21.75.31.124", "5a3ce9c14e7a08645677bbd1cfe7d8f956d53256"},
+		{"65.23.51.170", "a5d43220bc8f112a3d426c84764f8c2a1150e616"},
+		{"84.124.73.14", "1b0321dd1bb1fe518101ceef99462b947a01ff41"},
+		{"43.213.53.83", "e56f6cbf5b7c4be0237986d5243b87aa6d51305a"},
+	}
+
+	for _, c := range cases {
+		id, _ := hex.DecodeString(c.id)
+		if !isSecureNodeID(string(id), net.ParseIP(c.ip)) {
+			t.Errorf("%s should be secure for %s", c.id, c.ip)
+		}
+	}
+
+	id, _ := hex.DecodeString(cases[0].id)
+	if isSecureNodeID(string(id), net.ParseIP(cases[1].ip)) {
+		t.Fail()
+	}
+
+	// local networks are exempted
+	if !isSecureNodeID(randomString(20), net.ParseIP("192.168.1.1")) {
+		t.Fail()
+	}
+}
+
+func TestGenSecureNodeID(t *testing.T) {
+	for _, ip := range []string{"124.31.75.21", "2001:4860:4860::8888"} {
+		if !isSecureNodeID(genSecureNodeID(net.ParseIP(ip)), net.ParseIP(ip)) {
+			t.Fail()
+		}
+	}
+}
@@ -0,0 +1,123 @@
+package dht
+
+import (
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// The state file keeps the node id and the routing table between restarts.
+// It's a bencoded dict like
+// {"id": <node id>, "nodes": <compact node info>, "nodes6": <compact node
+// info>}.
+
+// state represents the saved node id and nodes.
+type state struct {
+	id    string
+	nodes []*node
+}
+
+// loadState reads the state from file.
+func loadState(file string) (*state, error) {
+	data, err := ioutil.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+
+	v, err := Decode(data)
+	if err != nil {
+		return nil, err
+	}
+
+	d, ok := v.(map[string]interface{})
+	if !ok {
+		return nil, errors.New("invalid state file")
+	}
+
+	if err := ParseKey(d, "id", "string"); err != nil {
+		return nil, err
+	}
+
+	s := &state{id: d["id"].(string)}
+	if len(s.id) != 20 {
+		return nil, errors.New("invalid node id")
+	}
+
+	for _, key := range []string{"nodes", "nodes6"} {
+		if err := ParseKey(d, key, "string"); err != nil {
+			continue
+		}
+
+		infos := d[key].(string)
+		size := 26
+		if key == "nodes6" {
+			size = 38
+		}
+
+		for i := 0; i+size <= len(infos); i += size {
+			no, err := newNodeFromCompactInfo(infos[i:i+size], "udp")
+			if err != nil {
+				continue
+			}
+			s.nodes = append(s.nodes, no)
+		}
+	}
+
+	return s, nil
+}
+
+// saveState writes the node id and the nodes in the routing tables to
+// file. It writes a temporary file first, so the old state is kept if it
+// fails.
+func (dht *DHT) saveState() error {
+	nodes := make([]string, 0, dht.nodesLen())
+	nodes6 := make([]string, 0)
+
+	for _, rt := range dht.tables() {
+		for item := range rt.cachedNodes.Iter() {
+			no := item.val.(*node)
+			if no.addr.IP.To4() != nil {
+				nodes = append(nodes, no.CompactNodeInfo())
+			} else {
+				nodes6 = append(nodes6, no.CompactNodeInfo())
+			}
+		}
+	}
+
+	data := Encode(map[string]interface{}{
+		"id":     dht.node.id.RawString(),
+		"nodes":  strings.Join(nodes, ""),
+		"nodes6": strings.Join(nodes6, ""),
+	})
+
+	tmp, err := ioutil.TempFile(filepath.Dir(dht.StateFile), ".dht-state")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	if _, err := tmp.WriteString(data); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+
+	return os.Rename(tmp.Name(), dht.StateFile)
+}
+
+// pingSavedNodes pings the nodes loaded from the state file. They are put
+// into the routing table when they respond.
+func (dht *DHT) pingSavedNodes() {
+	for _, no := range dht.savedNodes {
+		if dht.IsDualStack() || (no.addr.IP.To4() != nil) ==
+			(dht.Network == "udp4") {
+
+			dht.transactionManager.ping(no)
+		}
+	}
+	dht.savedNodes = nil
+}
@@ -0,0 +1,41 @@
+package dht
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestSaveAndLoadState(t *testing.T) {
+	dir, err := ioutil.TempDir("", "dht")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	config := NewStandardConfig()
+	config.StateFile = filepath.Join(dir, "dht.state")
+
+	dht := New(config)
+	dht.routingTable = newRoutingTable(dht.KBucketSize, dht)
+	dht.routingTable6 = newRoutingTable(dht.KBucketSize, dht)
+
+	for _, address := range []string{"1.2.3.4:6881", "[2001:4860::1]:6881"} {
+		no, _ := newNode(randomString(20), "udp", address)
+		dht.table(no.addr.IP).Insert(no)
+	}
+
+	if err := dht.saveState(); err != nil {
+		t.Fatal(err)
+	}
+
+	st, err := loadState(config.StateFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if st.id != dht.node.id.RawString() || len(st.nodes) != 2 {
+		t.Fail()
+	}
+}
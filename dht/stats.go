@@ -0,0 +1,121 @@
+package dht
+
+import (
+	"sync"
+	"sync/atomic"
+)
+
+// Packet types other than the query types.
+const (
+	responsePacket = "response"
+	errorPacket    = "error"
+	unknownPacket  = "unknown"
+	invalidPacket  = "invalid"
+)
+
+// queryTypes are the query types counted by name, others are counted as
+// unknownPacket so that a remote node can't add arbitrary types.
+var queryTypes = map[string]struct{}{
+	pingType:             {},
+	findNodeType:         {},
+	getPeersType:         {},
+	announcePeerType:     {},
+	sampleInfohashesType: {},
+	getType:              {},
+	putType:              {},
+}
+
+// packetType returns the type of a KRPC message, which is the query type,
+// responsePacket or errorPacket.
+func packetType(data map[string]interface{}) string {
+	switch data["y"] {
+	case "q":
+		q, _ := data["q"].(string)
+		if _, ok := queryTypes[q]; ok {
+			return q
+		}
+	case "r":
+		return responsePacket
+	case "e":
+		return errorPacket
+	}
+	return unknownPacket
+}
+
+// packetStats counts the received and sent packets by type.
+type packetStats struct {
+	sync.Mutex
+	in      map[string]uint64
+	out     map[string]uint64
+	dropped uint64
+}
+
+// newPacketStats returns a packetStats pointer.
+func newPacketStats() *packetStats {
+	return &packetStats{
+		in:  make(map[string]uint64),
+		out: make(map[string]uint64),
+	}
+}
+
+// received counts a received packet of type t.
+func (ps *packetStats) received(t string) {
+	ps.Lock()
+	ps.in[t]++
+	ps.Unlock()
+}
+
+// sent counts a sent packet of type t.
+func (ps *packetStats) sent(t string) {
+	ps.Lock()
+	ps.out[t]++
+	ps.Unlock()
+}
+
+// drop counts a packet dropped before it's decoded.
+func (ps *packetStats) drop() {
+	ps.Lock()
+	ps.dropped++
+	ps.Unlock()
+}
+
+// Stats is a snapshot of the counters of a dht.
+type Stats struct {
+	// received and sent packets by type, which is the query type,
+	// "response", "error", "unknown" or "invalid" for undecodable ones
+	PacketsIn  map[string]uint64
+	PacketsOut map[string]uint64
+	// received packets dropped by the worker limit, the rate limit or the
+	// blacklist
+	PacketsDropped uint64
+	// nodes in the IPv4 and IPv6 routing tables
+	Nodes  int
+	Nodes6 int
+	// pending transactions
+	Transactions int
+}
+
+// Stats returns the current counters. It's safe to call before Run.
+func (dht *DHT) Stats() Stats {
+	ps := dht.packetStats
+	ps.Lock()
+	st := Stats{
+		PacketsIn:      make(map[string]uint64, len(ps.in)),
+		PacketsOut:     make(map[string]uint64, len(ps.out)),
+		PacketsDropped: ps.dropped,
+	}
+	for t, n := range ps.in {
+		st.PacketsIn[t] = n
+	}
+	for t, n := range ps.out {
+		st.PacketsOut[t] = n
+	}
+	ps.Unlock()
+
+	if atomic.LoadInt32(&dht.initialized) == 1 {
+		st.Nodes = dht.routingTable.Len()
+		st.Nodes6 = dht.routingTable6.Len()
+		st.Transactions = dht.transactionManager.len()
+	}
+	return st
+}
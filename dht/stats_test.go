@@ -0,0 +1,41 @@
+package dht
+
+import (
+	"testing"
+)
+
+func TestPacketType(t *testing.T) {
+	cases := []struct {
+		in  map[string]interface{}
+		out string
+	}{
+		{makeQuery("aa", pingType, nil), pingType},
+		{makeQuery("aa", "vote", nil), unknownPacket},
+		{makeResponse("aa", nil), responsePacket},
+		{makeError("aa", protocolError, "bad"), errorPacket},
+		{map[string]interface{}{"y": "x"}, unknownPacket},
+	}
+
+	for _, c := range cases {
+		if packetType(c.in) != c.out {
+			t.Fatalf("packetType(%v) != %s", c.in, c.out)
+		}
+	}
+}
+
+func TestStatsBeforeRun(t *testing.T) {
+	d := New(NewStandardConfig())
+	d.packetStats.received(pingType)
+	d.packetStats.sent(responsePacket)
+	d.packetStats.drop()
+
+	st := d.Stats()
+	if st.PacketsIn[pingType] != 1 || st.PacketsOut[responsePacket] != 1 ||
+		st.PacketsDropped != 1 || st.Nodes != 0 || st.Transactions != 0 {
+
+		t.Fail()
+	}
+	if d.NodesNum() != 0 || d.Ready() {
+		t.Error("the dht shouldn't have nodes or be ready before Run")
+	}
+}
@@ -0,0 +1,17 @@
+package dht
+
+import (
+	"net"
+	"time"
+)
+
+// Transport sends and receives KRPC packets. *net.UDPConn implements it,
+// and the dhttest package provides an in-memory one.
+type Transport interface {
+	// ReadFromUDP blocks until a packet arrives, it returns an error after
+	// the transport is closed.
+	ReadFromUDP(b []byte) (int, *net.UDPAddr, error)
+	WriteToUDP(b []byte, addr *net.UDPAddr) (int, error)
+	SetWriteDeadline(t time.Time) error
+	Close() error
+}
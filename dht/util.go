@@ -7,7 +7,6 @@ import (
 	"net"
 	"net/http"
 	"strconv"
-	"strings"
 	"time"
 )
 
@@ -50,15 +49,23 @@ func int2bytes(val uint64) []byte {
 }
 
 // decodeCompactIPPortInfo decodes compactIP-address/port info in BitTorrent
-// DHT Protocol. It returns the ip and port number.
+// DHT Protocol. It returns the ip and port number. The info is 6-length for
+// IPv4 and 18-length for IPv6.
+// See http://www.bittorrent.org/beps/bep_0032.html.
 func decodeCompactIPPortInfo(info string) (ip net.IP, port int, err error) {
-	if len(info) != 6 {
-		err = errors.New("compact info should be 6-length long")
+	switch len(info) {
+	case 6:
+		ip = net.IPv4(info[0], info[1], info[2], info[3])
+	case 18:
+		ip = make(net.IP, net.IPv6len)
+		copy(ip, info[:16])
+	default:
+		err = errors.New("compact info should be 6 or 18-length long")
 		return
 	}
 
-	ip = net.IPv4(info[0], info[1], info[2], info[3])
-	port = int((uint16(info[4]) << 8) | uint16(info[5]))
+	n := len(info)
+	port = int((uint16(info[n-2]) << 8) | uint16(info[n-1]))
 	return
 }
 
@@ -71,13 +78,20 @@ func encodeCompactIPPortInfo(ip net.IP, port int) (info string, err error) {
 		return
 	}
 
+	if ip4 := ip.To4(); ip4 != nil {
+		ip = ip4
+	} else if ip = ip.To16(); ip == nil {
+		err = errors.New("invalid ip")
+		return
+	}
+
 	p := int2bytes(uint64(port))
 	if len(p) < 2 {
 		p = append(p, p[0])
 		p[0] = 0
 	}
 
-	info = string(append(ip, p...))
+	info = string(append(append(make([]byte, 0, len(ip)+2), ip...), p...))
 	return
 }
 
@@ -128,7 +142,8 @@ func getRemoteIP() (ip string, err error) {
 	return
 }
 
-// genAddress returns a ip:port address.
+// genAddress returns a ip:port address. IPv6 ip is enclosed in square
+// brackets, e.g. [::1]:6881.
 func genAddress(ip string, port int) string {
-	return strings.Join([]string{ip, strconv.Itoa(port)}, ":")
+	return net.JoinHostPort(ip, strconv.Itoa(port))
 }
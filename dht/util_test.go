@@ -1,6 +1,7 @@
 package dht
 
 import (
+	"net"
 	"testing"
 )
 
@@ -98,3 +99,38 @@ func TestEncodeCompactIPPortInfo(t *testing.T) {
 		}
 	}
 }
+
+func TestCompactIPPortInfoIPv6(t *testing.T) {
+	ip := net.ParseIP("2001:4860:4860::8888")
+
+	info, err := encodeCompactIPPortInfo(ip, 6881)
+	if err != nil || len(info) != 18 {
+		t.Fatal(err)
+	}
+
+	out, port, err := decodeCompactIPPortInfo(info)
+	if err != nil || !out.Equal(ip) || port != 6881 {
+		t.Fail()
+	}
+
+	if info, _ := encodeCompactIPPortInfo(net.ParseIP("1.2.3.4"), 1); len(info) != 6 {
+		t.Fail()
+	}
+}
+
+func TestGenAddress(t *testing.T) {
+	cases := []struct {
+		ip   string
+		port int
+		out  string
+	}{
+		{"1.2.3.4", 6881, "1.2.3.4:6881"},
+		{"::1", 6881, "[::1]:6881"},
+	}
+
+	for _, c := range cases {
+		if genAddress(c.ip, c.port) != c.out {
+			t.Fail()
+		}
+	}
+}
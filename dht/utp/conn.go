@@ -0,0 +1,682 @@
+package utp
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"math"
+	"net"
+	"os"
+	"sync"
+	"time"
+)
+
+const (
+	// maxPayload is the max payload of a packet, which keeps the packets
+	// under the MTU of most paths.
+	maxPayload = 1200
+	// minWindow and maxWindow bound the congestion window in bytes.
+	minWindow = maxPayload
+	maxWindow = 1 << 20
+	// initialWindow is the congestion window of a new connection.
+	initialWindow = 3 * maxPayload
+	// ccontrolTarget is the queuing delay LEDBAT keeps the window at, in
+	// microseconds.
+	ccontrolTarget = 100000
+	// maxCwndIncrease is how many bytes the window grows per RTT at most.
+	maxCwndIncrease = 3000
+	// recvBufferSize is the size of the receive buffer, which is advertised
+	// as the window to the remote peer.
+	recvBufferSize = 1 << 20
+	// maxOutPackets is how many packets can be sent and not acked.
+	maxOutPackets = 512
+	// maxReorder is how far after ack_nr a packet out of order is kept.
+	maxReorder = 1024
+
+	initialRTO = time.Second
+	minRTO     = time.Millisecond * 500
+	maxRTO     = time.Second * 30
+	// synTransmissions is how many times a SYN is sent before the dial
+	// fails, and maxTransmissions is the same for the other packets.
+	synTransmissions = 3
+	maxTransmissions = 6
+	// dupAckThreshold is how many duplicate acks or packets acked after the
+	// first unacked one make it lost.
+	dupAckThreshold = 3
+	// baseDelayPeriod is how long a min delay is kept, the base delay is
+	// the min one of the last two periods.
+	baseDelayPeriod = time.Minute
+)
+
+// the connection states
+const (
+	stateSynSent = iota
+	stateConnected
+	stateClosed
+)
+
+var (
+	errReset    = errors.New("utp: connection reset by peer")
+	errTimedOut = errors.New("utp: connection timed out")
+)
+
+// outPacket is a packet sent and not acked.
+type outPacket struct {
+	packet        *packet
+	sentAt        time.Time
+	transmissions int
+	// acked is set when it's acked selectively
+	acked bool
+	// fastResent is set when it's resent before the timeout
+	fastResent bool
+}
+
+// delayHistory keeps the min delays of the last two periods, the min of
+// which is the base delay of LEDBAT.
+type delayHistory struct {
+	mins  [2]uint32
+	n     int
+	since time.Time
+}
+
+// add adds a delay sample.
+func (h *delayHistory) add(sample uint32, now time.Time) {
+	switch {
+	case h.n == 0:
+		h.mins[0], h.n, h.since = sample, 1, now
+	case now.Sub(h.since) > baseDelayPeriod:
+		h.mins[1], h.mins[0], h.n, h.since = h.mins[0], sample, 2, now
+	case int32(sample-h.mins[0]) < 0:
+		h.mins[0] = sample
+	}
+}
+
+// base returns the base delay.
+func (h *delayHistory) base() uint32 {
+	if h.n == 2 && int32(h.mins[1]-h.mins[0]) < 0 {
+		return h.mins[1]
+	}
+	return h.mins[0]
+}
+
+// Conn is a uTP connection. It implements net.Conn.
+type Conn struct {
+	socket *Socket
+	key    connKey
+	raddr  *net.UDPAddr
+	// the connection ids of the packets received and sent
+	recvID uint16
+	sendID uint16
+
+	mu    sync.Mutex
+	state int
+	// err is why the connection is closed
+	err error
+	// closed is set by Close
+	closed bool
+	// changed is closed and renewed when the state changes, which wakes
+	// the blocked calls
+	changed       chan struct{}
+	readDeadline  time.Time
+	writeDeadline time.Time
+
+	// the next sequence number to send
+	seqNr uint16
+	// the last sequence number received in order
+	ackNr uint16
+	// the packets sent and not acked, in sequence order
+	outPackets []*outPacket
+	// the bytes of the payloads sent and not acked
+	inflight    int
+	finSent     bool
+	lastAckRecv uint16
+	dupAcks     int
+
+	// the congestion window in bytes
+	window     float64
+	peerWindow int
+	rtt        time.Duration
+	rttVar     time.Duration
+	rto        time.Duration
+	lastLoss   time.Time
+	// replyMicro is the delay of the last packet received, which is sent
+	// back to the remote peer
+	replyMicro uint32
+	delays     delayHistory
+	// ourDelay is the queuing delay of the packets sent, in microseconds
+	ourDelay int64
+
+	readBuf bytes.Buffer
+	// the payloads received out of order by sequence numbers
+	reorder      map[uint16][]byte
+	reorderBytes int
+	finRecv      bool
+	finSeq       uint16
+	eof          bool
+}
+
+// newConn returns a Conn pointer.
+func newConn(s *Socket, raddr *net.UDPAddr, recvID, sendID uint16) *Conn {
+	return &Conn{
+		socket:     s,
+		key:        connKey{raddr.String(), recvID},
+		raddr:      raddr,
+		recvID:     recvID,
+		sendID:     sendID,
+		changed:    make(chan struct{}),
+		window:     initialWindow,
+		peerWindow: initialWindow,
+		rto:        initialRTO,
+		reorder:    make(map[uint16][]byte),
+	}
+}
+
+// Read reads data from the connection. It returns io.EOF after the remote
+// peer closes the connection and all data is read.
+func (c *Conn) Read(b []byte) (int, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	for {
+		switch {
+		case c.closed:
+			return 0, net.ErrClosed
+		case c.readBuf.Len() > 0:
+			full := c.recvWindow() < maxPayload
+			n, _ := c.readBuf.Read(b)
+			// tell the remote peer the window is open again
+			if full && c.state == stateConnected {
+				c.sendState()
+			}
+			return n, nil
+		case c.eof:
+			return 0, io.EOF
+		case c.state == stateClosed:
+			return 0, c.err
+		}
+
+		if err := c.wait(c.readDeadline); err != nil {
+			return 0, err
+		}
+	}
+}
+
+// Write writes data to the connection. It blocks while the congestion
+// window or the window of the remote peer is full.
+func (c *Conn) Write(b []byte) (int, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	n := 0
+	for len(b) > 0 {
+		switch {
+		case c.closed:
+			return n, net.ErrClosed
+		case c.state == stateClosed:
+			return n, c.err
+		}
+
+		size := len(b)
+		if size > maxPayload {
+			size = maxPayload
+		}
+
+		if !c.canSend(size) {
+			if err := c.wait(c.writeDeadline); err != nil {
+				return n, err
+			}
+			continue
+		}
+
+		c.send(stData, append([]byte(nil), b[:size]...))
+		n += size
+		b = b[size:]
+	}
+	return n, nil
+}
+
+// Close closes the connection. The blocked Read and Write return, and FIN
+// is sent to the remote peer if it's connected.
+func (c *Conn) Close() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.closed {
+		return net.ErrClosed
+	}
+	c.closed = true
+	c.readBuf.Reset()
+
+	if c.state == stateConnected {
+		c.finSent = true
+		c.send(stFin, nil)
+	} else {
+		c.shutdown(net.ErrClosed)
+	}
+	c.notify()
+	return nil
+}
+
+// LocalAddr returns the address of the socket.
+func (c *Conn) LocalAddr() net.Addr {
+	return c.socket.Addr()
+}
+
+// RemoteAddr returns the address of the remote peer.
+func (c *Conn) RemoteAddr() net.Addr {
+	return c.raddr
+}
+
+// SetDeadline sets the read and write deadlines.
+func (c *Conn) SetDeadline(t time.Time) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.readDeadline, c.writeDeadline = t, t
+	c.notify()
+	return nil
+}
+
+// SetReadDeadline sets the read deadline.
+func (c *Conn) SetReadDeadline(t time.Time) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.readDeadline = t
+	c.notify()
+	return nil
+}
+
+// SetWriteDeadline sets the write deadline.
+func (c *Conn) SetWriteDeadline(t time.Time) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.writeDeadline = t
+	c.notify()
+	return nil
+}
+
+// notify wakes the blocked calls. c.mu must be held.
+func (c *Conn) notify() {
+	close(c.changed)
+	c.changed = make(chan struct{})
+}
+
+// wait releases c.mu until the state changes or the deadline passes.
+func (c *Conn) wait(deadline time.Time) error {
+	changed := c.changed
+
+	var timeout <-chan time.Time
+	if !deadline.IsZero() {
+		d := time.Until(deadline)
+		if d <= 0 {
+			return os.ErrDeadlineExceeded
+		}
+		timer := time.NewTimer(d)
+		defer timer.Stop()
+		timeout = timer.C
+	}
+
+	c.mu.Unlock()
+	defer c.mu.Lock()
+
+	select {
+	case <-changed:
+		return nil
+	case <-timeout:
+		return os.ErrDeadlineExceeded
+	}
+}
+
+// shutdown closes the connection with err and removes it from the socket.
+// c.mu must be held.
+func (c *Conn) shutdown(err error) {
+	if c.state == stateClosed {
+		return
+	}
+
+	c.state = stateClosed
+	c.err = err
+	c.notify()
+	c.socket.remove(c)
+}
+
+// sendWindow returns the bytes which can be in flight.
+func (c *Conn) sendWindow() int {
+	if window := int(c.window); window < c.peerWindow {
+		return window
+	}
+	return c.peerWindow
+}
+
+// canSend returns whether a payload of size can be sent now. One packet is
+// always allowed when nothing is in flight, which probes a zero window.
+func (c *Conn) canSend(size int) bool {
+	return len(c.outPackets) < maxOutPackets &&
+		(c.inflight == 0 || c.inflight+size <= c.sendWindow())
+}
+
+// recvWindow returns the free space of the receive buffer.
+func (c *Conn) recvWindow() int {
+	if n := recvBufferSize - c.readBuf.Len() - c.reorderBytes; n > 0 {
+		return n
+	}
+	return 0
+}
+
+// selectiveAck returns the bitmask of the packets received out of order,
+// nil if there's none.
+func (c *Conn) selectiveAck() []byte {
+	var bits []uint16
+	last := uint16(0)
+	for seq := range c.reorder {
+		if i := seq - c.ackNr - 2; i < maxSackBits {
+			bits = append(bits, i)
+			if i > last {
+				last = i
+			}
+		}
+	}
+	if len(bits) == 0 {
+		return nil
+	}
+
+	sack := make([]byte, (last/32+1)*4)
+	for _, i := range bits {
+		sack[i/8] |= 1 << (i % 8)
+	}
+	return sack
+}
+
+// stamp fills the fields of p which change on each transmission.
+func (c *Conn) stamp(p *packet) {
+	p.timestamp = timestamp()
+	p.timestampDiff = c.replyMicro
+	p.wndSize = uint32(c.recvWindow())
+	if p.typ != stSyn {
+		p.ackNr = c.ackNr
+	}
+}
+
+// send sends a packet which takes a sequence number and must be acked.
+func (c *Conn) send(typ byte, payload []byte) {
+	p := &packet{typ: typ, connID: c.sendID, seqNr: c.seqNr, payload: payload}
+	if typ == stSyn {
+		p.connID = c.recvID
+	}
+	c.seqNr++
+
+	op := &outPacket{packet: p}
+	c.outPackets = append(c.outPackets, op)
+	c.inflight += len(payload)
+	c.transmit(op, time.Now())
+}
+
+// transmit sends or resends op.
+func (c *Conn) transmit(op *outPacket, now time.Time) {
+	c.stamp(op.packet)
+	op.sentAt = now
+	op.transmissions++
+	c.socket.write(op.packet.marshal(), c.raddr)
+}
+
+// sendState acks the packets received.
+func (c *Conn) sendState() {
+	p := &packet{
+		typ:    stState,
+		connID: c.sendID,
+		seqNr:  c.seqNr,
+		sack:   c.selectiveAck(),
+	}
+	c.stamp(p)
+	c.socket.write(p.marshal(), c.raddr)
+}
+
+// receive handles a packet of the connection.
+func (c *Conn) receive(p *packet) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.state == stateClosed {
+		return
+	}
+	if p.typ == stReset {
+		c.shutdown(errReset)
+		return
+	}
+
+	now := time.Now()
+	c.replyMicro = timestamp() - p.timestamp
+	c.peerWindow = int(p.wndSize)
+	if p.timestampDiff != 0 {
+		c.delays.add(p.timestampDiff, now)
+		c.ourDelay = int64(int32(p.timestampDiff - c.delays.base()))
+	}
+
+	switch {
+	case p.typ == stSyn:
+		// the STATE answering the SYN is lost
+		c.sendState()
+		return
+	case c.state == stateSynSent:
+		if p.ackNr != c.seqNr-1 {
+			return
+		}
+		// the first packet of the remote peer takes the sequence number
+		// of its STATE answering the SYN
+		c.ackNr = p.seqNr - 1
+		c.state = stateConnected
+	}
+
+	c.ack(p, now)
+	if p.typ == stData || p.typ == stFin {
+		c.receiveData(p)
+	}
+	c.notify()
+}
+
+// ack handles the acks in p.
+func (c *Conn) ack(p *packet, now time.Time) {
+	acked := 0
+	ackPacket := func(op *outPacket) {
+		if op.acked {
+			return
+		}
+		op.acked = true
+		c.inflight -= len(op.packet.payload)
+		acked += len(op.packet.payload)
+		// the RTT of the resent packets is ambiguous
+		if op.transmissions == 1 {
+			c.updateRTT(now.Sub(op.sentAt))
+		}
+	}
+
+	for len(c.outPackets) > 0 && !seqLess(p.ackNr, c.outPackets[0].packet.seqNr) {
+		ackPacket(c.outPackets[0])
+		c.outPackets[0] = nil
+		c.outPackets = c.outPackets[1:]
+	}
+
+	for _, op := range c.outPackets {
+		i := op.packet.seqNr - p.ackNr - 2
+		if int(i) < len(p.sack)*8 && p.sack[i/8]&(1<<(i%8)) != 0 {
+			ackPacket(op)
+		}
+	}
+
+	if acked > 0 {
+		c.grow(acked)
+		c.dupAcks = 0
+	} else if p.typ == stState && p.ackNr == c.lastAckRecv && len(c.outPackets) > 0 {
+		c.dupAcks++
+	}
+	c.lastAckRecv = p.ackNr
+
+	c.resendLost(now)
+
+	if c.finSent && len(c.outPackets) == 0 {
+		c.shutdown(net.ErrClosed)
+	}
+}
+
+// resendLost resends the packets which are lost, that is, dupAckThreshold
+// packets after them are acked, or the first one is acked dupAckThreshold
+// times. Each packet is resent once until it times out.
+func (c *Conn) resendLost(now time.Time) {
+	var lost []*outPacket
+	later := 0
+	for i := len(c.outPackets) - 1; i >= 0; i-- {
+		op := c.outPackets[i]
+		switch {
+		case op.acked:
+			later++
+		case later >= dupAckThreshold ||
+			i == 0 && c.dupAcks >= dupAckThreshold:
+			if !op.fastResent {
+				lost = append(lost, op)
+			}
+		}
+	}
+
+	if len(lost) > 0 {
+		c.onLoss(now)
+	}
+	for i := len(lost) - 1; i >= 0; i-- {
+		lost[i].fastResent = true
+		c.transmit(lost[i], now)
+	}
+}
+
+// updateRTT updates the RTT and the timeout with a sample, see BEP 29.
+func (c *Conn) updateRTT(sample time.Duration) {
+	if c.rtt == 0 {
+		c.rtt, c.rttVar = sample, sample/2
+	} else {
+		delta := c.rtt - sample
+		if delta < 0 {
+			delta = -delta
+		}
+		c.rttVar += (delta - c.rttVar) / 4
+		c.rtt += (sample - c.rtt) / 8
+	}
+
+	c.rto = c.rtt + c.rttVar*4
+	if c.rto < minRTO {
+		c.rto = minRTO
+	}
+}
+
+// grow adjusts the congestion window by LEDBAT after acked bytes are
+// acked. It grows when the queuing delay is under ccontrolTarget, and
+// shrinks when it's over.
+func (c *Conn) grow(acked int) {
+	offTarget := float64(ccontrolTarget-c.ourDelay) / ccontrolTarget
+	windowFactor := math.Min(float64(acked), c.window) /
+		math.Max(c.window, float64(acked))
+
+	c.window += maxCwndIncrease * offTarget * windowFactor
+	c.window = math.Max(minWindow, math.Min(maxWindow, c.window))
+}
+
+// onLoss halves the congestion window, at most once per RTT.
+func (c *Conn) onLoss(now time.Time) {
+	if now.Sub(c.lastLoss) < c.rtt {
+		return
+	}
+	c.lastLoss = now
+	c.window = math.Max(minWindow, c.window/2)
+}
+
+// receiveData handles a DATA or FIN packet, and acks it.
+func (c *Conn) receiveData(p *packet) {
+	defer c.sendState()
+
+	if p.typ == stFin && !c.finRecv {
+		c.finRecv, c.finSeq = true, p.seqNr
+	}
+
+	switch {
+	case !seqLess(c.ackNr, p.seqNr) ||
+		c.finRecv && seqLess(c.finSeq, p.seqNr):
+		// duplicate, or after FIN
+		return
+	case p.seqNr != c.ackNr+1:
+		if _, ok := c.reorder[p.seqNr]; ok || p.seqNr-c.ackNr > maxReorder ||
+			c.recvWindow() < len(p.payload) {
+			return
+		}
+		c.reorder[p.seqNr] = p.payload
+		c.reorderBytes += len(p.payload)
+		return
+	case c.recvWindow() < len(p.payload):
+		// it will be resent when the window is open
+		return
+	}
+
+	c.deliver(p.payload)
+	c.ackNr = p.seqNr
+	for {
+		payload, ok := c.reorder[c.ackNr+1]
+		if !ok {
+			break
+		}
+		delete(c.reorder, c.ackNr+1)
+		c.reorderBytes -= len(payload)
+		c.deliver(payload)
+		c.ackNr++
+	}
+
+	if c.finRecv && c.ackNr == c.finSeq {
+		c.eof = true
+	}
+}
+
+// deliver appends payload to the read buffer, unless it's closed.
+func (c *Conn) deliver(payload []byte) {
+	if !c.closed {
+		c.readBuf.Write(payload)
+	}
+}
+
+// tick resends the first packet not acked when it times out, and closes
+// the connection after too many transmissions.
+func (c *Conn) tick(now time.Time) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.state == stateClosed {
+		return
+	}
+
+	for _, op := range c.outPackets {
+		if op.acked {
+			continue
+		}
+		if now.Sub(op.sentAt) < c.rto {
+			return
+		}
+
+		limit := maxTransmissions
+		if op.packet.typ == stSyn {
+			limit = synTransmissions
+		}
+		if op.transmissions >= limit {
+			c.shutdown(errTimedOut)
+			return
+		}
+
+		c.rto *= 2
+		if c.rto > maxRTO {
+			c.rto = maxRTO
+		}
+		c.window = minWindow
+		c.transmit(op, now)
+
+		// the packets resent may be lost again
+		for _, op := range c.outPackets {
+			op.fastResent = false
+		}
+		return
+	}
+}
@@ -0,0 +1,125 @@
+package utp
+
+import (
+	"encoding/binary"
+	"errors"
+	"time"
+)
+
+// the packet types, see BEP 29
+const (
+	stData = iota
+	stFin
+	stState
+	stReset
+	stSyn
+)
+
+const (
+	// version is the uTP version in the packet header.
+	version = 1
+	// headerSize is the size of the packet header without extensions.
+	headerSize = 20
+	// extSelectiveAck is the extension type of selective acks.
+	extSelectiveAck = 1
+	// maxSackBits is how many packets after ack_nr a selective ack covers.
+	maxSackBits = 256
+)
+
+var errInvalidPacket = errors.New("utp: invalid packet")
+
+// packet is a uTP packet.
+type packet struct {
+	typ    byte
+	connID uint16
+	// timestamp is when the packet is sent in microseconds
+	timestamp uint32
+	// timestampDiff is the delay of the last packet received from the
+	// remote peer, in microseconds
+	timestampDiff uint32
+	// wndSize is the free space of the receive buffer in bytes
+	wndSize uint32
+	seqNr   uint16
+	ackNr   uint16
+	// sack is the bitmask of the selective ack extension, nil if absent.
+	// The least significant bit of the first byte is ackNr + 2
+	sack    []byte
+	payload []byte
+}
+
+// marshal returns the encoded packet.
+func (p *packet) marshal() []byte {
+	size := headerSize + len(p.payload)
+	if p.sack != nil {
+		size += 2 + len(p.sack)
+	}
+
+	b := make([]byte, headerSize, size)
+	b[0] = p.typ<<4 | version
+	if p.sack != nil {
+		b[1] = extSelectiveAck
+	}
+	binary.BigEndian.PutUint16(b[2:], p.connID)
+	binary.BigEndian.PutUint32(b[4:], p.timestamp)
+	binary.BigEndian.PutUint32(b[8:], p.timestampDiff)
+	binary.BigEndian.PutUint32(b[12:], p.wndSize)
+	binary.BigEndian.PutUint16(b[16:], p.seqNr)
+	binary.BigEndian.PutUint16(b[18:], p.ackNr)
+
+	if p.sack != nil {
+		b = append(b, 0, byte(len(p.sack)))
+		b = append(b, p.sack...)
+	}
+	return append(b, p.payload...)
+}
+
+// unmarshal decodes a packet from b. The packet refers to b.
+func unmarshal(b []byte) (*packet, error) {
+	if len(b) < headerSize || b[0]&0xf != version || b[0]>>4 > stSyn {
+		return nil, errInvalidPacket
+	}
+
+	p := &packet{
+		typ:           b[0] >> 4,
+		connID:        binary.BigEndian.Uint16(b[2:]),
+		timestamp:     binary.BigEndian.Uint32(b[4:]),
+		timestampDiff: binary.BigEndian.Uint32(b[8:]),
+		wndSize:       binary.BigEndian.Uint32(b[12:]),
+		seqNr:         binary.BigEndian.Uint16(b[16:]),
+		ackNr:         binary.BigEndian.Uint16(b[18:]),
+	}
+
+	// skip the unknown extensions
+	ext, b := b[1], b[headerSize:]
+	for ext != 0 {
+		if len(b) < 2 || len(b) < 2+int(b[1]) {
+			return nil, errInvalidPacket
+		}
+
+		next, data := b[0], b[2:2+int(b[1])]
+		if ext == extSelectiveAck {
+			if len(data) == 0 || len(data)%4 != 0 {
+				return nil, errInvalidPacket
+			}
+			p.sack = data
+		}
+		ext, b = next, b[2+len(data):]
+	}
+
+	p.payload = b
+	return p, nil
+}
+
+// epoch is the base of the timestamps.
+var epoch = time.Now()
+
+// timestamp returns the current time in microseconds, which wraps around.
+func timestamp() uint32 {
+	return uint32(time.Since(epoch) / time.Microsecond)
+}
+
+// seqLess returns whether a is before b, taking the wrap around into
+// account.
+func seqLess(a, b uint16) bool {
+	return int16(a-b) < 0
+}
@@ -0,0 +1,345 @@
+// Package utp implements the Micro Transport Protocol (BEP 29), the
+// BitTorrent transport over UDP with LEDBAT congestion control, which lets
+// peers behind NAT accept connections that TCP can't reach.
+//
+// A Socket runs many connections over one UDP socket, it dials to the
+// remote peers and accepts their connections like a net.Listener. Conn
+// implements net.Conn.
+package utp
+
+import (
+	"errors"
+	"math/rand"
+	"net"
+	"sync"
+	"time"
+)
+
+const (
+	// tickInterval is how often the timeouts of the connections are checked.
+	tickInterval = time.Millisecond * 50
+	// backlogSize is how many connections wait to be accepted.
+	backlogSize = 64
+)
+
+// connKey identifies a connection by the remote address and the id of the
+// packets it receives.
+type connKey struct {
+	addr string
+	id   uint16
+}
+
+// Socket runs uTP connections over a UDP socket. It implements
+// net.Listener. The incoming connections are reset unless it's opened by
+// Listen or Accept is called.
+type Socket struct {
+	conn net.PacketConn
+
+	mu        sync.Mutex
+	conns     map[connKey]*Conn
+	accepting bool
+	backlog   chan *Conn
+
+	closed    chan struct{}
+	closeOnce sync.Once
+}
+
+// Listen opens a Socket on the UDP address, which accepts the incoming
+// connections from now on. network is udp, udp4 or udp6.
+func Listen(network, address string) (*Socket, error) {
+	addr, err := net.ResolveUDPAddr(network, address)
+	if err != nil {
+		return nil, err
+	}
+
+	conn, err := net.ListenUDP(network, addr)
+	if err != nil {
+		return nil, err
+	}
+	return newSocket(conn, true), nil
+}
+
+// NewSocket returns a Socket which runs over conn. It only dials until
+// Accept is called. Nothing else should read conn, and it's closed with
+// the Socket.
+func NewSocket(conn net.PacketConn) *Socket {
+	return newSocket(conn, false)
+}
+
+func newSocket(conn net.PacketConn, accepting bool) *Socket {
+	s := &Socket{
+		conn:      conn,
+		conns:     make(map[connKey]*Conn),
+		accepting: accepting,
+		backlog:   make(chan *Conn, backlogSize),
+		closed:    make(chan struct{}),
+	}
+
+	go s.listen()
+	go s.tick()
+	return s
+}
+
+// Addr returns the local address.
+func (s *Socket) Addr() net.Addr {
+	return s.conn.LocalAddr()
+}
+
+// Accept waits for the next incoming connection.
+func (s *Socket) Accept() (net.Conn, error) {
+	s.mu.Lock()
+	s.accepting = true
+	s.mu.Unlock()
+
+	select {
+	case c := <-s.backlog:
+		return c, nil
+	case <-s.closed:
+		return nil, net.ErrClosed
+	}
+}
+
+// DialTimeout connects to the uTP peer at address. It fails if the peer
+// doesn't answer in timeout, or in about 7 seconds when the SYN is resent
+// for the last time.
+func (s *Socket) DialTimeout(address string, timeout time.Duration) (*Conn, error) {
+	raddr, err := net.ResolveUDPAddr("udp", address)
+	if err != nil {
+		return nil, err
+	}
+
+	opError := func(err error) error {
+		return &net.OpError{Op: "dial", Net: "utp", Addr: raddr, Err: err}
+	}
+
+	c, err := s.newConn(raddr)
+	if err != nil {
+		return nil, opError(err)
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.seqNr = 1
+	c.send(stSyn, nil)
+
+	var deadline time.Time
+	if timeout > 0 {
+		deadline = time.Now().Add(timeout)
+	}
+	for c.state == stateSynSent {
+		if err := c.wait(deadline); err != nil {
+			c.shutdown(err)
+			return nil, opError(err)
+		}
+	}
+
+	if c.state == stateClosed {
+		return nil, opError(c.err)
+	}
+	return c, nil
+}
+
+// newConn registers an outgoing connection with a free id.
+func (s *Socket) newConn(raddr *net.UDPAddr) (*Conn, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	select {
+	case <-s.closed:
+		return nil, net.ErrClosed
+	default:
+	}
+
+	for i := 0; i < 16; i++ {
+		id := uint16(rand.Intn(1 << 16))
+		c := newConn(s, raddr, id, id+1)
+		if _, ok := s.conns[c.key]; !ok {
+			s.conns[c.key] = c
+			return c, nil
+		}
+	}
+	return nil, errors.New("utp: too many connections")
+}
+
+// Close closes the socket and all of its connections.
+func (s *Socket) Close() error {
+	err := net.ErrClosed
+	s.closeOnce.Do(func() {
+		close(s.closed)
+		err = s.conn.Close()
+
+		s.mu.Lock()
+		conns := make([]*Conn, 0, len(s.conns))
+		for _, c := range s.conns {
+			conns = append(conns, c)
+		}
+		s.mu.Unlock()
+
+		for _, c := range conns {
+			c.mu.Lock()
+			c.shutdown(net.ErrClosed)
+			c.mu.Unlock()
+		}
+	})
+	return err
+}
+
+// remove removes c after it's closed.
+func (s *Socket) remove(c *Conn) {
+	s.mu.Lock()
+	if s.conns[c.key] == c {
+		delete(s.conns, c.key)
+	}
+	s.mu.Unlock()
+}
+
+// write sends a packet to addr.
+func (s *Socket) write(b []byte, addr *net.UDPAddr) {
+	s.conn.WriteTo(b, addr)
+}
+
+// listen receives the packets and hands them to the connections.
+func (s *Socket) listen() {
+	buff := make([]byte, 65536)
+	for {
+		select {
+		case <-s.closed:
+			return
+		default:
+		}
+
+		n, addr, err := s.conn.ReadFrom(buff)
+		if errors.Is(err, net.ErrClosed) {
+			s.Close()
+			return
+		}
+		if err != nil {
+			continue
+		}
+		raddr, ok := addr.(*net.UDPAddr)
+		if !ok {
+			continue
+		}
+
+		// the packets are kept by the connections, so buff can't be shared
+		p, err := unmarshal(append([]byte(nil), buff[:n]...))
+		if err != nil {
+			continue
+		}
+		s.dispatch(p, raddr)
+	}
+}
+
+// dispatch hands p to its connection. A SYN makes a new connection if
+// Accept is called, and the packets of unknown connections are reset.
+func (s *Socket) dispatch(p *packet, raddr *net.UDPAddr) {
+	addr := raddr.String()
+
+	s.mu.Lock()
+	c := s.conns[connKey{addr, p.connID}]
+
+	switch {
+	case c != nil:
+	case p.typ == stSyn:
+		// a duplicate SYN goes to the connection it made
+		if c = s.conns[connKey{addr, p.connID + 1}]; c != nil {
+			break
+		}
+		if !s.accepting {
+			s.mu.Unlock()
+			s.reset(p, raddr)
+			return
+		}
+
+		c = s.accept(p, raddr)
+		s.mu.Unlock()
+		if c == nil {
+			s.reset(p, raddr)
+			return
+		}
+
+		c.mu.Lock()
+		c.sendState()
+		c.mu.Unlock()
+		return
+	case p.typ == stReset:
+		// the id may be the one the connection sends with, see libutp
+		for _, id := range []uint16{p.connID + 1, p.connID - 1} {
+			if c = s.conns[connKey{addr, id}]; c != nil && c.sendID == p.connID {
+				break
+			}
+			c = nil
+		}
+		if c == nil {
+			s.mu.Unlock()
+			return
+		}
+	default:
+		s.mu.Unlock()
+		s.reset(p, raddr)
+		return
+	}
+	s.mu.Unlock()
+
+	c.receive(p)
+}
+
+// accept makes the incoming connection of the SYN p, nil if the backlog is
+// full. s.mu must be held.
+func (s *Socket) accept(p *packet, raddr *net.UDPAddr) *Conn {
+	c := newConn(s, raddr, p.connID+1, p.connID)
+	c.state = stateConnected
+	c.seqNr = uint16(rand.Intn(1 << 16))
+	c.ackNr = p.seqNr
+	c.peerWindow = int(p.wndSize)
+	c.replyMicro = timestamp() - p.timestamp
+
+	select {
+	case s.backlog <- c:
+		s.conns[c.key] = c
+		return c
+	default:
+		return nil
+	}
+}
+
+// reset tells the sender of p that its connection doesn't exist.
+func (s *Socket) reset(p *packet, raddr *net.UDPAddr) {
+	if p.typ == stReset {
+		return
+	}
+
+	r := &packet{
+		typ:       stReset,
+		connID:    p.connID,
+		timestamp: timestamp(),
+		seqNr:     uint16(rand.Intn(1 << 16)),
+		ackNr:     p.seqNr,
+	}
+	s.write(r.marshal(), raddr)
+}
+
+// tick checks the timeouts of the connections periodically.
+func (s *Socket) tick() {
+	ticker := time.NewTicker(tickInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-s.closed:
+			return
+		case now := <-ticker.C:
+			s.mu.Lock()
+			conns := make([]*Conn, 0, len(s.conns))
+			for _, c := range s.conns {
+				conns = append(conns, c)
+			}
+			s.mu.Unlock()
+
+			for _, c := range conns {
+				c.tick(now)
+			}
+		}
+	}
+}
@@ -0,0 +1,259 @@
+package utp
+
+import (
+	"bytes"
+	"crypto/rand"
+	"errors"
+	"io"
+	"net"
+	"os"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestPacketMarshal(t *testing.T) {
+	p := &packet{
+		typ:           stState,
+		connID:        1234,
+		timestamp:     1,
+		timestampDiff: 2,
+		wndSize:       3,
+		seqNr:         65535,
+		ackNr:         5,
+		sack:          []byte{1, 0, 0, 128},
+		payload:       []byte("payload"),
+	}
+
+	q, err := unmarshal(p.marshal())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if q.typ != p.typ || q.connID != p.connID || q.timestamp != p.timestamp ||
+		q.timestampDiff != p.timestampDiff || q.wndSize != p.wndSize ||
+		q.seqNr != p.seqNr || q.ackNr != p.ackNr ||
+		!bytes.Equal(q.sack, p.sack) || !bytes.Equal(q.payload, p.payload) {
+
+		t.Errorf("unmarshal = %+v, want %+v", q, p)
+	}
+
+	// an unknown extension is skipped
+	b := (&packet{typ: stData, payload: []byte("x")}).marshal()
+	b = append(b[:headerSize:headerSize], append([]byte{0, 2, 9, 9}, b[headerSize:]...)...)
+	b[1] = 2
+	if q, err := unmarshal(b); err != nil || string(q.payload) != "x" || q.sack != nil {
+		t.Errorf("unmarshal = %+v, %v", q, err)
+	}
+
+	for _, b := range [][]byte{
+		make([]byte, headerSize-1),
+		append([]byte{stData<<4 | 2}, make([]byte, headerSize-1)...),
+		append([]byte{5<<4 | version}, make([]byte, headerSize-1)...),
+		append([]byte{stData<<4 | version, extSelectiveAck}, make([]byte, headerSize-2)...),
+		append(append([]byte{stData<<4 | version, extSelectiveAck},
+			make([]byte, headerSize-2)...), 0, 3, 1, 2, 3),
+	} {
+		if _, err := unmarshal(b); err == nil {
+			t.Errorf("unmarshal(%v) should fail", b)
+		}
+	}
+}
+
+func TestSeqLess(t *testing.T) {
+	if !seqLess(1, 2) || seqLess(2, 1) || seqLess(1, 1) ||
+		!seqLess(65535, 0) || seqLess(0, 65535) {
+
+		t.Error("wrong order")
+	}
+}
+
+func TestSelectiveAck(t *testing.T) {
+	c := newConn(nil, &net.UDPAddr{}, 0, 1)
+	c.ackNr = 65534
+	// the bits start at ackNr + 2 which wraps around to 0
+	c.reorder[0] = nil
+	c.reorder[42] = nil
+	c.reorder[maxSackBits] = nil
+
+	sack := c.selectiveAck()
+	want := make([]byte, 8)
+	want[0], want[5] = 1, 1<<2
+	if !bytes.Equal(sack, want) {
+		t.Errorf("selectiveAck = %v, want %v", sack, want)
+	}
+}
+
+// lossyConn drops every nth packet it sends.
+type lossyConn struct {
+	net.PacketConn
+	n int
+
+	mu    sync.Mutex
+	count int
+}
+
+func (c *lossyConn) WriteTo(b []byte, addr net.Addr) (int, error) {
+	c.mu.Lock()
+	c.count++
+	drop := c.count%c.n == 0
+	c.mu.Unlock()
+
+	if drop {
+		return len(b), nil
+	}
+	return c.PacketConn.WriteTo(b, addr)
+}
+
+// newPair returns a connected pair of Conns, whose sockets drop every nth
+// packet if n > 0.
+func newPair(t *testing.T, n int) (dialed *Conn, accepted net.Conn) {
+	socket := func() *Socket {
+		conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if n > 0 {
+			conn = &lossyConn{PacketConn: conn, n: n}
+		}
+		s := newSocket(conn, true)
+		t.Cleanup(func() { s.Close() })
+		return s
+	}
+
+	l, d := socket(), socket()
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		accepted, _ = l.Accept()
+	}()
+
+	dialed, err := d.DialTimeout(l.Addr().String(), time.Second*10)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	<-done
+	if accepted == nil {
+		t.Fatal("no connection accepted")
+	}
+	return
+}
+
+// echo copies the data read from conn back to it until EOF, then closes it.
+func echo(conn net.Conn) {
+	io.Copy(conn, conn)
+	conn.Close()
+}
+
+// testTransfer sends data through an echo connection and checks it's
+// received back in order.
+func testTransfer(t *testing.T, n, size int) {
+	dialed, accepted := newPair(t, n)
+	go echo(accepted)
+
+	data := make([]byte, size)
+	rand.Read(data)
+
+	go func() {
+		dialed.Write(data)
+	}()
+
+	dialed.SetReadDeadline(time.Now().Add(time.Second * 20))
+	got := make([]byte, size)
+	if _, err := io.ReadFull(dialed, got); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, data) {
+		t.Fatal("wrong data")
+	}
+
+	if err := dialed.Close(); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestTransfer(t *testing.T) {
+	testTransfer(t, 0, 1<<20)
+}
+
+func TestTransferLossy(t *testing.T) {
+	testTransfer(t, 10, 1<<17)
+}
+
+func TestFin(t *testing.T) {
+	dialed, accepted := newPair(t, 0)
+
+	accepted.Write([]byte("hello"))
+	accepted.Close()
+
+	dialed.SetReadDeadline(time.Now().Add(time.Second * 5))
+	data, err := io.ReadAll(dialed)
+	if err != nil || string(data) != "hello" {
+		t.Errorf("ReadAll = %q, %v", data, err)
+	}
+	if _, err := accepted.Write([]byte("x")); !errors.Is(err, net.ErrClosed) {
+		t.Errorf("Write after Close = %v", err)
+	}
+}
+
+func TestDeadline(t *testing.T) {
+	dialed, _ := newPair(t, 0)
+
+	dialed.SetReadDeadline(time.Now().Add(time.Millisecond * 50))
+	if _, err := dialed.Read(make([]byte, 1)); !errors.Is(err, os.ErrDeadlineExceeded) {
+		t.Errorf("Read = %v, want timeout", err)
+	}
+
+	// Close unblocks Read
+	dialed.SetReadDeadline(time.Time{})
+	go func() {
+		time.Sleep(time.Millisecond * 50)
+		dialed.Close()
+	}()
+	if _, err := dialed.Read(make([]byte, 1)); !errors.Is(err, net.ErrClosed) {
+		t.Errorf("Read = %v, want net.ErrClosed", err)
+	}
+}
+
+func TestDialReset(t *testing.T) {
+	// l doesn't accept connections
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	l := NewSocket(conn)
+	defer l.Close()
+
+	d, err := Listen("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer d.Close()
+
+	start := time.Now()
+	if _, err := d.DialTimeout(l.Addr().String(), time.Second*5); !errors.Is(err, errReset) {
+		t.Errorf("DialTimeout = %v, want reset", err)
+	}
+	if time.Since(start) > time.Second {
+		t.Error("reset too late")
+	}
+
+	// nothing answers on the closed socket
+	l.Close()
+	_, err = d.DialTimeout(l.Addr().String(), time.Millisecond*200)
+	if ne, ok := err.(net.Error); !ok || !ne.Timeout() {
+		t.Errorf("DialTimeout = %v, want timeout", err)
+	}
+}
+
+func TestSocketClose(t *testing.T) {
+	dialed, _ := newPair(t, 0)
+
+	dialed.socket.Close()
+	if _, err := dialed.Read(make([]byte, 1)); !errors.Is(err, net.ErrClosed) {
+		t.Errorf("Read = %v, want net.ErrClosed", err)
+	}
+	if _, err := dialed.socket.DialTimeout("127.0.0.1:1", time.Second); err == nil {
+		t.Error("DialTimeout should fail after Close")
+	}
+}
@@ -0,0 +1,418 @@
+package dht
+
+import (
+	"bytes"
+	"crypto/sha1"
+	"errors"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	// wireMaxAttempts is how many announced peers a task tries at most for an
+	// infohash, the peers told by ut_pex have their own pexTaskMaxAttempts.
+	wireMaxAttempts = 8
+	// wireMaxParallel is how many peers a task fetches from at the same time.
+	wireMaxParallel = 3
+	// wireSlowAfter is how long a task waits for the next piece before it
+	// fetches from another peer in parallel.
+	wireSlowAfter = time.Second * 5
+	// wireRetryBackoff is how long a task waits before it tries another peer
+	// after a failure. It doubles on each failure up to wireMaxRetryBackoff.
+	wireRetryBackoff    = time.Millisecond * 500
+	wireMaxRetryBackoff = time.Second * 8
+	// wireTaskIdleTimeout is how long a task waits for new peers when all of
+	// its peers have failed.
+	wireTaskIdleTimeout = time.Minute
+	// wirePieceBatch is how many pieces are requested from a peer at a time.
+	wirePieceBatch = 4
+)
+
+var errMetadataMismatch = errors.New("metadata doesn't match the infohash")
+
+// metadataTask fetches the metadata of an infohash from the peers which
+// announce it. The pieces are shared by the peers, so that they can be
+// fetched from several peers in parallel.
+type metadataTask struct {
+	sync.Mutex
+	infoHash []byte
+	// the announced peers and the ones told by ut_pex not tried yet
+	candidates    []Request
+	pexCandidates []Request
+	// how many of them are tried
+	attempts    int
+	pexAttempts int
+	// the addresses of the peers added
+	seen map[string]struct{}
+	// the addresses of the peers in the swarm, which are added and not
+	// dropped by ut_pex
+	swarm map[string]struct{}
+	// how many peers are added by ut_pex
+	pexPeers int
+	// closed is set when the task stops accepting peers
+	closed bool
+	// wake is signaled when a peer is added
+	wake chan struct{}
+	// finished is closed when the metadata is fetched
+	finished chan struct{}
+
+	metadataSize int
+	pieces       [][]byte
+	// how many peers are requested for each piece
+	requested    []int
+	received     int
+	lastProgress time.Time
+}
+
+// newMetadataTask returns a metadataTask pointer.
+func newMetadataTask(infoHash []byte) *metadataTask {
+	return &metadataTask{
+		infoHash:     infoHash,
+		seen:         make(map[string]struct{}),
+		swarm:        make(map[string]struct{}),
+		wake:         make(chan struct{}, 1),
+		finished:     make(chan struct{}),
+		lastProgress: time.Now(),
+	}
+}
+
+// addPeer adds r as a candidate peer if it's new. It returns false if the
+// task is closed and a new task should be made.
+func (task *metadataTask) addPeer(r Request) bool {
+	task.Lock()
+	defer task.Unlock()
+
+	if task.closed {
+		return false
+	}
+
+	task.add(r, &task.candidates)
+	return true
+}
+
+// add adds r to candidates if it's new, and returns whether it's added.
+// task must be locked.
+func (task *metadataTask) add(r Request, candidates *[]Request) bool {
+	address := genAddress(r.IP, r.Port)
+	task.swarm[address] = struct{}{}
+	if _, ok := task.seen[address]; ok {
+		return false
+	}
+	task.seen[address] = struct{}{}
+	*candidates = append(*candidates, r)
+
+	select {
+	case task.wake <- struct{}{}:
+	default:
+	}
+	return true
+}
+
+// addPex updates the swarm by a ut_pex message, and adds the new peers in
+// added as candidates until pexTaskMaxPeers are added. It returns how many
+// peers are added.
+//
+// The peers told by ut_pex don't use up the attempts of the announced peers,
+// at most pexTaskMaxAttempts of them are tried after the announced ones. More
+// candidates than the attempts are kept, as many peers in a swarm can't be
+// connected, and the swarm counts all of them.
+func (task *metadataTask) addPex(added, dropped []Request) (n int) {
+	task.Lock()
+	defer task.Unlock()
+
+	if task.closed {
+		return 0
+	}
+
+	for _, r := range dropped {
+		delete(task.swarm, genAddress(r.IP, r.Port))
+	}
+	for _, r := range added {
+		if task.pexPeers == pexTaskMaxPeers {
+			break
+		}
+		if task.add(r, &task.pexCandidates) {
+			task.pexPeers++
+			n++
+		}
+	}
+	return
+}
+
+// swarmSize returns how many peers are known in the swarm.
+func (task *metadataTask) swarmSize() int {
+	task.Lock()
+	defer task.Unlock()
+	return len(task.swarm)
+}
+
+// nextPeer pops the next candidate peer which can be tried. The announced
+// peers are tried before the ones told by ut_pex, each within its attempts.
+func (task *metadataTask) nextPeer() (r Request, ok bool) {
+	task.Lock()
+	defer task.Unlock()
+
+	switch {
+	case len(task.candidates) > 0 && task.attempts < wireMaxAttempts:
+		r = task.candidates[0]
+		task.candidates = task.candidates[1:]
+		task.attempts++
+	case len(task.pexCandidates) > 0 && task.pexAttempts < pexTaskMaxAttempts:
+		r = task.pexCandidates[0]
+		task.pexCandidates = task.pexCandidates[1:]
+		task.pexAttempts++
+	default:
+		return r, false
+	}
+	return r, true
+}
+
+// hasPeer returns whether there is a candidate peer which can be tried.
+func (task *metadataTask) hasPeer() bool {
+	task.Lock()
+	defer task.Unlock()
+	return len(task.candidates) > 0 && task.attempts < wireMaxAttempts ||
+		len(task.pexCandidates) > 0 && task.pexAttempts < pexTaskMaxAttempts
+}
+
+// canTryAnnounced returns whether more announced peers can be tried.
+func (task *metadataTask) canTryAnnounced() bool {
+	task.Lock()
+	defer task.Unlock()
+	return task.attempts < wireMaxAttempts
+}
+
+// close makes the task stop accepting peers.
+func (task *metadataTask) close() {
+	task.Lock()
+	task.closed = true
+	task.Unlock()
+}
+
+// isFinished returns whether the metadata is fetched.
+func (task *metadataTask) isFinished() bool {
+	select {
+	case <-task.finished:
+		return true
+	default:
+		return false
+	}
+}
+
+// slow returns whether no piece arrives in wireSlowAfter.
+func (task *metadataTask) slow() bool {
+	task.Lock()
+	defer task.Unlock()
+	return time.Since(task.lastProgress) > wireSlowAfter
+}
+
+// touch resets the time of the last progress.
+func (task *metadataTask) touch() {
+	task.Lock()
+	task.lastProgress = time.Now()
+	task.Unlock()
+}
+
+// setSize sets the metadata size told by a peer. It returns false if it
+// doesn't match the one told by the others.
+func (task *metadataTask) setSize(size int) bool {
+	task.Lock()
+	defer task.Unlock()
+
+	if task.pieces != nil {
+		return size == task.metadataSize
+	}
+	if size <= 0 {
+		return false
+	}
+
+	piecesNum := size / BLOCK
+	if size%BLOCK != 0 {
+		piecesNum++
+	}
+
+	task.metadataSize = size
+	task.pieces = make([][]byte, piecesNum)
+	task.requested = make([]int, piecesNum)
+	task.lastProgress = time.Now()
+	return true
+}
+
+// pieceSize returns the size of the piece, 0 if it's out of range.
+func (task *metadataTask) pieceSize(piece int) int {
+	task.Lock()
+	defer task.Unlock()
+
+	switch {
+	case piece < 0 || piece >= len(task.pieces):
+		return 0
+	case piece < len(task.pieces)-1 || task.metadataSize%BLOCK == 0:
+		return BLOCK
+	default:
+		return task.metadataSize % BLOCK
+	}
+}
+
+// claim returns at most n missing pieces to request from a peer, except the
+// ones in mine which are requested from it already. The pieces requested
+// from fewer peers are preferred, so that the peers fetch different pieces
+// until all are requested. The returned pieces are added to mine.
+func (task *metadataTask) claim(mine map[int]struct{}, n int) []int {
+	task.Lock()
+	defer task.Unlock()
+
+	pieces := make([]int, 0, n)
+	for least := 0; len(pieces) < n && least <= wireMaxParallel; least++ {
+		for i, piece := range task.pieces {
+			if len(pieces) == n {
+				break
+			}
+			if _, ok := mine[i]; ok || piece != nil || task.requested[i] != least {
+				continue
+			}
+			pieces = append(pieces, i)
+			mine[i] = struct{}{}
+		}
+	}
+
+	for _, i := range pieces {
+		task.requested[i]++
+	}
+	return pieces
+}
+
+// unclaim gives up the pieces in mine when the peer fails.
+func (task *metadataTask) unclaim(mine map[int]struct{}) {
+	task.Lock()
+	defer task.Unlock()
+
+	for i := range mine {
+		if i < len(task.requested) && task.requested[i] > 0 {
+			task.requested[i]--
+		}
+	}
+}
+
+// put stores a piece. When all pieces are stored, it returns the metadata
+// and finishes the task if the metadata matches the infohash, otherwise it
+// drops the pieces and returns errMetadataMismatch.
+func (task *metadataTask) put(piece int, data []byte) ([]byte, error) {
+	task.Lock()
+	defer task.Unlock()
+
+	if task.isFinished() || task.pieces[piece] != nil {
+		return nil, nil
+	}
+
+	task.pieces[piece] = data
+	task.received++
+	task.lastProgress = time.Now()
+
+	if task.received < len(task.pieces) {
+		return nil, nil
+	}
+
+	metadata := bytes.Join(task.pieces, nil)
+	if sum := sha1.Sum(metadata); !bytes.Equal(task.infoHash, sum[:]) {
+		// it's unknown which peer sends the wrong piece, so fetch them again
+		task.pieces = make([][]byte, len(task.pieces))
+		task.received = 0
+		return nil, errMetadataMismatch
+	}
+
+	close(task.finished)
+	return metadata, nil
+}
+
+// runTask tries the peers of task until the metadata is fetched, all peers
+// fail and no new one is added in wireTaskIdleTimeout, all the attempts of
+// the peers are used, or the wire stops. At most wireMaxParallel peers are
+// fetched from at the same time, a new one is tried when the others are
+// slow.
+func (wire *Wire) runTask(task *metadataTask) {
+	defer task.close()
+
+	var (
+		active   int
+		attempts int
+		failures int
+		stopping bool
+		results  = make(chan struct{})
+		idle     = time.Now()
+	)
+
+	// retry is when the next peer can be tried after a failure
+	retry := time.Now()
+
+	ticker := time.NewTicker(wireRetryBackoff)
+	defer ticker.Stop()
+
+	for {
+		// no peer is told by ut_pex when none is being fetched from, so only
+		// wait for new announced peers which can be tried
+		if task.isFinished() || stopping ||
+			active == 0 && !task.hasPeer() && (!task.canTryAnnounced() ||
+				time.Since(idle) > wireTaskIdleTimeout) {
+
+			break
+		}
+
+		// try a peer if none is being fetched from, or the others are slow
+		var tokens chan struct{}
+		if active < wireMaxParallel && task.hasPeer() &&
+			!time.Now().Before(retry) &&
+			(active == 0 || task.slow()) {
+
+			tokens = wire.workerTokens
+		}
+
+		select {
+		case tokens <- struct{}{}:
+			r, ok := task.nextPeer()
+			if !ok {
+				<-wire.workerTokens
+				continue
+			}
+			if attempts > 0 {
+				if active == 0 {
+					atomic.AddUint64(&wire.stats.Retried, 1)
+				} else {
+					atomic.AddUint64(&wire.stats.Parallel, 1)
+				}
+			}
+			attempts++
+			active++
+			task.touch()
+
+			go func() {
+				defer func() {
+					<-wire.workerTokens
+					results <- struct{}{}
+				}()
+				wire.fetchMetadata(task, r)
+			}()
+		case <-results:
+			active--
+			if active == 0 && !task.isFinished() {
+				failures++
+				backoff := wireRetryBackoff << uint(failures-1)
+				if backoff > wireMaxRetryBackoff || backoff <= 0 {
+					backoff = wireMaxRetryBackoff
+				}
+				retry = time.Now().Add(backoff)
+				idle = time.Now()
+			}
+		case <-task.wake:
+		case <-ticker.C:
+		case <-task.finished:
+		case <-wire.stopped:
+			stopping = true
+		}
+	}
+
+	// wait for the fetches, which are aborted when the wire stops
+	for ; active > 0; active-- {
+		<-results
+	}
+}
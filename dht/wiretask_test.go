@@ -0,0 +1,119 @@
+package dht
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha1"
+	"net"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestMetadataTaskClaim(t *testing.T) {
+	task := newMetadataTask(make([]byte, 20))
+	if !task.setSize(BLOCK*5 + 1) {
+		t.Fatal("setSize should succeed")
+	}
+	if task.setSize(BLOCK) {
+		t.Error("setSize should fail when the size changes")
+	}
+	if task.pieceSize(5) != 1 || task.pieceSize(0) != BLOCK ||
+		task.pieceSize(6) != 0 || task.pieceSize(-1) != 0 {
+
+		t.Error("wrong piece sizes")
+	}
+
+	a, b := make(map[int]struct{}), make(map[int]struct{})
+	if pieces := task.claim(a, 4); len(pieces) != 4 || pieces[0] != 0 {
+		t.Errorf("claim = %v", pieces)
+	}
+
+	// b gets the pieces not requested from a first
+	pieces := task.claim(b, 4)
+	if len(pieces) != 4 || pieces[0] != 4 || pieces[1] != 5 || pieces[2] != 0 {
+		t.Errorf("claim = %v", pieces)
+	}
+	if pieces := task.claim(b, 4); len(pieces) != 2 || pieces[0] != 2 {
+		t.Errorf("claim = %v", pieces)
+	}
+	if pieces := task.claim(b, 4); len(pieces) != 0 {
+		t.Errorf("claim = %v, all pieces are requested from b", pieces)
+	}
+
+	// the pieces of a failed peer are preferred
+	task.unclaim(a)
+	if pieces := task.claim(make(map[int]struct{}), 1); pieces[0] != 0 {
+		t.Errorf("claim = %v", pieces)
+	}
+}
+
+func TestMetadataTaskPut(t *testing.T) {
+	metadata := bytes.Repeat([]byte("a"), BLOCK+10)
+	infoHash := sha1.Sum(metadata)
+
+	task := newMetadataTask(infoHash[:])
+	task.setSize(len(metadata))
+
+	if m, err := task.put(1, []byte(strings.Repeat("b", 10))); m != nil || err != nil {
+		t.Fatal("the metadata isn't complete")
+	}
+	if _, err := task.put(0, metadata[:BLOCK]); err != errMetadataMismatch {
+		t.Fatalf("put = %v, want errMetadataMismatch", err)
+	}
+	if task.isFinished() {
+		t.Fatal("task shouldn't finish with wrong metadata")
+	}
+
+	task.put(0, metadata[:BLOCK])
+	m, err := task.put(1, metadata[BLOCK:])
+	if err != nil || !bytes.Equal(m, metadata) || !task.isFinished() {
+		t.Error("task should finish")
+	}
+}
+
+func TestWireRetry(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+
+	// a closed port to fail the first fetch
+	closed, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	closedAddr := closed.Addr().(*net.TCPAddr)
+	closed.Close()
+
+	metadata := []byte(Encode(map[string]interface{}{"name": "test"}))
+	infoHash := sha1.Sum(metadata)
+	go servePeer(t, l, "-TR2940-abcdefghijkl", metadata, nil)
+
+	wire := NewWire(16, 4, 4)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go wire.Run(ctx)
+
+	addr := l.Addr().(*net.TCPAddr)
+	wire.Request(infoHash[:], closedAddr.IP.String(), closedAddr.Port)
+	wire.Request(infoHash[:], addr.IP.String(), addr.Port)
+	wire.Request(infoHash[:], addr.IP.String(), addr.Port)
+
+	select {
+	case resp := <-wire.Response():
+		if !bytes.Equal(resp.MetadataInfo, metadata) || resp.Port != addr.Port {
+			t.Errorf("wrong response from %s:%d", resp.IP, resp.Port)
+		}
+	case <-time.After(time.Second * 5):
+		t.Fatal("no response")
+	}
+
+	stats := wire.Stats()
+	if stats.DialFailed != 1 || stats.Retried != 1 || stats.Deduplicated != 2 ||
+		stats.MetadataSucceeded != 1 {
+
+		t.Errorf("stats = %+v", stats)
+	}
+}
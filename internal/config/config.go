@@ -0,0 +1,349 @@
+// Package config 读取爬虫和 Web 服务的 YAML 配置文件，支持环境变量覆盖和校验
+package config
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/url"
+	"os"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"gopkg.in/yaml.v3"
+
+	"magnet-search/dht"
+)
+
+// EnvPrefix 环境变量的前缀，配置项 dht.max_nodes 对应环境变量 MAGNET_DHT_MAX_NODES，
+// 列表用逗号分隔
+const EnvPrefix = "MAGNET_"
+
+// Config 爬虫和 Web 服务的配置
+type Config struct {
+	DB      DBConfig      `yaml:"db"`
+	DHT     DHTConfig     `yaml:"dht"`
+	Wire    WireConfig    `yaml:"wire"`
+	Crawler CrawlerConfig `yaml:"crawler"`
+	Server  ServerConfig  `yaml:"server"`
+}
+
+// DBConfig 数据库配置
+type DBConfig struct {
+	URL string `yaml:"url"` // MongoDB 连接地址
+}
+
+// RedactedURL 返回隐藏了密码的连接地址，用于输出日志
+func (c *DBConfig) RedactedURL() string {
+	u, err := url.Parse(c.URL)
+	if err != nil {
+		// 无法解析时隐藏 @ 之前的全部内容
+		if i := strings.LastIndexByte(c.URL, '@'); i != -1 {
+			return "xxxxx" + c.URL[i:]
+		}
+		return c.URL
+	}
+	return u.Redacted()
+}
+
+// DHTConfig DHT 爬虫配置，对应 dht.Config 中可调的字段，默认值与 dht.NewCrawlConfig 一致
+type DHTConfig struct {
+	Address                    string        `yaml:"address"`                         // 监听地址
+	Network                    string        `yaml:"network"`                         // udp, udp4 或 udp6
+	PrimeNodes                 []string      `yaml:"prime_nodes"`                     // 加入 DHT 网络的引导节点
+	MaxNodes                   int           `yaml:"max_nodes"`                       // 路由表最多容纳的节点数
+	CheckKBucketPeriod         time.Duration `yaml:"check_kbucket_period"`            // 检查 kbucket 的间隔
+	Try                        int           `yaml:"try"`                             // 查询失败时的尝试次数
+	PacketJobLimit             int           `yaml:"packet_job_limit"`                // 待处理数据包队列大小
+	PacketWorkerLimit          int           `yaml:"packet_worker_limit"`             // 处理数据包的协程数
+	BlackListMaxSize           int           `yaml:"blacklist_max_size"`              // 黑名单大小
+	RefreshNodeNum             int           `yaml:"refresh_node_num"`                // 每次刷新的节点数
+	SampleNodeNum              int           `yaml:"sample_node_num"`                 // 每次 sample_infohashes 的节点数，0 表示不采样
+	SecureNodeID               bool          `yaml:"secure_node_id"`                  // 是否拒绝 id 与 ip 不符的节点 (BEP 42)
+	MaxQueriesPerSecond        int           `yaml:"max_queries_per_second"`          // 每秒最多发出的查询数，0 表示不限制
+	MaxQueriesPerNodePerSecond int           `yaml:"max_queries_per_node_per_second"` // 每秒最多向同一节点发出的查询数，0 表示不限制
+	MaxPacketsPerIPPerSecond   int           `yaml:"max_packets_per_ip_per_second"`   // 每秒最多接受同一 ip 的数据包数，0 表示不限制
+	BlacklistAfterDropped      int           `yaml:"blacklist_after_dropped"`         // 同一 ip 被限速丢弃多少个数据包后加入黑名单，0 表示不加入
+	StateFile                  string        `yaml:"state_file"`                      // 节点ID和路由表的保存文件，为空时不保存
+	SaveStatePeriod            time.Duration `yaml:"save_state_period"`               // 保存路由表的间隔
+	BlockedIPs                 []string      `yaml:"blocked_ips"`                     // 屏蔽的 ip、CIDR 或 ip 段
+	BlocklistFiles             []string      `yaml:"blocklist_files"`                 // PeerGuardian .p2p 或 eMule ipfilter.dat 屏蔽列表文件
+}
+
+// WireConfig 元数据获取配置
+type WireConfig struct {
+	BlackListSize    int    `yaml:"blacklist_size"`     // 获取失败的对等点黑名单大小
+	RequestQueueSize int    `yaml:"request_queue_size"` // 等待获取的请求队列大小
+	Concurrency      int    `yaml:"concurrency"`        // 同时获取元数据的连接数
+	UTP              bool   `yaml:"utp"`                // 是否同时通过 uTP 连接对等点
+	UTPAddress       string `yaml:"utp_address"`        // uTP 使用的 UDP 监听地址
+	PreferUTP        bool   `yaml:"prefer_utp"`         // 是否先尝试 uTP，失败时再用 TCP，否则相反
+	Encryption       string `yaml:"encryption"`         // 连接加密策略: prefer、require 或 disable
+}
+
+// CrawlerConfig 爬虫配置
+type CrawlerConfig struct {
+	KnownCacheSize int          `yaml:"known_cache_size"` // 已入库 infohash 缓存的容量，0 表示不缓存
+	MaxProcs       int          `yaml:"max_procs"`        // 最大处理器核心数，0 表示使用所有可用核心
+	MetricsAddr    string       `yaml:"metrics_addr"`     // Prometheus 指标的监听地址，为空时不启动
+	Filter         FilterConfig `yaml:"filter"`
+}
+
+// FilterConfig 关键词过滤规则
+type FilterConfig struct {
+	DefaultKeywords bool                `yaml:"default_keywords"` // 是否加入内置的关键词和黑名单
+	Keywords        map[string][]string `yaml:"keywords"`         // 分类 -> 关键词，环境变量不能覆盖
+	Blacklist       []string            `yaml:"blacklist"`        // 黑名单关键词
+}
+
+// ServerConfig Web 服务配置
+type ServerConfig struct {
+	Port string `yaml:"port"` // HTTP 服务端口
+}
+
+// Default 返回默认配置
+func Default() *Config {
+	dhtConfig := dht.NewCrawlConfig()
+
+	return &Config{
+		DB: DBConfig{
+			URL: "mongodb://localhost:27017",
+		},
+		DHT: DHTConfig{
+			Address:                    dhtConfig.Address,
+			Network:                    dhtConfig.Network,
+			PrimeNodes:                 dhtConfig.PrimeNodes,
+			MaxNodes:                   dhtConfig.MaxNodes,
+			CheckKBucketPeriod:         dhtConfig.CheckKBucketPeriod,
+			Try:                        dhtConfig.Try,
+			PacketJobLimit:             dhtConfig.PacketJobLimit,
+			PacketWorkerLimit:          dhtConfig.PacketWorkerLimit,
+			BlackListMaxSize:           dhtConfig.BlackListMaxSize,
+			RefreshNodeNum:             dhtConfig.RefreshNodeNum,
+			SampleNodeNum:              dhtConfig.SampleNodeNum,
+			SecureNodeID:               dhtConfig.SecureNodeID,
+			MaxQueriesPerSecond:        dhtConfig.MaxQueriesPerSecond,
+			MaxQueriesPerNodePerSecond: dhtConfig.MaxQueriesPerNodePerSecond,
+			MaxPacketsPerIPPerSecond:   dhtConfig.MaxPacketsPerIPPerSecond,
+			BlacklistAfterDropped:      dhtConfig.BlacklistAfterDropped,
+			StateFile:                  "dht.state",
+			SaveStatePeriod:            dhtConfig.SaveStatePeriod,
+		},
+		Wire: WireConfig{
+			BlackListSize:    65536,
+			RequestQueueSize: 1024,
+			Concurrency:      10,
+			UTP:              true,
+			UTPAddress:       ":0",
+			PreferUTP:        true,
+			Encryption:       "prefer",
+		},
+		Crawler: CrawlerConfig{
+			KnownCacheSize: 200000,
+			MetricsAddr:    ":27778",
+			Filter: FilterConfig{
+				DefaultKeywords: true,
+			},
+		},
+		Server: ServerConfig{
+			Port: "27777",
+		},
+	}
+}
+
+// Load 在默认配置上依次应用配置文件和环境变量，path 为空时只应用环境变量。
+// 配置文件中未知的配置项视为错误。Load 不校验配置，调用者应在应用命令行参数后调用 Validate
+func Load(path string) (*Config, error) {
+	config := Default()
+
+	if path != "" {
+		data, err := os.ReadFile(path)
+		if err != nil {
+			return nil, fmt.Errorf("读取配置文件失败: %v", err)
+		}
+
+		decoder := yaml.NewDecoder(bytes.NewReader(data))
+		decoder.KnownFields(true)
+		if err := decoder.Decode(config); err != nil && err != io.EOF {
+			return nil, fmt.Errorf("解析配置文件 %s 失败: %v", path, err)
+		}
+	}
+
+	if err := applyEnv(reflect.ValueOf(config).Elem(), EnvPrefix); err != nil {
+		return nil, err
+	}
+	return config, nil
+}
+
+// applyEnv 用环境变量覆盖结构体 v 的字段，环境变量名为 prefix 加大写的 yaml 标签
+func applyEnv(v reflect.Value, prefix string) error {
+	t := v.Type()
+	for i := 0; i < t.NumField(); i++ {
+		tag := strings.Split(t.Field(i).Tag.Get("yaml"), ",")[0]
+		if tag == "" || tag == "-" {
+			continue
+		}
+
+		name := prefix + strings.ToUpper(tag)
+		field := v.Field(i)
+		if field.Kind() == reflect.Struct {
+			if err := applyEnv(field, name+"_"); err != nil {
+				return err
+			}
+			continue
+		}
+
+		value, ok := os.LookupEnv(name)
+		if !ok {
+			continue
+		}
+		if err := setField(field, value); err != nil {
+			return fmt.Errorf("环境变量 %s 无效: %v", name, err)
+		}
+	}
+	return nil
+}
+
+// setField 将字符串 s 解析后赋给 field
+func setField(field reflect.Value, s string) error {
+	s = strings.TrimSpace(s)
+
+	switch field.Interface().(type) {
+	case string:
+		field.SetString(s)
+	case int:
+		n, err := strconv.Atoi(s)
+		if err != nil {
+			return err
+		}
+		field.SetInt(int64(n))
+	case bool:
+		b, err := strconv.ParseBool(s)
+		if err != nil {
+			return err
+		}
+		field.SetBool(b)
+	case time.Duration:
+		d, err := time.ParseDuration(s)
+		if err != nil {
+			return err
+		}
+		field.SetInt(int64(d))
+	case []string:
+		var list []string
+		for _, item := range strings.Split(s, ",") {
+			if item = strings.TrimSpace(item); item != "" {
+				list = append(list, item)
+			}
+		}
+		field.Set(reflect.ValueOf(list))
+	default:
+		return fmt.Errorf("不支持的类型 %s", field.Type())
+	}
+	return nil
+}
+
+// Validate 校验配置，返回所有错误
+func (c *Config) Validate() error {
+	var errs []error
+	check := func(ok bool, key, format string, args ...interface{}) {
+		if !ok {
+			errs = append(errs, fmt.Errorf("%s %s", key, fmt.Sprintf(format, args...)))
+		}
+	}
+	checkAddr := func(key, addr string) {
+		_, port, err := net.SplitHostPort(addr)
+		if err == nil {
+			_, err = strconv.ParseUint(port, 10, 16)
+		}
+		check(err == nil, key, "不是有效的监听地址: %q", addr)
+	}
+
+	check(c.DB.URL != "", "db.url", "不能为空")
+
+	checkAddr("dht.address", c.DHT.Address)
+	check(c.DHT.Network == "udp" || c.DHT.Network == "udp4" || c.DHT.Network == "udp6",
+		"dht.network", "必须是 udp、udp4 或 udp6: %q", c.DHT.Network)
+	check(c.DHT.MaxNodes > 0, "dht.max_nodes", "必须大于 0")
+	check(c.DHT.CheckKBucketPeriod > 0, "dht.check_kbucket_period", "必须大于 0")
+	check(c.DHT.Try > 0, "dht.try", "必须大于 0")
+	check(c.DHT.PacketJobLimit > 0, "dht.packet_job_limit", "必须大于 0")
+	check(c.DHT.PacketWorkerLimit > 0, "dht.packet_worker_limit", "必须大于 0")
+	check(c.DHT.BlackListMaxSize > 0, "dht.blacklist_max_size", "必须大于 0")
+	check(c.DHT.RefreshNodeNum > 0, "dht.refresh_node_num", "必须大于 0")
+	check(c.DHT.SampleNodeNum >= 0, "dht.sample_node_num", "不能小于 0")
+	check(c.DHT.MaxQueriesPerSecond >= 0, "dht.max_queries_per_second", "不能小于 0")
+	check(c.DHT.MaxQueriesPerNodePerSecond >= 0, "dht.max_queries_per_node_per_second", "不能小于 0")
+	check(c.DHT.MaxPacketsPerIPPerSecond >= 0, "dht.max_packets_per_ip_per_second", "不能小于 0")
+	check(c.DHT.BlacklistAfterDropped >= 0, "dht.blacklist_after_dropped", "不能小于 0")
+	check(c.DHT.StateFile == "" || c.DHT.SaveStatePeriod > 0, "dht.save_state_period", "必须大于 0")
+	blocklist := dht.NewBlocklist()
+	for _, entry := range c.DHT.BlockedIPs {
+		check(blocklist.Add(entry) == nil, "dht.blocked_ips", "包含无效的地址: %q", entry)
+	}
+
+	check(c.Wire.BlackListSize > 0, "wire.blacklist_size", "必须大于 0")
+	check(c.Wire.RequestQueueSize > 0, "wire.request_queue_size", "必须大于 0")
+	check(c.Wire.Concurrency > 0, "wire.concurrency", "必须大于 0")
+	if c.Wire.UTP {
+		checkAddr("wire.utp_address", c.Wire.UTPAddress)
+	}
+	_, err := dht.ParseEncryptionPolicy(c.Wire.Encryption)
+	check(err == nil, "wire.encryption", "必须是 prefer、require 或 disable: %q", c.Wire.Encryption)
+
+	check(c.Crawler.KnownCacheSize >= 0, "crawler.known_cache_size", "不能小于 0")
+	check(c.Crawler.MaxProcs >= 0, "crawler.max_procs", "不能小于 0")
+	if c.Crawler.MetricsAddr != "" {
+		checkAddr("crawler.metrics_addr", c.Crawler.MetricsAddr)
+	}
+	for _, category := range c.Crawler.Filter.Categories() {
+		check(category != "", "crawler.filter.keywords", "的分类不能为空")
+	}
+
+	port, err := strconv.ParseUint(c.Server.Port, 10, 16)
+	check(err == nil && port > 0, "server.port", "不是有效的端口: %q", c.Server.Port)
+
+	if len(errs) > 0 {
+		return fmt.Errorf("配置错误: %w", errors.Join(errs...))
+	}
+	return nil
+}
+
+// Categories 返回按名称排序的关键词分类，使关键词的添加顺序固定
+func (f *FilterConfig) Categories() []string {
+	categories := make([]string, 0, len(f.Keywords))
+	for category := range f.Keywords {
+		categories = append(categories, category)
+	}
+	sort.Strings(categories)
+	return categories
+}
+
+// Apply 将配置应用到 dht.Config
+func (c *DHTConfig) Apply(config *dht.Config) {
+	config.Address = c.Address
+	config.Network = c.Network
+	config.PrimeNodes = c.PrimeNodes
+	config.MaxNodes = c.MaxNodes
+	config.CheckKBucketPeriod = c.CheckKBucketPeriod
+	config.Try = c.Try
+	config.PacketJobLimit = c.PacketJobLimit
+	config.PacketWorkerLimit = c.PacketWorkerLimit
+	config.BlackListMaxSize = c.BlackListMaxSize
+	config.RefreshNodeNum = c.RefreshNodeNum
+	config.SampleNodeNum = c.SampleNodeNum
+	config.SecureNodeID = c.SecureNodeID
+	config.MaxQueriesPerSecond = c.MaxQueriesPerSecond
+	config.MaxQueriesPerNodePerSecond = c.MaxQueriesPerNodePerSecond
+	config.MaxPacketsPerIPPerSecond = c.MaxPacketsPerIPPerSecond
+	config.BlacklistAfterDropped = c.BlacklistAfterDropped
+	config.StateFile = c.StateFile
+	config.SaveStatePeriod = c.SaveStatePeriod
+	config.BlockedIPs = c.BlockedIPs
+	config.BlocklistFiles = c.BlocklistFiles
+}
@@ -0,0 +1,119 @@
+package crawler
+
+import (
+	"fmt"
+	"log"
+	"time"
+	"unicode"
+	"unicode/utf8"
+
+	"magnet-search/dht"
+	"magnet-search/internal/database"
+)
+
+const (
+	// clientFlushPeriod 将内存中的客户端统计写入数据库的间隔
+	clientFlushPeriod = 30 * time.Second
+	// maxClientNameLength 和 maxClientVersionLength 单独统计的客户端名称和版本的最大长度
+	maxClientNameLength    = 32
+	maxClientVersionLength = 16
+	// maxClients 两次写入之间最多单独统计的客户端数
+	maxClients = 1024
+	// otherClient 名称不可打印、过长或超出 maxClients 的客户端统一计入的名称
+	otherClient = "other"
+)
+
+// clientKey 客户端统计的索引
+type clientKey struct {
+	name    string
+	version string
+}
+
+// clientCount 尚未写入数据库的获取数和保存数
+type clientCount struct {
+	fetched int64
+	saved   int64
+}
+
+// recordClient 记录提供元数据的客户端，供统计哪些客户端的种子进入了索引。
+// 只在内存中计数，由 processClients 定期写入数据库；无法识别名称的客户端不计入。
+// 名称和版本来自对等点，为避免数据库中出现大量任意的客户端，异常的名称计入 otherClient，
+// 异常的版本计为空
+func (c *Crawler) recordClient(client dht.PeerClient, fetched, saved int64) {
+	if fetched > 0 {
+		c.logger.Debug(fmt.Sprintf("元数据来自客户端: %s %s, peer_id=%q, yourip=%v, reqq=%d, 扩展=%v",
+			client.Name, client.Version, client.PeerID, client.YourIP, client.Reqq, client.ExtensionNames()))
+	}
+
+	if client.Name == "" {
+		return
+	}
+
+	key := clientKey{name: client.Name, version: client.Version}
+	if !isPrintable(key.name, maxClientNameLength) {
+		key = clientKey{name: otherClient}
+	} else if !isPrintable(key.version, maxClientVersionLength) {
+		key.version = ""
+	}
+
+	c.clientsMutex.Lock()
+	count, ok := c.clients[key]
+	if !ok {
+		if len(c.clients) >= maxClients {
+			key = clientKey{name: otherClient}
+			count, ok = c.clients[key]
+		}
+		if !ok {
+			count = &clientCount{}
+			c.clients[key] = count
+		}
+	}
+	count.fetched += fetched
+	count.saved += saved
+	c.clientsMutex.Unlock()
+}
+
+// processClients 每隔 clientFlushPeriod 将客户端统计写入数据库，stop 关闭时写入剩余的统计后返回
+func (c *Crawler) processClients(stop <-chan struct{}) {
+	ticker := time.NewTicker(clientFlushPeriod)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			c.flushClients()
+		case <-stop:
+			c.flushClients()
+			return
+		}
+	}
+}
+
+// flushClients 将内存中的客户端统计写入数据库并清空，写入失败的统计被丢弃
+func (c *Crawler) flushClients() {
+	c.clientsMutex.Lock()
+	clients := c.clients
+	c.clients = make(map[clientKey]*clientCount, len(clients))
+	c.clientsMutex.Unlock()
+
+	for key, count := range clients {
+		if err := database.IncrementClientStats(c.db, key.name, key.version,
+			count.fetched, count.saved); err != nil {
+
+			log.Printf("更新客户端统计失败: %v", err)
+		}
+	}
+}
+
+// isPrintable 判断 s 是否为不超过 max 字节的 UTF-8 字符串，且只包含可打印字符
+func isPrintable(s string, max int) bool {
+	if len(s) > max || !utf8.ValidString(s) {
+		return false
+	}
+	for _, r := range s {
+		if !unicode.IsPrint(r) {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,49 @@
+package crawler
+
+import (
+	"strconv"
+	"strings"
+	"testing"
+
+	"magnet-search/dht"
+)
+
+func TestRecordClient(t *testing.T) {
+	c := &Crawler{clients: make(map[clientKey]*clientCount)}
+
+	for _, client := range []dht.PeerClient{
+		{Name: "Transmission", Version: "2.9.4"},
+		{Name: "Transmission", Version: "2.9.4"},
+		{Name: "Transmission", Version: strings.Repeat("1", maxClientVersionLength+1)},
+		{Name: ""},
+		{Name: strings.Repeat("a", maxClientNameLength+1), Version: "1"},
+		{Name: "a\x00b", Version: "1"},
+	} {
+		c.recordClient(client, 0, 1)
+	}
+
+	want := map[clientKey]int64{
+		{"Transmission", "2.9.4"}: 2,
+		{"Transmission", ""}:      1,
+		{otherClient, ""}:         2,
+	}
+	if len(c.clients) != len(want) {
+		t.Errorf("clients = %v, want %v", c.clients, want)
+	}
+	for key, saved := range want {
+		if count, ok := c.clients[key]; !ok || count.saved != saved {
+			t.Errorf("%v is counted %v, want %d", key, count, saved)
+		}
+	}
+
+	// the clients beyond maxClients are counted as other
+	for i := 0; i < maxClients; i++ {
+		c.recordClient(dht.PeerClient{Name: "client" + strconv.Itoa(i)}, 0, 1)
+	}
+	if len(c.clients) != maxClients {
+		t.Errorf("%d clients, want %d", len(c.clients), maxClients)
+	}
+	if count := c.clients[clientKey{name: otherClient}]; count.saved != 5 {
+		t.Errorf("other is counted %d, want 5", count.saved)
+	}
+}
@@ -1,104 +1,178 @@
 package crawler
 
 import (
+	"bytes"
+	"context"
 	"encoding/hex"
 	"encoding/json"
+	"errors"
 	"fmt"
+	"io"
 	"log"
+	"magnet-search/internal/config"
 	"magnet-search/internal/database"
 	"magnet-search/internal/logger"
 	"magnet-search/internal/model"
+	"net"
 	"net/url"
+	"strconv"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"magnet-search/dht"
+	"magnet-search/dht/bencode"
+	"magnet-search/dht/utp"
 )
 
+const (
+	// scrapeTimeout 估算做种数和下载数的超时时间，包括查找最近节点的时间
+	scrapeTimeout = 15 * time.Second
+	// scrapeBufferSize 等待估算做种数和下载数的新种子的缓冲区大小，满时丢弃
+	scrapeBufferSize = 1024
+	// scrapeWorkers 同时估算做种数和下载数的协程数
+	scrapeWorkers = 4
+	// eventBufferSize DHT 事件订阅的缓冲区大小
+	eventBufferSize = 4096
+	// metadataMaxDepth 解码元数据时列表和字典的最大嵌套深度，正常的 info 字典不超过 4 层
+	metadataMaxDepth = 16
+	// heatBufferSize 等待更新热度的已知种子的缓冲区大小，满时丢弃
+	heatBufferSize = 4096
+)
+
+// errTrailingData 元数据在 info 字典之后还有多余的数据
+var errTrailingData = errors.New("元数据末尾有多余的数据")
+
+// Stats 爬虫的统计信息
+type Stats struct {
+	Announced int64 // 收到的 announce_peer 数
+	Known     int64 // 命中已知 infohash 缓存、不再获取元数据的 announce 数
+	Sampled   int64 // 通过 sample_infohashes 采样到、查找对等点的 infohash 数
+	Fetched   int64 // 获取到的元数据数
+	Invalid   int64 // 无法解析的元数据数
+	Malformed int64 // 格式错误或超出限制的元数据数，多来自恶意节点
+	Existed   int64 // 已存在并更新热度的种子数
+	Skipped   int64 // 不匹配关键词而跳过的种子数
+	Matched   int64 // 匹配关键词的种子数
+	Saved     int64 // 保存的新种子数
+}
+
 // Crawler 磁力链接爬虫管理器
 type Crawler struct {
-	db           *database.DB
-	logger       *logger.Logger
-	dhtCrawler   *dht.DHT
-	dhtWire      *dht.Wire
-	metadataChan chan *model.TorrentMetadata
-	filter       *KeywordFilter
-	running      bool
-	wg           sync.WaitGroup
+	// stats 放在第一个字段以保证原子操作的 64 位对齐
+	stats Stats
+
+	db         *database.DB
+	logger     *logger.Logger
+	dhtCrawler *dht.DHT
+	dhtWire    *dht.Wire
+	events     *dht.Subscription
+	filter     *KeywordFilter
+	known      *knownCache
+	// heat 命中已知缓存的 infohash，由 processHeat 更新热度
+	heat chan []byte
+	// scrapes 新保存的种子的 infohash，由 processScrapes 估算做种数和下载数后更新
+	scrapes chan string
+	// samples 采样到的 infohash，由 processSamples 查找对等点；sampling 为正在查找的 infohash
+	samples  chan string
+	sampling sync.Map
+	// clients 尚未写入数据库的客户端统计，由 processClients 定期写入
+	clientsMutex sync.Mutex
+	clients      map[clientKey]*clientCount
+	// utpSocket Wire 通过 uTP 连接对等点使用的套接字，未启用 uTP 时为 nil
+	utpSocket *utp.Socket
+
+	// Start 和 Stop 使用
+	mutex  sync.Mutex
+	cancel context.CancelFunc
+	done   chan struct{}
 }
 
-// NewCrawler 创建一个新的爬虫
-func NewCrawler(db *database.DB, listenAddr string, metadataConcurrency int) (*Crawler, error) {
+// NewCrawler 按配置创建一个新的爬虫，cfg 应已通过 Validate 校验。
+// 屏蔽列表同时用于 DHT 和元数据获取，文件修改后自动重新加载；
+// 命中已入库 infohash 缓存的 announce 只更新热度而不获取元数据
+func NewCrawler(db *database.DB, cfg *config.Config) (*Crawler, error) {
 	// 创建日志记录器
 	crawlerLogger, err := logger.NewLogger("logs")
 	if err != nil {
 		return nil, fmt.Errorf("创建日志记录器失败: %v", err)
 	}
 
-	// 创建元数据通道
-	metadataChan := make(chan *model.TorrentMetadata, 1024)
-
-	// 创建过滤器并添加默认关键词
+	// 创建过滤器并添加关键词
 	filter := NewKeywordFilter()
-	initDefaultKeywords(filter)
+	if cfg.Crawler.Filter.DefaultKeywords {
+		initDefaultKeywords(filter)
+	}
+	for _, category := range cfg.Crawler.Filter.Categories() {
+		filter.AddKeywords(cfg.Crawler.Filter.Keywords[category], category)
+	}
+	filter.AddBlacklist(cfg.Crawler.Filter.Blacklist)
 
 	// 创建 DHT Wire 组件，用于获取元数据
-	// 参数: 下载缓冲区大小, 对等点数量限制, 每个 torrent 的并发下载数
-	dhtWire := dht.NewWire(65536, 1024, metadataConcurrency)
+	// 参数: 对等点黑名单大小, 请求队列大小, 并发下载数
+	dhtWire := dht.NewWire(cfg.Wire.BlackListSize, cfg.Wire.RequestQueueSize, cfg.Wire.Concurrency)
 
 	// 创建 DHT 爬虫配置
 	dhtConfig := dht.NewCrawlConfig()
-	dhtConfig.Address = listenAddr
+	cfg.DHT.Apply(dhtConfig)
 	// 解析监听地址获取端口
-	host, port, err := parseListenAddr(listenAddr)
+	host, port, err := parseListenAddr(cfg.DHT.Address)
 	if err != nil {
 		return nil, fmt.Errorf("解析监听地址失败: %v", err)
 	}
 
 	// 设置DHT监听地址
-	dhtConfig.Address = fmt.Sprintf("%s:%d", host, port)
+	dhtConfig.Address = net.JoinHostPort(host, strconv.Itoa(port))
 
 	// 创建爬虫实例
 	crawler := &Crawler{
-		db:           db,
-		logger:       crawlerLogger,
-		dhtWire:      dhtWire,
-		metadataChan: metadataChan,
-		filter:       filter,
-		running:      false,
-	}
-
-	// 设置 DHT 的回调函数
-	dhtConfig.OnAnnouncePeer = func(infoHash, ip string, port int) {
-		if crawler.running {
-			// 请求获取元数据
-			crawler.dhtWire.Request([]byte(infoHash), ip, port)
+		db:      db,
+		logger:  crawlerLogger,
+		dhtWire: dhtWire,
+		filter:  filter,
+		known:   newKnownCache(cfg.Crawler.KnownCacheSize),
+		clients: make(map[clientKey]*clientCount),
+	}
+
+	// 很多 NAT 之后的客户端只接受 uTP 连接，首选的传输方式失败时改用另一种
+	if cfg.Wire.UTP {
+		conn, err := net.ListenPacket(cfg.DHT.Network, cfg.Wire.UTPAddress)
+		if err != nil {
+			return nil, fmt.Errorf("监听 uTP 地址失败: %v", err)
 		}
+		crawler.utpSocket = utp.NewSocket(conn)
+		dhtWire.SetUTP(crawler.utpSocket, cfg.Wire.PreferUTP)
 	}
 
+	// 部分运营商会干扰明文的 BitTorrent 握手，用 MSE/PE 加密连接
+	encryption, err := dht.ParseEncryptionPolicy(cfg.Wire.Encryption)
+	if err != nil {
+		return nil, fmt.Errorf("解析加密策略失败: %v", err)
+	}
+	dhtWire.SetEncryption(encryption)
+
 	// 创建 DHT 爬虫
 	crawler.dhtCrawler = dht.New(dhtConfig)
+	// Wire 与 DHT 共用屏蔽列表，不连接被屏蔽的对等点
+	dhtWire.SetBlocklist(crawler.dhtCrawler.Blocklist())
 	log.Println("[init] DHT 爬虫已创建....")
+
+	// 注册 /metrics 指标
+	crawler.registerMetrics()
 	return crawler, nil
 }
 
-// 解析监听地址
+// 解析监听地址，支持IPv6格式如 [::]:26881，主机为空时监听所有IPv4和IPv6地址
 func parseListenAddr(addr string) (string, int, error) {
-	parts := strings.Split(addr, ":")
-	if len(parts) != 2 {
+	host, portStr, err := net.SplitHostPort(addr)
+	if err != nil {
 		return "", 0, fmt.Errorf("无效的地址格式: %s", addr)
 	}
 
-	host := parts[0]
-	if host == "" {
-		host = "0.0.0.0"
-	}
-
-	var port int
-	_, err := fmt.Sscanf(parts[1], "%d", &port)
+	port, err := strconv.Atoi(portStr)
 	if err != nil {
-		return "", 0, fmt.Errorf("无效的端口: %s", parts[1])
+		return "", 0, fmt.Errorf("无效的端口: %s", portStr)
 	}
 
 	return host, port, nil
@@ -146,80 +220,257 @@ func (c *Crawler) GetBlacklist() []string {
 	return c.filter.GetBlacklist()
 }
 
-// Start 启动爬虫
-func (c *Crawler) Start() {
-	if c.running {
-		return
-	}
-	c.running = true
+// Run 启动爬虫并阻塞直到 ctx 结束，然后按顺序关闭各组件:
+// DHT (保存路由表、释放NAT映射) -> 事件订阅 -> 采样查找 -> Wire (等待进行中的元数据获取，
+// 关闭响应通道) -> 元数据处理器 (处理完剩余的元数据) -> 客户端统计 (写入剩余的计数)
+// -> 做种数估算，最后输出统计信息
+func (c *Crawler) Run(ctx context.Context) {
+	// 各组件使用独立的 context，以便按顺序关闭
+	dhtCtx, cancelDHT := context.WithCancel(context.Background())
+	defer cancelDHT()
+	wireCtx, cancelWire := context.WithCancel(context.Background())
+	defer cancelWire()
 
 	// 启动 DHT Wire 组件
-	go c.dhtWire.Run()
+	wireDone := make(chan struct{})
+	go func() {
+		c.dhtWire.Run(wireCtx)
+		close(wireDone)
+	}()
 	c.logger.Info("DHT Wire 组件已启动")
 
+	// 从数据库预热已知 infohash 缓存，预热完成前未命中的 announce 照常获取元数据
+	go c.warmKnown()
+
+	// 启动热度更新器
+	c.heat = make(chan []byte, heatBufferSize)
+	heatDone := make(chan struct{})
+	go func() {
+		c.processHeat()
+		close(heatDone)
+	}()
+
+	// 启动做种数和下载数的估算，DHT 停止时进行中的估算随之结束
+	c.scrapes = make(chan string, scrapeBufferSize)
+	scrapesDone := make(chan struct{})
+	go func() {
+		c.processScrapes(dhtCtx)
+		close(scrapesDone)
+	}()
+
+	// 启动客户端统计的定期写入
+	clientsStop := make(chan struct{})
+	clientsDone := make(chan struct{})
+	go func() {
+		c.processClients(clientsStop)
+		close(clientsDone)
+	}()
+
 	// 启动元数据处理器
-	c.wg.Add(1)
-	go c.processMetadata()
+	metadataDone := make(chan struct{})
+	go func() {
+		c.processMetadata()
+		close(metadataDone)
+	}()
 	c.logger.Info("元数据处理器已启动")
 
+	// 启动采样 infohash 的对等点查找，DHT 停止时进行中的查找随之结束
+	c.samples = make(chan string, sampleBufferSize)
+	samplesDone := make(chan struct{})
+	go func() {
+		c.processSamples(dhtCtx)
+		close(samplesDone)
+	}()
+
+	// 订阅 DHT 事件，不阻塞 DHT 的数据包处理
+	c.events = c.dhtCrawler.Events(eventBufferSize)
+	eventsDone := make(chan struct{})
+	go func() {
+		c.processEvents()
+		close(eventsDone)
+	}()
+
 	// 启动 DHT 爬虫
-	go c.dhtCrawler.Run()
+	dhtDone := make(chan struct{})
+	go func() {
+		c.dhtCrawler.Run(dhtCtx)
+		close(dhtDone)
+	}()
 	c.logger.Info("DHT 爬虫已启动")
 
 	log.Println("爬虫已启动")
 	c.logger.Info("爬虫已启动")
+
+	<-ctx.Done()
+
+	// 停止 DHT 爬虫，同时保存路由表并释放NAT映射
+	cancelDHT()
+	<-dhtDone
+	c.logger.Info("DHT 爬虫已停止")
+
+	// 取消事件订阅，之后不再有新的元数据请求
+	c.events.Close()
+	<-eventsDone
+	c.logger.Info(fmt.Sprintf("DHT 事件订阅已关闭, 丢弃事件数: %d", c.events.Dropped()))
+
+	// 不再有新的采样 infohash，等待进行中的查找结束
+	close(c.samples)
+	<-samplesDone
+
+	// 不再有新的热度更新，等待剩余的更新完成
+	close(c.heat)
+	<-heatDone
+
+	// 停止 Wire，等待进行中的元数据获取完成后关闭响应通道
+	cancelWire()
+	<-wireDone
+	if c.utpSocket != nil {
+		c.utpSocket.Close()
+	}
+	c.logger.Info("DHT Wire 组件已停止")
+
+	// 等待剩余的元数据处理完成，之后写入剩余的客户端统计
+	<-metadataDone
+	close(clientsStop)
+	<-clientsDone
+
+	// 不再有新保存的种子，等待进行中的估算结束
+	close(c.scrapes)
+	<-scrapesDone
+
+	stats := c.Stats()
+	log.Printf("爬虫已停止, 最终统计: announce=%d 已知=%d 采样=%d 元数据=%d 无效=%d 格式错误=%d 已存在=%d 跳过=%d 匹配=%d 保存=%d",
+		stats.Announced, stats.Known, stats.Sampled, stats.Fetched, stats.Invalid, stats.Malformed, stats.Existed, stats.Skipped, stats.Matched, stats.Saved)
+	c.logger.Info("爬虫已停止")
 }
 
-// Stop 停止爬虫
-func (c *Crawler) Stop() {
-	if !c.running {
+// Start 在后台启动爬虫
+func (c *Crawler) Start() {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	if c.cancel != nil {
 		return
 	}
-	c.running = false
 
-	// DHT 爬虫没有提供 Stop 方法，我们只能停止使用它
-	c.logger.Info("DHT 爬虫已停止")
+	ctx, cancel := context.WithCancel(context.Background())
+	c.cancel = cancel
+	c.done = make(chan struct{})
 
-	// 等待处理结束
-	c.wg.Wait()
+	go func(done chan struct{}) {
+		c.Run(ctx)
+		close(done)
+	}(c.done)
+}
 
-	// 关闭元数据通道
-	close(c.metadataChan)
+// Stop 停止爬虫并等待关闭完成
+func (c *Crawler) Stop() {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
 
-	log.Println("爬虫已停止")
-	c.logger.Info("爬虫已停止")
+	if c.cancel == nil {
+		return
+	}
+
+	c.cancel()
+	<-c.done
+	c.cancel = nil
 }
 
-// processMetadata 处理元数据
-func (c *Crawler) processMetadata() {
-	defer c.wg.Done()
+// Stats 返回爬虫的统计信息
+func (c *Crawler) Stats() Stats {
+	return Stats{
+		Announced: atomic.LoadInt64(&c.stats.Announced),
+		Known:     atomic.LoadInt64(&c.stats.Known),
+		Sampled:   atomic.LoadInt64(&c.stats.Sampled),
+		Fetched:   atomic.LoadInt64(&c.stats.Fetched),
+		Invalid:   atomic.LoadInt64(&c.stats.Invalid),
+		Malformed: atomic.LoadInt64(&c.stats.Malformed),
+		Existed:   atomic.LoadInt64(&c.stats.Existed),
+		Skipped:   atomic.LoadInt64(&c.stats.Skipped),
+		Matched:   atomic.LoadInt64(&c.stats.Matched),
+		Saved:     atomic.LoadInt64(&c.stats.Saved),
+	}
+}
 
-	// 处理从 DHT Wire 接收到的元数据
-	for resp := range c.dhtWire.Response() {
-		// 检查是否需要停止
-		if !c.running {
-			break
+// processEvents 处理 DHT 事件，收到 announce_peer 时请求获取元数据，
+// 已入库的种子不再获取元数据，只更新热度；sample_infohashes 采样到的
+// infohash 先查找对等点再获取元数据
+func (c *Crawler) processEvents() {
+	for event := range c.events.C {
+		switch e := event.(type) {
+		case dht.AnnouncePeerEvent:
+			atomic.AddInt64(&c.stats.Announced, 1)
+
+			infoHash := []byte(e.InfoHash)
+			if c.known.Contains(infoHash) {
+				atomic.AddInt64(&c.stats.Known, 1)
+				select {
+				case c.heat <- infoHash:
+				default:
+					// 数据库跟不上时丢弃，热度只是估算值
+				}
+				continue
+			}
+
+			c.dhtWire.Request(infoHash, e.IP, e.Port)
+		case dht.SampleInfohashesEvent:
+			c.enqueueSamples(e.InfoHashes)
 		}
+	}
+}
 
-		// 解码元数据
-		metadata, err := dht.Decode(resp.MetadataInfo)
-		if err != nil {
-			c.logger.Debug(fmt.Sprintf("解码元数据失败: %v", err))
-			continue
+// processHeat 更新命中已知缓存的种子的热度，直到 heat 关闭
+func (c *Crawler) processHeat() {
+	for infoHash := range c.heat {
+		if err := database.IncrementTorrentHeat(c.db, infoHash); err != nil {
+			log.Printf("更新种子热度失败: %v", err)
 		}
+	}
+}
 
-		b, _ := json.Marshal(metadata)
-		log.Println("[processMetadata]----->转换后的元数据:", string(b))
+// warmKnown 从数据库加载热度最高的种子到已知 infohash 缓存
+func (c *Crawler) warmKnown() {
+	if c.known == nil {
+		return
+	}
 
-		// 转换为元数据对象
-		torrentMetadata, err := c.convertToTorrentMetadata(resp.InfoHash, metadata)
-		if err != nil {
-			c.logger.Debug(fmt.Sprintf("转换元数据失败: %v", err))
-			continue
+	start := time.Now()
+	hexHashes, err := database.GetHotInfoHashes(c.db, c.known.capacity)
+	if err != nil {
+		log.Printf("预热已知 infohash 缓存失败: %v", err)
+		return
+	}
+
+	infoHashes := make([][]byte, 0, len(hexHashes))
+	for _, h := range hexHashes {
+		if infoHash, err := hex.DecodeString(h); err == nil && len(infoHash) == 20 {
+			infoHashes = append(infoHashes, infoHash)
 		}
+	}
+
+	n := c.known.Warm(infoHashes)
+	c.logger.Info(fmt.Sprintf("已知 infohash 缓存预热完成, 加载 %d 个, 耗时 %v", n, time.Since(start)))
+}
 
-		// 如果名称为空，跳过
-		if torrentMetadata.Name == "" {
+// processMetadata 处理元数据，直到 Wire 的响应通道关闭
+func (c *Crawler) processMetadata() {
+	// 处理从 DHT Wire 接收到的元数据
+	for resp := range c.dhtWire.Response() {
+		atomic.AddInt64(&c.stats.Fetched, 1)
+		c.recordClient(resp.Client, 1, 0)
+
+		// 解码元数据
+		torrentMetadata, err := c.convertToTorrentMetadata(resp.InfoHash, resp.MetadataInfo)
+		if err != nil {
+			if isMalformed(err) {
+				atomic.AddInt64(&c.stats.Malformed, 1)
+				c.logger.Debug(fmt.Sprintf("元数据格式错误: %s, 来自 %s:%d, %v",
+					hex.EncodeToString(resp.InfoHash), resp.IP, resp.Port, err))
+			} else {
+				atomic.AddInt64(&c.stats.Invalid, 1)
+				c.logger.Debug(fmt.Sprintf("解码元数据失败: %v", err))
+			}
 			continue
 		}
 
@@ -231,6 +482,9 @@ func (c *Crawler) processMetadata() {
 		}
 
 		if exists {
+			atomic.AddInt64(&c.stats.Existed, 1)
+			c.known.Add(resp.InfoHash)
+
 			// 更新种子热度
 			err = database.IncrementTorrentHeat(c.db, torrentMetadata.InfoHash)
 			if err != nil {
@@ -242,11 +496,15 @@ func (c *Crawler) processMetadata() {
 		// 使用关键词过滤器匹配名称
 		matched, keyword := c.filter.MatchContent(torrentMetadata.Name)
 		if !matched {
+			atomic.AddInt64(&c.stats.Skipped, 1)
+
 			// 不匹配任何关键词，跳过
 			log.Printf("不匹配任何关键词: %s", torrentMetadata.Name)
 			continue
 		}
 
+		atomic.AddInt64(&c.stats.Matched, 1)
+
 		// 获取匹配关键词的分类
 		category := c.filter.GetCategory(keyword)
 		if category == "" {
@@ -258,6 +516,9 @@ func (c *Crawler) processMetadata() {
 		// 转换为种子模型
 		torrent := convertMetadataToTorrent(torrentMetadata, category)
 
+		// 先用 announce 和 ut_pex 得到的对等点数，保存后再异步通过 DHT scrape 估算
+		torrent.Peers = resp.Swarm
+
 		// 保存到数据库
 		err = database.AddTorrent(c.db, torrent)
 		if err != nil {
@@ -265,100 +526,150 @@ func (c *Crawler) processMetadata() {
 			continue
 		}
 
-		log.Printf("添加新种子: %s, 关键词: %s, 分类: %s, InfoHash: %s",
-			torrent.Title, keyword, torrent.Category, torrent.InfoHash)
+		atomic.AddInt64(&c.stats.Saved, 1)
+		c.known.Add(resp.InfoHash)
+
+		select {
+		case c.scrapes <- torrent.InfoHash:
+		default:
+			// 估算跟不上时丢弃，保留 ut_pex 得到的对等点数
+		}
+		c.recordClient(resp.Client, 0, 1)
+
+		log.Printf("添加新种子: %s, 关键词: %s, 分类: %s, InfoHash: %s, 客户端: %s %s",
+			torrent.Title, keyword, torrent.Category, torrent.InfoHash, resp.Client.Name, resp.Client.Version)
 		c.logger.Info(fmt.Sprintf("添加新种子: %s [%s]", torrent.Title, torrent.InfoHash))
 	}
 }
 
-// convertToTorrentMetadata 将 DHT 库的元数据转换为我们的 TorrentMetadata 结构
-func (c *Crawler) convertToTorrentMetadata(infoHash []byte, metadata interface{}) (*model.TorrentMetadata, error) {
-	info, ok := metadata.(map[string]interface{})
-	if !ok {
-		return nil, fmt.Errorf("无效的元数据格式")
+// processScrapes 启动 scrapeWorkers 个协程估算新种子的做种数和下载数，
+// 不阻塞元数据处理，直到 scrapes 关闭。ctx 结束时进行中的估算立即返回
+func (c *Crawler) processScrapes(ctx context.Context) {
+	var wg sync.WaitGroup
+	for i := 0; i < scrapeWorkers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for infoHash := range c.scrapes {
+				c.scrapeSwarm(ctx, infoHash)
+			}
+		}()
 	}
+	wg.Wait()
+}
 
-	// 创建元数据对象
-	result := &model.TorrentMetadata{
-		InfoHash: infoHash,
-	}
+// scrapeSwarm 通过 BEP 33 scrape 估算种子的做种数和下载数并更新到数据库，失败时保持不变
+func (c *Crawler) scrapeSwarm(ctx context.Context, infoHash string) {
+	ctx, cancel := context.WithTimeout(ctx, scrapeTimeout)
+	defer cancel()
 
-	// 提取名称
-	if name, ok := info["name"].(string); ok {
-		result.Name = name
-	} else {
-		return nil, fmt.Errorf("元数据中没有名称")
+	seeds, peers, err := c.dhtCrawler.Scrape(ctx, infoHash)
+	if err != nil {
+		c.logger.Debug(fmt.Sprintf("scrape 失败: %s, %v", infoHash, err))
+		return
 	}
 
-	// 提取注释
-	if comment, ok := info["comment"].(string); ok {
-		result.Comment = comment
+	if err := database.UpdateTorrentSwarm(c.db, infoHash, seeds, peers); err != nil {
+		log.Printf("更新做种数失败: %v", err)
 	}
+}
 
-	// 提取创建时间
-	if creation, ok := info["creation date"].(int64); ok {
-		result.Creation = time.Unix(creation, 0)
-	}
+// torrentFile 元数据中多文件模式的一个文件
+type torrentFile struct {
+	Length int64    `bencode:"length"`
+	Path   []string `bencode:"path"`
+}
 
-	// 提取宣告地址
-	if announce, ok := info["announce"].(string); ok {
-		result.Announce = announce
-	}
+// torrentInfo 元数据 info 字典中用到的字段
+type torrentInfo struct {
+	Name         string        `bencode:"name"`
+	Length       int64         `bencode:"length,omitempty"`
+	Files        []torrentFile `bencode:"files,omitempty"`
+	PieceLength  int64         `bencode:"piece length"`
+	Private      int           `bencode:"private,omitempty"`
+	Comment      string        `bencode:"comment,omitempty"`
+	CreationDate int64         `bencode:"creation date,omitempty"`
+	Announce     string        `bencode:"announce,omitempty"`
+}
 
-	// 提取piece长度
-	if pieceLength, ok := info["piece length"].(int64); ok {
-		result.PieceLength = pieceLength
-	} else if pieceLength, ok := info["piece length"].(int); ok {
-		result.PieceLength = int64(pieceLength)
-	}
+// decodeTorrentInfo 解码 info 字典，拒绝过深的嵌套和超出元数据长度的字符串。
+// 元数据已通过 SHA-1 校验，不规范的编码 (如键未排序) 也来自真实的种子，因此不使用严格模式。
+// 类型不符的字段被跳过，其余字段照常解码，此时返回第一个 *bencode.UnmarshalTypeError
+func decodeTorrentInfo(data []byte, info *torrentInfo) error {
+	d := bencode.NewDecoder(bytes.NewReader(data))
+	d.SetMaxDepth(metadataMaxDepth)
+	// 字符串不可能比元数据本身更长，声明的长度超出时不必读取即可判定为格式错误
+	d.SetMaxStringLength(int64(len(data)))
 
-	// 提取私有标志
-	if private, ok := info["private"].(int64); ok {
-		result.Private = int(private)
-	} else if private, ok := info["private"].(int); ok {
-		result.Private = private
+	err := d.Decode(info)
+	var typeErr *bencode.UnmarshalTypeError
+	if err != nil && !errors.As(err, &typeErr) {
+		return err
 	}
+	if d.InputOffset() != int64(len(data)) {
+		return errTrailingData
+	}
+	return err
+}
 
-	// 处理单文件或多文件情况
-	if length, ok := info["length"].(int64); ok {
-		// 单文件情况
-		result.Length = length
-	} else if length, ok := info["length"].(int); ok {
-		// 单文件情况 (int类型)
-		result.Length = int64(length)
-	} else if files, ok := info["files"].([]interface{}); ok {
-		// 多文件情况
-		result.Files = make([]model.TorrentFile, 0, len(files))
-		var totalLength int64
+// isMalformed 判断解码错误是否由格式错误的数据引起，而不是缺少字段或类型不符
+func isMalformed(err error) bool {
+	var syntaxErr *bencode.SyntaxError
+	return errors.As(err, &syntaxErr) || err == errTrailingData || err == io.EOF
+}
 
-		for _, file := range files {
-			if fileDict, ok := file.(map[string]interface{}); ok {
-				var tf model.TorrentFile
+// convertToTorrentMetadata 将 Wire 获取的 bencode 元数据解码为我们的 TorrentMetadata 结构。
+// 只有名称是必需的，类型不符的可选字段 (如字符串形式的 private) 被忽略
+func (c *Crawler) convertToTorrentMetadata(infoHash []byte, metadataInfo []byte) (*model.TorrentMetadata, error) {
+	var info torrentInfo
+	if err := decodeTorrentInfo(metadataInfo, &info); err != nil {
+		var typeErr *bencode.UnmarshalTypeError
+		if !errors.As(err, &typeErr) {
+			return nil, err
+		}
+	}
 
-				// 处理长度
-				if length, ok := fileDict["length"].(int64); ok {
-					tf.Length = length
-					totalLength += length
-				} else if length, ok := fileDict["length"].(int); ok {
-					tf.Length = int64(length)
-					totalLength += int64(length)
-				}
+	if info.Name == "" {
+		return nil, fmt.Errorf("元数据中没有名称")
+	}
 
-				// 处理路径
-				if path, ok := fileDict["path"].([]interface{}); ok {
-					tf.Path = make([]string, 0, len(path))
-					for _, p := range path {
-						if ps, ok := p.(string); ok {
-							tf.Path = append(tf.Path, ps)
-						}
-					}
+	// 创建元数据对象
+	result := &model.TorrentMetadata{
+		InfoHash:    infoHash,
+		Name:        info.Name,
+		Length:      info.Length,
+		PieceLength: info.PieceLength,
+		Private:     info.Private,
+		Announce:    info.Announce,
+		Comment:     info.Comment,
+	}
+
+	if info.CreationDate != 0 {
+		result.Creation = time.Unix(info.CreationDate, 0)
+	}
+
+	// 多文件情况，总长度为各文件长度之和
+	if len(info.Files) > 0 {
+		result.Files = make([]model.TorrentFile, 0, len(info.Files))
+		result.Length = 0
+		for _, file := range info.Files {
+			// 类型不符的路径元素解码为空字符串，去掉它们；没有路径的文件不是有效的文件
+			path := make([]string, 0, len(file.Path))
+			for _, p := range file.Path {
+				if p != "" {
+					path = append(path, p)
 				}
-
-				result.Files = append(result.Files, tf)
 			}
-		}
+			if len(path) == 0 {
+				continue
+			}
 
-		result.Length = totalLength
+			result.Files = append(result.Files, model.TorrentFile{
+				Length: file.Length,
+				Path:   path,
+			})
+			result.Length += file.Length
+		}
 	}
 
 	b, _ := json.Marshal(result)
@@ -402,8 +713,8 @@ func convertMetadataToTorrent(metadata *model.TorrentMetadata, category string)
 		FileCount:   fileCount,
 		Category:    category,
 		UploadDate:  metadata.Creation,
-		Seeds:       0, // 未知
-		Peers:       0, // 未知
+		Seeds:       0, // 由 scrape 填充
+		Peers:       0, // 由 scrape 或 ut_pex 填充
 		Downloads:   0, // 未知
 		Description: metadata.Comment,
 		Source:      "DHT",
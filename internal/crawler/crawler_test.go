@@ -0,0 +1,77 @@
+package crawler
+
+import (
+	"reflect"
+	"testing"
+
+	"magnet-search/internal/model"
+)
+
+func TestConvertToTorrentMetadata(t *testing.T) {
+	tests := []struct {
+		name      string
+		data      string
+		want      *model.TorrentMetadata
+		malformed bool
+	}{
+		{
+			name: "single file",
+			data: "d6:lengthi10e4:name1:a12:piece lengthi16384e7:privatei1ee",
+			want: &model.TorrentMetadata{Name: "a", Length: 10, PieceLength: 16384, Private: 1},
+		},
+		{
+			name: "mistyped private",
+			data: "d6:lengthi10e4:name1:a7:private1:0e",
+			want: &model.TorrentMetadata{Name: "a", Length: 10},
+		},
+		{
+			name: "mistyped comment and length",
+			data: "d7:commentli1ee6:length2:104:name1:ae",
+			want: &model.TorrentMetadata{Name: "a"},
+		},
+		{
+			name: "mistyped path",
+			data: "d5:filesld6:lengthi1e4:pathl1:bi2e1:cee" +
+				"d6:lengthi2e4:pathi3eee4:name1:ae",
+			want: &model.TorrentMetadata{
+				Name:   "a",
+				Length: 1,
+				Files:  []model.TorrentFile{{Length: 1, Path: []string{"b", "c"}}},
+			},
+		},
+		{
+			name: "not canonical",
+			data: "d4:name1:a6:lengthi010ee",
+			want: &model.TorrentMetadata{Name: "a", Length: 10},
+		},
+		{name: "no name", data: "d6:lengthi10ee"},
+		{name: "mistyped name", data: "d4:namei1ee"},
+		{name: "truncated", data: "d4:name5:ae", malformed: true},
+		{name: "trailing data", data: "d4:name1:aee", malformed: true},
+	}
+
+	c := &Crawler{}
+	infoHash := make([]byte, 20)
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := c.convertToTorrentMetadata(infoHash, []byte(tt.data))
+			if tt.want == nil {
+				if err == nil {
+					t.Fatalf("convertToTorrentMetadata = %+v, want an error", got)
+				}
+				if isMalformed(err) != tt.malformed {
+					t.Errorf("isMalformed(%v) = %v", err, !tt.malformed)
+				}
+				return
+			}
+
+			if err != nil {
+				t.Fatal(err)
+			}
+			tt.want.InfoHash = infoHash
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("convertToTorrentMetadata = %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
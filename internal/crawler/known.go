@@ -0,0 +1,108 @@
+package crawler
+
+import (
+	"container/list"
+	"sync"
+)
+
+// knownCache 已入库 infohash 的 LRU 缓存，命中时不再获取元数据。
+// 使用 LRU 而不是布隆过滤器，是为了避免误判导致新种子被跳过
+type knownCache struct {
+	capacity int
+	mutex    sync.Mutex
+	list     *list.List               // 最近使用的在前
+	items    map[string]*list.Element // 20 字节 infohash -> 链表元素
+}
+
+// newKnownCache 创建容量为 capacity 的缓存，capacity 不大于 0 时返回 nil，表示不缓存
+func newKnownCache(capacity int) *knownCache {
+	if capacity <= 0 {
+		return nil
+	}
+
+	return &knownCache{
+		capacity: capacity,
+		list:     list.New(),
+		items:    make(map[string]*list.Element),
+	}
+}
+
+// Contains 检查 infohash 是否已知，命中时将其移到最前，nil 缓存总是返回 false
+func (kc *knownCache) Contains(infoHash []byte) bool {
+	if kc == nil {
+		return false
+	}
+
+	kc.mutex.Lock()
+	defer kc.mutex.Unlock()
+
+	e, ok := kc.items[string(infoHash)]
+	if ok {
+		kc.list.MoveToFront(e)
+	}
+	return ok
+}
+
+// Add 添加已知的 infohash，超出容量时淘汰最久未使用的
+func (kc *knownCache) Add(infoHash []byte) {
+	if kc == nil {
+		return
+	}
+
+	kc.mutex.Lock()
+	defer kc.mutex.Unlock()
+
+	kc.add(string(infoHash))
+}
+
+// add 添加 key，调用者需持有锁
+func (kc *knownCache) add(key string) {
+	if e, ok := kc.items[key]; ok {
+		kc.list.MoveToFront(e)
+		return
+	}
+
+	kc.items[key] = kc.list.PushFront(key)
+	if kc.list.Len() > kc.capacity {
+		oldest := kc.list.Back()
+		kc.list.Remove(oldest)
+		delete(kc.items, oldest.Value.(string))
+	}
+}
+
+// Warm 启动时预热缓存，将按热度从高到低排列的 infohash 加在缓存末尾，
+// 不影响预热期间已加入的，缓存满时停止。返回加入的数量
+func (kc *knownCache) Warm(infoHashes [][]byte) int {
+	if kc == nil {
+		return 0
+	}
+
+	kc.mutex.Lock()
+	defer kc.mutex.Unlock()
+
+	n := 0
+	for _, infoHash := range infoHashes {
+		key := string(infoHash)
+		if _, ok := kc.items[key]; ok {
+			continue
+		}
+		if kc.list.Len() >= kc.capacity {
+			break
+		}
+		// 加在最后，淘汰时先淘汰热度低的
+		kc.items[key] = kc.list.PushBack(key)
+		n++
+	}
+	return n
+}
+
+// Len 返回缓存中的 infohash 数
+func (kc *knownCache) Len() int {
+	if kc == nil {
+		return 0
+	}
+
+	kc.mutex.Lock()
+	defer kc.mutex.Unlock()
+	return kc.list.Len()
+}
@@ -0,0 +1,97 @@
+package crawler
+
+import (
+	"magnet-search/internal/metrics"
+)
+
+// registerMetrics 注册 DHT、Wire 和爬虫的指标，抓取时读取各组件的统计信息
+func (c *Crawler) registerMetrics() {
+	metrics.NewCounterFunc("magnet_dht_packets_total",
+		"按方向和类型统计的 KRPC 数据包数",
+		func() []metrics.Sample {
+			stats := c.dhtCrawler.Stats()
+			samples := make([]metrics.Sample, 0, len(stats.PacketsIn)+len(stats.PacketsOut))
+			for t, n := range stats.PacketsIn {
+				samples = append(samples, metrics.Sample{LabelValues: []string{"in", t}, Value: float64(n)})
+			}
+			for t, n := range stats.PacketsOut {
+				samples = append(samples, metrics.Sample{LabelValues: []string{"out", t}, Value: float64(n)})
+			}
+			return samples
+		}, "direction", "type")
+
+	metrics.NewCounterFunc("magnet_dht_packets_dropped_total",
+		"因工作协程已满、限速或黑名单丢弃的 KRPC 数据包数",
+		func() []metrics.Sample {
+			return []metrics.Sample{{Value: float64(c.dhtCrawler.Stats().PacketsDropped)}}
+		})
+
+	metrics.NewGaugeFunc("magnet_dht_routing_table_nodes",
+		"路由表中的节点数",
+		func() []metrics.Sample {
+			stats := c.dhtCrawler.Stats()
+			return []metrics.Sample{
+				{LabelValues: []string{"ipv4"}, Value: float64(stats.Nodes)},
+				{LabelValues: []string{"ipv6"}, Value: float64(stats.Nodes6)},
+			}
+		}, "family")
+
+	metrics.NewGaugeFunc("magnet_dht_transactions",
+		"等待响应的 KRPC 事务数",
+		func() []metrics.Sample {
+			return []metrics.Sample{{Value: float64(c.dhtCrawler.Stats().Transactions)}}
+		})
+
+	metrics.NewCounterFunc("magnet_wire_operations_total",
+		"元数据获取各阶段的结果数",
+		func() []metrics.Sample {
+			stats := c.dhtWire.Stats()
+			return []metrics.Sample{
+				{LabelValues: []string{"dial", "ok"}, Value: float64(stats.DialSucceeded)},
+				{LabelValues: []string{"dial", "failed"}, Value: float64(stats.DialFailed)},
+				{LabelValues: []string{"dial", "utp"}, Value: float64(stats.UTPConnected)},
+				{LabelValues: []string{"dial", "fallback"}, Value: float64(stats.Fallbacks)},
+				{LabelValues: []string{"handshake", "ok"}, Value: float64(stats.HandshakeSucceeded)},
+				{LabelValues: []string{"handshake", "failed"}, Value: float64(stats.HandshakeFailed)},
+				{LabelValues: []string{"handshake", "encrypted"}, Value: float64(stats.Encrypted)},
+				{LabelValues: []string{"handshake", "plaintext_fallback"}, Value: float64(stats.PlaintextFallbacks)},
+				{LabelValues: []string{"metadata", "ok"}, Value: float64(stats.MetadataSucceeded)},
+				{LabelValues: []string{"metadata", "failed"}, Value: float64(stats.MetadataFailed)},
+				{LabelValues: []string{"metadata", "invalid"}, Value: float64(stats.MetadataInvalid)},
+				{LabelValues: []string{"schedule", "deduplicated"}, Value: float64(stats.Deduplicated)},
+				{LabelValues: []string{"schedule", "dropped"}, Value: float64(stats.Dropped)},
+				{LabelValues: []string{"schedule", "retried"}, Value: float64(stats.Retried)},
+				{LabelValues: []string{"schedule", "parallel"}, Value: float64(stats.Parallel)},
+				{LabelValues: []string{"pex", "messages"}, Value: float64(stats.PexMessages)},
+				{LabelValues: []string{"pex", "peers"}, Value: float64(stats.PexPeers)},
+			}
+		}, "stage", "result")
+
+	metrics.NewCounterFunc("magnet_crawler_announces_total",
+		"收到的 announce_peer 数",
+		func() []metrics.Sample {
+			return []metrics.Sample{{Value: float64(c.Stats().Announced)}}
+		})
+
+	metrics.NewCounterFunc("magnet_crawler_samples_total",
+		"通过 sample_infohashes 采样到、查找对等点的 infohash 数",
+		func() []metrics.Sample {
+			return []metrics.Sample{{Value: float64(c.Stats().Sampled)}}
+		})
+
+	metrics.NewCounterFunc("magnet_crawler_torrents_total",
+		"按处理结果统计的种子数",
+		func() []metrics.Sample {
+			stats := c.Stats()
+			return []metrics.Sample{
+				{LabelValues: []string{"fetched"}, Value: float64(stats.Fetched)},
+				{LabelValues: []string{"invalid"}, Value: float64(stats.Invalid)},
+				{LabelValues: []string{"malformed"}, Value: float64(stats.Malformed)},
+				{LabelValues: []string{"existed"}, Value: float64(stats.Existed)},
+				{LabelValues: []string{"known"}, Value: float64(stats.Known)},
+				{LabelValues: []string{"skipped"}, Value: float64(stats.Skipped)},
+				{LabelValues: []string{"matched"}, Value: float64(stats.Matched)},
+				{LabelValues: []string{"saved"}, Value: float64(stats.Saved)},
+			}
+		}, "result")
+}
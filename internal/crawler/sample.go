@@ -0,0 +1,76 @@
+package crawler
+
+import (
+	"context"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	// sampleBufferSize 等待查找对等点的采样 infohash 的缓冲区大小，满时丢弃
+	sampleBufferSize = 4096
+	// sampleWorkers 同时查找采样 infohash 对等点的协程数
+	sampleWorkers = 8
+	// sampleLookupTimeout 查找一个采样 infohash 的对等点的超时时间
+	sampleLookupTimeout = 15 * time.Second
+	// samplePeers 每个采样 infohash 最多交给 Wire 的对等点数，与 Wire 每个任务的最多尝试数相同
+	samplePeers = 8
+)
+
+// enqueueSamples 将 sample_infohashes 采样到的 infohash 交给 processSamples 查找对等点，
+// 已入库或正在查找的跳过，缓冲区满时丢弃
+func (c *Crawler) enqueueSamples(infoHashes []string) {
+	for _, infoHash := range infoHashes {
+		if c.known.Contains([]byte(infoHash)) {
+			continue
+		}
+		if _, loaded := c.sampling.LoadOrStore(infoHash, struct{}{}); loaded {
+			continue
+		}
+
+		select {
+		case c.samples <- infoHash:
+			atomic.AddInt64(&c.stats.Sampled, 1)
+		default:
+			c.sampling.Delete(infoHash)
+		}
+	}
+}
+
+// processSamples 启动 sampleWorkers 个协程，通过 get_peers 迭代查找采样 infohash 的对等点，
+// 并请求 Wire 获取元数据，直到 samples 关闭。ctx 结束时进行中的查找立即返回
+func (c *Crawler) processSamples(ctx context.Context) {
+	var wg sync.WaitGroup
+	for i := 0; i < sampleWorkers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for infoHash := range c.samples {
+				c.lookupSample(ctx, infoHash)
+				c.sampling.Delete(infoHash)
+			}
+		}()
+	}
+	wg.Wait()
+}
+
+// lookupSample 查找 infoHash 的对等点，将最先找到的 samplePeers 个交给 Wire
+func (c *Crawler) lookupSample(ctx context.Context, infoHash string) {
+	ctx, cancel := context.WithTimeout(ctx, sampleLookupTimeout)
+	defer cancel()
+
+	peers, err := c.dhtCrawler.LookupPeers(ctx, infoHash)
+	if err != nil {
+		return
+	}
+
+	n := 0
+	for p := range peers {
+		c.dhtWire.Request([]byte(infoHash), p.IP.String(), p.Port)
+		if n++; n == samplePeers {
+			// 取消 ctx 结束查找，不必读完 peers
+			return
+		}
+	}
+}
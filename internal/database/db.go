@@ -21,6 +21,7 @@ type DB struct {
 	Torrents   *mongo.Collection
 	keywords   *mongo.Collection
 	statistics *mongo.Collection
+	clients    *mongo.Collection
 	Ctx        context.Context
 	cancel     context.CancelFunc
 }
@@ -33,9 +34,10 @@ func InitDB(mongoURL string) (*DB, error) {
 	// 创建客户端连接选项
 	clientOptions := options.Client().
 		ApplyURI(mongoURL).
-		SetMaxPoolSize(100).                // 设置最大连接池大小
-		SetMinPoolSize(10).                 // 设置最小连接池大小
-		SetMaxConnIdleTime(5 * time.Minute) // 空闲连接最大存活时间
+		SetMaxPoolSize(100).                 // 设置最大连接池大小
+		SetMinPoolSize(10).                  // 设置最小连接池大小
+		SetMaxConnIdleTime(5 * time.Minute). // 空闲连接最大存活时间
+		SetMonitor(newCommandMonitor())      // 记录命令耗时
 
 	client, err := mongo.Connect(ctx, clientOptions)
 	if err != nil {
@@ -55,6 +57,7 @@ func InitDB(mongoURL string) (*DB, error) {
 	torrentsCollection := database.Collection("torrents")
 	keywordsCollection := database.Collection("keywords")
 	statisticsCollection := database.Collection("statistics")
+	clientsCollection := database.Collection("clients")
 
 	// 创建索引
 	indexModels := []mongo.IndexModel{
@@ -87,6 +90,15 @@ func InitDB(mongoURL string) (*DB, error) {
 		}
 	}
 
+	// 客户端统计按名称和版本唯一
+	_, err = clientsCollection.Indexes().CreateOne(ctx, mongo.IndexModel{
+		Keys:    bson.D{{Key: "name", Value: 1}, {Key: "version", Value: 1}},
+		Options: options.Index().SetUnique(true),
+	})
+	if err != nil {
+		log.Printf("创建索引失败: %v", err)
+	}
+
 	log.Println("MongoDB 连接成功")
 
 	return &DB{
@@ -94,6 +106,7 @@ func InitDB(mongoURL string) (*DB, error) {
 		Torrents:   torrentsCollection,
 		keywords:   keywordsCollection,
 		statistics: statisticsCollection,
+		clients:    clientsCollection,
 		Ctx:        ctx,
 		cancel:     cancel,
 	}, nil
@@ -158,6 +171,19 @@ func IncrementTorrentHeat(db *DB, infoHash []byte) error {
 	return err
 }
 
+// UpdateTorrentSwarm 更新种子的做种数和下载数，下载数只增不减，
+// 保留 ut_pex 等来源得到的更大的估算值
+func UpdateTorrentSwarm(db *DB, infoHash string, seeds, peers int) error {
+	ctx, cancel := createContext()
+	defer cancel()
+	update := bson.M{
+		"$set": bson.M{"seeds": seeds},
+		"$max": bson.M{"peers": peers},
+	}
+	_, err := db.Torrents.UpdateOne(ctx, bson.M{"info_hash": infoHash}, update)
+	return err
+}
+
 // InfoHashExists 检查InfoHash是否存在
 func InfoHashExists(db *DB, infoHash []byte) (bool, error) {
 	ctx, cancel := createContext()
@@ -353,3 +379,65 @@ func GetTorrentByInfoHash(db *DB, infoHash string) (*model.Torrent, error) {
 	}
 	return &torrent, nil
 }
+
+// GetHotInfoHashes 按热度从高到低获取最多 limit 个种子的 InfoHash，只读取 info_hash 字段
+func GetHotInfoHashes(db *DB, limit int) ([]string, error) {
+	// 数据量较大，使用比 createContext 更长的超时时间
+	ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+	defer cancel()
+	options := options.Find().
+		SetSort(bson.D{{Key: "heat", Value: -1}}).
+		SetLimit(int64(limit)).
+		SetProjection(bson.M{"info_hash": 1, "_id": 0})
+
+	cursor, err := db.Torrents.Find(ctx, bson.M{}, options)
+	if err != nil {
+		return nil, err
+	}
+	defer cursor.Close(ctx)
+
+	infoHashes := make([]string, 0, limit)
+	for cursor.Next(ctx) {
+		var doc struct {
+			InfoHash string `bson:"info_hash"`
+		}
+		if err := cursor.Decode(&doc); err != nil {
+			return nil, err
+		}
+		infoHashes = append(infoHashes, doc.InfoHash)
+	}
+	return infoHashes, cursor.Err()
+}
+
+// IncrementClientStats 增加客户端的获取数和保存数，客户端不存在时创建
+func IncrementClientStats(db *DB, name, version string, fetched, saved int64) error {
+	ctx, cancel := createContext()
+	defer cancel()
+	update := bson.M{
+		"$inc": bson.M{"fetched": fetched, "saved": saved},
+		"$set": bson.M{"last_seen": time.Now()},
+	}
+	_, err := db.clients.UpdateOne(ctx, bson.M{"name": name, "version": version}, update,
+		options.Update().SetUpsert(true))
+	return err
+}
+
+// GetClientStats 按获取数从多到少获取客户端统计
+func GetClientStats(db *DB, limit int) ([]model.ClientStat, error) {
+	ctx, cancel := createContext()
+	defer cancel()
+	options := options.Find().
+		SetSort(bson.D{{Key: "fetched", Value: -1}}).
+		SetLimit(int64(limit))
+
+	cursor, err := db.clients.Find(ctx, bson.M{}, options)
+	if err != nil {
+		return nil, err
+	}
+
+	var stats []model.ClientStat
+	if err := cursor.All(ctx, &stats); err != nil {
+		return nil, err
+	}
+	return stats, nil
+}
@@ -0,0 +1,25 @@
+package database
+
+import (
+	"context"
+
+	"magnet-search/internal/metrics"
+
+	"go.mongodb.org/mongo-driver/event"
+)
+
+// mongoLatency MongoDB 命令的耗时
+var mongoLatency = metrics.NewHistogramVec("magnet_mongo_command_duration_seconds",
+	"MongoDB 命令的耗时 (秒)", metrics.DefBuckets, "command", "result")
+
+// newCommandMonitor 返回记录每个命令耗时的监视器
+func newCommandMonitor() *event.CommandMonitor {
+	return &event.CommandMonitor{
+		Succeeded: func(_ context.Context, e *event.CommandSucceededEvent) {
+			mongoLatency.Observe(e.Duration.Seconds(), e.CommandName, "ok")
+		},
+		Failed: func(_ context.Context, e *event.CommandFailedEvent) {
+			mongoLatency.Observe(e.Duration.Seconds(), e.CommandName, "failed")
+		},
+	}
+}
@@ -0,0 +1,270 @@
+// Package metrics 以 Prometheus 文本格式 (0.0.4) 导出指标，供 /metrics 接口使用
+package metrics
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// DefBuckets 默认的直方图桶 (秒)，与 Prometheus 客户端一致
+var DefBuckets = []float64{.005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5, 10}
+
+// Sample 一个采样值，LabelValues 与指标的标签一一对应
+type Sample struct {
+	LabelValues []string
+	Value       float64
+}
+
+// collector 可以按文本格式输出的指标
+type collector interface {
+	write(w io.Writer)
+}
+
+// registry 已注册的指标，按名称索引
+type registry struct {
+	sync.RWMutex
+	collectors map[string]collector
+}
+
+var defaultRegistry = &registry{collectors: make(map[string]collector)}
+
+// register 注册指标，同名的指标会被替换
+func (r *registry) register(name string, c collector) {
+	r.Lock()
+	r.collectors[name] = c
+	r.Unlock()
+}
+
+// write 按名称顺序输出所有指标
+func (r *registry) write(w io.Writer) {
+	r.RLock()
+	names := make([]string, 0, len(r.collectors))
+	for name := range r.collectors {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	collectors := make([]collector, 0, len(names))
+	for _, name := range names {
+		collectors = append(collectors, r.collectors[name])
+	}
+	r.RUnlock()
+
+	for _, c := range collectors {
+		c.write(w)
+	}
+}
+
+// Handler 返回输出所有已注册指标的 http.Handler
+func Handler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+
+		bw := bufio.NewWriter(w)
+		defaultRegistry.write(bw)
+		bw.Flush()
+	})
+}
+
+// desc 指标的名称、说明、类型和标签名
+type desc struct {
+	name   string
+	help   string
+	typ    string
+	labels []string
+}
+
+// writeHeader 输出 HELP 和 TYPE 行
+func (d *desc) writeHeader(w io.Writer) {
+	help := strings.NewReplacer(`\`, `\\`, "\n", `\n`).Replace(d.help)
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n", d.name, help, d.name, d.typ)
+}
+
+// writeSample 输出一行采样，extra 是追加的一对标签名和值，例如直方图的 le
+func (d *desc) writeSample(w io.Writer, suffix string, labelValues []string,
+	value float64, extra ...string) {
+
+	pairs := make([]string, 0, len(d.labels)+1)
+	for i, label := range d.labels {
+		v := ""
+		if i < len(labelValues) {
+			v = labelValues[i]
+		}
+		pairs = append(pairs, label+`="`+escapeLabel(v)+`"`)
+	}
+	if len(extra) == 2 {
+		pairs = append(pairs, extra[0]+`="`+escapeLabel(extra[1])+`"`)
+	}
+
+	labels := ""
+	if len(pairs) > 0 {
+		labels = "{" + strings.Join(pairs, ",") + "}"
+	}
+
+	fmt.Fprintf(w, "%s%s%s %s\n", d.name, suffix, labels, formatFloat(value))
+}
+
+// escapeLabel 转义标签值中的反斜杠、双引号和换行
+func escapeLabel(v string) string {
+	return strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`).Replace(v)
+}
+
+// formatFloat 按文本格式输出浮点数
+func formatFloat(v float64) string {
+	switch {
+	case math.IsInf(v, 1):
+		return "+Inf"
+	case math.IsInf(v, -1):
+		return "-Inf"
+	case math.IsNaN(v):
+		return "NaN"
+	}
+	return strconv.FormatFloat(v, 'g', -1, 64)
+}
+
+// seriesKey 返回一组标签值的索引
+func seriesKey(labelValues []string) string {
+	return strings.Join(labelValues, "\xff")
+}
+
+// funcCollector 在每次抓取时调用 fn 获取采样的指标
+type funcCollector struct {
+	desc
+	fn func() []Sample
+}
+
+func (c *funcCollector) write(w io.Writer) {
+	samples := c.fn()
+	sort.Slice(samples, func(i, j int) bool {
+		return seriesKey(samples[i].LabelValues) < seriesKey(samples[j].LabelValues)
+	})
+
+	c.writeHeader(w)
+	for _, s := range samples {
+		c.writeSample(w, "", s.LabelValues, s.Value)
+	}
+}
+
+// NewCounterFunc 注册一个计数器，每次抓取时由 fn 返回各标签的当前值，
+// 适用于已有统计计数的组件
+func NewCounterFunc(name, help string, fn func() []Sample, labels ...string) {
+	defaultRegistry.register(name, &funcCollector{
+		desc: desc{name: name, help: help, typ: "counter", labels: labels},
+		fn:   fn,
+	})
+}
+
+// NewGaugeFunc 注册一个仪表盘，每次抓取时由 fn 返回各标签的当前值
+func NewGaugeFunc(name, help string, fn func() []Sample, labels ...string) {
+	defaultRegistry.register(name, &funcCollector{
+		desc: desc{name: name, help: help, typ: "gauge", labels: labels},
+		fn:   fn,
+	})
+}
+
+// histogram 一组标签值的直方图数据
+type histogram struct {
+	labelValues []string
+	counts      []uint64
+	count       uint64
+	sum         float64
+}
+
+// HistogramVec 按标签区分的直方图
+type HistogramVec struct {
+	desc
+	buckets []float64
+
+	mutex  sync.Mutex
+	series map[string]*histogram
+}
+
+// NewHistogramVec 创建并注册一个直方图，buckets 为空时使用 DefBuckets
+func NewHistogramVec(name, help string, buckets []float64,
+	labels ...string) *HistogramVec {
+
+	if len(buckets) == 0 {
+		buckets = DefBuckets
+	}
+	buckets = append([]float64(nil), buckets...)
+	sort.Float64s(buckets)
+
+	h := &HistogramVec{
+		desc:    desc{name: name, help: help, typ: "histogram", labels: labels},
+		buckets: buckets,
+		series:  make(map[string]*histogram),
+	}
+	defaultRegistry.register(name, h)
+	return h
+}
+
+// Observe 记录一个采样值
+func (h *HistogramVec) Observe(value float64, labelValues ...string) {
+	key := seriesKey(labelValues)
+
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+
+	s, ok := h.series[key]
+	if !ok {
+		s = &histogram{
+			labelValues: append([]string(nil), labelValues...),
+			counts:      make([]uint64, len(h.buckets)),
+		}
+		h.series[key] = s
+	}
+
+	for i, bound := range h.buckets {
+		if value <= bound {
+			s.counts[i]++
+		}
+	}
+	s.count++
+	s.sum += value
+}
+
+// ObserveSince 记录从 start 到现在经过的秒数
+func (h *HistogramVec) ObserveSince(start time.Time, labelValues ...string) {
+	h.Observe(time.Since(start).Seconds(), labelValues...)
+}
+
+func (h *HistogramVec) write(w io.Writer) {
+	h.mutex.Lock()
+	keys := make([]string, 0, len(h.series))
+	for key := range h.series {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	series := make([]histogram, 0, len(keys))
+	for _, key := range keys {
+		s := h.series[key]
+		series = append(series, histogram{
+			labelValues: s.labelValues,
+			counts:      append([]uint64(nil), s.counts...),
+			count:       s.count,
+			sum:         s.sum,
+		})
+	}
+	h.mutex.Unlock()
+
+	h.writeHeader(w)
+	for _, s := range series {
+		for i, bound := range h.buckets {
+			h.writeSample(w, "_bucket", s.labelValues, float64(s.counts[i]),
+				"le", formatFloat(bound))
+		}
+		h.writeSample(w, "_bucket", s.labelValues, float64(s.count),
+			"le", "+Inf")
+		h.writeSample(w, "_sum", s.labelValues, s.sum)
+		h.writeSample(w, "_count", s.labelValues, float64(s.count))
+	}
+}
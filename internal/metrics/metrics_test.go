@@ -0,0 +1,127 @@
+package metrics
+
+import (
+	"bytes"
+	"math"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestFuncCollector(t *testing.T) {
+	tests := []struct {
+		name   string
+		typ    string
+		help   string
+		labels []string
+		fn     func() []Sample
+		want   string
+	}{
+		{
+			name: "test_total",
+			typ:  "counter",
+			help: "help",
+			fn: func() []Sample {
+				return []Sample{{Value: 3}}
+			},
+			want: "# HELP test_total help\n" +
+				"# TYPE test_total counter\n" +
+				"test_total 3\n",
+		},
+		{
+			name:   "test_gauge",
+			typ:    "gauge",
+			help:   "多行\n说明 \\ 反斜杠",
+			labels: []string{"kind", "name"},
+			fn: func() []Sample {
+				return []Sample{
+					{LabelValues: []string{"b", `a"b\c` + "\n"}, Value: 0.5},
+					{LabelValues: []string{"a", "x"}, Value: math.Inf(1)},
+					{LabelValues: []string{"c"}, Value: math.NaN()},
+				}
+			},
+			want: "# HELP test_gauge 多行\\n说明 \\\\ 反斜杠\n" +
+				"# TYPE test_gauge gauge\n" +
+				"test_gauge{kind=\"a\",name=\"x\"} +Inf\n" +
+				"test_gauge{kind=\"b\",name=\"a\\\"b\\\\c\\n\"} 0.5\n" +
+				"test_gauge{kind=\"c\",name=\"\"} NaN\n",
+		},
+	}
+
+	for _, tt := range tests {
+		c := &funcCollector{
+			desc: desc{name: tt.name, help: tt.help, typ: tt.typ, labels: tt.labels},
+			fn:   tt.fn,
+		}
+
+		var buf bytes.Buffer
+		c.write(&buf)
+		if buf.String() != tt.want {
+			t.Errorf("%s:\n%s\nwant:\n%s", tt.name, buf.String(), tt.want)
+		}
+	}
+}
+
+func TestHistogramVec(t *testing.T) {
+	h := &HistogramVec{
+		desc:    desc{name: "test_seconds", help: "耗时", typ: "histogram", labels: []string{"handler"}},
+		buckets: []float64{0.1, 1},
+		series:  make(map[string]*histogram),
+	}
+
+	h.Observe(0.05, "search")
+	h.Observe(0.5, "search")
+	h.Observe(2, "search")
+	h.Observe(1, `st"atic`)
+
+	want := "# HELP test_seconds 耗时\n" +
+		"# TYPE test_seconds histogram\n" +
+		"test_seconds_bucket{handler=\"search\",le=\"0.1\"} 1\n" +
+		"test_seconds_bucket{handler=\"search\",le=\"1\"} 2\n" +
+		"test_seconds_bucket{handler=\"search\",le=\"+Inf\"} 3\n" +
+		"test_seconds_sum{handler=\"search\"} 2.55\n" +
+		"test_seconds_count{handler=\"search\"} 3\n" +
+		"test_seconds_bucket{handler=\"st\\\"atic\",le=\"0.1\"} 0\n" +
+		"test_seconds_bucket{handler=\"st\\\"atic\",le=\"1\"} 1\n" +
+		"test_seconds_bucket{handler=\"st\\\"atic\",le=\"+Inf\"} 1\n" +
+		"test_seconds_sum{handler=\"st\\\"atic\"} 1\n" +
+		"test_seconds_count{handler=\"st\\\"atic\"} 1\n"
+
+	var buf bytes.Buffer
+	h.write(&buf)
+	if buf.String() != want {
+		t.Errorf("got:\n%s\nwant:\n%s", buf.String(), want)
+	}
+}
+
+func TestHandler(t *testing.T) {
+	NewGaugeFunc("test_handler_b", "b", func() []Sample {
+		return []Sample{{Value: 2}}
+	})
+	NewCounterFunc("test_handler_a", "a", func() []Sample {
+		return []Sample{{LabelValues: []string{"x"}, Value: 1}}
+	}, "label")
+	h := NewHistogramVec("test_handler_c", "c", nil)
+	h.Observe(0.001)
+
+	rec := httptest.NewRecorder()
+	Handler().ServeHTTP(rec, httptest.NewRequest("GET", "/metrics", nil))
+
+	if ct := rec.Header().Get("Content-Type"); ct != "text/plain; version=0.0.4; charset=utf-8" {
+		t.Errorf("Content-Type = %q", ct)
+	}
+
+	body := rec.Body.String()
+	a := strings.Index(body, "# HELP test_handler_a a\n# TYPE test_handler_a counter\n"+
+		"test_handler_a{label=\"x\"} 1\n")
+	b := strings.Index(body, "# HELP test_handler_b b\n# TYPE test_handler_b gauge\n"+
+		"test_handler_b 2\n")
+	c := strings.Index(body, "test_handler_c_bucket{le=\"0.005\"} 1\n")
+	if a < 0 || b < 0 || c < 0 || !(a < b && b < c) {
+		t.Errorf("metrics aren't written in order of names:\n%s", body)
+	}
+	if !strings.Contains(body, "test_handler_c_bucket{le=\"+Inf\"} 1\n"+
+		"test_handler_c_sum 0.001\ntest_handler_c_count 1\n") {
+		t.Errorf("histogram without +Inf bucket, sum or count:\n%s", body)
+	}
+}
@@ -42,6 +42,15 @@ type Torrent struct {
 	Files       []TorrentFile `json:"files" bson:"files"` // 文件列表
 }
 
+// ClientStat 表示一种 BitTorrent 客户端提供元数据的统计
+type ClientStat struct {
+	Name     string    `json:"name" bson:"name"`           // 客户端名称，未知时为空
+	Version  string    `json:"version" bson:"version"`     // 客户端版本
+	Fetched  int64     `json:"fetched" bson:"fetched"`     // 从该客户端获取的元数据数
+	Saved    int64     `json:"saved" bson:"saved"`         // 其中保存为新种子的数
+	LastSeen time.Time `json:"last_seen" bson:"last_seen"` // 最近一次获取的时间
+}
+
 // CategoryCount 表示分类及其数量
 type CategoryCount struct {
 	Category string `json:"category" bson:"category"`
@@ -0,0 +1,36 @@
+package server
+
+import (
+	"net/http"
+	"strconv"
+	"time"
+
+	"magnet-search/internal/metrics"
+)
+
+// httpLatency HTTP 请求的耗时，按处理器和状态码区分
+var httpLatency = metrics.NewHistogramVec("magnet_http_request_duration_seconds",
+	"HTTP 请求的耗时 (秒)", metrics.DefBuckets, "handler", "code")
+
+// statusRecorder 记录处理器写入的状态码
+type statusRecorder struct {
+	http.ResponseWriter
+	status int
+}
+
+func (r *statusRecorder) WriteHeader(status int) {
+	r.status = status
+	r.ResponseWriter.WriteHeader(status)
+}
+
+// instrument 包装处理器，记录名为 name 的处理器的请求耗时
+func instrument(name string, handler http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		recorder := &statusRecorder{ResponseWriter: w, status: http.StatusOK}
+
+		handler.ServeHTTP(recorder, r)
+
+		httpLatency.ObserveSince(start, name, strconv.Itoa(recorder.status))
+	})
+}
@@ -7,6 +7,7 @@ import (
 	"log"
 	"magnet-search/internal/crawler"
 	"magnet-search/internal/database"
+	"magnet-search/internal/metrics"
 	"magnet-search/internal/model"
 	"net/http"
 	"os"
@@ -115,8 +116,14 @@ func Run(port string, db *database.DB, crawler *crawler.Crawler) error {
 	server.templates = templates
 
 	// 设置路由
-	http.HandleFunc("/", server.searchHandler)
-	http.HandleFunc("/search", server.searchHandler)
+	http.Handle("/", instrument("search", http.HandlerFunc(server.searchHandler)))
+	http.Handle("/search", instrument("search", http.HandlerFunc(server.searchHandler)))
+
+	// Prometheus 指标
+	http.Handle("/metrics", instrument("metrics", metrics.Handler()))
+
+	// 提供元数据的客户端统计
+	http.Handle("/api/clients", instrument("clients", http.HandlerFunc(server.clientsAPIHandler)))
 
 	// 添加管理界面
 	//http.HandleFunc("/admin", server.adminHandler)
@@ -133,7 +140,7 @@ func Run(port string, db *database.DB, crawler *crawler.Crawler) error {
 
 	// 静态文件服务
 	fs := http.FileServer(http.Dir(server.staticPath))
-	http.Handle("/static/", http.StripPrefix("/static/", fs))
+	http.Handle("/static/", instrument("static", http.StripPrefix("/static/", fs)))
 
 	// 启动服务器
 	log.Printf("服务器启动在 http://localhost:%s", port)
@@ -460,6 +467,25 @@ func (s *Server) apiSearchHandler(w http.ResponseWriter, r *http.Request) {
 	json.NewEncoder(w).Encode(result)
 }
 
+// clientsAPIHandler 返回提供元数据最多的客户端统计，limit 默认为 100
+func (s *Server) clientsAPIHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+
+	limit, err := strconv.Atoi(r.URL.Query().Get("limit"))
+	if err != nil || limit <= 0 || limit > 1000 {
+		limit = 100
+	}
+
+	stats, err := database.GetClientStats(s.db, limit)
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		json.NewEncoder(w).Encode(map[string]string{"error": "获取客户端统计失败"})
+		return
+	}
+
+	json.NewEncoder(w).Encode(stats)
+}
+
 // apiAddTorrentHandler 处理添加种子的API请求(仅用于测试)
 func (s *Server) apiAddTorrentHandler(w http.ResponseWriter, r *http.Request) {
 	if r.Method != http.MethodPost {